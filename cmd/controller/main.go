@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	golibvirt "github.com/digitalocean/go-libvirt"
+	_ "github.com/joho/godotenv/autoload"
+
+	"libvirt-controller/internal/api"
+	"libvirt-controller/internal/filesystem"
+)
+
+func gracefulShutdown(apiServer *http.Server, a *api.API, done chan bool) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	<-ctx.Done()
+
+	log.Println("shutting down gracefully, press Ctrl+C again to force")
+
+	// Requests such as a graceful VM stop may take a while to finish
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := apiServer.Shutdown(ctx); err != nil {
+		log.Printf("Server forced to shutdown with error: %v", err)
+	}
+	// Let downloads and block jobs clean up after themselves
+	if err := a.Shutdown(ctx); err != nil {
+		log.Printf("Background work did not stop cleanly: %v", err)
+	}
+
+	done <- true
+}
+
+func main() {
+	uri := os.Getenv("LIBVIRT_URI")
+	if uri == "" {
+		uri = string(golibvirt.QEMUSystem)
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		log.Fatalf("invalid LIBVIRT_URI %q: %v", uri, err)
+	}
+	conn, err := golibvirt.ConnectToURI(u)
+	if err != nil {
+		log.Fatalf("failed to connect to libvirt at %s: %v", uri, err)
+	}
+	defer conn.Disconnect()
+
+	// Keep image downloads from starving the traffic of running VMs
+	if limit := os.Getenv("DOWNLOAD_BANDWIDTH_LIMIT"); limit != "" {
+		bytesPerSec, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil {
+			log.Fatalf("invalid DOWNLOAD_BANDWIDTH_LIMIT %q: %v", limit, err)
+		}
+		filesystem.SetGlobalBandwidthLimit(bytesPerSec)
+	}
+
+	config := api.ConfigFromEnv()
+	a, err := api.New(conn, config)
+	if err != nil {
+		log.Fatalf("failed to set up the API: %v", err)
+	}
+	filesystem.SetDefaultCacheObserver(a.Metrics)
+	server := api.NewServer(a, config)
+
+	done := make(chan bool, 1)
+	go gracefulShutdown(server, a, done)
+
+	log.Printf("listening on %s", server.Addr)
+	err = server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		panic(fmt.Sprintf("http server error: %s", err))
+	}
+
+	<-done
+	log.Println("Graceful shutdown complete.")
+}
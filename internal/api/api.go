@@ -0,0 +1,212 @@
+// Package api exposes the domain, provisioning and snapshot managers as a
+// JSON REST API.
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	golibvirt "github.com/digitalocean/go-libvirt"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+
+	"libvirt-controller/internal/libvirt"
+	"libvirt-controller/internal/metrics"
+	"libvirt-controller/internal/server/utils"
+	"libvirt-controller/internal/state"
+)
+
+// DefaultAddr is the listen address used when none is configured.
+const DefaultAddr = ":8080"
+
+// maxBodyBytes bounds the size of request bodies.
+const maxBodyBytes = 1 << 20
+
+// Config describes where the API listens and keeps VM files.
+type Config struct {
+	Addr     string // Listen address, DefaultAddr when empty
+	VMDir    string // Directory holding one subdirectory per VM
+	ImageDir string // Directory of the images disks may use besides those in VMDir
+	StateDir string // Directory of the state store, tenant quotas are off when empty
+
+	// Auth authenticates every request, which are all rejected when it
+	// is nil. With a StateDir only principals with a Tenant can create
+	// VMs, which count against the quota of that tenant.
+	Auth Authenticator
+}
+
+// ConfigFromEnv builds a Config from the LISTEN_ADDR, DEFINITIONS_DIR,
+// IMAGE_DIR and STATE_DIR environment variables. AUTH_TOKEN is accepted as a bearer token with
+// every scope and AUTH_READ_TOKEN as one that can only read VMs and metrics. The VMs created
+// with AUTH_TOKEN count against the quota of AUTH_TENANT.
+func ConfigFromEnv() Config {
+	config := Config{
+		Addr:     os.Getenv("LISTEN_ADDR"),
+		VMDir:    os.Getenv("DEFINITIONS_DIR"),
+		ImageDir: os.Getenv("IMAGE_DIR"),
+		StateDir: os.Getenv("STATE_DIR"),
+	}
+	tokens := StaticTokens{}
+	if token := os.Getenv("AUTH_TOKEN"); token != "" {
+		tokens[token] = Principal{Name: "admin", Scopes: []string{ScopeAll}, Tenant: os.Getenv("AUTH_TENANT")}
+	}
+	if token := os.Getenv("AUTH_READ_TOKEN"); token != "" {
+		tokens[token] = Principal{Name: "reader", Scopes: []string{ScopeVMRead, ScopeMetricsRead}}
+	}
+	if len(tokens) > 0 {
+		config.Auth = tokens
+	}
+	return config
+}
+
+// API serves the REST endpoints. The managers are exported so observers,
+// loggers and admission control can be set on them before serving.
+type API struct {
+	Domains     *libvirt.DomainManager
+	Provisioner *libvirt.Provisioner
+	Snapshots   *libvirt.SnapshotManager
+
+	// Metrics observes the domain and provisioning operations and is
+	// served on /metrics to principals with ScopeMetricsRead.
+	Metrics *metrics.Metrics
+
+	// Jobs runs the requests made with "async" set. It keeps jobs in
+	// memory unless replaced by one with a store.
+	Jobs *libvirt.JobManager
+
+	vmDir    string
+	imageDir string
+	auth     Authenticator
+}
+
+// New creates an API using the given libvirt connection. With a StateDir
+// the state store is opened there, keeps a record of every VM and counts
+// VMs against the quota of their tenant.
+func New(conn *golibvirt.Libvirt, config Config) (*API, error) {
+	// The VM files are written locally, so the controller runs on the host
+	domains := libvirt.NewDomainManager(conn)
+	domains.CheckBackingChains = true
+	provisioner := libvirt.NewProvisioner(conn)
+
+	m := metrics.New()
+	domains.Observer = m
+	provisioner.Observer = m
+	m.WatchDomains(func() (map[string]int, error) {
+		counts, err := domains.CountByState()
+		byState := make(map[string]int, len(counts))
+		for state, n := range counts {
+			byState[string(state)] = n
+		}
+		return byState, err
+	})
+	if config.StateDir != "" {
+		store, err := state.NewStore(config.StateDir)
+		if err != nil {
+			return nil, err
+		}
+		provisioner.Quotas = libvirt.NewQuotaManager(store)
+		provisioner.Records = store
+		domains.Records = store
+	}
+	return &API{
+		Domains:     domains,
+		Provisioner: provisioner,
+		Snapshots:   libvirt.NewSnapshotManager(conn),
+		Metrics:     m,
+		Jobs:        libvirt.NewJobManager(nil),
+		vmDir:       config.VMDir,
+		imageDir:    config.ImageDir,
+		auth:        config.Auth,
+	}, nil
+}
+
+// Shutdown stops the background work of the API for a clean exit. It
+// cancels the running jobs and waits for them until ctx is done, aborts the
+// block jobs still running and stops the lifecycle event loop. Call it once
+// the http.Server has shut down, so no new jobs are submitted.
+func (a *API) Shutdown(ctx context.Context) error {
+	return errors.Join(a.Jobs.Shutdown(ctx), a.Domains.AbortBlockJobs(), a.Domains.Close())
+}
+
+// NewServer creates an http.Server serving the API on config.Addr.
+func NewServer(a *API, config Config) *http.Server {
+	addr := config.Addr
+	if addr == "" {
+		addr = DefaultAddr
+	}
+	return &http.Server{
+		Addr:        addr,
+		Handler:     a.Handler(),
+		IdleTimeout: time.Minute,
+		ReadTimeout: 10 * time.Second,
+		// Creating a VM and stopping it gracefully can take a while
+		WriteTimeout: 5 * time.Minute,
+	}
+}
+
+// Handler returns the router of the API.
+func (a *API) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Use(middleware.Logger)
+	r.Use(middleware.Recoverer)
+
+	// Prometheus scrape endpoint
+	r.With(Authenticate(a.auth), RequireScope(ScopeMetricsRead)).Handle("/metrics", a.Metrics.Handler())
+
+	r.Route("/v1/vms", func(r chi.Router) {
+		r.Use(Authenticate(a.auth))
+		r.Use(requireVMScope)
+		r.Get("/", a.listVMs)
+		r.Post("/", a.createVM)
+		r.Route("/{name}", func(r chi.Router) {
+			r.Get("/", a.getVM)
+			r.Delete("/", a.deleteVM)
+			r.Post("/start", a.startVM)
+			r.Post("/stop", a.stopVM)
+			r.Post("/reboot", a.rebootVM)
+			r.Get("/stats", a.vmStats)
+			r.Get("/snapshots", a.listSnapshots)
+			r.Post("/snapshots", a.createSnapshot)
+			r.Post("/snapshots/{snapshot}/revert", a.revertSnapshot)
+			r.Delete("/snapshots/{snapshot}", a.deleteSnapshot)
+		})
+	})
+	r.Route("/v1/jobs/{id}", func(r chi.Router) {
+		r.Use(Authenticate(a.auth))
+		r.Use(requireVMScope)
+		r.Get("/", a.getJob)
+		r.Delete("/", a.cancelJob)
+	})
+	return r
+}
+
+// errInvalidRequest marks errors caused by the request rather than the host.
+var errInvalidRequest = errors.New("invalid request")
+
+func invalid(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", errInvalidRequest, fmt.Sprintf(format, args...))
+}
+
+// writeError responds with the status matching err.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errInvalidRequest):
+		status = http.StatusBadRequest
+	case libvirt.IsNotFound(err):
+		status = http.StatusNotFound
+	case errors.Is(err, libvirt.ErrInsufficientSpace):
+		status = http.StatusInsufficientStorage
+	case errors.Is(err, libvirt.ErrAlreadyExists),
+		errors.Is(err, libvirt.ErrDomainRunning),
+		errors.Is(err, libvirt.ErrInsufficientResources),
+		errors.Is(err, libvirt.ErrQuotaExceeded),
+		errors.Is(err, libvirt.ErrRevertRequiresForce):
+		status = http.StatusConflict
+	}
+	utils.JSONErrorResponse(w, err.Error(), status)
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	golibvirt "github.com/digitalocean/go-libvirt"
+	"github.com/digitalocean/go-libvirt/libvirttest"
+)
+
+var testTokens = StaticTokens{
+	"admin-token":   {Name: "admin", Scopes: []string{ScopeAll}, Tenant: "team-a"},
+	"monitor-token": {Name: "monitor", Scopes: []string{ScopeVMRead, ScopeMetricsRead}},
+	"robot-token":   {Name: "robot", Scopes: []string{ScopeAll}},
+}
+
+func do(url, method, token, body string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func TestCreateVMValidation(t *testing.T) {
+	a, err := New(nil, Config{VMDir: t.TempDir(), StateDir: t.TempDir(), Auth: testTokens})
+	if err != nil {
+		t.Fatalf("error creating API. Err: %v", err)
+	}
+	server := httptest.NewServer(a.Handler())
+	defer server.Close()
+
+	for _, body := range []string{
+		``,
+		`{"name":`,
+		`{"name":"vm-1","vcpus":1,"memory_mib":512,"color":"red"}`,
+		`{"name":"../etc","vcpus":1,"memory_mib":512}`,
+		`{"name":"vm-1","vcpus":0,"memory_mib":512}`,
+		`{"name":"vm-1","vcpus":1,"memory_mib":512,"disks":[{"target":"vda"}]}`,
+		`{"name":"vm-1","vcpus":1,"memory_mib":512,"disks":[{"target":"vda","base_image":"base.qcow2"}]}`,
+		`{"name":"vm-1","vcpus":1,"memory_mib":512,"disks":[{"target":"vda","base_image":"/etc/passwd"}]}`,
+		`{"name":"vm-1","vcpus":1,"memory_mib":512,"disks":[{"target":"vda","source":"/etc/shadow"}]}`,
+		`{"name":"vm-1","vcpus":1,"memory_mib":512,"tenant":"team-b"}`,
+	} {
+		resp, err := do(server.URL+"/v1/vms", http.MethodPost, "admin-token", body)
+		if err != nil {
+			t.Fatalf("error making request to server. Err: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status 400 for body %q; got %v", body, resp.Status)
+		}
+	}
+}
+
+func TestCreateVMRequiresTenant(t *testing.T) {
+	a, err := New(nil, Config{VMDir: t.TempDir(), StateDir: t.TempDir(), Auth: testTokens})
+	if err != nil {
+		t.Fatalf("error creating API. Err: %v", err)
+	}
+	server := httptest.NewServer(a.Handler())
+	defer server.Close()
+
+	resp, err := do(server.URL+"/v1/vms", http.MethodPost, "robot-token", `{"name":"vm-1","vcpus":1,"memory_mib":512}`)
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status 403 for a principal without a tenant; got %v", resp.Status)
+	}
+}
+
+func TestAuthScopes(t *testing.T) {
+	a, err := New(nil, Config{VMDir: t.TempDir(), Auth: testTokens})
+	if err != nil {
+		t.Fatalf("error creating API. Err: %v", err)
+	}
+	server := httptest.NewServer(a.Handler())
+	defer server.Close()
+
+	for _, tc := range []struct {
+		method, token string
+		expected      int
+	}{
+		{http.MethodDelete, "", http.StatusUnauthorized},
+		{http.MethodDelete, "wrong-token", http.StatusUnauthorized},
+		{http.MethodDelete, "monitor-token", http.StatusForbidden},
+		{http.MethodDelete, "admin-token", http.StatusBadRequest}, // Past auth, the name is invalid
+	} {
+		resp, err := do(server.URL+"/v1/vms/-bad", tc.method, tc.token, "")
+		if err != nil {
+			t.Fatalf("error making request to server. Err: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.expected {
+			t.Errorf("expected status %d for %s with token %q; got %v", tc.expected, tc.method, tc.token, resp.Status)
+		}
+	}
+
+	resp, err := do(server.URL+"/v1/vms", http.MethodGet, "", "")
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("expected a WWW-Authenticate header on 401")
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	// Scrapes count the domains, which needs a connection
+	conn := golibvirt.NewWithDialer(libvirttest.New())
+	if err := conn.Connect(); err != nil {
+		t.Fatalf("error connecting to mock libvirt. Err: %v", err)
+	}
+	defer conn.Disconnect()
+	a, err := New(conn, Config{VMDir: t.TempDir(), Auth: testTokens})
+	if err != nil {
+		t.Fatalf("error creating API. Err: %v", err)
+	}
+	if a.Domains.Observer != a.Metrics || a.Provisioner.Observer != a.Metrics {
+		t.Errorf("expected the managers to report to the API metrics")
+	}
+	a.Metrics.ObserveOperation("create", time.Second, nil)
+	server := httptest.NewServer(a.Handler())
+	defer server.Close()
+
+	resp, err := do(server.URL+"/metrics", http.MethodGet, "", "")
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for a scrape without a token; got %v", resp.Status)
+	}
+
+	resp, err = do(server.URL+"/metrics", http.MethodGet, "monitor-token", "")
+	if err != nil {
+		t.Fatalf("error making request to server. Err: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("error reading metrics. Err: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200; got %v", resp.Status)
+	}
+	for _, metric := range []string{"libvirt_controller_operations_total", `libvirt_controller_domains{state="running"}`} {
+		if !strings.Contains(string(body), metric) {
+			t.Errorf("expected %s on /metrics", metric)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"libvirt-controller/internal/server/utils"
+)
+
+// Scopes granted to principals. ScopeAll grants every scope.
+const (
+	ScopeVMRead      = "vm:read"
+	ScopeVMWrite     = "vm:write"
+	ScopeMetricsRead = "metrics:read"
+	ScopeAll         = "*"
+)
+
+// ErrUnauthenticated is returned by an Authenticator when the request
+// carries no credentials it accepts. Other errors are also answered with
+// 401 but are not passed on to the next Authenticator of a chain.
+var ErrUnauthenticated = errors.New("missing or invalid credentials")
+
+// Principal is the caller a request was authenticated as.
+type Principal struct {
+	Name   string
+	Scopes []string
+	Tenant string // Quota the VMs the principal creates count against
+}
+
+// HasScope reports whether the principal was granted scope.
+func (p Principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope) || slices.Contains(p.Scopes, ScopeAll)
+}
+
+// Authenticator identifies the caller of a request. Implementations can
+// validate JWTs, API keys or anything else carried by the request.
+type Authenticator interface {
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+// StaticTokens authenticates bearer tokens from a fixed map of token to
+// principal.
+type StaticTokens map[string]Principal
+
+// Authenticate looks up the bearer token of the request. Every token is
+// compared in constant time so response times do not leak tokens.
+func (t StaticTokens) Authenticate(r *http.Request) (Principal, error) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return Principal{}, ErrUnauthenticated
+	}
+	var (
+		found Principal
+		match bool
+	)
+	for known, p := range t {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+			found, match = p, true
+		}
+	}
+	if !match {
+		return Principal{}, ErrUnauthenticated
+	}
+	return found, nil
+}
+
+// ClientCertCN authenticates TLS client certificates by mapping the common
+// name of the verified certificate to a principal. The server must require
+// and verify client certificates, e.g. with tls.RequireAndVerifyClientCert.
+type ClientCertCN map[string]Principal
+
+// Authenticate maps the common name of the verified client certificate.
+func (c ClientCertCN) Authenticate(r *http.Request) (Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return Principal{}, ErrUnauthenticated
+	}
+	p, ok := c[r.TLS.VerifiedChains[0][0].Subject.CommonName]
+	if !ok {
+		return Principal{}, ErrUnauthenticated
+	}
+	return p, nil
+}
+
+// Authenticators tries each Authenticator in turn until one accepts the
+// request.
+type Authenticators []Authenticator
+
+// Authenticate returns the principal of the first Authenticator that accepts
+// the request.
+func (a Authenticators) Authenticate(r *http.Request) (Principal, error) {
+	for _, auth := range a {
+		p, err := auth.Authenticate(r)
+		if errors.Is(err, ErrUnauthenticated) {
+			continue
+		}
+		return p, err
+	}
+	return Principal{}, ErrUnauthenticated
+}
+
+type principalKey struct{}
+
+// PrincipalFromContext returns the principal stored by Authenticate.
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// Authenticate rejects requests auth does not accept with 401 and stores
+// the principal of the others in the request context. A nil auth rejects
+// every request.
+func Authenticate(auth Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if auth == nil {
+				unauthorized(w)
+				return
+			}
+			p, err := auth.Authenticate(r)
+			if err != nil {
+				unauthorized(w)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+		})
+	}
+}
+
+// RequireScope rejects requests whose principal lacks scope with 403. It
+// must run after Authenticate.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, ok := PrincipalFromContext(r.Context())
+			if !ok {
+				unauthorized(w)
+				return
+			}
+			if !p.HasScope(scope) {
+				utils.JSONErrorResponse(w, "missing scope "+scope, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireVMScope requires ScopeVMRead for reads and ScopeVMWrite for
+// everything else.
+func requireVMScope(next http.Handler) http.Handler {
+	read, write := RequireScope(ScopeVMRead)(next), RequireScope(ScopeVMWrite)(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			read.ServeHTTP(w, r)
+			return
+		}
+		write.ServeHTTP(w, r)
+	})
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="libvirt-controller"`)
+	utils.JSONErrorResponse(w, ErrUnauthenticated.Error(), http.StatusUnauthorized)
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"libvirt-controller/internal/libvirt"
+	"libvirt-controller/internal/server/utils"
+)
+
+// submitJob runs fn as a job and responds with its status, pointing the
+// client at the job with the Location header.
+func (a *API) submitJob(w http.ResponseWriter, fn libvirt.JobFunc) {
+	id := a.Jobs.Submit(fn)
+	status, err := a.Jobs.Status(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/v1/jobs/"+string(id))
+	utils.JSONResponse(w, status, http.StatusAccepted)
+}
+
+func (a *API) getJob(w http.ResponseWriter, r *http.Request) {
+	status, err := a.Jobs.Status(libvirt.JobID(chi.URLParam(r, "id")))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	utils.JSONResponse(w, status, http.StatusOK)
+}
+
+// cancelJob asks a running job to stop and responds with its status, which
+// changes to cancelled once the job has returned.
+func (a *API) cancelJob(w http.ResponseWriter, r *http.Request) {
+	id := libvirt.JobID(chi.URLParam(r, "id"))
+	if err := a.Jobs.Cancel(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	status, err := a.Jobs.Status(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	utils.JSONResponse(w, status, http.StatusAccepted)
+}
@@ -0,0 +1,212 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+
+	"libvirt-controller/internal/filesystem"
+	"libvirt-controller/internal/helpers"
+	"libvirt-controller/internal/libvirt"
+	"libvirt-controller/internal/state"
+)
+
+// CreateVMRequest is the body of POST /v1/vms.
+type CreateVMRequest struct {
+	Name      string            `json:"name"`
+	VCPUs     uint              `json:"vcpus"`
+	MemoryMiB uint64            `json:"memory_mib"`
+	Disks     []DiskRequest     `json:"disks"`
+	NICs      []NICRequest      `json:"nics"`
+	CloudInit *CloudInitRequest `json:"cloud_init,omitempty"`
+	Start     bool              `json:"start"` // Boot the VM once it is defined
+	Async     bool              `json:"async"` // Respond with a job instead of waiting
+}
+
+// DiskRequest is a disk of a new VM. A disk either uses an existing image
+// as Source or gets a qcow2 overlay on top of BaseImage in the VM directory.
+type DiskRequest struct {
+	Target    string `json:"target"`
+	Source    string `json:"source,omitempty"`
+	BaseImage string `json:"base_image,omitempty"`
+	SizeBytes uint64 `json:"size_bytes,omitempty"` // Virtual size of the overlay, the base image's when zero
+	Bus       string `json:"bus,omitempty"`
+	ReadOnly  bool   `json:"read_only,omitempty"`
+
+	// Preallocation of the overlay: "off" (the default), "metadata",
+	// "falloc" or "full"
+	Preallocation string `json:"preallocation,omitempty"`
+}
+
+// NICRequest is a network interface of a new VM.
+type NICRequest struct {
+	Network string `json:"network,omitempty"`
+	Bridge  string `json:"bridge,omitempty"`
+	MAC     string `json:"mac,omitempty"`
+	Model   string `json:"model,omitempty"`
+}
+
+// CloudInitRequest is the cloud-init seed of a new VM. Datasource is
+// "nocloud" (the default) or "configdrive", for which MetaData and
+// NetworkConfig are the OpenStack meta_data.json and network_data.json.
+type CloudInitRequest struct {
+	UserData      string `json:"user_data"`
+	MetaData      string `json:"meta_data"`
+	NetworkConfig string `json:"network_config,omitempty"`
+	Datasource    string `json:"datasource,omitempty"`
+}
+
+// StopRequest is the optional body of POST /v1/vms/{name}/stop. Without a
+// body the guest is asked to shut down and the call returns immediately.
+type StopRequest struct {
+	Force          bool `json:"force"`           // Power off without asking the guest
+	TimeoutSeconds int  `json:"timeout_seconds"` // Wait for the guest, then power off
+	Async          bool `json:"async"`           // Respond with a job instead of waiting
+}
+
+// SnapshotRequest is the body of POST /v1/vms/{name}/snapshots.
+type SnapshotRequest struct {
+	Name   string `json:"name"`
+	Memory bool   `json:"memory"`
+}
+
+// RevertRequest is the optional body of a snapshot revert.
+type RevertRequest struct {
+	Force bool `json:"force"` // Revert a running VM, discarding its state
+}
+
+// VMSummary is an entry of GET /v1/vms.
+type VMSummary struct {
+	Name  string              `json:"name"`
+	State libvirt.DomainState `json:"state"`
+}
+
+// VMResponse describes one VM.
+type VMResponse struct {
+	Name      string              `json:"name"`
+	State     libvirt.DomainState `json:"state"`
+	VCPUs     libvirt.VCPUInfo    `json:"vcpus"`
+	Autostart bool                `json:"autostart"`
+}
+
+// maxStopTimeoutSeconds keeps a graceful stop within the server's write
+// timeout.
+const maxStopTimeoutSeconds = 240
+
+// decode reads a JSON body into v, rejecting unknown fields. An empty body
+// is accepted when optional is set.
+func decode(r *http.Request, v any, optional bool) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		if err == io.EOF && optional {
+			return nil
+		}
+		if err == io.EOF {
+			return invalid("empty request body")
+		}
+		return invalid("malformed JSON: %v", err)
+	}
+	return nil
+}
+
+// vmSpec turns the request into a VMSpec with its files in vmDir, counting
+// against the quota of tenant. The images of the disks must be in vmDir or
+// imageDir.
+func (req CreateVMRequest) vmSpec(vmDir, imageDir, tenant string) (libvirt.VMSpec, error) {
+	if vmDir == "" {
+		return libvirt.VMSpec{}, fmt.Errorf("no VM directory is configured")
+	}
+	if err := libvirt.ValidateDomainName(req.Name); err != nil {
+		return libvirt.VMSpec{}, invalid("%v", err)
+	}
+
+	layout := libvirt.Layout{Base: vmDir}
+	dir, err := layout.VMDir(req.Name)
+	if err != nil {
+		return libvirt.VMSpec{}, err
+	}
+	if tenant != "" {
+		if err := state.ValidateTenant(tenant); err != nil {
+			return libvirt.VMSpec{}, err
+		}
+	}
+	spec := libvirt.VMSpec{
+		Domain: libvirt.DomainSpec{Name: req.Name, VCPUs: req.VCPUs, MemoryMiB: req.MemoryMiB},
+		Dir:    dir,
+		Tenant: tenant,
+	}
+	// checkImage rejects images outside the directories of the controller
+	checkImage := func(i int, field, path string) error {
+		if !filepath.IsAbs(path) {
+			return invalid("disk %d: %s must be an absolute path", i, field)
+		}
+		for _, root := range []string{vmDir, imageDir} {
+			if root == "" {
+				continue
+			}
+			err := filesystem.CheckWithin(root, path)
+			if err == nil {
+				return nil
+			}
+			if !errors.Is(err, filesystem.ErrPathEscape) {
+				return err
+			}
+		}
+		return invalid("disk %d: %s %s is outside of the VM and image directories", i, field, path)
+	}
+	for i, d := range req.Disks {
+		disk := libvirt.DiskSpec{Source: d.Source, Target: d.Target, Bus: d.Bus, ReadOnly: d.ReadOnly}
+		switch {
+		case d.Source != "" && d.BaseImage != "":
+			return libvirt.VMSpec{}, invalid("disk %d: source and base_image are mutually exclusive", i)
+		case d.BaseImage != "":
+			if err := checkImage(i, "base_image", d.BaseImage); err != nil {
+				return libvirt.VMSpec{}, err
+			}
+			if disk.Source, err = layout.DiskPath(req.Name, d.Target); err != nil {
+				return libvirt.VMSpec{}, invalid("disk %d: %v", i, err)
+			}
+			spec.Overlays = append(spec.Overlays, libvirt.OverlaySpec{
+				Path:          disk.Source,
+				BasePath:      d.BaseImage,
+				SizeBytes:     d.SizeBytes,
+				Preallocation: d.Preallocation,
+			})
+		case d.Source == "":
+			return libvirt.VMSpec{}, invalid("disk %d: source or base_image is required", i)
+		case d.Preallocation != "":
+			return libvirt.VMSpec{}, invalid("disk %d: preallocation requires base_image", i)
+		default:
+			if err := checkImage(i, "source", d.Source); err != nil {
+				return libvirt.VMSpec{}, err
+			}
+		}
+		if err := filesystem.ValidatePreallocation(d.Preallocation, filesystem.FormatQcow2); err != nil {
+			return libvirt.VMSpec{}, invalid("disk %d: %v", i, err)
+		}
+		spec.Domain.Disks = append(spec.Domain.Disks, disk)
+	}
+	for _, n := range req.NICs {
+		spec.Domain.NICs = append(spec.Domain.NICs, libvirt.NICSpec{Network: n.Network, Bridge: n.Bridge, MAC: n.MAC, Model: n.Model})
+	}
+	if ci := req.CloudInit; ci != nil {
+		spec.CloudInit = &libvirt.CloudInitSpec{
+			UserData:      []byte(ci.UserData),
+			MetaData:      []byte(ci.MetaData),
+			NetworkConfig: []byte(ci.NetworkConfig),
+			Datasource:    helpers.Datasource(ci.Datasource),
+		}
+		if err := spec.CloudInit.Datasource.Validate(); err != nil {
+			return libvirt.VMSpec{}, invalid("%v", err)
+		}
+	}
+
+	if err := spec.Domain.Validate(); err != nil {
+		return libvirt.VMSpec{}, invalid("%v", err)
+	}
+	return spec, nil
+}
@@ -0,0 +1,248 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"libvirt-controller/internal/libvirt"
+	"libvirt-controller/internal/server/utils"
+)
+
+func (a *API) listVMs(w http.ResponseWriter, r *http.Request) {
+	stats, err := a.Domains.AllStats()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	vms := make([]VMSummary, 0, len(stats))
+	for _, s := range stats {
+		vms = append(vms, VMSummary{Name: s.Name, State: s.State})
+	}
+	utils.JSONResponse(w, vms, http.StatusOK)
+}
+
+func (a *API) createVM(w http.ResponseWriter, r *http.Request) {
+	var req CreateVMRequest
+	if err := decode(r, &req, false); err != nil {
+		writeError(w, err)
+		return
+	}
+	// The VM counts against the quota of the caller's tenant
+	p, _ := PrincipalFromContext(r.Context())
+	if a.Provisioner.Quotas != nil && p.Tenant == "" {
+		utils.JSONErrorResponse(w, "principal "+p.Name+" has no tenant to count the VM against", http.StatusForbidden)
+		return
+	}
+	spec, err := req.vmSpec(a.vmDir, a.imageDir, p.Tenant)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// CreateVM accepts an existing domain matching the request, so a client
+	// can retry a create that failed midway
+	create := func() error {
+		if err := a.Provisioner.CreateVM(spec); err != nil {
+			return err
+		}
+		if !req.Start {
+			return nil
+		}
+		// A retry may find the domain started by the first attempt
+		state, err := a.Domains.GetState(req.Name)
+		if err != nil {
+			return err
+		}
+		if state != libvirt.StateShutoff && state != libvirt.StateCrashed {
+			return nil
+		}
+		return a.Domains.Start(req.Name)
+	}
+	if req.Async {
+		a.submitJob(w, func(context.Context, libvirt.JobProgress) error {
+			return create()
+		})
+		return
+	}
+	if err := create(); err != nil {
+		writeError(w, err)
+		return
+	}
+	a.respondVM(w, req.Name, http.StatusCreated)
+}
+
+func (a *API) getVM(w http.ResponseWriter, r *http.Request) {
+	a.respondVM(w, chi.URLParam(r, "name"), http.StatusOK)
+}
+
+func (a *API) respondVM(w http.ResponseWriter, name string, status int) {
+	state, err := a.Domains.GetState(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	vcpus, err := a.Domains.GetVCPUs(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	autostart, err := a.Domains.GetAutostart(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	utils.JSONResponse(w, VMResponse{Name: name, State: state, VCPUs: vcpus, Autostart: autostart}, status)
+}
+
+// deleteVM powers the VM off, undefines it, returns its resources to the
+// quota of its tenant and removes its directory.
+func (a *API) deleteVM(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	// The name becomes a path below vmDir
+	if err := libvirt.ValidateDomainName(name); err != nil {
+		writeError(w, invalid("%v", err))
+		return
+	}
+	state, err := a.Domains.GetState(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if state != libvirt.StateShutoff {
+		if err := a.Domains.Destroy(name); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if err := a.Domains.Undefine(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	if quotas := a.Provisioner.Quotas; quotas != nil {
+		if err := quotas.ReleaseVM(name); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if a.vmDir != "" {
+		dir, err := libvirt.Layout{Base: a.vmDir}.VMDir(name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) startVM(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := a.Domains.Start(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	a.respondVM(w, name, http.StatusOK)
+}
+
+func (a *API) stopVM(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	var req StopRequest
+	if err := decode(r, &req, true); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.TimeoutSeconds < 0 || req.TimeoutSeconds > maxStopTimeoutSeconds {
+		writeError(w, invalid("timeout_seconds must be between 0 and %d", maxStopTimeoutSeconds))
+		return
+	}
+
+	stop := func(ctx context.Context) error {
+		if req.Force {
+			return a.Domains.Destroy(name)
+		}
+		return a.Domains.Shutdown(ctx, name, time.Duration(req.TimeoutSeconds)*time.Second)
+	}
+	if req.Async {
+		a.submitJob(w, func(ctx context.Context, _ libvirt.JobProgress) error {
+			return stop(ctx)
+		})
+		return
+	}
+	if err := stop(r.Context()); err != nil {
+		writeError(w, err)
+		return
+	}
+	a.respondVM(w, name, http.StatusOK)
+}
+
+func (a *API) rebootVM(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := a.Domains.Reboot(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	a.respondVM(w, name, http.StatusOK)
+}
+
+func (a *API) vmStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := a.Domains.Stats(chi.URLParam(r, "name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	utils.JSONResponse(w, stats, http.StatusOK)
+}
+
+func (a *API) listSnapshots(w http.ResponseWriter, r *http.Request) {
+	snaps, err := a.Snapshots.ListSnapshots(chi.URLParam(r, "name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	utils.JSONResponse(w, snaps, http.StatusOK)
+}
+
+func (a *API) createSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req SnapshotRequest
+	if err := decode(r, &req, false); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Name == "" {
+		writeError(w, invalid("missing snapshot name"))
+		return
+	}
+	info, err := a.Snapshots.CreateSnapshot(chi.URLParam(r, "name"), req.Name, req.Memory)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	utils.JSONResponse(w, info, http.StatusCreated)
+}
+
+func (a *API) revertSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req RevertRequest
+	if err := decode(r, &req, true); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := a.Snapshots.RevertSnapshot(chi.URLParam(r, "name"), chi.URLParam(r, "snapshot"), req.Force); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) deleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	if err := a.Snapshots.DeleteSnapshot(chi.URLParam(r, "name"), chi.URLParam(r, "snapshot")); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,536 @@
+package filesystem
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"libvirt-controller/internal/logging"
+)
+
+// cacheLocks serializes access to each cache file within this process.
+var cacheLocks KeyedMutex
+
+// DefaultCacheTTL is how long cached images are kept when no TTL is configured.
+const DefaultCacheTTL = 604800 * time.Second // 7 days
+
+// CacheConfig describes where and for how long downloaded images are cached.
+type CacheConfig struct {
+	Dir      string        // Cache directory, caching is disabled when empty
+	TTL      time.Duration // How long a cached file is kept after its last access, DefaultCacheTTL when not positive
+	MaxBytes int64         // Upper bound on the total cache size, 0 means unlimited
+
+	// SkipVerify disables checking cached files against their ".sha256"
+	// sidecar on every cache hit, trading self-healing for speed.
+	SkipVerify bool
+
+	// Logger receives cache maintenance events and is also used for
+	// downloads that don't set their own. Nothing is logged when it is nil.
+	Logger logging.Logger
+
+	// Observer is told about every cache lookup and download, e.g. to
+	// export metrics. It may be nil.
+	Observer CacheObserver
+}
+
+// CacheObserver receives the outcome of cache lookups and downloads.
+type CacheObserver interface {
+	ObserveCacheLookup(hit bool)
+	ObserveDownload(bytes int64, duration time.Duration, err error)
+}
+
+// defaultCacheObserver is set on the caches built by CacheConfigFromEnv.
+var defaultCacheObserver atomic.Pointer[CacheObserver]
+
+// SetDefaultCacheObserver makes every cache built by CacheConfigFromEnv,
+// including those of DownloadCachedFile and its variants, report to o. A
+// nil o stops the reports.
+func SetDefaultCacheObserver(o CacheObserver) {
+	if o == nil {
+		defaultCacheObserver.Store(nil)
+		return
+	}
+	defaultCacheObserver.Store(&o)
+}
+
+type nopCacheObserver struct{}
+
+func (nopCacheObserver) ObserveCacheLookup(bool)                     {}
+func (nopCacheObserver) ObserveDownload(int64, time.Duration, error) {}
+
+// CacheConfigFromEnv builds a CacheConfig from the CACHE_DIR, CACHE_SECONDS,
+// CACHE_MAX_BYTES and CACHE_SKIP_VERIFY environment variables. Its Observer
+// is the one set with SetDefaultCacheObserver.
+func CacheConfigFromEnv() CacheConfig {
+	config := CacheConfig{
+		Dir: os.Getenv("CACHE_DIR"),
+		TTL: DefaultCacheTTL,
+	}
+	if o := defaultCacheObserver.Load(); o != nil {
+		config.Observer = *o
+	}
+
+	if cacheSecondsStr := os.Getenv("CACHE_SECONDS"); cacheSecondsStr != "" {
+		// Fallback to default if conversion fails
+		if seconds, err := strconv.Atoi(cacheSecondsStr); err == nil {
+			config.TTL = time.Duration(seconds) * time.Second
+		}
+	}
+
+	if maxBytesStr := os.Getenv("CACHE_MAX_BYTES"); maxBytesStr != "" {
+		if maxBytes, err := strconv.ParseInt(maxBytesStr, 10, 64); err == nil {
+			config.MaxBytes = maxBytes
+		}
+	}
+
+	if skipVerify, err := strconv.ParseBool(os.Getenv("CACHE_SKIP_VERIFY")); err == nil {
+		config.SkipVerify = skipVerify
+	}
+
+	return config
+}
+
+// Cache downloads files through a local cache directory.
+type Cache struct {
+	config CacheConfig
+}
+
+// NewCache creates a Cache with the given configuration.
+func NewCache(config CacheConfig) *Cache {
+	// A zero TTL would expire every file, including those in use, on each lookup
+	if config.TTL <= 0 {
+		config.TTL = DefaultCacheTTL
+	}
+	config.Logger = logging.OrNop(config.Logger)
+	if config.Observer == nil {
+		config.Observer = nopCacheObserver{}
+	}
+	return &Cache{config: config}
+}
+
+// Config returns the configuration of the cache.
+func (c *Cache) Config() CacheConfig {
+	return c.config
+}
+
+// Get copies the file at url to dst, downloading it into the cache first if
+// it is not already present. When no cache directory is configured the file
+// is downloaded directly to dst.
+//
+// Concurrent calls for the same file are serialized: the first caller
+// downloads while the others block and then get a cache hit. Within a process
+// this uses a keyed mutex; across processes a "<file>.lock" file in the cache
+// directory is locked with flock. Downloads go to a temp file that is renamed
+// into place, so a reader never sees a partially downloaded file.
+//
+// The SHA-256 of every file entering the cache is stored in a "<file>.sha256"
+// sidecar and checked on cache hits; a file that no longer matches, e.g.
+// after an ungraceful shutdown, is downloaded again.
+func (c *Cache) Get(url, dst string, mode os.FileMode) error {
+	return c.GetContext(context.Background(), url, dst, mode)
+}
+
+// GetContext is Get aborting the download when ctx is cancelled.
+func (c *Cache) GetContext(ctx context.Context, url, dst string, mode os.FileMode) error {
+	return c.GetWithOptions(ctx, url, dst, mode, DownloadOptions{})
+}
+
+// GetWithOptions is GetContext applying the verification configured in opts
+// to files entering the cache. An expected Format is also checked on cache hits.
+func (c *Cache) GetWithOptions(ctx context.Context, url, dst string, mode os.FileMode, opts DownloadOptions) error {
+	if opts.Logger == nil {
+		opts.Logger = c.config.Logger
+	}
+
+	// If no cache directory is set, directly download the file to the destination
+	if c.config.Dir == "" {
+		start := time.Now()
+		err := DownloadFileWithOptions(ctx, url, dst, mode, opts)
+		c.observeDownload(dst, start, err)
+		return err
+	}
+
+	_, err := c.fetch(ctx, url, mode, opts, func(cacheFilePath string) error {
+		// A reflink is free when the cache and dst share a CoW filesystem
+		_, err := CopyFileReflink(cacheFilePath, dst, mode)
+		return err
+	})
+	return err
+}
+
+// Use calls fn with the path of the file at url, downloading it into the
+// cache first if needed, without making a copy. The cache entry stays locked
+// until fn returns, so fn must only read the file. When no cache directory is
+// configured the file is downloaded to a temp file that is removed afterwards.
+func (c *Cache) Use(ctx context.Context, url string, opts DownloadOptions, fn func(path string) error) error {
+	if opts.Logger == nil {
+		opts.Logger = c.config.Logger
+	}
+
+	if c.config.Dir == "" {
+		tmp, err := os.CreateTemp("", "download-*")
+		if err != nil {
+			return err
+		}
+		tmpPath := tmp.Name()
+		tmp.Close()
+		defer os.Remove(tmpPath)
+
+		start := time.Now()
+		err = DownloadFileWithOptions(ctx, url, tmpPath, 0600, opts)
+		c.observeDownload(tmpPath, start, err)
+		if err != nil {
+			return err
+		}
+		return fn(tmpPath)
+	}
+
+	_, err := c.fetch(ctx, url, 0644, opts, fn)
+	return err
+}
+
+// fetch makes sure url is in the cache, downloading it if needed, and calls
+// use with the cached file while still holding its lock. It reports whether
+// the file was already cached.
+func (c *Cache) fetch(ctx context.Context, url string, mode os.FileMode, opts DownloadOptions, use func(cacheFilePath string) error) (bool, error) {
+	// Ensure cache directory exists
+	if err := os.MkdirAll(c.config.Dir, os.ModePerm); err != nil {
+		return false, err
+	}
+
+	// Perform a cache clean-up before checking for the file
+	removed, reclaimed, err := c.expire()
+	if err != nil {
+		// Log the error but proceed with download logic
+		c.config.Logger.Error("failed to clean cache directory", "dir", c.config.Dir, "err", err)
+	}
+	if removed > 0 {
+		c.config.Logger.Info("removed expired files from cache", "dir", c.config.Dir, "files", removed, "bytes", reclaimed)
+	}
+
+	// Determine the cache filename from the full URL
+	cacheFilePath := filepath.Join(c.config.Dir, cacheKey(url))
+
+	// Serialize access to the cache file within and across processes
+	unlock := cacheLocks.Lock(cacheFilePath)
+	defer unlock()
+	unlockFile, err := lockFile(cacheFilePath + ".lock")
+	if err != nil {
+		return false, fmt.Errorf("failed to lock cache file %s: %w", cacheFilePath, err)
+	}
+	defer unlockFile()
+
+	// Adopt an entry cached under the legacy basename-only key
+	c.migrateLegacyEntry(url, cacheFilePath)
+
+	// Discard a cached file that fails its integrity check
+	if FileExists(cacheFilePath) && !c.config.SkipVerify {
+		if err := verifyCacheFile(cacheFilePath); err != nil {
+			c.config.Logger.Warn("discarding cached file", "path", cacheFilePath, "err", err)
+			os.Remove(cacheFilePath)
+			os.Remove(cacheFilePath + ".sha256")
+		}
+	}
+
+	// Check if file is in the cache (after cleanup)
+	if FileExists(cacheFilePath) {
+		c.config.Observer.ObserveCacheLookup(true)
+		if opts.Format != "" {
+			if err := VerifyImageFormat(cacheFilePath, opts.Format); err != nil {
+				return true, err
+			}
+		}
+		return true, use(cacheFilePath)
+	}
+
+	// Download the file into the cache
+	c.config.Observer.ObserveCacheLookup(false)
+	start := time.Now()
+	err = c.download(ctx, url, cacheFilePath, mode, opts)
+	c.observeDownload(cacheFilePath, start, err)
+	if err != nil {
+		return false, err
+	}
+
+	// Keep the cache within its size budget
+	if err := c.evict(cacheFilePath); err != nil {
+		return false, err
+	}
+	return false, use(cacheFilePath)
+}
+
+// DownloadCachedFile manages the cache logic using the cache configured by the
+// CACHE_DIR and CACHE_SECONDS environment variables.
+func DownloadCachedFile(url string, name string, mode os.FileMode) error {
+	return DownloadCachedFileContext(context.Background(), url, name, mode)
+}
+
+// DownloadCachedFileContext is DownloadCachedFile aborting when ctx is cancelled.
+func DownloadCachedFileContext(ctx context.Context, url string, name string, mode os.FileMode) error {
+	return NewCache(CacheConfigFromEnv()).GetContext(ctx, url, name, mode)
+}
+
+// DownloadCachedFileWithOptions is DownloadCachedFileContext applying the
+// verification configured in opts.
+func DownloadCachedFileWithOptions(ctx context.Context, url string, name string, mode os.FileMode, opts DownloadOptions) error {
+	return NewCache(CacheConfigFromEnv()).GetWithOptions(ctx, url, name, mode, opts)
+}
+
+// cacheKey returns the cache filename for url: a prefix of the SHA-256 of the
+// full URL followed by the original basename for readability.
+func cacheKey(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:8]) + "-" + filepath.Base(url)
+}
+
+// migrateLegacyEntry renames a file cached under the old filepath.Base(url)
+// key to its URL-hashed key. The caller must hold the lock for cacheFilePath.
+func (c *Cache) migrateLegacyEntry(url, cacheFilePath string) {
+	legacyPath := filepath.Join(c.config.Dir, filepath.Base(url))
+	if legacyPath == cacheFilePath || FileExists(cacheFilePath) || !FileExists(legacyPath) {
+		return
+	}
+
+	unlock := cacheLocks.Lock(legacyPath)
+	defer unlock()
+	if err := os.Rename(legacyPath, cacheFilePath); err != nil && !os.IsNotExist(err) {
+		c.config.Logger.Error("failed to migrate legacy cache entry", "path", legacyPath, "err", err)
+	}
+}
+
+// download fetches url into a temp file next to cacheFilePath and renames it
+// into place once complete.
+func (c *Cache) download(ctx context.Context, url, cacheFilePath string, mode os.FileMode, opts DownloadOptions) error {
+	tmp, err := os.CreateTemp(c.config.Dir, fmt.Sprintf("%s.tmp-%d-*", filepath.Base(cacheFilePath), os.Getpid()))
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+
+	// Hash the file as it is written for the integrity sidecar
+	h := sha256.New()
+	opts.sink = h
+	if err := DownloadFileWithOptions(ctx, url, tmpPath, mode, opts); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// Write the sidecar first so a renamed cache file always has one
+	sum := hex.EncodeToString(h.Sum(nil)) + "\n"
+	if _, err := writeFileAtomic(c.config.Dir, filepath.Base(cacheFilePath)+".sha256", strings.NewReader(sum), 0644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, cacheFilePath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// observeDownload reports a download that started at start to the observer,
+// taking the size from the downloaded file at path.
+func (c *Cache) observeDownload(path string, start time.Time, err error) {
+	var size int64
+	if err == nil {
+		if info, statErr := os.Stat(path); statErr == nil {
+			size = info.Size()
+		}
+	}
+	c.config.Observer.ObserveDownload(size, time.Since(start), err)
+}
+
+// verifyCacheFile checks a cached file against its ".sha256" sidecar. Files
+// cached before sidecars existed have none and are accepted as is.
+func verifyCacheFile(path string) error {
+	data, err := os.ReadFile(path + ".sha256")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	expected := strings.TrimSpace(string(data))
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		return fmt.Errorf("checksum mismatch: expected sha256 %s, got %s", expected, actual)
+	}
+	return nil
+}
+
+// isCacheEntry reports whether name in the cache directory is a cached file
+// rather than a lock file, a sidecar or a download in progress.
+func isCacheEntry(name string) bool {
+	return !strings.HasSuffix(name, ".lock") && !strings.HasSuffix(name, ".sha256") && !strings.Contains(name, ".tmp-")
+}
+
+// tryLockEntry takes the in-process and the file lock of the cached file at
+// path without waiting. It reports false when the file is in use, by a Use
+// callback or a download in this or another process, so the sweeps skip it.
+func tryLockEntry(path string) (func(), bool) {
+	unlock, ok := cacheLocks.TryLock(path)
+	if !ok {
+		return nil, false
+	}
+	unlockFile, ok, err := tryLockFile(path + ".lock")
+	if err != nil || !ok {
+		unlock()
+		return nil, false
+	}
+	return func() {
+		unlockFile()
+		unlock()
+	}, true
+}
+
+// expire removes the cached files that have not been accessed within the TTL
+// along with their sidecars and returns the number of files removed and the
+// bytes reclaimed. Files in use are skipped. Lock files are kept: removing
+// one while another process holds its flock would let the next opener lock a
+// fresh inode.
+func (c *Cache) expire() (int, int64, error) {
+	dirEntries, err := os.ReadDir(c.config.Dir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var (
+		removed   int
+		reclaimed int64
+		errs      []error
+	)
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || !isCacheEntry(dirEntry.Name()) {
+			continue
+		}
+		path := filepath.Join(c.config.Dir, dirEntry.Name())
+		info, err := os.Stat(path)
+		if err != nil {
+			continue // Removed concurrently
+		}
+		if time.Since(lastAccessTime(info)) <= c.config.TTL {
+			continue
+		}
+		n, err := c.removeIdle(path, func() bool {
+			// Check again now that no one can be using the file
+			info, err := os.Stat(path)
+			return err == nil && time.Since(lastAccessTime(info)) > c.config.TTL
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if n > 0 {
+			removed++
+			reclaimed += n
+		}
+	}
+	return removed, reclaimed, errors.Join(errs...)
+}
+
+// removeIdle removes the cached file at path and its sidecar unless the file
+// is in use or stale reports false once the file is locked. It returns the
+// size of the removed file, 0 when it was kept.
+func (c *Cache) removeIdle(path string, stale func() bool) (int64, error) {
+	unlock, ok := tryLockEntry(path)
+	if !ok {
+		return 0, nil
+	}
+	defer unlock()
+	info, err := os.Stat(path)
+	if err != nil || !stale() {
+		return 0, nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("failed to delete %s: %w", path, err)
+	}
+	os.Remove(path + ".sha256")
+	return info.Size(), nil
+}
+
+// cacheEntry is a file in the cache directory considered for eviction.
+type cacheEntry struct {
+	path       string
+	size       int64
+	lastAccess time.Time
+}
+
+// evict removes the least recently used files from the cache until its total
+// size is within MaxBytes. The file at keep, whose lock the caller holds, and
+// files in use are never evicted; if keep alone exceeds MaxBytes it is
+// removed from the cache and an error is returned.
+func (c *Cache) evict(keep string) error {
+	if c.config.MaxBytes <= 0 {
+		return nil
+	}
+
+	dirEntries, err := os.ReadDir(c.config.Dir)
+	if err != nil {
+		return err
+	}
+
+	var (
+		entries []cacheEntry
+		total   int64
+	)
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || !isCacheEntry(dirEntry.Name()) {
+			continue
+		}
+		path := filepath.Join(c.config.Dir, dirEntry.Name())
+		info, err := os.Stat(path)
+		if err != nil {
+			continue // Removed concurrently
+		}
+		total += info.Size()
+
+		if path == keep {
+			if info.Size() > c.config.MaxBytes {
+				os.Remove(path)
+				os.Remove(path + ".sha256")
+				return fmt.Errorf("file %s (%d bytes) exceeds the cache size limit of %d bytes", path, info.Size(), c.config.MaxBytes)
+			}
+			continue
+		}
+		entries = append(entries, cacheEntry{path: path, size: info.Size(), lastAccess: lastAccessTime(info)})
+	}
+
+	// Oldest access first
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastAccess.Before(entries[j].lastAccess)
+	})
+
+	for _, entry := range entries {
+		if total <= c.config.MaxBytes {
+			break
+		}
+		size, err := c.removeIdle(entry.path, func() bool { return true })
+		if err != nil {
+			c.config.Logger.Error("failed to evict cached file", "path", entry.path, "err", err)
+			continue
+		}
+		total -= size
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheDistinctURLsWithSameBasename(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content from " + r.URL.Path))
+	}))
+	defer server.Close()
+
+	cache := NewCache(CacheConfig{Dir: t.TempDir(), TTL: DefaultCacheTTL})
+	dstDir := t.TempDir()
+
+	for _, name := range []string{"a", "b"} {
+		url := server.URL + "/" + name + "/disk.img"
+		if err := cache.Get(url, filepath.Join(dstDir, name+".img"), 0644); err != nil {
+			t.Fatalf("error fetching %s. Err: %v", url, err)
+		}
+	}
+
+	for _, name := range []string{"a", "b"} {
+		got, err := os.ReadFile(filepath.Join(dstDir, name+".img"))
+		if err != nil {
+			t.Fatalf("error reading downloaded file. Err: %v", err)
+		}
+		expected := "content from /" + name + "/disk.img"
+		if string(got) != expected {
+			t.Errorf("expected %s to contain %q; got %q", name, expected, string(got))
+		}
+	}
+
+	if cacheKey(server.URL+"/a/disk.img") == cacheKey(server.URL+"/b/disk.img") {
+		t.Errorf("expected distinct cache keys for URLs sharing a basename")
+	}
+}
+
+func TestCachePrefetchAll(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte("content from " + r.URL.Path))
+	}))
+	defer server.Close()
+
+	cache := NewCache(CacheConfig{Dir: t.TempDir(), TTL: DefaultCacheTTL})
+	urls := []string{server.URL + "/a.img", server.URL + "/b.img", server.URL + "/a.img", server.URL + "/c.img"}
+
+	results, err := cache.PrefetchAll(context.Background(), urls, 2)
+	if err != nil {
+		t.Fatalf("error prefetching. Err: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results for 3 distinct URLs; got %d", len(results))
+	}
+	for _, r := range results {
+		if r.CacheHit {
+			t.Errorf("expected %s to be a cache miss on the first prefetch", r.URL)
+		}
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("expected 3 downloads; got %d", n)
+	}
+
+	results, err = cache.PrefetchAll(context.Background(), urls, 2)
+	if err != nil {
+		t.Fatalf("error prefetching again. Err: %v", err)
+	}
+	for _, r := range results {
+		if !r.CacheHit {
+			t.Errorf("expected %s to be a cache hit on the second prefetch", r.URL)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err = cache.PrefetchAll(ctx, []string{server.URL + "/d.img"}, 2)
+	if !errors.Is(err, context.Canceled) || !errors.Is(results[0].Err, context.Canceled) {
+		t.Errorf("expected a cancelled context to stop the prefetch; got %v", err)
+	}
+}
+
+// tenByteServer serves 10 bytes for every path.
+func tenByteServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// ageCacheFile makes the cached file of url look last used age ago.
+func ageCacheFile(t *testing.T, dir, url string, age time.Duration) {
+	t.Helper()
+	past := time.Now().Add(-age)
+	if err := os.Chtimes(filepath.Join(dir, cacheKey(url)), past, past); err != nil {
+		t.Fatalf("error setting file times. Err: %v", err)
+	}
+}
+
+func TestCacheZeroTTLKeepsFiles(t *testing.T) {
+	server := tenByteServer(t)
+	dir := t.TempDir()
+	cache := NewCache(CacheConfig{Dir: dir})
+	dstDir := t.TempDir()
+
+	if err := cache.Get(server.URL+"/a.img", filepath.Join(dstDir, "a.img"), 0644); err != nil {
+		t.Fatalf("error fetching file. Err: %v", err)
+	}
+	ageCacheFile(t, dir, server.URL+"/a.img", time.Hour)
+	if err := cache.Get(server.URL+"/b.img", filepath.Join(dstDir, "b.img"), 0644); err != nil {
+		t.Fatalf("error fetching file. Err: %v", err)
+	}
+	if !FileExists(filepath.Join(dir, cacheKey(server.URL+"/a.img"))) {
+		t.Errorf("expected a zero TTL to keep cached files for DefaultCacheTTL")
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	server := tenByteServer(t)
+	dir := t.TempDir()
+	cache := NewCache(CacheConfig{Dir: dir, MaxBytes: 25})
+	dstDir := t.TempDir()
+
+	get := func(name string) error {
+		return cache.Get(server.URL+"/"+name, filepath.Join(dstDir, name), 0644)
+	}
+	for _, name := range []string{"a.img", "b.img"} {
+		if err := get(name); err != nil {
+			t.Fatalf("error fetching %s. Err: %v", name, err)
+		}
+	}
+	ageCacheFile(t, dir, server.URL+"/a.img", 2*time.Hour)
+	ageCacheFile(t, dir, server.URL+"/b.img", time.Hour)
+
+	if err := get("c.img"); err != nil {
+		t.Fatalf("error fetching c.img. Err: %v", err)
+	}
+	a := filepath.Join(dir, cacheKey(server.URL+"/a.img"))
+	if FileExists(a) || FileExists(a+".sha256") {
+		t.Errorf("expected the least recently used file and its sidecar to be evicted")
+	}
+	for _, name := range []string{"b.img", "c.img"} {
+		if !FileExists(filepath.Join(dir, cacheKey(server.URL+"/"+name))) {
+			t.Errorf("expected %s to stay cached", name)
+		}
+	}
+
+	smallDir := t.TempDir()
+	small := NewCache(CacheConfig{Dir: smallDir, MaxBytes: 5})
+	if err := small.Get(server.URL+"/d.img", filepath.Join(dstDir, "d.img"), 0644); err == nil {
+		t.Errorf("expected a file larger than MaxBytes to be rejected")
+	}
+	if entries, _ := os.ReadDir(smallDir); len(entries) > 1 {
+		t.Errorf("expected the rejected file and its sidecar to be removed; got %d entries", len(entries))
+	}
+}
+
+func TestCacheExpireKeepsLockFiles(t *testing.T) {
+	server := tenByteServer(t)
+	dir := t.TempDir()
+	cache := NewCache(CacheConfig{Dir: dir, TTL: time.Hour})
+	dstDir := t.TempDir()
+
+	if err := cache.Get(server.URL+"/a.img", filepath.Join(dstDir, "a.img"), 0644); err != nil {
+		t.Fatalf("error fetching file. Err: %v", err)
+	}
+	a := filepath.Join(dir, cacheKey(server.URL+"/a.img"))
+	past := time.Now().Add(-2 * time.Hour)
+	for _, path := range []string{a, a + ".sha256", a + ".lock"} {
+		if err := os.Chtimes(path, past, past); err != nil {
+			t.Fatalf("error setting file times. Err: %v", err)
+		}
+	}
+
+	if err := cache.Get(server.URL+"/b.img", filepath.Join(dstDir, "b.img"), 0644); err != nil {
+		t.Fatalf("error fetching file. Err: %v", err)
+	}
+	if FileExists(a) || FileExists(a+".sha256") {
+		t.Errorf("expected the expired file and its sidecar to be removed")
+	}
+	if !FileExists(a + ".lock") {
+		t.Errorf("expected the lock file of the expired file to be kept")
+	}
+}
+
+func TestCacheKeepsFilesInUse(t *testing.T) {
+	server := tenByteServer(t)
+	dir := t.TempDir()
+	cache := NewCache(CacheConfig{Dir: dir, TTL: time.Hour, MaxBytes: 15})
+	dstDir := t.TempDir()
+
+	err := cache.Use(context.Background(), server.URL+"/a.img", DownloadOptions{}, func(path string) error {
+		// Expired and over budget, but in use until this returns
+		ageCacheFile(t, dir, server.URL+"/a.img", 2*time.Hour)
+		if err := cache.Get(server.URL+"/b.img", filepath.Join(dstDir, "b.img"), 0644); err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected the file in use to stay cached; got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error using cached file. Err: %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package filesystem
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression formats understood by the download path.
+const (
+	CompressionGzip = "gzip"
+	CompressionXz   = "xz"
+	CompressionZstd = "zstd"
+)
+
+// detectCompression returns the compression of a download based on its
+// Content-Encoding header or, failing that, the suffix of the URL path.
+// It returns an empty string for uncompressed downloads.
+func detectCompression(rawURL, contentEncoding string) string {
+	switch strings.ToLower(contentEncoding) {
+	case "gzip", "x-gzip":
+		return CompressionGzip
+	case "xz":
+		return CompressionXz
+	case "zstd":
+		return CompressionZstd
+	}
+
+	p := rawURL
+	if u, err := url.Parse(rawURL); err == nil && u.Path != "" {
+		p = u.Path
+	}
+	switch strings.ToLower(path.Ext(p)) {
+	case ".gz":
+		return CompressionGzip
+	case ".xz":
+		return CompressionXz
+	case ".zst":
+		return CompressionZstd
+	}
+	return ""
+}
+
+// newDecompressor wraps r in a streaming decompressor for the given compression.
+func newDecompressor(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionXz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	case CompressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", compression)
+	}
+}
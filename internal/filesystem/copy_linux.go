@@ -0,0 +1,83 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl request, see ioctl_ficlone(2).
+const ficlone = 0x40049409
+
+// reflinkFile makes out share the data blocks of in. Filesystems and file
+// pairs that cannot be cloned yield an error wrapping errReflinkUnsupported.
+func reflinkFile(out, in *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd())
+	switch errno {
+	case 0:
+		return nil
+	case syscall.EXDEV, syscall.EOPNOTSUPP, syscall.EINVAL, syscall.ENOTTY, syscall.ENOSYS:
+		return fmt.Errorf("%w: %w", errReflinkUnsupported, errno)
+	default:
+		return fmt.Errorf("failed to reflink %s to %s: %w", in.Name(), out.Name(), errno)
+	}
+}
+
+// lseek whence values for hole detection (see lseek(2)).
+const (
+	seekData = 3 // SEEK_DATA
+	seekHole = 4 // SEEK_HOLE
+)
+
+// copyFileContents copies in to out, preserving holes in sparse files so thin
+// provisioned images stay thin. Data regions are copied with io.CopyN, which
+// uses copy_file_range between regular files. Filesystems without
+// SEEK_DATA/SEEK_HOLE support fall back to a plain copy.
+func copyFileContents(out, in *os.File) (int64, error) {
+	info, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+
+	// Probe for hole support
+	if _, err := in.Seek(0, seekData); err != nil && !errors.Is(err, syscall.ENXIO) {
+		if _, err := in.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		return io.Copy(out, in)
+	}
+
+	var copied int64
+	for offset := int64(0); offset < size; {
+		dataStart, err := in.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			break // The rest of the file is a hole
+		}
+		if err != nil {
+			return copied, err
+		}
+		dataEnd, err := in.Seek(dataStart, seekHole)
+		if err != nil {
+			return copied, err
+		}
+
+		if _, err := in.Seek(dataStart, io.SeekStart); err != nil {
+			return copied, err
+		}
+		if _, err := out.Seek(dataStart, io.SeekStart); err != nil {
+			return copied, err
+		}
+		n, err := io.CopyN(out, in, dataEnd-dataStart)
+		copied += n
+		if err != nil {
+			return copied, err
+		}
+		offset = dataEnd
+	}
+
+	// Extend the destination over any trailing hole
+	return copied, out.Truncate(size)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package filesystem
+
+import (
+	"io"
+	"os"
+)
+
+// copyFileContents copies in to out.
+func copyFileContents(out, in *os.File) (int64, error) {
+	return io.Copy(out, in)
+}
+
+// reflinkFile is not supported outside of Linux.
+func reflinkFile(out, in *os.File) error {
+	return errReflinkUnsupported
+}
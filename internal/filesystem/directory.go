@@ -2,7 +2,9 @@ package filesystem
 
 import (
 	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
 )
 
 // CreateDirectory creates a directory and any necessary parent directories.
@@ -11,13 +13,14 @@ func CreateDirectory(path string, perm os.FileMode) error {
 	return os.MkdirAll(path, perm)
 }
 
-// DeleteDirectory removes a directory at the specified path.
+// DeleteDirectory removes a directory at the specified path. A missing
+// directory fails with ErrNotFound.
 func DeleteDirectory(path string) error {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return fmt.Errorf("directory does not exist")
+		return fmt.Errorf("directory %s %w: %w", path, ErrNotFound, err)
 	}
 	if err := os.RemoveAll(path); err != nil {
-		return fmt.Errorf("failed to delete directory: %v", err)
+		return fmt.Errorf("failed to delete directory: %w", err)
 	}
 	return nil
 }
@@ -26,7 +29,8 @@ func DeleteDirectory(path string) error {
 // It returns:
 //   - true, nil if the path exists and is a directory.
 //   - false, nil if the path does not exist.
-//   - false, an error if the path exists but is not a directory, or if another error occurs.
+//   - false, an error wrapping ErrNotDirectory if the path exists but is not a directory.
+//   - false, an error if another error occurs.
 func CheckDirectoryExists(path string) (bool, error) {
 	info, err := os.Stat(path)
 
@@ -38,8 +42,55 @@ func CheckDirectoryExists(path string) (bool, error) {
 	}
 
 	if !info.IsDir() {
-		return false, fmt.Errorf("path '%s' exists but is not a directory", path)
+		return false, fmt.Errorf("path '%s' exists but %w", path, ErrNotDirectory)
 	}
 
 	return true, nil // Directory exists and is a directory
 }
+
+// DiskUsage totals the apparent size of all regular files under dir and
+// returns the byte count and number of files. Symlinks are not followed to
+// avoid double-counting and loops.
+func DiskUsage(dir string) (int64, int, error) {
+	return diskUsage(dir, false)
+}
+
+// DiskUsageAllocated is DiskUsage counting the blocks actually allocated on
+// disk rather than the apparent size, which differs widely for sparse images.
+func DiskUsageAllocated(dir string) (int64, int, error) {
+	return diskUsage(dir, true)
+}
+
+func diskUsage(dir string, allocated bool) (int64, int, error) {
+	var (
+		bytes     int64
+		fileCount int
+	)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skip directories, symlinks and special files
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // Removed while walking
+			}
+			return err
+		}
+		if allocated {
+			bytes += allocatedSize(info)
+		} else {
+			bytes += info.Size()
+		}
+		fileCount++
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to compute disk usage of '%s': %w", dir, err)
+	}
+	return bytes, fileCount, nil
+}
@@ -0,0 +1,452 @@
+package filesystem
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"libvirt-controller/internal/logging"
+)
+
+const (
+	// progressInterval is the minimum number of bytes between progress callbacks.
+	progressInterval = 1 << 20 // 1MB
+	// progressPeriod is the maximum time between progress callbacks.
+	progressPeriod = time.Second
+)
+
+// DownloadFile handles actual downloading from the URL to a specified path.
+// Besides http(s) URLs, file:// URLs and absolute paths are copied locally.
+func DownloadFile(url, filePath string, mode os.FileMode) error {
+	return DownloadFileContext(context.Background(), url, filePath, mode)
+}
+
+// DownloadFileContext downloads the URL to filePath, aborting when ctx is
+// cancelled. A partially written file is removed on any error.
+func DownloadFileContext(ctx context.Context, url, filePath string, mode os.FileMode) error {
+	return DownloadFileWithOptions(ctx, url, filePath, mode, DownloadOptions{})
+}
+
+// DownloadFileWithProgress downloads the URL to filePath and periodically calls
+// progress with the number of bytes written so far and the total size taken
+// from the Content-Length header, or -1 when the size is unknown.
+func DownloadFileWithProgress(url, filePath string, mode os.FileMode, progress func(bytesDone, bytesTotal int64)) error {
+	return DownloadFileWithOptions(context.Background(), url, filePath, mode, DownloadOptions{Progress: progress})
+}
+
+// DownloadFileWithChecksum downloads the URL to filePath while hashing the body
+// with algo (sha256, sha512 or md5) and compares the hex digest to expected.
+// On a mismatch the downloaded file is removed.
+func DownloadFileWithChecksum(url, filePath string, mode os.FileMode, algo string, expected string) error {
+	return DownloadFileWithOptions(context.Background(), url, filePath, mode, DownloadOptions{ChecksumAlgo: algo, Checksum: expected})
+}
+
+// DownloadOptions holds the optional behaviour shared by the download variants.
+type DownloadOptions struct {
+	Progress     func(bytesDone, bytesTotal int64) // Called periodically with the bytes received so far
+	ChecksumAlgo string                            // Checksum algorithm, empty to skip verification
+	Checksum     string                            // Expected hex digest
+	Format       string                            // Expected image format, empty to skip verification
+
+	// Compressed downloads (.gz, .xz, .zst or a matching Content-Encoding)
+	// are decompressed while streaming unless KeepCompressed is set. The
+	// checksum is verified against the bytes as downloaded unless
+	// ChecksumDecompressed is set.
+	KeepCompressed       bool
+	ChecksumDecompressed bool
+
+	// Retry controls retries of transient failures, DefaultRetryPolicy is
+	// used when it is left empty.
+	Retry RetryPolicy
+
+	// BandwidthLimit caps the rate of this download in bytes per second, 0
+	// means unlimited. SetGlobalBandwidthLimit caps all downloads together.
+	BandwidthLimit int64
+
+	// Logger receives retries and resumes, nothing is logged when it is nil.
+	Logger logging.Logger
+
+	sink io.Writer // Receives a copy of the bytes written to the file
+}
+
+// DownloadFileWithOptions downloads the URL to filePath, aborting when ctx is
+// cancelled and applying the verification configured in opts. A partially
+// written or rejected file is removed.
+//
+// Transient failures (connection errors, 408, 429 and 5xx responses) are
+// retried with exponential backoff, honoring Retry-After. If the server
+// supports range requests, a body interrupted midway is resumed from the
+// current offset rather than downloaded again.
+func DownloadFileWithOptions(ctx context.Context, url, filePath string, mode os.FileMode, opts DownloadOptions) error {
+	rt := newRetrier(opts.Retry, logging.OrNop(opts.Logger))
+	for {
+		err := downloadOnce(ctx, url, filePath, mode, opts, rt)
+		if err == nil || !rt.retry(ctx, err) {
+			return err
+		}
+		rt.log.Warn("retrying download", "url", url, "err", err)
+	}
+}
+
+// downloadOnce makes a single attempt at downloading url to filePath.
+func downloadOnce(ctx context.Context, url, filePath string, mode os.FileMode, opts DownloadOptions, rt *retrier) (err error) {
+	var h hash.Hash
+	if opts.ChecksumAlgo != "" {
+		if h, err = newHash(opts.ChecksumAlgo); err != nil {
+			return err
+		}
+	}
+
+	compression := ""
+	if !opts.KeepCompressed {
+		compression = detectCompression(url, "")
+	}
+	path, local, err := localSourcePath(url)
+	if err != nil {
+		return err
+	}
+	if local && compression == "" && opts.BandwidthLimit <= 0 && globalLimiter.Load() == nil {
+		return copyLocal(ctx, path, filePath, mode, opts, h)
+	}
+
+	// Open the source before touching the destination
+	src, err := openSource(ctx, url, rt)
+	if err != nil {
+		return err
+	}
+	defer src.body.Close()
+
+	// Create the file
+	out, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// Remove the partial file on any failure
+	defer func() {
+		if err != nil {
+			os.Remove(filePath)
+		}
+	}()
+
+	// Throttle before progress so it reports the limited rate
+	body := newLimitedReader(ctx, src.body, opts.BandwidthLimit)
+
+	// Report progress on the bytes received, which is what Content-Length counts
+	var pr *progressReader
+	if opts.Progress != nil {
+		pr = &progressReader{r: body, total: src.size, progress: opts.Progress}
+		body = pr
+	}
+
+	// Hash the body while writing it so the image is only read once
+	if !opts.KeepCompressed {
+		compression = detectCompression(url, src.encoding)
+	}
+	if h != nil && (compression == "" || !opts.ChecksumDecompressed) {
+		body = io.TeeReader(body, h)
+	}
+	if compression != "" {
+		dr, err := newDecompressor(body, compression)
+		if err != nil {
+			return fmt.Errorf("failed to decompress %s: %w", url, err)
+		}
+		defer dr.Close()
+		body = dr
+		if h != nil && opts.ChecksumDecompressed {
+			body = io.TeeReader(body, h)
+		}
+	}
+
+	// Write the body to file
+	var dst io.Writer = out
+	if opts.sink != nil {
+		// Drop anything received by a previous attempt
+		if r, ok := opts.sink.(interface{ Reset() }); ok {
+			r.Reset()
+		}
+		dst = io.MultiWriter(out, opts.sink)
+	}
+	if _, err := io.Copy(dst, body); err != nil {
+		if compression != "" {
+			return fmt.Errorf("failed to decompress %s: %w", url, err)
+		}
+		return err
+	}
+	if pr != nil {
+		pr.report()
+	}
+
+	if h != nil {
+		actual := hex.EncodeToString(h.Sum(nil))
+		if !strings.EqualFold(actual, opts.Checksum) {
+			return fmt.Errorf("checksum mismatch for %s: expected %s %s, got %s", url, opts.ChecksumAlgo, opts.Checksum, actual)
+		}
+	}
+
+	// Reject error pages and unexpected formats before the file gets used as a disk
+	if opts.Format != "" {
+		if err := VerifyImageFormat(filePath, opts.Format); err != nil {
+			return err
+		}
+	}
+
+	// Set file permissions
+	return os.Chmod(filePath, mode)
+}
+
+// copyLocal copies the local file at path to filePath with CopyFile, which
+// keeps the holes of sparse images. The copy is then read back for the
+// checksum and the sink, so the verification matches downloads over HTTP.
+func copyLocal(ctx context.Context, path, filePath string, mode os.FileMode, opts DownloadOptions, h hash.Hash) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := CopyFile(path, filePath, mode); err != nil {
+		return err
+	}
+
+	// Remove the copy on any failure
+	defer func() {
+		if err != nil {
+			os.Remove(filePath)
+		}
+	}()
+
+	var sinks []io.Writer
+	if h != nil {
+		sinks = append(sinks, h)
+	}
+	if opts.sink != nil {
+		if r, ok := opts.sink.(interface{ Reset() }); ok {
+			r.Reset()
+		}
+		sinks = append(sinks, opts.sink)
+	}
+	var size int64
+	if len(sinks) > 0 {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if size, err = io.Copy(io.MultiWriter(sinks...), &contextReader{ctx: ctx, ReadCloser: f}); err != nil {
+			return err
+		}
+	} else {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return err
+		}
+		size = info.Size()
+	}
+	if opts.Progress != nil {
+		opts.Progress(size, size)
+	}
+
+	if h != nil {
+		actual := hex.EncodeToString(h.Sum(nil))
+		if !strings.EqualFold(actual, opts.Checksum) {
+			return fmt.Errorf("checksum mismatch for %s: expected %s %s, got %s", path, opts.ChecksumAlgo, opts.Checksum, actual)
+		}
+	}
+
+	if opts.Format != "" {
+		return VerifyImageFormat(filePath, opts.Format)
+	}
+	return nil
+}
+
+// progressReader wraps a reader and invokes a progress callback every
+// progressInterval bytes or progressPeriod, whichever comes first.
+type progressReader struct {
+	r          io.Reader
+	done       int64
+	total      int64
+	lastDone   int64
+	lastReport time.Time
+	progress   func(bytesDone, bytesTotal int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.done += int64(n)
+	if p.done-p.lastDone >= progressInterval || time.Since(p.lastReport) >= progressPeriod {
+		p.report()
+	}
+	return n, err
+}
+
+// report invokes the progress callback with the current counters.
+func (p *progressReader) report() {
+	p.lastDone = p.done
+	p.lastReport = time.Now()
+	if p.progress != nil {
+		p.progress(p.done, p.total)
+	}
+}
+
+// downloadMeta records the validators of an in-progress download so a later
+// resume can detect that the upstream file changed.
+type downloadMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// validator returns the value to send in an If-Range header, preferring the ETag.
+func (m *downloadMeta) validator() string {
+	if m.ETag != "" {
+		return m.ETag
+	}
+	return m.LastModified
+}
+
+// matches reports whether the response still refers to the same upstream file.
+func (m *downloadMeta) matches(resp *http.Response) bool {
+	if m.ETag != "" {
+		return m.ETag == resp.Header.Get("ETag")
+	}
+	if m.LastModified != "" {
+		return m.LastModified == resp.Header.Get("Last-Modified")
+	}
+	return false
+}
+
+// DownloadResumable downloads the URL to filePath, resuming a previous partial
+// download with a Range request when possible. The ETag/Last-Modified of the
+// upstream file are stored in a "<filePath>.download" sidecar while the
+// download is in progress; if the upstream file has changed since, or the
+// server ignores the Range header, the download restarts from zero.
+func DownloadResumable(url, filePath string, mode os.FileMode) error {
+	return DownloadResumableContext(context.Background(), url, filePath, mode)
+}
+
+// DownloadResumableContext is DownloadResumable aborting when ctx is cancelled.
+// The partial file is kept so that a later call can resume it.
+func DownloadResumableContext(ctx context.Context, url, filePath string, mode os.FileMode) error {
+	// Local sources are cheap to copy again, there is nothing to resume
+	if _, local, err := localSourcePath(url); err != nil || local {
+		return DownloadFileContext(ctx, url, filePath, mode)
+	}
+
+	metaPath := filePath + ".download"
+
+	// Only resume when a sidecar for the same URL marks the file as partial
+	var offset int64
+	meta, err := readDownloadMeta(metaPath)
+	if err == nil && meta.URL == url && meta.validator() != "" {
+		if info, err := os.Stat(filePath); err == nil {
+			offset = info.Size()
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", meta.validator())
+	}
+
+	resp, err := doRequest(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var flags int
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0 && meta.matches(resp):
+		// Append to the partial file
+		flags = os.O_WRONLY | os.O_APPEND
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		// Upstream changed underneath us; start over without a Range header
+		resp.Body.Close()
+		os.Remove(metaPath)
+		os.Remove(filePath)
+		return DownloadResumableContext(ctx, url, filePath, mode)
+	case resp.StatusCode == http.StatusOK:
+		// Server ignored the range or there was nothing to resume
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	default:
+		return newHTTPStatusError(resp)
+	}
+
+	// Record the validators before writing so an interrupted copy can resume
+	meta = &downloadMeta{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if err := writeDownloadMeta(metaPath, meta); err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(filePath, flags, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// Write the body to file
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		return err
+	}
+
+	// The download is complete, the sidecar is no longer needed
+	if err := os.Remove(metaPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// Set file permissions
+	return os.Chmod(filePath, mode)
+}
+
+// readDownloadMeta loads a download sidecar file.
+func readDownloadMeta(path string) (*downloadMeta, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var meta downloadMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// writeDownloadMeta stores a download sidecar file.
+func writeDownloadMeta(path string, meta *downloadMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// newHash returns a hash.Hash for the named algorithm.
+func newHash(algo string) (hash.Hash, error) {
+	switch strings.ToLower(algo) {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "md5":
+		return md5.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm: %s", algo)
+	}
+}
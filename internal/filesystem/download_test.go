@@ -0,0 +1,171 @@
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloadResumesDroppedBody(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	var (
+		mu     sync.Mutex
+		ranges []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("ETag", `"v1"`)
+
+		if r.Header.Get("Range") == "" {
+			// Send half of the body, then drop the connection
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(data[:len(data)/2])
+			w.(http.Flusher).Flush()
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("error hijacking connection. Err: %v", err)
+				return
+			}
+			conn.Close()
+			return
+		}
+
+		var offset int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &offset); err != nil || r.Header.Get("If-Range") != `"v1"` {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(data)-1, len(data)))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)-offset))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[offset:])
+	}))
+	t.Cleanup(server.Close)
+
+	dst := filepath.Join(t.TempDir(), "image.raw")
+	opts := DownloadOptions{Retry: RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}}
+	if err := DownloadFileWithOptions(context.Background(), server.URL+"/image.raw", dst, 0644, opts); err != nil {
+		t.Fatalf("error downloading file. Err: %v", err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("error reading file. Err: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("expected the resumed download to match the source; got %d bytes", len(got))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ranges) != 2 || ranges[0] != "" || ranges[1] == "" {
+		t.Errorf("expected a full request then a Range request; got %q", ranges)
+	}
+}
+
+func TestDownloadHonorsRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+	}{
+		{name: "too many requests", status: http.StatusTooManyRequests},
+		{name: "service unavailable", status: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				requests []time.Time
+			)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				requests = append(requests, time.Now())
+				first := len(requests) == 1
+				mu.Unlock()
+				if first {
+					w.Header().Set("Retry-After", "1")
+					w.WriteHeader(tt.status)
+					return
+				}
+				w.Write([]byte("image"))
+			}))
+			t.Cleanup(server.Close)
+
+			// The backoff alone would retry after a millisecond
+			dst := filepath.Join(t.TempDir(), "image.raw")
+			opts := DownloadOptions{Retry: RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}}
+			if err := DownloadFileWithOptions(context.Background(), server.URL+"/image.raw", dst, 0644, opts); err != nil {
+				t.Fatalf("error downloading file. Err: %v", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(requests) != 2 {
+				t.Fatalf("expected 2 requests; got %d", len(requests))
+			}
+			if delay := requests[1].Sub(requests[0]); delay < 900*time.Millisecond {
+				t.Errorf("expected the retry to wait for Retry-After; waited %v", delay)
+			}
+		})
+	}
+}
+
+func TestDownloadChecksum(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("image"))
+	}))
+	t.Cleanup(server.Close)
+	local := filepath.Join(t.TempDir(), "image.raw")
+	if err := os.WriteFile(local, []byte("image"), 0644); err != nil {
+		t.Fatalf("error writing file. Err: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		algo     string
+		checksum string
+		wantErr  bool
+	}{
+		{name: "sha256", algo: "sha256", checksum: "6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d"},
+		{name: "sha512", algo: "sha512", checksum: "eb31d04da633dc9f49dfbd66cdb92fbb9b4f9c9be67914c0209b5dd31cc65a136e1cdce7d0db88112e3a759131b9d970cfaac7ee77ccd620c3dd49043f88958e"},
+		{name: "md5", algo: "md5", checksum: "78805a221a988e79ef3f42d7c5bfd418"},
+		{name: "upper case digest", algo: "sha256", checksum: "6105D6CC76AF400325E94D588CE511BE5BFDBB73B437DC51ECA43917D7A43E3D"},
+		{name: "mismatch", algo: "sha256", checksum: "0000000000000000000000000000000000000000000000000000000000000000", wantErr: true},
+		{name: "truncated digest", algo: "md5", checksum: "78805a221a988e79", wantErr: true},
+		{name: "unsupported algorithm", algo: "crc32", checksum: "00000000", wantErr: true},
+	}
+	for _, tt := range tests {
+		for source, url := range map[string]string{"http": server.URL + "/image.raw", "local": local} {
+			t.Run(tt.name+"/"+source, func(t *testing.T) {
+				dst := filepath.Join(t.TempDir(), "image.raw")
+				err := DownloadFileWithChecksum(url, dst, 0644, tt.algo, tt.checksum)
+				if tt.wantErr {
+					if err == nil {
+						t.Errorf("expected the checksum to be rejected")
+					}
+					if FileExists(dst) {
+						t.Errorf("expected a rejected file to be removed")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("error downloading file. Err: %v", err)
+				}
+				if got, _ := os.ReadFile(dst); string(got) != "image" {
+					t.Errorf("expected file content to be %q; got %q", "image", got)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package filesystem
+
+import "errors"
+
+// Errors wrapped by the helpers of this package, so callers can tell the
+// cause apart with errors.Is instead of matching the message. Errors caused
+// by the operating system wrap its error as well, e.g. os.ErrNotExist.
+var (
+	// ErrNotFound means the file or directory to act on does not exist.
+	ErrNotFound = errors.New("does not exist")
+	// ErrAlreadyExists means a file that would be replaced already exists.
+	ErrAlreadyExists = errors.New("already exists")
+	// ErrNotDirectory means a path expected to be a directory is not.
+	ErrNotDirectory = errors.New("is not a directory")
+	// ErrInsufficientSpace is returned when a filesystem has too little
+	// free space for a fully preallocated image.
+	ErrInsufficientSpace = errors.New("not enough free space")
+)
@@ -1,143 +1,217 @@
 package filesystem
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
+	"syscall"
 	"time"
 )
 
+// DirPerm is the permission used when SaveFile creates a missing target directory.
+var DirPerm os.FileMode = 0755
+
+// errReflinkUnsupported means a file could not be reflinked and has to be
+// copied instead.
+var errReflinkUnsupported = errors.New("reflink is not supported")
+
 // SaveFile saves data to a file within a specified directory.
-// It will overwrite the file if it already exists.
+// It will overwrite the file if it already exists and creates dir if it is
+// missing. The data is written to a temporary file in the same directory and
+// renamed into place, so readers never observe a partially written file.
+// A filename leading out of dir, through ".." or a symlinked directory, is
+// rejected with ErrPathEscape, as it is by the other dir/filename helpers.
 func SaveFile(dir string, filename string, data []byte) error {
-	filePath := filepath.Join(dir, filename)
-	err := os.WriteFile(filePath, data, 0644) // 0644 is a common file permission
-	if err != nil {
-		return fmt.Errorf("failed to save file %s: %w", filePath, err)
-	}
-	return nil
+	return SaveFileMode(dir, filename, data, 0644) // 0644 is a common file permission
 }
 
-// DeleteFile deletes a file at the specified path.
-func DeleteFile(dir, filename string) error {
-	filePath := filepath.Join(dir, filename)
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return fmt.Errorf("file does not exist")
+// SaveFileMode is SaveFile with an explicit file mode, e.g. 0600 for files
+// containing credentials. The mode is applied even when replacing an existing file.
+func SaveFileMode(dir string, filename string, data []byte, mode os.FileMode) error {
+	_, err := SaveFileStream(dir, filename, bytes.NewReader(data), mode)
+	return err
+}
+
+// SaveFileStream is SaveFileMode reading the content from r, so large
+// generated content does not have to be buffered in memory. It returns the
+// number of bytes written.
+func SaveFileStream(dir string, filename string, r io.Reader, mode os.FileMode) (int64, error) {
+	filePath, err := safeJoin(dir, filename)
+	if err != nil {
+		return 0, err
 	}
-	if err := os.Remove(filePath); err != nil {
-		return fmt.Errorf("failed to delete file: %v", err)
+	dir, filename = filepath.Dir(filePath), filepath.Base(filePath)
+	if err := os.MkdirAll(dir, DirPerm); err != nil {
+		return 0, fmt.Errorf("failed to create directory %s: %w", dir, err)
 	}
-	return nil
+	n, err := writeFileAtomic(dir, filename, r, mode)
+	if err != nil {
+		return n, fmt.Errorf("failed to save file %s: %w", filePath, err)
+	}
+	return n, nil
 }
 
-// UpdateFile updates the content of an existing file.
-func UpdateFile(dir, filename string, data []byte) error {
-	filePath := filepath.Join(dir, filename)
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return fmt.Errorf("file does not exist")
+// writeFileAtomic writes r to a sibling temp file, fsyncs it, renames it
+// over dir/filename and then fsyncs the parent directory so the rename
+// survives a power loss.
+func writeFileAtomic(dir, filename string, r io.Reader, mode os.FileMode) (int64, error) {
+	tmp, err := os.CreateTemp(dir, fmt.Sprintf("%s.tmp-%d-*", filename, os.Getpid()))
+	if err != nil {
+		return 0, err
 	}
-	return os.WriteFile(filePath, data, 0644) // Overwrite the file with new data
+	tmpPath := tmp.Name()
+
+	// Remove the temp file on any failure before the rename
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		return n, err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		return n, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return n, err
+	}
+	if err := tmp.Close(); err != nil {
+		return n, err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(dir, filename)); err != nil {
+		return n, err
+	}
+	committed = true
+
+	return n, syncDir(dir)
 }
 
-// downloadFile handles actual downloading from the URL to a specified path
-func DownloadFile(url, filePath string, mode os.FileMode) error {
-	// Create the file
-	out, err := os.Create(filePath)
+// syncDir fsyncs a directory so that entries created or renamed in it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
+	defer d.Close()
+	return d.Sync()
+}
 
-	// Get the data
-	resp, err := http.Get(url)
+// DeleteFile deletes a file at the specified path. A missing file fails
+// with ErrNotFound.
+func DeleteFile(dir, filename string) error {
+	filePath, err := safeJoin(dir, filename)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-
-	// Check server response
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to download file: %s", resp.Status)
+	if err := os.Remove(filePath); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("file %s %w: %w", filePath, ErrNotFound, err)
+		}
+		return fmt.Errorf("failed to delete file: %w", err)
 	}
+	return nil
+}
 
-	// Write the body to file
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
+// DeleteFilePrune deletes a file like DeleteFile and then removes the
+// directories above it that are left empty, starting with dir. It stops at
+// the first directory that is not empty and never removes root or anything
+// above it. dir must be root or below it.
+func DeleteFilePrune(root, dir, filename string) error {
+	root, dir = filepath.Clean(root), filepath.Clean(dir)
+	if !isWithin(root, dir) {
+		return fmt.Errorf("directory %s is not below %s", dir, root)
+	}
+	if err := DeleteFile(dir, filename); err != nil {
 		return err
 	}
-
-	// Set file permissions
-	return os.Chmod(filePath, mode)
+	return PruneEmptyDirs(root, dir)
 }
 
-// DownloadCachedFile manages the cache logic and uses downloadFile if necessary
-func DownloadCachedFile(url string, name string, mode os.FileMode) error {
-	// Get cache directory from environment
-	cacheDir := os.Getenv("CACHE_DIR")
-	useCache := cacheDir != "" // Determine if caching should be used
-
-	// Determine cache duration
-	var cacheDuration time.Duration
-	cacheSecondsStr := os.Getenv("CACHE_SECONDS")
-	if cacheSecondsStr != "" {
-		seconds, err := strconv.Atoi(cacheSecondsStr)
-		if err == nil {
-			cacheDuration = time.Duration(seconds) * time.Second
-		} else {
-			// Fallback to default if conversion fails
-			cacheDuration = 604800 * time.Second // 7 days in seconds
+// PruneEmptyDirs removes dir and the directories above it that are left
+// empty. It stops at the first directory that is not empty and never
+// removes root or anything above it. dir must be root or below it.
+func PruneEmptyDirs(root, dir string) error {
+	root, dir = filepath.Clean(root), filepath.Clean(dir)
+	if !isWithin(root, dir) {
+		return fmt.Errorf("directory %s is not below %s", dir, root)
+	}
+	for d := dir; d != root; d = filepath.Dir(d) {
+		err := os.Remove(d)
+		if err == nil || os.IsNotExist(err) {
+			continue
 		}
-	} else {
-		cacheDuration = 604800 * time.Second // Default: 7 days (604800 seconds)
+		if errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST) {
+			return nil
+		}
+		return fmt.Errorf("failed to remove empty directory %s: %w", d, err)
 	}
+	return nil
+}
 
-	// If no cache directory is set, directly download and copy the file
-	if !useCache {
-		// Download the file directly to the destination
-		return DownloadFile(url, name, mode)
+// DeleteFileIfExists deletes a file at the specified path if it exists.
+// It returns false and no error when the file is already gone, so cleanup
+// paths can safely be re-run.
+func DeleteFileIfExists(dir, filename string) (bool, error) {
+	filePath, err := safeJoin(dir, filename)
+	if err != nil {
+		return false, err
+	}
+	if err := os.Remove(filePath); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to delete file: %w", err)
 	}
+	return true, nil
+}
+
+// UpdateFile updates the content of an existing file.
+// The file is opened without O_CREATE, so a missing file fails with
+// ErrNotFound.
+func UpdateFile(dir, filename string, data []byte) error {
+	return UpdateFileMode(dir, filename, data, 0644)
+}
 
-	// Ensure cache directory exists if caching is enabled
-	err := os.MkdirAll(cacheDir, os.ModePerm)
+// UpdateFileMode is UpdateFile with an explicit file mode. The mode is applied
+// with an explicit chmod so the file does not keep its previous permissions.
+func UpdateFileMode(dir, filename string, data []byte, mode os.FileMode) error {
+	filePath, err := safeJoin(dir, filename)
 	if err != nil {
 		return err
 	}
-
-	// Perform a cache clean-up before checking for the file
-	err = CleanCache(cacheDir, cacheDuration)
-	if err != nil {
-		// Log the error but proceed with download logic
-		fmt.Printf("Error cleaning cache directory %s: %v\n", cacheDir, err)
+	// Opening the file would follow a symlink wherever it points
+	if info, err := os.Lstat(filePath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("failed to update file %s: %w: it is a symlink", filePath, ErrPathEscape)
 	}
-
-	// Determine the filename from the URL
-	fileName := filepath.Base(url)
-	cacheFilePath := filepath.Join(cacheDir, fileName)
-
-	// Check if file is in the cache and not older than the specified duration
-	/*if FileExists(cacheFilePath) && !IsFileOlderThan(cacheFilePath, cacheDuration) {
-		// Copy the file from cache to the destination
-		return CopyFile(cacheFilePath, name, mode)
-	}*/
-
-	// Check if file is in the cache (after cleanup)
-	if FileExists(cacheFilePath) {
-		// Copy the file from cache to the destination
-		return CopyFile(cacheFilePath, name, mode)
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_TRUNC, mode)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("file %s %w: %w", filePath, ErrNotFound, err)
 	}
-
-	// Download the file into the cache
-	err = DownloadFile(url, cacheFilePath, mode)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to update file %s: %w", filePath, err)
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to update file %s: %w", filePath, err)
 	}
 
-	// Copy the cached file to the destination
-	return CopyFile(cacheFilePath, name, mode)
+	// Overwrite the file with new data
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to update file %s: %w", filePath, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to update file %s: %w", filePath, err)
+	}
+	return nil
 }
 
 // FileExists checks if a file exists at the given path
@@ -146,56 +220,177 @@ func FileExists(path string) bool {
 	return !os.IsNotExist(err)
 }
 
-// IsFileOlderThan checks if a file is older than the specified duration
-func IsFileOlderThan(path string, duration time.Duration) bool {
+// IsFileOlderThan checks if a file is older than the specified duration.
+// Stat failures are returned rather than reported as an old file.
+func IsFileOlderThan(path string, duration time.Duration) (bool, error) {
 	info, err := os.Stat(path)
 	if err != nil {
-		return true
+		return false, err
 	}
-	return time.Since(info.ModTime()) > duration
+	return time.Since(info.ModTime()) > duration, nil
+}
+
+// CleanCache sweeps through the cache directory and deletes files that have not been
+// accessed within the specified duration. Subdirectories are skipped.
+// It keeps going past individual failures and returns the number of files removed,
+// the bytes reclaimed and the combined errors of any files that could not be deleted.
+func CleanCache(cacheDir string, duration time.Duration) (int, int64, error) {
+	return cleanCache(cacheDir, duration, false)
 }
 
-// CleanCache sweeps through the cache directory and deletes files older than the specified duration.
-func CleanCache(cacheDir string, duration time.Duration) error {
-	files, err := ioutil.ReadDir(cacheDir)
+// CleanCacheRecursive behaves like CleanCache but also sweeps subdirectories,
+// removing any that are left empty afterwards.
+func CleanCacheRecursive(cacheDir string, duration time.Duration) (int, int64, error) {
+	return cleanCache(cacheDir, duration, true)
+}
+
+func cleanCache(cacheDir string, duration time.Duration, recursive bool) (int, int64, error) {
+	entries, err := os.ReadDir(cacheDir)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 
-	for _, file := range files {
-		if file.IsDir() {
-			continue // Skip subdirectories
-		}
-		filePath := filepath.Join(cacheDir, file.Name())
-		if time.Since(file.ModTime()) > duration {
-			err := os.Remove(filePath)
+	var (
+		removed   int
+		reclaimed int64
+		errs      []error
+	)
+	for _, entry := range entries {
+		filePath := filepath.Join(cacheDir, entry.Name())
+		if entry.IsDir() {
+			if !recursive {
+				continue // Skip subdirectories
+			}
+			n, size, err := cleanCache(filePath, duration, true)
+			removed += n
+			reclaimed += size
 			if err != nil {
-				// Log the error but continue to clean other files
-				// fmt.Printf("Error deleting file %s: %v\n", filePath, err)
+				errs = append(errs, err)
+				continue
+			}
+			// Remove the subdirectory if the sweep left it empty
+			if rest, err := os.ReadDir(filePath); err == nil && len(rest) == 0 {
+				if err := os.Remove(filePath); err != nil {
+					errs = append(errs, fmt.Errorf("failed to delete %s: %w", filePath, err))
+				}
 			}
+			continue
+		}
+
+		// Stat each file fresh rather than trusting the directory listing
+		info, err := os.Stat(filePath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				errs = append(errs, fmt.Errorf("failed to stat %s: %w", filePath, err))
+			}
+			continue
+		}
+		if time.Since(lastAccessTime(info)) > duration {
+			if err := os.Remove(filePath); err != nil {
+				// Record the error but continue to clean other files
+				errs = append(errs, fmt.Errorf("failed to delete %s: %w", filePath, err))
+				continue
+			}
+			removed++
+			reclaimed += info.Size()
 		}
 	}
-	return nil
+	return removed, reclaimed, errors.Join(errs...)
 }
 
-// CopyFile copies a file from src to dst with the specified mode
+// CopyFile copies a file from src to dst with the specified mode.
+// Holes in sparse source files are preserved where the filesystem supports it.
+// The copy is written to a temp file next to dst and renamed into place once
+// it is complete and synced, so dst is never left partially written.
 func CopyFile(src, dst string, mode os.FileMode) error {
+	return copyFile(src, dst, mode, copyFileContents)
+}
+
+// CopyFileReflink is CopyFile sharing the data blocks of src with dst via
+// the FICLONE ioctl where the filesystem supports it, as btrfs and XFS do,
+// which is instant and takes no extra space until either file is written.
+// It falls back to a normal copy when src and dst are on different
+// filesystems or the filesystem cannot reflink, and reports which was done.
+func CopyFileReflink(src, dst string, mode os.FileMode) (reflinked bool, err error) {
+	err = copyFile(src, dst, mode, func(out, in *os.File) (int64, error) {
+		err := reflinkFile(out, in)
+		if err == nil {
+			reflinked = true
+			info, err := in.Stat()
+			if err != nil {
+				return 0, err
+			}
+			return info.Size(), nil
+		}
+		if !errors.Is(err, errReflinkUnsupported) {
+			return 0, err
+		}
+		return copyFileContents(out, in)
+	})
+	return reflinked && err == nil, err
+}
+
+// copyFile implements CopyFile with contents filling the temp file.
+func copyFile(src, dst string, mode os.FileMode, contents func(out, in *os.File) (int64, error)) (err error) {
 	in, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer in.Close()
 
-	out, err := os.Create(dst)
+	dir := filepath.Dir(dst)
+	out, err := os.CreateTemp(dir, fmt.Sprintf("%s.tmp-%d-*", filepath.Base(dst), os.Getpid()))
 	if err != nil {
 		return err
 	}
-	defer out.Close()
+	tmpPath := out.Name()
+
+	// Remove the temp file on any failure
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(tmpPath)
+		}
+	}()
 
-	_, err = io.Copy(out, in)
+	n, err := contents(out, in)
 	if err != nil {
+		return fmt.Errorf("failed to copy %s to %s after %d bytes: %w", src, dst, n, err)
+	}
+	if err = out.Chmod(mode); err != nil {
+		return err
+	}
+	if err = out.Sync(); err != nil {
 		return err
 	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, dst); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
 
-	return os.Chmod(dst, mode)
+// MoveFile moves src to dst with the specified mode. It renames the file when
+// both paths are on the same filesystem and otherwise copies it and removes
+// the source. A failed copy leaves neither a partial dst nor removes src.
+func MoveFile(src, dst string, mode os.FileMode) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return os.Chmod(dst, mode)
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return fmt.Errorf("failed to move %s to %s: %w", src, dst, err)
+	}
+
+	// Cross-filesystem move, CopyFile only creates dst once the copy is complete
+	if err := CopyFile(src, dst, mode); err != nil {
+		return fmt.Errorf("failed to move %s to %s: %w", src, dst, err)
+	}
+	if err := os.Remove(src); err != nil {
+		return fmt.Errorf("moved %s to %s but failed to remove source: %w", src, dst, err)
+	}
+	return nil
 }
@@ -0,0 +1,349 @@
+package filesystem
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestSaveFileCreatesMissingDirectories(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "a", "b", "c")
+
+	if err := SaveFile(dir, "server.xml", []byte("<domain/>")); err != nil {
+		t.Fatalf("error saving file. Err: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "server.xml"))
+	if err != nil {
+		t.Fatalf("error reading saved file. Err: %v", err)
+	}
+	if string(got) != "<domain/>" {
+		t.Errorf("expected file content to be %q; got %q", "<domain/>", string(got))
+	}
+}
+
+func TestSaveFileReplacesAtomically(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string // Content before the save, empty for no file
+		r        io.Reader
+		mode     os.FileMode
+		want     string
+		wantErr  bool
+	}{
+		{name: "new file", r: strings.NewReader("<domain/>"), mode: 0644, want: "<domain/>"},
+		{name: "shorter content", existing: "<domain>old</domain>", r: strings.NewReader("<domain/>"), mode: 0644, want: "<domain/>"},
+		{name: "empty content", existing: "<domain/>", r: strings.NewReader(""), mode: 0644, want: ""},
+		{name: "new mode", existing: "<domain/>", r: strings.NewReader("secret"), mode: 0600, want: "secret"},
+		{name: "failed write keeps old file", existing: "<domain/>", r: io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(io.ErrUnexpectedEOF)), mode: 0644, want: "<domain/>", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "server.xml")
+			if tt.existing != "" {
+				if err := os.WriteFile(path, []byte(tt.existing), 0644); err != nil {
+					t.Fatalf("error writing file. Err: %v", err)
+				}
+			}
+
+			_, err := SaveFileStream(dir, "server.xml", tt.r, tt.mode)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("expected error %v; got %v", tt.wantErr, err)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("error reading saved file. Err: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("expected file content to be %q; got %q", tt.want, got)
+			}
+			if info, err := os.Stat(path); err == nil && !tt.wantErr && info.Mode().Perm() != tt.mode {
+				t.Errorf("expected mode %v; got %v", tt.mode, info.Mode().Perm())
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+				t.Errorf("expected no temp files to be left behind; got %d entries", len(entries))
+			}
+		})
+	}
+}
+
+func TestDeleteFilePrune(t *testing.T) {
+	root := t.TempDir()
+	vmDir := filepath.Join(root, "tenant", "vm1", "config")
+	if err := SaveFile(vmDir, "server.xml", []byte("<domain/>")); err != nil {
+		t.Fatalf("error saving file. Err: %v", err)
+	}
+	if err := SaveFile(filepath.Join(root, "tenant", "vm2"), "server.xml", []byte("<domain/>")); err != nil {
+		t.Fatalf("error saving file. Err: %v", err)
+	}
+
+	if err := DeleteFilePrune(root, vmDir, "server.xml"); err != nil {
+		t.Fatalf("error deleting file. Err: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "tenant", "vm1")); !os.IsNotExist(err) {
+		t.Errorf("expected empty VM directory to be removed; got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "tenant")); err != nil {
+		t.Errorf("expected non-empty tenant directory to be kept; got %v", err)
+	}
+
+	if err := DeleteFilePrune(root, filepath.Join(root, "tenant", "vm2"), "server.xml"); err != nil {
+		t.Fatalf("error deleting file. Err: %v", err)
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Errorf("expected root to be kept; got %v", err)
+	}
+	if err := DeleteFilePrune(filepath.Join(root, "tenant"), root, "x"); err == nil {
+		t.Errorf("expected an error for a directory above the root")
+	}
+}
+
+func TestWithFileLockTimeout(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("flock is only used on linux")
+	}
+	path := filepath.Join(t.TempDir(), "leases.json")
+
+	err := WithFileLock(path, func() error {
+		err := WithFileLockTimeout(path, 50*time.Millisecond, func() error { return nil })
+		if !errors.Is(err, ErrLockTimeout) {
+			t.Errorf("expected ErrLockTimeout while the lock is held; got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error taking lock. Err: %v", err)
+	}
+	if err := WithFileLockTimeout(path, 50*time.Millisecond, func() error { return nil }); err != nil {
+		t.Errorf("expected released lock to be free; got %v", err)
+	}
+}
+
+func TestFileHelpersRejectPathEscapes(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	dir := filepath.Join(root, "vms")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("error creating directory. Err: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("error creating symlink. Err: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "victim"), []byte("keep"), 0644); err != nil {
+		t.Fatalf("error writing file. Err: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "victim"), filepath.Join(dir, "victim")); err != nil {
+		t.Fatalf("error creating symlink. Err: %v", err)
+	}
+
+	for _, name := range []string{"../escape", "a/../../escape", "/etc/passwd", "", "link/escape"} {
+		if err := SaveFile(dir, name, []byte("x")); !errors.Is(err, ErrPathEscape) {
+			t.Errorf("expected SaveFile(%q) to fail with ErrPathEscape; got %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "escape")); !os.IsNotExist(err) {
+		t.Errorf("expected no file to be written outside of the directory")
+	}
+	if err := UpdateFile(dir, "victim", []byte("x")); !errors.Is(err, ErrPathEscape) {
+		t.Errorf("expected UpdateFile through a symlink to fail with ErrPathEscape; got %v", err)
+	}
+	if err := DeleteFile(dir, "link/victim"); !errors.Is(err, ErrPathEscape) {
+		t.Errorf("expected DeleteFile through a symlinked directory to fail with ErrPathEscape; got %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(outside, "victim")); string(got) != "keep" {
+		t.Errorf("expected file outside of the directory to be untouched; got %q", got)
+	}
+
+	if err := SaveFile(dir, "sub/server.xml", []byte("<domain/>")); err != nil {
+		t.Errorf("expected a file in a subdirectory to be saved; got %v", err)
+	}
+
+	for _, p := range []string{"/etc/passwd", filepath.Join(dir, "../escape"), filepath.Join(dir, "link/victim"), filepath.Join(dir, "victim"), "sub/server.xml"} {
+		if err := CheckWithin(dir, p); !errors.Is(err, ErrPathEscape) {
+			t.Errorf("expected CheckWithin(%q) to fail with ErrPathEscape; got %v", p, err)
+		}
+	}
+	if err := CheckWithin(dir, filepath.Join(dir, "sub/server.xml")); err != nil {
+		t.Errorf("expected a file below the directory to be accepted; got %v", err)
+	}
+}
+
+func TestCopyFileReflinkFallsBack(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "base.qcow2")
+	if err := os.WriteFile(src, []byte("QFI\xfbimage"), 0644); err != nil {
+		t.Fatalf("error writing file. Err: %v", err)
+	}
+
+	// Whether a reflink is possible depends on the filesystem of TempDir
+	if _, err := CopyFileReflink(src, filepath.Join(dir, "copy.qcow2"), 0600); err != nil {
+		t.Fatalf("error copying file. Err: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "copy.qcow2"))
+	if err != nil {
+		t.Fatalf("error reading copy. Err: %v", err)
+	}
+	if string(got) != "QFI\xfbimage" {
+		t.Errorf("expected copy to match source; got %q", got)
+	}
+}
+
+func TestDownloadBandwidthLimit(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "image.raw")
+	if err := os.WriteFile(src, make([]byte, 48<<10), 0644); err != nil {
+		t.Fatalf("error writing file. Err: %v", err)
+	}
+
+	// The first 32KiB fit in the burst, the rest takes half a second
+	var done int64
+	opts := DownloadOptions{BandwidthLimit: 32 << 10, Progress: func(bytesDone, _ int64) { done = bytesDone }}
+	start := time.Now()
+	if err := DownloadFileWithOptions(context.Background(), src, filepath.Join(dir, "copy.raw"), 0600, opts); err != nil {
+		t.Fatalf("error downloading file. Err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("expected download to be throttled; took %v", elapsed)
+	}
+	if done != 48<<10 {
+		t.Errorf("expected progress to report %d bytes; got %d", 48<<10, done)
+	}
+}
+
+func TestDownloadLocalSourceKeepsHoles(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "base.raw")
+	if err := os.WriteFile(src, []byte("data"), 0644); err != nil {
+		t.Fatalf("error writing file. Err: %v", err)
+	}
+	if err := os.Truncate(src, 8<<20); err != nil {
+		t.Fatalf("error extending file. Err: %v", err)
+	}
+	if info, err := os.Stat(src); err != nil || allocatedSize(info) >= 8<<20 {
+		t.Skip("filesystem of TempDir does not support sparse files")
+	}
+
+	sum := sha256.New()
+	sum.Write([]byte("data"))
+	sum.Write(make([]byte, 8<<20-4))
+	dst := filepath.Join(dir, "copy.raw")
+	if err := DownloadFileWithChecksum("file://"+src, dst, 0600, "sha256", hex.EncodeToString(sum.Sum(nil))); err != nil {
+		t.Fatalf("error downloading file. Err: %v", err)
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("error reading file info. Err: %v", err)
+	}
+	if info.Size() != 8<<20 || allocatedSize(info) >= 8<<20 {
+		t.Errorf("expected a sparse copy of 8MiB; got size %d, allocated %d", info.Size(), allocatedSize(info))
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600; got %v", info.Mode().Perm())
+	}
+
+	if err := DownloadFileWithChecksum(src, dst, 0600, "sha256", strings.Repeat("0", 64)); err == nil || FileExists(dst) {
+		t.Errorf("expected a checksum mismatch to fail and remove the copy; got %v", err)
+	}
+}
+
+func TestWipeVolumeZero(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.qcow2")
+	data := bytes.Repeat([]byte("tenant data "), wipeChunkSize/4)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("error writing file. Err: %v", err)
+	}
+
+	if err := WipeVolume(path, WipeZero); err != nil {
+		t.Fatalf("error wiping file. Err: %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading wiped file. Err: %v", err)
+	}
+	if len(got) != len(data) {
+		t.Errorf("expected wiped file to keep its size %d; got %d", len(data), len(got))
+	}
+	if !bytes.Equal(got, make([]byte, len(data))) {
+		t.Errorf("expected wiped file to contain only zeros")
+	}
+
+	if err := WipeVolume(path, "shred"); err == nil {
+		t.Errorf("expected an invalid method to be rejected")
+	}
+}
+
+func TestPreallocateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.raw")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatalf("error writing file. Err: %v", err)
+	}
+
+	// Filesystems without fallocate only support full preallocation
+	if err := PreallocateFile(path, 1<<20, PreallocFull); err != nil {
+		t.Fatalf("error preallocating file. Err: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("error reading file info. Err: %v", err)
+	}
+	if info.Size() != 1<<20 || allocatedSize(info) < 1<<20 {
+		t.Errorf("expected 1MiB allocated; got size %d, allocated %d", info.Size(), allocatedSize(info))
+	}
+
+	if err := PreallocateFile(path, 1<<20, PreallocMetadata); err == nil {
+		t.Errorf("expected metadata preallocation of a raw file to be rejected")
+	}
+	if err := CheckFreeSpace(filepath.Dir(path), 1<<62); runtime.GOOS == "linux" && !errors.Is(err, ErrInsufficientSpace) {
+		t.Errorf("expected ErrInsufficientSpace; got %v", err)
+	}
+}
+
+func TestMissingFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, err := range map[string]error{
+		"DeleteFile": DeleteFile(dir, "missing"),
+		"UpdateFile": UpdateFile(dir, "missing", []byte("x")),
+	} {
+		if !errors.Is(err, ErrNotFound) || !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected %s of a missing file to wrap ErrNotFound and os.ErrNotExist; got %v", name, err)
+		}
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatalf("error writing file. Err: %v", err)
+	}
+	if _, err := CheckDirectoryExists(file); !errors.Is(err, ErrNotDirectory) {
+		t.Errorf("expected ErrNotDirectory; got %v", err)
+	}
+}
+
+func TestIsRetryableNetworkErrors(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&url.Error{Op: "Get", URL: "http://x", Err: &net.DNSError{Err: "no such host", Name: "x", IsNotFound: true}}, false},
+		{&url.Error{Op: "Get", URL: "http://x", Err: &net.DNSError{Err: "i/o timeout", Name: "x", IsTimeout: true}}, true},
+		{&url.Error{Op: "Get", URL: "http://x", Err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}}, true},
+		{&url.Error{Op: "parse", URL: "::", Err: errors.New("missing protocol scheme")}, false},
+	} {
+		if got := isRetryable(tc.err); got != tc.want {
+			t.Errorf("expected isRetryable(%v) to be %v; got %v", tc.err, tc.want, got)
+		}
+	}
+}
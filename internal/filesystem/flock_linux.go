@@ -0,0 +1,70 @@
+package filesystem
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// lockPollInterval is how often lockFileTimeout retries a held lock.
+const lockPollInterval = 20 * time.Millisecond
+
+// lockFile takes an exclusive flock on path, creating it if needed, and
+// returns a function that releases the lock. It blocks until the lock is held.
+func lockFile(path string) (func(), error) {
+	return lockFileTimeout(path, 0)
+}
+
+// tryLockFile is lockFile reporting false instead of blocking when another
+// holder has the lock.
+func tryLockFile(path string) (func(), bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, true, nil
+}
+
+// lockFileTimeout is lockFile giving up with ErrLockTimeout once timeout has
+// passed. It blocks like lockFile when timeout is not positive.
+func lockFileTimeout(path string, timeout time.Duration) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	} else {
+		deadline := time.Now().Add(timeout)
+		for {
+			err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+			if !errors.Is(err, syscall.EWOULDBLOCK) {
+				break
+			}
+			if time.Now().After(deadline) {
+				err = ErrLockTimeout
+				break
+			}
+			time.Sleep(lockPollInterval)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package filesystem
+
+import "time"
+
+// lockFile is a no-op on platforms without flock; only in-process locking applies.
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
+
+// tryLockFile is a no-op like lockFile and always succeeds.
+func tryLockFile(path string) (func(), bool, error) {
+	return func() {}, true, nil
+}
+
+// lockFileTimeout is a no-op like lockFile.
+func lockFileTimeout(path string, timeout time.Duration) (func(), error) {
+	return func() {}, nil
+}
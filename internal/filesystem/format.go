@@ -0,0 +1,98 @@
+package filesystem
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Image formats returned by DetectImageFormat. The disk formats match the
+// names libvirt expects in <driver type='...'/>.
+const (
+	FormatQcow2 = "qcow2"
+	FormatRaw   = "raw"
+	FormatVMDK  = "vmdk"
+	FormatVDI   = "vdi"
+	FormatVHDX  = "vhdx"
+	FormatVPC   = "vpc"
+	FormatISO   = "iso"
+	FormatGzip  = "gzip"
+	FormatXz    = "xz"
+	FormatZstd  = "zstd"
+)
+
+// formatMagic maps magic bytes at a given offset to an image format.
+var formatMagic = []struct {
+	offset int
+	magic  []byte
+	format string
+}{
+	{0, []byte("QFI\xfb"), FormatQcow2},
+	{0, []byte("KDMV"), FormatVMDK},
+	{0, []byte("vhdxfile"), FormatVHDX},
+	{0, []byte("conectix"), FormatVPC},
+	{0, []byte("\x1f\x8b"), FormatGzip},
+	{0, []byte("\xfd7zXZ\x00"), FormatXz},
+	{0, []byte("\x28\xb5\x2f\xfd"), FormatZstd},
+	{0x40, []byte("\x7f\x10\xda\xbe"), FormatVDI},
+	{0x8001, []byte("CD001"), FormatISO},
+}
+
+// textPrefixes are the starts of bodies that are clearly not disk images,
+// such as error pages served with a 200 status.
+var textPrefixes = [][]byte{
+	[]byte("<!doctype"),
+	[]byte("<html"),
+	[]byte("<?xml"),
+	[]byte("{"),
+}
+
+// DetectImageFormat reads the magic bytes of the file at path and returns its
+// format. Files without a known signature are reported as raw, unless they
+// look like an HTML/XML/JSON document, in which case an error is returned.
+func DetectImageFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, 0x8001+5)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("failed to read image header of %s: %w", path, err)
+	}
+	header = header[:n]
+
+	if n == 0 {
+		return "", fmt.Errorf("image %s is empty", path)
+	}
+
+	for _, m := range formatMagic {
+		if len(header) >= m.offset+len(m.magic) && bytes.Equal(header[m.offset:m.offset+len(m.magic)], m.magic) {
+			return m.format, nil
+		}
+	}
+
+	start := bytes.ToLower(bytes.TrimLeft(header[:min(n, 512)], " \t\r\n"))
+	for _, prefix := range textPrefixes {
+		if bytes.HasPrefix(start, prefix) {
+			return "", fmt.Errorf("image %s looks like a text document, not a disk image", path)
+		}
+	}
+
+	return FormatRaw, nil
+}
+
+// VerifyImageFormat checks that the file at path has the expected format.
+func VerifyImageFormat(path, expected string) error {
+	format, err := DetectImageFormat(path)
+	if err != nil {
+		return err
+	}
+	if format != expected {
+		return fmt.Errorf("image %s has format %s, expected %s", path, format, expected)
+	}
+	return nil
+}
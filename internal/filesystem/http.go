@@ -0,0 +1,122 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DownloadIdleTimeout is how long a download may go without receiving any
+// body bytes before it is aborted as stalled.
+var DownloadIdleTimeout = 60 * time.Second
+
+// errDownloadStalled is wrapped by errors of downloads that hit DownloadIdleTimeout.
+var errDownloadStalled = errors.New("download stalled")
+
+var (
+	httpClientMu sync.RWMutex
+	httpClient   = newHTTPClient()
+)
+
+// newHTTPClient returns the default client used for downloads. It has no
+// overall timeout since images can be very large; stalls are caught by the
+// dial, TLS and response header timeouts and by DownloadIdleTimeout.
+func newHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConns:          10,
+			MaxIdleConnsPerHost:   2,
+			ForceAttemptHTTP2:     true,
+		},
+	}
+}
+
+// SetHTTPClient replaces the client used for all downloads, e.g. to configure
+// a proxy or inject a stub in tests. Passing nil restores the default client.
+func SetHTTPClient(client *http.Client) {
+	if client == nil {
+		client = newHTTPClient()
+	}
+	httpClientMu.Lock()
+	httpClient = client
+	httpClientMu.Unlock()
+}
+
+// getHTTPClient returns the client used for downloads.
+func getHTTPClient() *http.Client {
+	httpClientMu.RLock()
+	defer httpClientMu.RUnlock()
+	return httpClient
+}
+
+// doRequest sends req with the download client. The returned body is aborted
+// if no bytes arrive for DownloadIdleTimeout.
+func doRequest(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := getHTTPClient().Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = newIdleTimeoutReader(resp.Body, DownloadIdleTimeout, cancel)
+	return resp, nil
+}
+
+// idleTimeoutReader cancels the request when a Read does not complete within
+// the timeout, which unblocks the pending Read with an error.
+type idleTimeoutReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+
+	mu      sync.Mutex
+	stalled bool
+}
+
+func newIdleTimeoutReader(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *idleTimeoutReader {
+	r := &idleTimeoutReader{body: body, timeout: timeout, cancel: cancel}
+	r.timer = time.AfterFunc(timeout, func() {
+		r.mu.Lock()
+		r.stalled = true
+		r.mu.Unlock()
+		cancel()
+	})
+	return r
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	if err != nil && err != io.EOF {
+		r.mu.Lock()
+		stalled := r.stalled
+		r.mu.Unlock()
+		if stalled {
+			return n, fmt.Errorf("%w: no data received for %s", errDownloadStalled, r.timeout)
+		}
+	}
+	return n, err
+}
+
+func (r *idleTimeoutReader) Close() error {
+	r.timer.Stop()
+	r.cancel()
+	return r.body.Close()
+}
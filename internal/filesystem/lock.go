@@ -0,0 +1,104 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// KeyedMutex hands out one mutex per key so that unrelated keys do not
+// contend with each other. The zero value is ready to use.
+type KeyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// Lock acquires the mutex for key and returns a function that releases it.
+func (k *KeyedMutex) Lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.mu.Lock()
+
+	return func() {
+		l.mu.Unlock()
+
+		k.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// TryLock acquires the mutex for key if it is free and returns a function
+// that releases it. It reports false without blocking when key is held.
+func (k *KeyedMutex) TryLock(key string) (func(), bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	if !l.mu.TryLock() {
+		return nil, false
+	}
+	l.refs++
+
+	return func() {
+		l.mu.Unlock()
+
+		k.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}, true
+}
+
+// ErrLockTimeout is returned by WithFileLockTimeout when another holder
+// kept the lock for longer than the timeout.
+var ErrLockTimeout = errors.New("timed out waiting for file lock")
+
+// WithFileLock runs fn while holding an exclusive advisory lock for path,
+// so sections editing a file shared between processes, such as a hook
+// config, are serialized. The lock is taken with flock on a "<path>.lock"
+// file next to path rather than on path itself, which SaveFile replaces by
+// renaming. Every writer of the file must use the same lock; on platforms
+// without flock it does not lock at all.
+func WithFileLock(path string, fn func() error) error {
+	return WithFileLockTimeout(path, 0, fn)
+}
+
+// WithFileLockTimeout is WithFileLock failing with an error wrapping
+// ErrLockTimeout when the lock is not free within timeout. It waits for as
+// long as it takes when timeout is not positive.
+func WithFileLockTimeout(path string, timeout time.Duration, fn func() error) error {
+	unlock, err := lockFileTimeout(path+".lock", timeout)
+	if err != nil {
+		return fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	defer unlock()
+	return fn()
+}
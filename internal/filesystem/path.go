@@ -0,0 +1,104 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrPathEscape is returned when a file name would resolve to a path outside
+// of the directory it was given with.
+var ErrPathEscape = errors.New("path escapes its directory")
+
+// safeJoin joins rel to root and checks that the result stays below root,
+// both lexically and after resolving symlinks in the directories of the path
+// that exist. A symlink as the last element is not followed, SaveFile
+// replaces it and DeleteFile removes it. rel must be relative and must not
+// name root itself.
+func safeJoin(root, rel string) (string, error) {
+	if filepath.IsAbs(rel) {
+		return "", fmt.Errorf("%w: %q is absolute", ErrPathEscape, rel)
+	}
+	root = filepath.Clean(root)
+	p := filepath.Join(root, rel)
+	if p == root || !isWithin(root, p) {
+		return "", fmt.Errorf("%w: %q is not below %s", ErrPathEscape, rel, root)
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if os.IsNotExist(err) {
+		// Nothing below a missing root can be a symlink yet
+		return p, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	realDir, err := evalExisting(filepath.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	if !isWithin(realRoot, realDir) {
+		return "", fmt.Errorf("%w: %q resolves to %s outside of %s", ErrPathEscape, rel, realDir, root)
+	}
+	return p, nil
+}
+
+// CheckWithin returns an error wrapping ErrPathEscape unless the absolute
+// path p lies below root. Unlike the dir/filename helpers it also follows a
+// symlink as the last element, since p is a file to be read.
+func CheckWithin(root, p string) error {
+	if !filepath.IsAbs(p) {
+		return fmt.Errorf("%w: %q is not absolute", ErrPathEscape, p)
+	}
+	rel, err := filepath.Rel(filepath.Clean(root), filepath.Clean(p))
+	if err != nil {
+		return fmt.Errorf("%w: %q is not below %s", ErrPathEscape, p, root)
+	}
+	if _, err := safeJoin(root, rel); err != nil {
+		return err
+	}
+	real, err := filepath.EvalSymlinks(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	if !isWithin(realRoot, real) {
+		return fmt.Errorf("%w: %q resolves to %s outside of %s", ErrPathEscape, p, real, root)
+	}
+	return nil
+}
+
+// evalExisting resolves the symlinks in the longest existing prefix of p and
+// appends the rest of p unchanged.
+func evalExisting(p string) (string, error) {
+	rest := ""
+	for {
+		real, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return filepath.Join(p, rest), nil
+		}
+		rest = filepath.Join(filepath.Base(p), rest)
+		p = parent
+	}
+}
+
+// isWithin reports whether the cleaned path p is root or lies below it.
+func isWithin(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
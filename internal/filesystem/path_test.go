@@ -0,0 +1,59 @@
+package filesystem
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSafeJoin(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatalf("error creating directory. Err: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "out")); err != nil {
+		t.Fatalf("error creating symlink. Err: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "sub"), filepath.Join(root, "in")); err != nil {
+		t.Fatalf("error creating symlink. Err: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		rel     string
+		want    string
+		wantErr bool
+	}{
+		{name: "file", rel: "server.xml", want: filepath.Join(root, "server.xml")},
+		{name: "subdirectory", rel: "sub/server.xml", want: filepath.Join(root, "sub", "server.xml")},
+		{name: "dot dot within root", rel: "sub/../server.xml", want: filepath.Join(root, "server.xml")},
+		{name: "missing directories", rel: "a/b/server.xml", want: filepath.Join(root, "a", "b", "server.xml")},
+		{name: "symlink within root", rel: "in/server.xml", want: filepath.Join(root, "in", "server.xml")},
+		{name: "parent", rel: "../escape", wantErr: true},
+		{name: "nested parent", rel: "sub/../../escape", wantErr: true},
+		{name: "absolute", rel: "/etc/passwd", wantErr: true},
+		{name: "empty", rel: "", wantErr: true},
+		{name: "root itself", rel: ".", wantErr: true},
+		{name: "symlink out of root", rel: "out/escape", wantErr: true},
+		{name: "missing directories below symlink out of root", rel: "out/a/b/escape", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := safeJoin(root, tt.rel)
+			if tt.wantErr {
+				if !errors.Is(err, ErrPathEscape) {
+					t.Errorf("expected ErrPathEscape; got %q, %v", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error joining %q. Err: %v", tt.rel, err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %s; got %s", tt.want, got)
+			}
+		})
+	}
+}
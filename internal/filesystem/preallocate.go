@@ -0,0 +1,86 @@
+package filesystem
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Preallocation modes of disk images, named after the preallocation option
+// of qemu-img create.
+const (
+	// PreallocOff creates a sparse image, blocks are allocated on write.
+	PreallocOff = "off"
+	// PreallocMetadata allocates the qcow2 tables but no data clusters.
+	PreallocMetadata = "metadata"
+	// PreallocFalloc reserves the blocks with fallocate without writing
+	// them, so the guest never hits ENOSPC on the host.
+	PreallocFalloc = "falloc"
+	// PreallocFull writes zeros to every block, which also works on
+	// filesystems without fallocate but takes as long as the write.
+	PreallocFull = "full"
+)
+
+// ValidatePreallocation checks that mode, PreallocOff when empty, can be used
+// for an image in format.
+func ValidatePreallocation(mode, format string) error {
+	switch mode {
+	case "", PreallocOff, PreallocFalloc, PreallocFull:
+		return nil
+	case PreallocMetadata:
+		if format != FormatQcow2 {
+			return fmt.Errorf("preallocation %s requires qcow2, not %s", mode, format)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid preallocation %q", mode)
+}
+
+// NeedsSpace reports whether mode allocates the whole virtual size of an
+// image up front.
+func NeedsSpace(mode string) bool {
+	return mode == PreallocFalloc || mode == PreallocFull
+}
+
+// CheckFreeSpace returns ErrInsufficientSpace when the filesystem holding dir
+// has less than size bytes available. Platforms that do not report free
+// space pass.
+func CheckFreeSpace(dir string, size uint64) error {
+	free, err := FreeSpace(dir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get free space of %s: %w", dir, err)
+	}
+	if free < size {
+		return fmt.Errorf("%w in %s: %d bytes needed, %d available", ErrInsufficientSpace, dir, size, free)
+	}
+	return nil
+}
+
+// PreallocateFile allocates the first size bytes of the existing raw image
+// at path, growing the file to size when it is shorter. PreallocOff leaves
+// the file sparse.
+func PreallocateFile(path string, size int64, mode string) error {
+	if err := ValidatePreallocation(mode, FormatRaw); err != nil {
+		return err
+	}
+	if !NeedsSpace(mode) {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if mode == PreallocFull {
+		err = zeroRange(f, 0, size)
+	} else {
+		err = fallocate(f, size)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to preallocate %s: %w", path, err)
+	}
+	return f.Sync()
+}
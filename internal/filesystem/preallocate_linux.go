@@ -0,0 +1,21 @@
+package filesystem
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate reserves the first size bytes of f.
+func fallocate(f *os.File, size int64) error {
+	return syscall.Fallocate(int(f.Fd()), 0, 0, size)
+}
+
+// FreeSpace returns the bytes available to unprivileged users on the
+// filesystem holding path.
+func FreeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
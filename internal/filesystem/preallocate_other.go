@@ -0,0 +1,18 @@
+//go:build !linux
+
+package filesystem
+
+import (
+	"errors"
+	"os"
+)
+
+// fallocate writes zeros on platforms without fallocate(2).
+func fallocate(f *os.File, size int64) error {
+	return zeroRange(f, 0, size)
+}
+
+// FreeSpace is only supported on Linux.
+func FreeSpace(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
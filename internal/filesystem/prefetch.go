@@ -0,0 +1,90 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrCacheDisabled is returned by Prefetch and PrefetchAll when the cache
+// has no directory to prefetch into.
+var ErrCacheDisabled = errors.New("caching is disabled, no cache directory is configured")
+
+// DefaultPrefetchConcurrency is how many downloads PrefetchAll runs at once
+// when no concurrency is given.
+const DefaultPrefetchConcurrency = 4
+
+// PrefetchResult is the outcome of prefetching one URL.
+type PrefetchResult struct {
+	URL      string `json:"url"`
+	CacheHit bool   `json:"cache_hit"`
+	Err      error  `json:"-"`
+}
+
+// Prefetch downloads url into the cache without copying it anywhere and
+// reports whether it was already cached.
+func (c *Cache) Prefetch(ctx context.Context, url string) (bool, error) {
+	if c.config.Dir == "" {
+		return false, ErrCacheDisabled
+	}
+	opts := DownloadOptions{Logger: c.config.Logger}
+	return c.fetch(ctx, url, 0644, opts, func(string) error { return nil })
+}
+
+// PrefetchAll warms the cache with urls, running up to concurrency downloads
+// at once. Duplicate URLs are fetched once and the result has one entry per
+// distinct URL in the order they first appear. Workers share the per-file
+// locks of Get, so a URL another caller is already downloading is waited for
+// and then reported as a cache hit.
+//
+// When ctx is cancelled no further downloads are started and the URLs not
+// yet fetched report the context's error. The returned error joins the
+// errors of every URL that failed; the results are complete either way.
+func (c *Cache) PrefetchAll(ctx context.Context, urls []string, concurrency int) ([]PrefetchResult, error) {
+	if c.config.Dir == "" {
+		return nil, ErrCacheDisabled
+	}
+	if concurrency <= 0 {
+		concurrency = DefaultPrefetchConcurrency
+	}
+
+	seen := make(map[string]bool, len(urls))
+	var results []PrefetchResult
+	for _, url := range urls {
+		if !seen[url] {
+			seen[url] = true
+			results = append(results, PrefetchResult{URL: url})
+		}
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(concurrency, len(results)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				r := &results[i]
+				if err := ctx.Err(); err != nil {
+					r.Err = err
+					continue
+				}
+				r.CacheHit, r.Err = c.Prefetch(ctx, r.URL)
+			}
+		}()
+	}
+	for i := range results {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var errs []error
+	for _, r := range results {
+		if r.Err != nil {
+			errs = append(errs, fmt.Errorf("failed to prefetch %s: %w", r.URL, r.Err))
+		}
+	}
+	return results, errors.Join(errs...)
+}
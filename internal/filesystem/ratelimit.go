@@ -0,0 +1,81 @@
+package filesystem
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+
+	"golang.org/x/time/rate"
+)
+
+// globalLimiter caps the combined bandwidth of all downloads, nil when unlimited.
+var globalLimiter atomic.Pointer[rate.Limiter]
+
+// SetGlobalBandwidthLimit caps the combined rate of all downloads of the
+// process, including those already in progress, to bytesPerSec. A value
+// of 0 or less removes the cap. It applies on top of
+// DownloadOptions.BandwidthLimit.
+func SetGlobalBandwidthLimit(bytesPerSec int64) {
+	if bytesPerSec <= 0 {
+		globalLimiter.Store(nil)
+		return
+	}
+	if l := globalLimiter.Load(); l != nil {
+		l.SetLimit(rate.Limit(bytesPerSec))
+		l.SetBurst(limiterBurst(bytesPerSec))
+		return
+	}
+	globalLimiter.Store(newLimiter(bytesPerSec))
+}
+
+// newLimiter returns a token bucket allowing bytesPerSec with a burst of up
+// to one second of traffic.
+func newLimiter(bytesPerSec int64) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(bytesPerSec), limiterBurst(bytesPerSec))
+}
+
+// limiterBurst bounds the burst so a single read never exceeds it while
+// keeping reads large enough for io.Copy to stay efficient at high rates.
+func limiterBurst(bytesPerSec int64) int {
+	return int(min(bytesPerSec, 1<<20))
+}
+
+// limitedReader throttles reads from r to the given limiters. The global
+// limiter is looked up on every read so changes apply to running downloads.
+type limitedReader struct {
+	ctx   context.Context
+	r     io.Reader
+	limit *rate.Limiter // Per-download limit, may be nil
+}
+
+// newLimitedReader wraps r, bytesPerSec of 0 or less only applies the
+// global limit.
+func newLimitedReader(ctx context.Context, r io.Reader, bytesPerSec int64) io.Reader {
+	lr := &limitedReader{ctx: ctx, r: r}
+	if bytesPerSec > 0 {
+		lr.limit = newLimiter(bytesPerSec)
+	}
+	return lr
+}
+
+func (l *limitedReader) Read(b []byte) (int, error) {
+	limiters := []*rate.Limiter{l.limit, globalLimiter.Load()}
+	for _, lim := range limiters {
+		if lim != nil && len(b) > lim.Burst() {
+			b = b[:lim.Burst()]
+		}
+	}
+	n, err := l.r.Read(b)
+	if n > 0 {
+		for _, lim := range limiters {
+			if lim == nil {
+				continue
+			}
+			// The burst may have shrunk since b was sized
+			if werr := lim.WaitN(l.ctx, min(n, lim.Burst())); werr != nil {
+				return n, werr
+			}
+		}
+	}
+	return n, err
+}
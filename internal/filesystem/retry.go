@@ -0,0 +1,210 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"libvirt-controller/internal/logging"
+)
+
+// RetryPolicy controls how failed downloads are retried.
+type RetryPolicy struct {
+	MaxAttempts int           // Total attempts including the first, 1 disables retries
+	BaseDelay   time.Duration // Delay before the first retry, doubled for each further retry
+	MaxDelay    time.Duration // Upper bound on the delay between attempts
+}
+
+// DefaultRetryPolicy is used when DownloadOptions.Retry is left empty.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   time.Second,
+	MaxDelay:    30 * time.Second,
+}
+
+// withDefaults fills in an empty policy from DefaultRetryPolicy.
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts == 0 {
+		return DefaultRetryPolicy
+	}
+	return p
+}
+
+// backoff returns the delay before the given retry (1-based), using
+// exponential backoff with jitter.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < retry && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	// Pick a delay between half and the full backoff
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// httpStatusError is returned when a server answers with an unexpected status.
+type httpStatusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration // From the Retry-After header, 0 when absent
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("failed to download file: %s", e.Status)
+}
+
+// newHTTPStatusError builds an httpStatusError from a response.
+func newHTTPStatusError(resp *http.Response) *httpStatusError {
+	return &httpStatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// isRetryable reports whether a download error is likely transient.
+func isRetryable(err error) bool {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests,
+			http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	if errors.Is(err, errDownloadStalled) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	// Other network errors (bad URLs, DNS failures, TLS errors) won't go away
+	// on their own; only timeouts are worth another attempt.
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retrier counts the attempts of one download and sleeps between them.
+type retrier struct {
+	policy   RetryPolicy
+	attempts int
+	log      logging.Logger
+}
+
+func newRetrier(policy RetryPolicy, log logging.Logger) *retrier {
+	return &retrier{policy: policy.withDefaults(), attempts: 1, log: log}
+}
+
+// retry reports whether another attempt should be made after err, sleeping
+// for the backoff delay (or the server's Retry-After) first.
+func (r *retrier) retry(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || !isRetryable(err) || r.attempts >= r.policy.MaxAttempts {
+		return false
+	}
+
+	delay := r.policy.backoff(r.attempts)
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		delay = statusErr.RetryAfter
+	}
+	r.attempts++
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// resumingReader reads an HTTP body and, when a read fails with a transient
+// error, reconnects with a Range request to continue from the current offset.
+type resumingReader struct {
+	ctx       context.Context
+	url       string
+	body      io.ReadCloser
+	offset    int64
+	validator string // ETag or Last-Modified sent as If-Range
+	retrier   *retrier
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	if !r.retrier.retry(r.ctx, err) {
+		return n, err
+	}
+
+	r.retrier.log.Warn("resuming download", "url", r.url, "offset", r.offset, "err", err)
+	resp, rerr := fetchRange(r.ctx, r.url, r.offset, r.validator)
+	if rerr != nil {
+		// Give up on resuming, the caller may still restart the download
+		return n, err
+	}
+	r.body.Close()
+	r.body = resp.Body
+	return n, nil
+}
+
+func (r *resumingReader) Close() error {
+	return r.body.Close()
+}
+
+// fetchRange requests url from offset onwards. It fails unless the server
+// answers with the remaining bytes of the same file.
+func fetchRange(ctx context.Context, url string, offset int64, validator string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	req.Header.Set("If-Range", validator)
+
+	resp, err := doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, newHTTPStatusError(resp)
+	}
+	return resp, nil
+}
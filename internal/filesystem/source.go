@@ -0,0 +1,108 @@
+package filesystem
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// localSourcePath reports whether rawURL refers to a local file, either as a
+// file:// URL or a plain absolute path, and returns that path. Schemes other
+// than http, https and file are rejected.
+func localSourcePath(rawURL string) (string, bool, error) {
+	if filepath.IsAbs(rawURL) {
+		return rawURL, true, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid source URL %s: %w", rawURL, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return "", false, nil
+	case "file":
+		if u.Host != "" && u.Host != "localhost" {
+			return "", false, fmt.Errorf("unsupported file URL host %q in %s", u.Host, rawURL)
+		}
+		return u.Path, true, nil
+	default:
+		return "", false, fmt.Errorf("unsupported source URL scheme %q in %s", u.Scheme, rawURL)
+	}
+}
+
+// source is an opened download source.
+type source struct {
+	body     io.ReadCloser
+	size     int64  // Size of the body, -1 when unknown
+	encoding string // Content-Encoding of the body, if any
+}
+
+// openSource opens rawURL for reading. HTTP(S) URLs are fetched with the
+// download client, local files are read directly when they are decompressed
+// or throttled on the way and are otherwise copied by copyLocal. When the server supports
+// range requests, transient failures mid-body are resumed using rt.
+func openSource(ctx context.Context, rawURL string, rt *retrier) (*source, error) {
+	path, local, err := localSourcePath(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if local {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &source{body: &contextReader{ctx: ctx, ReadCloser: f}, size: info.Size()}, nil
+	}
+
+	// Get the data
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check server response
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, newHTTPStatusError(resp)
+	}
+
+	body := resp.Body
+	validator := resp.Header.Get("ETag")
+	if validator == "" {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	if rt != nil && resp.Header.Get("Accept-Ranges") == "bytes" && validator != "" {
+		body = &resumingReader{ctx: ctx, url: rawURL, body: body, validator: validator, retrier: rt}
+	}
+
+	return &source{body: body, size: resp.ContentLength, encoding: resp.Header.Get("Content-Encoding")}, nil
+}
+
+// contextReader stops reading once its context is cancelled.
+type contextReader struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(p)
+}
@@ -0,0 +1,32 @@
+package filesystem
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// lastAccessTime returns the access time of a file, falling back to the
+// modification time when it is unavailable.
+func lastAccessTime(info os.FileInfo) time.Time {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.ModTime()
+	}
+	atime := time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
+	// With noatime mounts the access time may lag behind the last write
+	if atime.Before(info.ModTime()) {
+		return info.ModTime()
+	}
+	return atime
+}
+
+// allocatedSize returns the number of bytes actually allocated on disk for a
+// file, which for sparse files can be far less than its apparent size.
+func allocatedSize(info os.FileInfo) int64 {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.Size()
+	}
+	return stat.Blocks * 512
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package filesystem
+
+import (
+	"os"
+	"time"
+)
+
+// lastAccessTime returns the modification time of a file on platforms where
+// the access time is not exposed.
+func lastAccessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+// allocatedSize returns the apparent size of a file on platforms where the
+// allocated block count is not exposed.
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
@@ -0,0 +1,81 @@
+package filesystem
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Wipe methods for WipeVolume.
+const (
+	// WipeZero overwrites the data of the file or device with zeros.
+	WipeZero = "zero"
+	// WipeDiscard discards the blocks, punching holes into a file or
+	// issuing BLKDISCARD to a block device, so an SSD can TRIM them.
+	WipeDiscard = "discard"
+	// WipeZeroDiscard zero-fills and then discards.
+	WipeZeroDiscard = "zero+discard"
+)
+
+// wipeChunkSize is how many zeros WipeVolume writes at a time.
+const wipeChunkSize = 1 << 20
+
+// WipeVolume destroys the data in the file or block device at path before
+// it is handed to another tenant. The file itself is kept, remove it
+// afterwards.
+//
+// For a qcow2 image on ext4 or xfs only WipeZeroDiscard is meaningful:
+// zero-filling overwrites the blocks the image occupies in place, while the
+// discard alone frees the blocks without clearing them and leaves the data
+// readable on the disk until the device reuses them. Discarding is only
+// supported on Linux. On copy-on-write filesystems such as btrfs or ZFS
+// overwriting writes new blocks, so no method reaches the old ones.
+func WipeVolume(path string, method string) error {
+	zero := method == WipeZero || method == WipeZeroDiscard
+	discard := method == WipeDiscard || method == WipeZeroDiscard
+	if !zero && !discard {
+		return fmt.Errorf("invalid wipe method %q", method)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s for wiping: %w", path, err)
+	}
+	defer f.Close()
+
+	// Seeking to the end also sizes block devices, which Stat reports as 0
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to size %s: %w", path, err)
+	}
+
+	if zero {
+		if err := zeroFill(f, size); err != nil {
+			return fmt.Errorf("failed to zero-fill %s: %w", path, err)
+		}
+		if err := f.Sync(); err != nil {
+			return fmt.Errorf("failed to sync %s: %w", path, err)
+		}
+	}
+	if discard {
+		if err := discardRange(f, size); err != nil {
+			return fmt.Errorf("failed to discard %s: %w", path, err)
+		}
+	}
+	return f.Close()
+}
+
+// zeroRange writes length zeros at offset in chunks of wipeChunkSize.
+func zeroRange(f *os.File, offset, length int64) error {
+	zeros := make([]byte, min(wipeChunkSize, length))
+	for length > 0 {
+		n := min(int64(len(zeros)), length)
+		written, err := f.WriteAt(zeros[:n], offset)
+		if err != nil {
+			return err
+		}
+		offset += int64(written)
+		length -= int64(written)
+	}
+	return nil
+}
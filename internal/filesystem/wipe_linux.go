@@ -0,0 +1,72 @@
+package filesystem
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Linux constants for discarding blocks (see fallocate(2) and
+// <linux/fs.h>).
+const (
+	fallocKeepSize  = 0x01 // FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 0x02 // FALLOC_FL_PUNCH_HOLE
+	blkDiscard      = 0x1277
+)
+
+// zeroFill overwrites the first size bytes of f with zeros. In regular files
+// only the data regions are written so holes in sparse images stay holes.
+func zeroFill(f *os.File, size int64) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return zeroRange(f, 0, size)
+	}
+
+	// Probe for hole support
+	if _, err := f.Seek(0, seekData); err != nil && !errors.Is(err, syscall.ENXIO) {
+		return zeroRange(f, 0, size)
+	}
+	for offset := int64(0); offset < size; {
+		dataStart, err := f.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			break // The rest of the file is a hole
+		}
+		if err != nil {
+			return err
+		}
+		dataEnd, err := f.Seek(dataStart, seekHole)
+		if err != nil {
+			return err
+		}
+		if err := zeroRange(f, dataStart, dataEnd-dataStart); err != nil {
+			return err
+		}
+		offset = dataEnd
+	}
+	return nil
+}
+
+// discardRange discards the first size bytes of f: block devices get a
+// BLKDISCARD and regular files have their blocks punched out, which the
+// filesystem passes on as a TRIM when it is mounted with discard.
+func discardRange(f *os.File, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeDevice != 0 {
+		r := [2]uint64{0, uint64(size)}
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), blkDiscard, uintptr(unsafe.Pointer(&r[0]))); errno != 0 {
+			return errno
+		}
+		return nil
+	}
+	return syscall.Fallocate(int(f.Fd()), fallocPunchHole|fallocKeepSize, 0, size)
+}
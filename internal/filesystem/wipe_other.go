@@ -0,0 +1,18 @@
+//go:build !linux
+
+package filesystem
+
+import (
+	"errors"
+	"os"
+)
+
+// zeroFill overwrites the first size bytes of f with zeros.
+func zeroFill(f *os.File, size int64) error {
+	return zeroRange(f, 0, size)
+}
+
+// discardRange is only supported on Linux.
+func discardRange(f *os.File, size int64) error {
+	return errors.New("discarding is not supported on this platform")
+}
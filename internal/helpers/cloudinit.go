@@ -0,0 +1,262 @@
+package helpers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+
+	"libvirt-controller/internal/cmdutil"
+	"libvirt-controller/internal/filesystem"
+)
+
+// SeedISOName is the file name of the NoCloud seed ISO written by BuildSeedISO.
+const SeedISOName = "seed.iso"
+
+// BuildSeedISO writes user-data, meta-data and, if given, network-config into
+// dir and packs them into a NoCloud seed ISO labelled "cidata", which can be
+// attached to the domain as a cdrom. It returns the path of the ISO.
+func BuildSeedISO(dir string, userData, metaData, networkConfig []byte) (string, error) {
+	if err := ValidateUserData(userData); err != nil {
+		return "", err
+	}
+	if len(networkConfig) > 0 {
+		var v map[string]interface{}
+		if err := yaml.Unmarshal(networkConfig, &v); err != nil {
+			return "", fmt.Errorf("network-config is not valid YAML: %w", err)
+		}
+	}
+
+	files := map[string][]byte{
+		"user-data": userData,
+		// cloud-init requires meta-data to exist, even when it is empty
+		"meta-data": metaData,
+	}
+	if len(networkConfig) > 0 {
+		files["network-config"] = networkConfig
+	} else if _, err := filesystem.DeleteFileIfExists(dir, "network-config"); err != nil {
+		return "", err
+	}
+
+	var paths []string
+	for _, name := range []string{"user-data", "meta-data", "network-config"} {
+		data, ok := files[name]
+		if !ok {
+			continue
+		}
+		// user-data commonly carries passwords and keys
+		if err := filesystem.SaveFileMode(dir, name, data, 0600); err != nil {
+			return "", fmt.Errorf("failed to write %s: %w", name, err)
+		}
+		paths = append(paths, filepath.Join(dir, name))
+	}
+
+	isoPath := filepath.Join(dir, SeedISOName)
+	_, err := cmdutil.Execute("genisoimage",
+		append([]string{
+			"-output", isoPath,
+			"-volid", "cidata",
+			"-joliet",
+			"-rock",
+		}, paths...)...,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to create seed ISO: %w", err)
+	}
+	return isoPath, nil
+}
+
+// ValidateUserData checks that user-data is either a shell script or a
+// "#cloud-config" document holding a YAML mapping.
+func ValidateUserData(userData []byte) error {
+	switch {
+	case len(bytes.TrimSpace(userData)) == 0:
+		return errors.New("user-data is empty")
+	case bytes.HasPrefix(userData, []byte("#!")):
+		return nil
+	case !bytes.HasPrefix(userData, []byte("#cloud-config")):
+		return errors.New("user-data must start with #cloud-config or #!")
+	}
+
+	var v map[string]interface{}
+	if err := yaml.Unmarshal(userData, &v); err != nil {
+		return fmt.Errorf("user-data is not valid YAML: %w", err)
+	}
+	return nil
+}
+
+// CloudInitUser is a user created by cloud-init.
+type CloudInitUser struct {
+	Name    string   `yaml:"name"`
+	Groups  []string `yaml:"groups,omitempty"`
+	Sudo    string   `yaml:"sudo,omitempty"`
+	Shell   string   `yaml:"shell,omitempty"`
+	SSHKeys []string `yaml:"ssh_authorized_keys,omitempty"`
+}
+
+// CloudInitConfig is the subset of #cloud-config used to provision VMs.
+// SSHKeys are authorized for the image's default user.
+type CloudInitConfig struct {
+	Hostname string          `yaml:"hostname,omitempty"`
+	Users    []CloudInitUser `yaml:"users,omitempty"`
+	SSHKeys  []string        `yaml:"ssh_authorized_keys,omitempty"`
+	Packages []string        `yaml:"packages,omitempty"`
+	RunCmds  []string        `yaml:"runcmd,omitempty"`
+}
+
+var (
+	hostnameRegex = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+	userNameRegex = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+	sshKeyRegex   = regexp.MustCompile(`^(ssh-(rsa|dss|ed25519)|ecdsa-sha2-nistp(256|384|521)|sk-(ssh-ed25519|ecdsa-sha2-nistp256)@openssh\.com) [A-Za-z0-9+/]+={0,3}( .*)?$`)
+)
+
+// Validate checks the fields that cloud-init silently ignores when malformed.
+func (c CloudInitConfig) Validate() error {
+	var errs []error
+	if c.Hostname != "" && !hostnameRegex.MatchString(c.Hostname) {
+		errs = append(errs, fmt.Errorf("invalid hostname %q", c.Hostname))
+	}
+	for _, u := range c.Users {
+		if !userNameRegex.MatchString(u.Name) {
+			errs = append(errs, fmt.Errorf("invalid user name %q", u.Name))
+		}
+		for _, key := range u.SSHKeys {
+			if err := validateSSHKey(key); err != nil {
+				errs = append(errs, fmt.Errorf("user %s: %w", u.Name, err))
+			}
+		}
+	}
+	for _, key := range c.SSHKeys {
+		if err := validateSSHKey(key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, pkg := range c.Packages {
+		if pkg == "" || strings.ContainsAny(pkg, " \t\n") {
+			errs = append(errs, fmt.Errorf("invalid package name %q", pkg))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid cloud-init config: %w", err)
+	}
+	return nil
+}
+
+// Marshal renders the config as a #cloud-config document.
+func (c CloudInitConfig) Marshal() ([]byte, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	out, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal cloud-init config: %w", err)
+	}
+	return append([]byte("#cloud-config\n"), out...), nil
+}
+
+// validateSSHKey checks that key is a single line OpenSSH public key.
+func validateSSHKey(key string) error {
+	if !sshKeyRegex.MatchString(strings.TrimSpace(key)) {
+		return fmt.Errorf("invalid SSH public key %q", truncate(key, 40))
+	}
+	return nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// userDataFuncs are the helpers available to RenderUserData templates:
+//
+//	{{ indent 4 .Script }}     indents every line but the first by 4 spaces
+//	{{ quote .Password }}      renders a string as a YAML scalar
+//	{{ sshKeys 6 .Keys }}      renders keys as a YAML list indented by 6 spaces
+var userDataFuncs = template.FuncMap{
+	"indent": func(n int, s string) string {
+		pad := strings.Repeat(" ", n)
+		return strings.ReplaceAll(strings.TrimRight(s, "\n"), "\n", "\n"+pad)
+	},
+	"quote": func(s string) (string, error) {
+		out, err := yaml.Marshal(s)
+		return strings.TrimSuffix(string(out), "\n"), err
+	},
+	"sshKeys": func(n int, keys []string) (string, error) {
+		pad := strings.Repeat(" ", n)
+		var b strings.Builder
+		for i, key := range keys {
+			key = strings.TrimSpace(key)
+			if err := validateSSHKey(key); err != nil {
+				return "", err
+			}
+			if i > 0 {
+				b.WriteString("\n" + pad)
+			}
+			b.WriteString("- " + key)
+		}
+		return b.String(), nil
+	},
+}
+
+// userDataListFields are top level #cloud-config fields that must be lists.
+// A wrong indentation turns them into strings or nulls, which cloud-init
+// ignores without an error.
+var userDataListFields = []string{"users", "ssh_authorized_keys", "packages", "runcmd", "write_files", "bootcmd"}
+
+// RenderUserData executes a text/template with vars and checks the result is
+// a well-formed #cloud-config document.
+func RenderUserData(tmpl string, vars map[string]any) ([]byte, error) {
+	t, err := template.New("user-data").Option("missingkey=error").Funcs(userDataFuncs).Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse user-data template: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, vars); err != nil {
+		return nil, fmt.Errorf("failed to render user-data template: %w", err)
+	}
+
+	out := buf.Bytes()
+	if err := ValidateUserData(out); err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(out, []byte("#!")) {
+		return out, nil
+	}
+
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(out, &doc); err != nil {
+		return nil, fmt.Errorf("user-data is not valid YAML: %w", err)
+	}
+	for _, field := range userDataListFields {
+		if v, ok := doc[field]; ok {
+			if _, isList := v.([]interface{}); !isList {
+				return nil, fmt.Errorf("user-data field %s must be a list, check its indentation", field)
+			}
+		}
+	}
+	if users, ok := doc["users"].([]interface{}); ok {
+		for _, u := range users {
+			user, ok := u.(map[string]interface{})
+			if !ok {
+				// "default" is the only plain string cloud-init accepts here
+				if u == "default" {
+					continue
+				}
+				return nil, fmt.Errorf("user-data users entries must be mappings, check their indentation")
+			}
+			if keys, ok := user["ssh_authorized_keys"]; ok {
+				if _, isList := keys.([]interface{}); !isList {
+					return nil, fmt.Errorf("user-data ssh_authorized_keys of user %v must be a list, check its indentation", user["name"])
+				}
+			}
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,97 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"libvirt-controller/internal/cmdutil"
+	"libvirt-controller/internal/filesystem"
+)
+
+// Datasource is the cloud-init datasource a seed ISO is laid out for.
+type Datasource string
+
+const (
+	// DatasourceNoCloud is a "cidata" ISO with user-data and meta-data at
+	// its root, built by BuildSeedISO.
+	DatasourceNoCloud Datasource = "nocloud"
+	// DatasourceConfigDrive is an OpenStack "config-2" ISO, built by
+	// BuildConfigDrive.
+	DatasourceConfigDrive Datasource = "configdrive"
+)
+
+// Validate checks that d is a known datasource. The empty datasource is
+// NoCloud.
+func (d Datasource) Validate() error {
+	switch d {
+	case "", DatasourceNoCloud, DatasourceConfigDrive:
+		return nil
+	}
+	return fmt.Errorf("unknown cloud-init datasource %q", d)
+}
+
+// ISOName returns the file name of the seed ISO for the datasource.
+func (d Datasource) ISOName() string {
+	if d == DatasourceConfigDrive {
+		return ConfigDriveISOName
+	}
+	return SeedISOName
+}
+
+// ConfigDriveISOName is the file name of the ISO written by BuildConfigDrive.
+const ConfigDriveISOName = "config-drive.iso"
+
+// configDrivePath is where cloud-init reads the ConfigDrive files from.
+const configDrivePath = "openstack/latest"
+
+// BuildConfigDrive packs meta_data.json, user_data and, if given,
+// network_data.json into an OpenStack ConfigDrive ISO labelled "config-2" in
+// dir, which can be attached to the domain as a cdrom. metaData must be a
+// JSON object and networkData, when set, JSON as well. The files are staged
+// in a temporary directory, so only the ISO is left in dir. It returns the
+// path of the ISO.
+func BuildConfigDrive(dir string, metaData, userData, networkData []byte) (string, error) {
+	var meta map[string]any
+	if err := json.Unmarshal(metaData, &meta); err != nil {
+		return "", fmt.Errorf("meta_data.json is not a valid JSON object: %w", err)
+	}
+	if err := ValidateUserData(userData); err != nil {
+		return "", err
+	}
+	if len(networkData) > 0 && !json.Valid(networkData) {
+		return "", fmt.Errorf("network_data.json is not valid JSON")
+	}
+
+	staging, err := os.MkdirTemp(dir, ".config-drive-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create config drive staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	files := map[string][]byte{"meta_data.json": metaData, "user_data": userData}
+	if len(networkData) > 0 {
+		files["network_data.json"] = networkData
+	}
+	latest := filepath.Join(staging, configDrivePath)
+	for name, data := range files {
+		// user_data commonly carries passwords and keys
+		if err := filesystem.SaveFileMode(latest, name, data, 0600); err != nil {
+			return "", fmt.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+
+	isoPath := filepath.Join(dir, ConfigDriveISOName)
+	_, err = cmdutil.Execute("genisoimage",
+		"-output", isoPath,
+		"-volid", "config-2",
+		"-joliet",
+		"-rock",
+		staging,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to create config drive ISO: %w", err)
+	}
+	return isoPath, nil
+}
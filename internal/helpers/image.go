@@ -1,24 +1,306 @@
 package helpers
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"libvirt-controller/internal/cmdutil"
+	"libvirt-controller/internal/filesystem"
 )
 
 // ResizeDisk resizes the disk image to the desired size in GB.
 func ResizeDisk(imagePath string, sizeGB int) error {
-	// Convert size in GB to the required format for qemu-img (e.g., "10G" for 10 GB)
-	size := fmt.Sprintf("%dG", sizeGB)
+	if err := DefaultQemuImg.Resize(imagePath, uint64(sizeGB)<<30); err != nil {
+		return fmt.Errorf("failed to resize disk image: %w", err)
+	}
+	return nil
+}
 
-	// Use cmdutil.Execute to run the qemu-img command
-	_, err := cmdutil.Execute("qemu-img", "resize", imagePath, size)
+// ResizeImage resizes the disk image to the given size in bytes.
+func ResizeImage(imagePath string, sizeBytes uint64) error {
+	if err := DefaultQemuImg.Resize(imagePath, sizeBytes); err != nil {
+		return fmt.Errorf("failed to resize disk image %s: %w", imagePath, err)
+	}
+	return nil
+}
+
+// ImageInfo is the subset of `qemu-img info` output used by the helpers.
+type ImageInfo struct {
+	Filename        string `json:"filename"`
+	Format          string `json:"format"`
+	VirtualSize     uint64 `json:"virtual-size"`
+	ActualSize      uint64 `json:"actual-size"` // Space allocated on the host
+	BackingFilename string `json:"backing-filename,omitempty"`
+}
+
+// GetImageInfo reads the format and virtual size of a disk image. Images in
+// use by a running domain can be inspected as well.
+func GetImageInfo(imagePath string) (ImageInfo, error) {
+	info, err := DefaultQemuImg.Info(imagePath)
 	if err != nil {
-		return fmt.Errorf("failed to resize disk image: %w", err)
+		return ImageInfo{}, fmt.Errorf("failed to get info of image %s: %w", imagePath, err)
+	}
+	return info, nil
+}
+
+// imageInfoCacheSize bounds the number of images CachedImageInfo remembers.
+const imageInfoCacheSize = 1024
+
+// imageInfoKey identifies a version of an image file. Any write to the
+// image, including a resize, changes its mtime.
+type imageInfoKey struct {
+	modTime time.Time
+	size    int64
+}
+
+var imageInfoCache struct {
+	sync.Mutex
+	entries map[string]imageInfoEntry
+}
+
+type imageInfoEntry struct {
+	key  imageInfoKey
+	info ImageInfo
+}
+
+// CachedImageInfo is GetImageInfo remembering the result until the mtime or
+// size of the image changes, so repeated size checks of the same base image
+// do not run qemu-img every time.
+func CachedImageInfo(imagePath string) (ImageInfo, error) {
+	fi, err := os.Stat(imagePath)
+	if err != nil {
+		return ImageInfo{}, fmt.Errorf("failed to get info of image %s: %w", imagePath, err)
+	}
+	key := imageInfoKey{modTime: fi.ModTime(), size: fi.Size()}
+
+	imageInfoCache.Lock()
+	entry, ok := imageInfoCache.entries[imagePath]
+	imageInfoCache.Unlock()
+	if ok && entry.key == key {
+		return entry.info, nil
+	}
+
+	info, err := GetImageInfo(imagePath)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+
+	imageInfoCache.Lock()
+	defer imageInfoCache.Unlock()
+	if imageInfoCache.entries == nil || len(imageInfoCache.entries) >= imageInfoCacheSize {
+		imageInfoCache.entries = map[string]imageInfoEntry{}
+	}
+	imageInfoCache.entries[imagePath] = imageInfoEntry{key: key, info: info}
+	return info, nil
+}
+
+// maxBackingChainDepth bounds the chains BackingChain follows.
+const maxBackingChainDepth = 64
+
+// BackingChain returns the layers of the image at imagePath, starting with
+// the image itself and ending with the image that has no backing file.
+// Relative backing files are resolved against the directory of the image
+// referencing them, the way qemu does. A missing layer is reported as
+// "base image X is missing" and wraps os.ErrNotExist.
+func BackingChain(imagePath string) ([]ImageInfo, error) {
+	var chain []ImageInfo
+	seen := map[string]bool{}
+	current := imagePath
+	for {
+		abs, err := filepath.Abs(current)
+		if err != nil {
+			return nil, err
+		}
+		if seen[abs] {
+			return nil, fmt.Errorf("backing chain of image %s loops back to %s", imagePath, current)
+		}
+		if len(chain) == maxBackingChainDepth {
+			return nil, fmt.Errorf("backing chain of image %s is deeper than %d", imagePath, maxBackingChainDepth)
+		}
+		seen[abs] = true
+
+		if _, err := os.Stat(current); errors.Is(err, os.ErrNotExist) {
+			if len(chain) == 0 {
+				return nil, fmt.Errorf("image %s is missing: %w", current, os.ErrNotExist)
+			}
+			return nil, fmt.Errorf("base image %s of %s is missing: %w", current, chain[len(chain)-1].Filename, os.ErrNotExist)
+		}
+		info, err := CachedImageInfo(current)
+		if err != nil {
+			return nil, err
+		}
+		info.Filename = current
+		chain = append(chain, info)
+		if info.BackingFilename == "" {
+			return chain, nil
+		}
+		next := info.BackingFilename
+		if !filepath.IsAbs(next) {
+			next = filepath.Join(filepath.Dir(current), next)
+		}
+		current = next
+	}
+}
+
+// ValidateBackingChain checks that every layer of the image at imagePath
+// exists and that the chain ends, so a domain using it can boot.
+func ValidateBackingChain(imagePath string) error {
+	_, err := BackingChain(imagePath)
+	return err
+}
+
+// CreateOverlay creates a qcow2 image at overlayPath that uses basePath as its
+// read-only backing file. The overlay gets the virtual size of the base when
+// virtualSizeBytes is zero.
+func CreateOverlay(basePath, overlayPath string, virtualSizeBytes uint64) error {
+	_, err := CreateOverlayWithOptions(basePath, overlayPath, OverlayOptions{SizeBytes: virtualSizeBytes})
+	return err
+}
+
+// OverlayOptions controls CreateOverlayWithOptions.
+type OverlayOptions struct {
+	SizeBytes uint64 // Virtual size, that of the base image when zero
+
+	// Preallocation is one of the filesystem.Prealloc modes. Falloc and
+	// full allocate the whole virtual size up front, avoiding the
+	// copy-on-write amplification of growing the overlay, and fail early
+	// when the filesystem lacks the space.
+	Preallocation string
+}
+
+// CreateOverlayWithOptions is CreateOverlay with preallocation. It returns
+// the info of the new overlay, whose ActualSize is the space it takes on the
+// host. An overlay that cannot be created completely is removed again.
+func CreateOverlayWithOptions(basePath, overlayPath string, opts OverlayOptions) (_ ImageInfo, err error) {
+	// qemu-img resolves a relative backing path against the overlay's directory,
+	// which breaks as soon as the overlay is moved.
+	if !filepath.IsAbs(basePath) {
+		return ImageInfo{}, fmt.Errorf("base image path %q must be absolute", basePath)
+	}
+	if err := filesystem.ValidatePreallocation(opts.Preallocation, filesystem.FormatQcow2); err != nil {
+		return ImageInfo{}, err
+	}
+	f, err := os.Open(basePath)
+	if err != nil {
+		return ImageInfo{}, fmt.Errorf("base image is not readable: %w", err)
+	}
+	f.Close()
+
+	// qemu-img create would silently replace an existing image, so the path
+	// is claimed with an empty file first, which qemu-img then overwrites
+	claim, err := os.OpenFile(overlayPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return ImageInfo{}, fmt.Errorf("overlay %s %w", overlayPath, filesystem.ErrAlreadyExists)
+	}
+	if err != nil {
+		return ImageInfo{}, fmt.Errorf("failed to create overlay %s: %w", overlayPath, err)
+	}
+	claim.Close()
+	defer func() {
+		if err != nil {
+			os.Remove(overlayPath)
+		}
+	}()
+
+	base, err := CachedImageInfo(basePath)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	size := opts.SizeBytes
+	if size != 0 && size < base.VirtualSize {
+		return ImageInfo{}, fmt.Errorf("overlay size %d is smaller than base image size %d", size, base.VirtualSize)
+	}
+	if size == 0 {
+		size = base.VirtualSize
+	}
+	if filesystem.NeedsSpace(opts.Preallocation) {
+		if err := filesystem.CheckFreeSpace(filepath.Dir(overlayPath), size); err != nil {
+			return ImageInfo{}, fmt.Errorf("cannot preallocate overlay %s: %w", overlayPath, err)
+		}
 	}
 
+	create := CreateImageOptions{
+		Format:        filesystem.FormatQcow2,
+		SizeBytes:     opts.SizeBytes,
+		BackingFile:   basePath,
+		BackingFormat: base.Format,
+		Preallocation: opts.Preallocation,
+	}
+	if err := DefaultQemuImg.Create(overlayPath, create); err != nil {
+		// A preallocation running out of space leaves a partial image
+		return ImageInfo{}, fmt.Errorf("failed to create overlay %s: %w", overlayPath, err)
+	}
+	info, err := GetImageInfo(overlayPath)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	info.Filename = overlayPath
+	return info, nil
+}
+
+// convertFormats are the disk formats ConvertImage reads and writes.
+var convertFormats = map[string]bool{
+	filesystem.FormatQcow2: true,
+	filesystem.FormatRaw:   true,
+	filesystem.FormatVMDK:  true,
+	filesystem.FormatVDI:   true,
+	filesystem.FormatVHDX:  true,
+	filesystem.FormatVPC:   true,
+}
+
+// ConvertOptions controls ConvertImageWithOptions.
+type ConvertOptions struct {
+	SrcFormat string // Detected from the magic bytes when empty
+	DstFormat string
+
+	// Compress compresses the clusters of a qcow2 destination, saving space
+	// in the image cache at the cost of slower guest reads.
+	Compress bool
+}
+
+// ConvertImage converts the disk image at src to a new image at dst in
+// dstFormat. The source format is detected when srcFormat is empty.
+func ConvertImage(src, dst, srcFormat, dstFormat string) error {
+	return ConvertImageWithOptions(src, dst, ConvertOptions{SrcFormat: srcFormat, DstFormat: dstFormat})
+}
+
+// ConvertImageWithOptions is ConvertImage with compression support. dst must
+// not exist yet and is removed again when the conversion fails.
+func ConvertImageWithOptions(src, dst string, opts ConvertOptions) error {
+	srcFormat := opts.SrcFormat
+	if srcFormat == "" {
+		detected, err := filesystem.DetectImageFormat(src)
+		if err != nil {
+			return err
+		}
+		srcFormat = detected
+	}
+	if !convertFormats[srcFormat] {
+		return fmt.Errorf("cannot convert image %s: unsupported source format %s", src, srcFormat)
+	}
+	if !convertFormats[opts.DstFormat] {
+		return fmt.Errorf("cannot convert image %s: unsupported destination format %q", src, opts.DstFormat)
+	}
+	if opts.Compress && opts.DstFormat != filesystem.FormatQcow2 {
+		return fmt.Errorf("cannot convert image %s: compression requires qcow2 output, not %s", src, opts.DstFormat)
+	}
+
+	// qemu-img convert would silently replace an existing image
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("image %s %w", dst, filesystem.ErrAlreadyExists)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to check image %s: %w", dst, err)
+	}
+
+	opts.SrcFormat = srcFormat
+	if err := DefaultQemuImg.Convert(src, dst, opts); err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("failed to convert image %s to %s: %w", src, opts.DstFormat, err)
+	}
 	return nil
 }
 
@@ -0,0 +1,157 @@
+package helpers
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"libvirt-controller/internal/filesystem"
+)
+
+// fakeQemuImg answers Info from images and records the images created.
+type fakeQemuImg struct {
+	images  map[string]ImageInfo
+	created map[string]CreateImageOptions
+}
+
+func (f *fakeQemuImg) Create(path string, opts CreateImageOptions) error {
+	f.created[path] = opts
+	f.images[path] = ImageInfo{Format: opts.Format, VirtualSize: opts.SizeBytes, BackingFilename: opts.BackingFile}
+	return os.WriteFile(path, nil, 0600)
+}
+
+func (f *fakeQemuImg) Resize(string, uint64) error { return nil }
+
+func (f *fakeQemuImg) Convert(string, string, ConvertOptions) error { return nil }
+
+func (f *fakeQemuImg) Info(path string) (ImageInfo, error) {
+	info, ok := f.images[path]
+	if !ok {
+		return ImageInfo{}, &QemuImgError{Op: "info", Message: "Could not open '" + path + "': No such file or directory", kind: os.ErrNotExist}
+	}
+	return info, nil
+}
+
+func (f *fakeQemuImg) Commit(string) error { return nil }
+
+func useFakeQemuImg(t *testing.T, dir string, images map[string]ImageInfo) *fakeQemuImg {
+	t.Helper()
+	fake := &fakeQemuImg{images: map[string]ImageInfo{}, created: map[string]CreateImageOptions{}}
+	for name, info := range images {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(name), 0600); err != nil {
+			t.Fatalf("error writing image. Err: %v", err)
+		}
+		fake.images[path] = info
+	}
+	prev := DefaultQemuImg
+	DefaultQemuImg = fake
+	t.Cleanup(func() { DefaultQemuImg = prev })
+	return fake
+}
+
+func TestBackingChain(t *testing.T) {
+	dir := t.TempDir()
+	useFakeQemuImg(t, dir, map[string]ImageInfo{
+		"vda.qcow2":    {Format: "qcow2", BackingFilename: "base.qcow2"},
+		"base.qcow2":   {Format: "qcow2", BackingFilename: filepath.Join(dir, "ubuntu.raw")},
+		"ubuntu.raw":   {Format: "raw"},
+		"broken.qcow2": {Format: "qcow2", BackingFilename: "gone.qcow2"},
+		"loop-a.qcow2": {Format: "qcow2", BackingFilename: "loop-b.qcow2"},
+		"loop-b.qcow2": {Format: "qcow2", BackingFilename: "loop-a.qcow2"},
+	})
+
+	chain, err := BackingChain(filepath.Join(dir, "vda.qcow2"))
+	if err != nil {
+		t.Fatalf("error walking backing chain. Err: %v", err)
+	}
+	var formats []string
+	for _, layer := range chain {
+		formats = append(formats, layer.Format)
+	}
+	if got := strings.Join(formats, ","); got != "qcow2,qcow2,raw" {
+		t.Errorf("expected chain qcow2,qcow2,raw; got %s", got)
+	}
+	if chain[2].Filename != filepath.Join(dir, "ubuntu.raw") {
+		t.Errorf("expected last layer %s; got %s", filepath.Join(dir, "ubuntu.raw"), chain[2].Filename)
+	}
+
+	err = ValidateBackingChain(filepath.Join(dir, "broken.qcow2"))
+	if !errors.Is(err, os.ErrNotExist) || !strings.Contains(err.Error(), "base image "+filepath.Join(dir, "gone.qcow2")) {
+		t.Errorf("expected missing base image to be named; got %v", err)
+	}
+	if err := ValidateBackingChain(filepath.Join(dir, "loop-a.qcow2")); err == nil || !strings.Contains(err.Error(), "loops") {
+		t.Errorf("expected backing chain cycle to be rejected; got %v", err)
+	}
+}
+
+func TestCreateOverlayUsesBaseFormat(t *testing.T) {
+	dir := t.TempDir()
+	fake := useFakeQemuImg(t, dir, map[string]ImageInfo{
+		"base.raw": {Format: "raw", VirtualSize: 10 << 30},
+	})
+	base := filepath.Join(dir, "base.raw")
+	overlay := filepath.Join(dir, "vda.qcow2")
+
+	if err := CreateOverlay(base, overlay, 5<<30); err == nil {
+		t.Errorf("expected overlay smaller than its base to be rejected")
+	}
+	if err := CreateOverlay(base, overlay, 20<<30); err != nil {
+		t.Fatalf("error creating overlay. Err: %v", err)
+	}
+	want := CreateImageOptions{Format: "qcow2", SizeBytes: 20 << 30, BackingFile: base, BackingFormat: "raw"}
+	if got := fake.created[overlay]; got != want {
+		t.Errorf("expected overlay created with %+v; got %+v", want, got)
+	}
+	if err := CreateOverlay(base, overlay, 0); err == nil {
+		t.Errorf("expected existing overlay to be rejected")
+	}
+}
+
+func TestParseQemuImgError(t *testing.T) {
+	stderr := "qemu-img: warning: ignoring unknown option\n" +
+		"qemu-img: Failed to get \"write\" lock\nIs another process using the image [/var/lib/vms/vda.qcow2]?\n"
+	err := parseQemuImgError("resize", stderr, &exec.ExitError{})
+	if !errors.Is(err, ErrImageLocked) {
+		t.Errorf("expected ErrImageLocked; got %v", err)
+	}
+	if err.Message != `Failed to get "write" lock` {
+		t.Errorf("expected the cause to be kept; got %q", err.Message)
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Errorf("expected the exit error to be wrapped")
+	}
+
+	err = parseQemuImgError("info", "qemu-img: Could not open 'vda.qcow2': Could not open 'vda.qcow2': No such file or directory\n", &exec.ExitError{})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist; got %v", err)
+	}
+}
+
+func TestCreateOverlayPreallocation(t *testing.T) {
+	dir := t.TempDir()
+	fake := useFakeQemuImg(t, dir, map[string]ImageInfo{
+		"base.qcow2": {Format: "qcow2", VirtualSize: 1 << 30},
+	})
+	base := filepath.Join(dir, "base.qcow2")
+
+	if _, err := CreateOverlayWithOptions(base, filepath.Join(dir, "a.qcow2"), OverlayOptions{Preallocation: "sparse"}); err == nil {
+		t.Errorf("expected invalid preallocation to be rejected")
+	}
+	overlay := filepath.Join(dir, "b.qcow2")
+	if _, err := CreateOverlayWithOptions(base, overlay, OverlayOptions{Preallocation: filesystem.PreallocMetadata}); err != nil {
+		t.Fatalf("error creating overlay. Err: %v", err)
+	}
+	if got := fake.created[overlay].Preallocation; got != filesystem.PreallocMetadata {
+		t.Errorf("expected preallocation metadata; got %q", got)
+	}
+
+	_, err := CreateOverlayWithOptions(base, filepath.Join(dir, "c.qcow2"), OverlayOptions{SizeBytes: 1 << 62, Preallocation: filesystem.PreallocFull})
+	if !errors.Is(err, filesystem.ErrInsufficientSpace) {
+		t.Errorf("expected ErrInsufficientSpace; got %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package helpers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"libvirt-controller/internal/filesystem"
+)
+
+// ErrImageLocked is wrapped by a QemuImgError when the image is opened for
+// writing by another process, usually the QEMU of a running domain.
+var ErrImageLocked = errors.New("image is locked by another process")
+
+// QemuImg runs the qemu-img operations the image helpers are built on. The
+// helpers use DefaultQemuImg, which tests can replace with a fake.
+type QemuImg interface {
+	// Create creates a new image at path.
+	Create(path string, opts CreateImageOptions) error
+	// Resize sets the virtual size of the image to sizeBytes.
+	Resize(path string, sizeBytes uint64) error
+	// Convert writes src to dst in opts.DstFormat, opts.SrcFormat must be
+	// set.
+	Convert(src, dst string, opts ConvertOptions) error
+	// Info inspects the image without taking its write lock.
+	Info(path string) (ImageInfo, error)
+	// Commit writes the changes of the overlay at path into its backing
+	// image.
+	Commit(path string) error
+}
+
+// CreateImageOptions controls QemuImg.Create.
+type CreateImageOptions struct {
+	Format        string
+	SizeBytes     uint64 // Taken from the backing file when zero
+	BackingFile   string // Absolute path of the backing image, if any
+	BackingFormat string // Format of the backing image, required with BackingFile
+	Preallocation string // One of the filesystem.Prealloc modes, off when empty
+}
+
+// DefaultQemuImg is the QemuImg used by the image helpers.
+var DefaultQemuImg QemuImg = ExecQemuImg{}
+
+// ExecQemuImg runs the qemu-img binary.
+type ExecQemuImg struct {
+	// Binary is the qemu-img executable, looked up in PATH when empty.
+	Binary string
+}
+
+func (q ExecQemuImg) Create(path string, opts CreateImageOptions) error {
+	args := []string{"create", "-f", opts.Format}
+	if opts.BackingFile != "" {
+		args = append(args, "-F", opts.BackingFormat, "-b", opts.BackingFile)
+	}
+	if opts.Preallocation != "" && opts.Preallocation != filesystem.PreallocOff {
+		args = append(args, "-o", "preallocation="+opts.Preallocation)
+		// qcow2 only preallocates an image with a backing file when its
+		// clusters can track which subclusters are allocated
+		if opts.BackingFile != "" && opts.Format == filesystem.FormatQcow2 {
+			args = append(args, "-o", "extended_l2=on")
+		}
+	}
+	args = append(args, path)
+	if opts.SizeBytes != 0 {
+		args = append(args, strconv.FormatUint(opts.SizeBytes, 10))
+	}
+	_, err := q.run(args...)
+	return err
+}
+
+func (q ExecQemuImg) Resize(path string, sizeBytes uint64) error {
+	_, err := q.run("resize", path, strconv.FormatUint(sizeBytes, 10))
+	return err
+}
+
+func (q ExecQemuImg) Convert(src, dst string, opts ConvertOptions) error {
+	args := []string{"convert", "-f", opts.SrcFormat, "-O", opts.DstFormat}
+	if opts.Compress {
+		args = append(args, "-c")
+	}
+	_, err := q.run(append(args, src, dst)...)
+	return err
+}
+
+func (q ExecQemuImg) Info(path string) (ImageInfo, error) {
+	out, err := q.run("info", "--force-share", "--output=json", path)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	var info ImageInfo
+	if err := json.Unmarshal(out, &info); err != nil {
+		return ImageInfo{}, fmt.Errorf("failed to parse qemu-img info output: %w", err)
+	}
+	return info, nil
+}
+
+func (q ExecQemuImg) Commit(path string) error {
+	_, err := q.run("commit", path)
+	return err
+}
+
+// run executes qemu-img with args and returns its stdout. A failure is
+// returned as a *QemuImgError holding the message qemu-img printed.
+func (q ExecQemuImg) run(args ...string) ([]byte, error) {
+	binary := q.Binary
+	if binary == "" {
+		binary = "qemu-img"
+	}
+	cmd := exec.Command(binary, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, parseQemuImgError(args[0], stderr.String(), err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// QemuImgError is a failed qemu-img invocation. It wraps os.ErrNotExist,
+// os.ErrPermission or ErrImageLocked when the message says so.
+type QemuImgError struct {
+	Op      string // The qemu-img subcommand, such as "resize"
+	Message string // What qemu-img printed, without its "qemu-img: " prefix
+	Err     error  // Why the command failed, usually an *exec.ExitError
+
+	kind error
+}
+
+func (e *QemuImgError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("qemu-img %s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("qemu-img %s: %s", e.Op, e.Message)
+}
+
+func (e *QemuImgError) Unwrap() []error {
+	if e.kind == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Err, e.kind}
+}
+
+// parseQemuImgError builds a QemuImgError from the stderr of qemu-img. The
+// last line prefixed with "qemu-img: " carries the cause, earlier lines are
+// warnings.
+func parseQemuImgError(op, stderr string, err error) *QemuImgError {
+	e := &QemuImgError{Op: op, Err: err}
+	for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
+		if msg, ok := strings.CutPrefix(strings.TrimSpace(line), "qemu-img: "); ok {
+			e.Message = msg
+		} else if e.Message == "" {
+			e.Message = strings.TrimSpace(line)
+		}
+	}
+	switch {
+	case strings.Contains(e.Message, "No such file or directory"):
+		e.kind = os.ErrNotExist
+	case strings.Contains(e.Message, "Permission denied"):
+		e.kind = os.ErrPermission
+	case strings.Contains(e.Message, `Failed to get "write" lock`), strings.Contains(e.Message, `Failed to get shared "write" lock`):
+		e.kind = ErrImageLocked
+	}
+	return e
+}
@@ -0,0 +1,189 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// ErrInsufficientResources is wrapped by the *InsufficientResourcesError
+// returned when admitting a domain would overcommit the host.
+var ErrInsufficientResources = errors.New("insufficient host resources")
+
+// OvercommitPolicy sets how far each resource may be committed beyond the
+// host's capacity: a ratio of 1.0 allows exactly the capacity, 4.0 four
+// times as much. A zero ratio leaves the resource unchecked.
+type OvercommitPolicy struct {
+	MemoryRatio float64
+	CPURatio    float64
+	DiskRatio   float64 // Virtual size of volumes against the pool capacity
+}
+
+// DefaultOvercommitPolicy never overcommits memory or disk and allows four
+// vCPUs per host CPU.
+var DefaultOvercommitPolicy = OvercommitPolicy{MemoryRatio: 1.0, CPURatio: 4.0, DiskRatio: 1.0}
+
+// Shortfall is one resource a domain would overcommit. Units are KiB for
+// memory, vCPUs for cpu and bytes for disk.
+type Shortfall struct {
+	Resource  string `json:"resource"` // "memory", "cpu" or "disk"
+	Requested uint64 `json:"requested"`
+	Committed uint64 `json:"committed"`
+	Limit     uint64 `json:"limit"` // Capacity times the overcommit ratio
+	Missing   uint64 `json:"missing"`
+}
+
+func (s Shortfall) String() string {
+	return fmt.Sprintf("%s: requested %d with %d committed exceeds the limit of %d by %d", s.Resource, s.Requested, s.Committed, s.Limit, s.Missing)
+}
+
+// InsufficientResourcesError lists every resource a domain would
+// overcommit. It matches ErrInsufficientResources with errors.Is.
+type InsufficientResourcesError struct {
+	Shortfalls []Shortfall
+}
+
+func (e *InsufficientResourcesError) Error() string {
+	parts := make([]string, len(e.Shortfalls))
+	for i, s := range e.Shortfalls {
+		parts[i] = s.String()
+	}
+	return fmt.Sprintf("%v: %s", ErrInsufficientResources, strings.Join(parts, "; "))
+}
+
+func (e *InsufficientResourcesError) Unwrap() error {
+	return ErrInsufficientResources
+}
+
+// AdmissionControl checks new domains against the host capacity scaled by
+// an OvercommitPolicy. Every domain defined on the host counts as committed,
+// whether or not it is running, since a stopped domain can be started at any
+// time.
+type AdmissionControl struct {
+	conn   *libvirt.Libvirt
+	Policy OvercommitPolicy
+
+	// mu serializes admissions and guards pending, the resources reserved
+	// for domains that are admitted but not defined yet.
+	mu          sync.Mutex
+	pending     map[int]Resources
+	nextPending int
+}
+
+// NewAdmissionControl creates an AdmissionControl using
+// DefaultOvercommitPolicy.
+func NewAdmissionControl(conn *libvirt.Libvirt) *AdmissionControl {
+	return &AdmissionControl{conn: conn, Policy: DefaultOvercommitPolicy}
+}
+
+// Admit checks whether a domain needing required fits on the host. It
+// returns an *InsufficientResourcesError when it does not.
+func (a *AdmissionControl) Admit(required Resources) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.admit(required)
+}
+
+// Reserve admits required and keeps it counted as committed until release
+// is called, so concurrent creations cannot both take the last capacity.
+// Call release once the domain is defined or its creation failed.
+func (a *AdmissionControl) Reserve(required Resources) (release func(), err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.admit(required); err != nil {
+		return nil, err
+	}
+	if a.pending == nil {
+		a.pending = make(map[int]Resources)
+	}
+	id := a.nextPending
+	a.nextPending++
+	a.pending[id] = required
+
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		delete(a.pending, id)
+	}, nil
+}
+
+// admit checks required against the committed resources. a.mu must be held.
+func (a *AdmissionControl) admit(required Resources) error {
+	_, memKiB, cpus, _, _, _, _, _, err := a.conn.NodeGetInfo()
+	if err != nil {
+		return fmt.Errorf("failed to get node info: %w", err)
+	}
+
+	var committedMemKiB, committedVCPUs uint64
+	doms, _, err := a.conn.ConnectListAllDomains(1, 0)
+	if err != nil {
+		return fmt.Errorf("failed to list domains: %w", err)
+	}
+	for _, dom := range doms {
+		_, maxMem, _, vcpus, _, err := a.conn.DomainGetInfo(dom)
+		if isLibvirtError(err, libvirt.ErrNoDomain) {
+			// Undefined since it was listed
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get info for domain %s: %w", dom.Name, err)
+		}
+		committedMemKiB += maxMem
+		committedVCPUs += uint64(vcpus)
+	}
+	var pendingDisk uint64
+	for _, r := range a.pending {
+		committedMemKiB += r.MemoryMiB * 1024
+		committedVCPUs += uint64(r.VCPUs)
+		if r.Pool == required.Pool {
+			pendingDisk += r.DiskBytes
+		}
+	}
+
+	var shortfalls []Shortfall
+	check := func(resource string, requested, committed, capacity uint64, ratio float64) {
+		if ratio <= 0 {
+			return
+		}
+		limit := uint64(float64(capacity) * ratio)
+		if committed+requested > limit {
+			shortfalls = append(shortfalls, Shortfall{
+				Resource:  resource,
+				Requested: requested,
+				Committed: committed,
+				Limit:     limit,
+				Missing:   committed + requested - limit,
+			})
+		}
+	}
+	check("memory", required.MemoryMiB*1024, committedMemKiB, memKiB, a.Policy.MemoryRatio)
+	check("cpu", uint64(required.VCPUs), committedVCPUs, uint64(cpus), a.Policy.CPURatio)
+
+	if required.Pool != "" && a.Policy.DiskRatio > 0 {
+		vols, err := NewStoragePoolManager(a.conn).ListVolumes(required.Pool)
+		if err != nil {
+			return err
+		}
+		pool, err := a.conn.StoragePoolLookupByName(required.Pool)
+		if err != nil {
+			return fmt.Errorf("failed to look up pool %s: %w", required.Pool, err)
+		}
+		_, capacity, _, _, err := a.conn.StoragePoolGetInfo(pool)
+		if err != nil {
+			return fmt.Errorf("failed to get info for pool %s: %w", required.Pool, err)
+		}
+		committed := pendingDisk
+		for _, vol := range vols {
+			committed += vol.CapacityBytes
+		}
+		check("disk", required.DiskBytes, committed, capacity, a.Policy.DiskRatio)
+	}
+
+	if len(shortfalls) > 0 {
+		return &InsufficientResourcesError{Shortfalls: shortfalls}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package libvirt
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+
+	"libvirt-controller/internal/filesystem"
+)
+
+// backupTimeout is how long Backup waits for the backup job to finish.
+const backupTimeout = 24 * time.Hour
+
+// BackupInfo describes a finished backup so it can be recorded in a catalog.
+type BackupInfo struct {
+	ID          string       `json:"id"`
+	Domain      string       `json:"domain"`
+	Checkpoint  string       `json:"checkpoint"`
+	Parent      string       `json:"parent,omitempty"`
+	Incremental bool         `json:"incremental"`
+	Disks       []BackupDisk `json:"disks"`
+	SizeBytes   int64        `json:"size_bytes"`
+	StartedAt   time.Time    `json:"started_at"`
+	CompletedAt time.Time    `json:"completed_at"`
+}
+
+// BackupDisk is the backup file written for one disk of the domain.
+type BackupDisk struct {
+	Disk      string `json:"disk"`
+	Path      string `json:"path"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// Backup writes a backup of every writable disk of the running domain into
+// targetDir and creates a checkpoint, which tracks changed blocks in a qcow2
+// dirty bitmap from then on. With incremental set only blocks changed since
+// the latest checkpoint are copied; the first backup of a domain is always a
+// full one.
+//
+// Backups run in push mode, so qemu writes the files itself and no NBD
+// export has to be torn down. If the backup fails the job is aborted and the
+// partial files and the new checkpoint are removed, so the next incremental
+// is still based on a complete backup. Cancelling ctx fails the backup the
+// same way.
+func (m *DomainManager) Backup(ctx context.Context, name, targetDir string, incremental bool) (BackupInfo, error) {
+	dom, err := m.lookup(name)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	active, err := m.conn.DomainIsActive(dom)
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("failed to get state of domain %s: %w", name, err)
+	}
+	if active != 1 {
+		return BackupInfo{}, fmt.Errorf("cannot back up domain %s: domain is not running", name)
+	}
+	domain, err := m.domainXML(dom)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	info := BackupInfo{
+		ID:        time.Now().UTC().Format("20060102T150405Z"),
+		Domain:    name,
+		StartedAt: time.Now(),
+	}
+	info.Checkpoint = "backup-" + info.ID
+	if incremental {
+		if info.Parent, err = m.latestCheckpoint(dom); err != nil {
+			return BackupInfo{}, err
+		}
+		info.Incremental = info.Parent != ""
+	}
+
+	if err := os.MkdirAll(targetDir, filesystem.DirPerm); err != nil {
+		return BackupInfo{}, fmt.Errorf("failed to create backup directory %s: %w", targetDir, err)
+	}
+
+	backup := domainBackupXML{Mode: "push", Incremental: info.Parent}
+	checkpoint := domainCheckpointXML{Name: info.Checkpoint, Disks: &checkpointDisksXML{}}
+	for _, disk := range domain.Devices.Disks {
+		dev := disk.Target.Dev
+		if disk.Device == "cdrom" || disk.ReadOnly != nil || disk.Source.File == "" {
+			backup.Disks.Disks = append(backup.Disks.Disks, backupDiskXML{Name: dev, Backup: "no"})
+			checkpoint.Disks.Disks = append(checkpoint.Disks.Disks, checkpointDiskXML{Name: dev, Checkpoint: "no"})
+			continue
+		}
+		path := filepath.Join(targetDir, fmt.Sprintf("%s-%s-%s.qcow2", name, info.ID, dev))
+		backup.Disks.Disks = append(backup.Disks.Disks, backupDiskXML{
+			Name:   dev,
+			Backup: "yes",
+			Type:   "file",
+			Target: &diskSourceXML{File: path},
+			Driver: &snapshotDiskDriverXML{Type: "qcow2"},
+		})
+		checkpoint.Disks.Disks = append(checkpoint.Disks.Disks, checkpointDiskXML{Name: dev, Checkpoint: "bitmap"})
+		info.Disks = append(info.Disks, BackupDisk{Disk: dev, Path: path})
+	}
+	if len(info.Disks) == 0 {
+		return BackupInfo{}, fmt.Errorf("domain %s has no writable disks to back up", name)
+	}
+
+	backupDesc, err := xml.Marshal(backup)
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("failed to build backup XML: %w", err)
+	}
+	checkpointDesc, err := xml.Marshal(checkpoint)
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("failed to build checkpoint XML: %w", err)
+	}
+
+	if err := m.conn.DomainBackupBegin(dom, string(backupDesc), libvirt.OptString{string(checkpointDesc)}, 0); err != nil {
+		m.cleanupBackup(dom, info, false)
+		return BackupInfo{}, fmt.Errorf("failed to start backup of domain %s: %w", name, err)
+	}
+	if err := m.waitForBackup(ctx, dom); err != nil {
+		m.cleanupBackup(dom, info, true)
+		return BackupInfo{}, fmt.Errorf("backup of domain %s failed: %w", name, err)
+	}
+
+	info.CompletedAt = time.Now()
+	for i := range info.Disks {
+		fi, err := os.Stat(info.Disks[i].Path)
+		if err != nil {
+			return BackupInfo{}, fmt.Errorf("failed to stat backup file: %w", err)
+		}
+		info.Disks[i].SizeBytes = fi.Size()
+		info.SizeBytes += fi.Size()
+	}
+	return info, nil
+}
+
+// waitForBackup waits until the backup job of the domain has finished and
+// reports whether it failed.
+func (m *DomainManager) waitForBackup(ctx context.Context, dom libvirt.Domain) error {
+	done, err := m.waitFor(ctx, backupTimeout, func() (bool, error) {
+		jobType, _, _, _, _, _, _, _, _, _, _, _, err := m.conn.DomainGetJobInfo(dom)
+		if err != nil {
+			return false, err
+		}
+		return libvirt.DomainJobType(jobType) == libvirt.DomainJobNone, nil
+	})
+	if err != nil {
+		return err
+	}
+	if !done {
+		return errors.New("timed out waiting for backup job")
+	}
+
+	jobType, _, err := m.conn.DomainGetJobStats(dom, libvirt.DomainJobStatsCompleted)
+	if err != nil {
+		return fmt.Errorf("failed to get result of backup job: %w", err)
+	}
+	switch libvirt.DomainJobType(jobType) {
+	case libvirt.DomainJobCompleted:
+		return nil
+	case libvirt.DomainJobCancelled:
+		return errors.New("backup job was cancelled")
+	default:
+		return errors.New("backup job did not complete")
+	}
+}
+
+// cleanupBackup aborts a running backup job and removes its partial files
+// and checkpoint. Errors are logged since the backup error is what matters.
+func (m *DomainManager) cleanupBackup(dom libvirt.Domain, info BackupInfo, started bool) {
+	if started {
+		if err := m.conn.DomainAbortJob(dom); err != nil && !isLibvirtError(err, libvirt.ErrOperationInvalid) {
+			m.log().Error("failed to abort backup job", "domain", info.Domain, "err", err)
+		}
+	}
+	if cp, err := m.conn.DomainCheckpointLookupByName(dom, info.Checkpoint, 0); err == nil {
+		if err := m.conn.DomainCheckpointDelete(cp, 0); err != nil {
+			m.log().Error("failed to delete checkpoint", "domain", info.Domain, "checkpoint", info.Checkpoint, "err", err)
+		}
+	}
+	for _, disk := range info.Disks {
+		if _, err := filesystem.DeleteFileIfExists(filepath.Dir(disk.Path), filepath.Base(disk.Path)); err != nil {
+			m.log().Error("failed to delete partial backup", "domain", info.Domain, "path", disk.Path, "err", err)
+		}
+	}
+}
+
+// latestCheckpoint returns the name of the most recent checkpoint of the
+// domain, or "" if it has none.
+func (m *DomainManager) latestCheckpoint(dom libvirt.Domain) (string, error) {
+	checkpoints, _, err := m.conn.DomainListAllCheckpoints(dom, 1, uint32(libvirt.DomainCheckpointListLeaves))
+	if err != nil {
+		return "", fmt.Errorf("failed to list checkpoints of domain %s: %w", dom.Name, err)
+	}
+
+	var latest string
+	var latestTime int64
+	for _, cp := range checkpoints {
+		desc, err := m.conn.DomainCheckpointGetXMLDesc(cp, 0)
+		if err != nil {
+			return "", fmt.Errorf("failed to get XML of checkpoint %s: %w", cp.Name, err)
+		}
+		var parsed domainCheckpointXML
+		if err := xml.Unmarshal([]byte(desc), &parsed); err != nil {
+			return "", fmt.Errorf("failed to parse XML of checkpoint %s: %w", cp.Name, err)
+		}
+		if latest == "" || parsed.CreationTime > latestTime {
+			latest, latestTime = parsed.Name, parsed.CreationTime
+		}
+	}
+	return latest, nil
+}
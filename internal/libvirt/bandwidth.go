@@ -0,0 +1,83 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Bandwidth shapes traffic in one direction of an interface. Rates are in
+// kilobytes per second and the burst in kilobytes, as libvirt expects. A zero
+// average means unlimited.
+type Bandwidth struct {
+	AverageKBps uint `json:"average_kbps"`
+	PeakKBps    uint `json:"peak_kbps,omitempty"` // Rate allowed while sending a burst
+	BurstKB     uint `json:"burst_kb,omitempty"`  // Amount that may be sent at peak rate
+}
+
+// Validate checks that peak and burst only come with an average they do not
+// undercut.
+func (b Bandwidth) Validate() error {
+	if b.AverageKBps == 0 && (b.PeakKBps != 0 || b.BurstKB != 0) {
+		return errors.New("peak and burst require an average")
+	}
+	if b.PeakKBps != 0 && b.PeakKBps < b.AverageKBps {
+		return fmt.Errorf("peak %d KB/s is less than average %d KB/s", b.PeakKBps, b.AverageKBps)
+	}
+	return nil
+}
+
+func (b *Bandwidth) xml() *bandwidthLimitXML {
+	if b == nil || b.AverageKBps == 0 {
+		return nil
+	}
+	return &bandwidthLimitXML{Average: b.AverageKBps, Peak: b.PeakKBps, Burst: b.BurstKB}
+}
+
+// SetInterfaceBandwidth replaces the bandwidth limits of the interface with
+// the given MAC. A zero Bandwidth removes the limit in that direction. The
+// limits are written to the domain config and, when the domain is running,
+// applied to it immediately.
+func (m *DomainManager) SetInterfaceBandwidth(name, mac string, in, out Bandwidth) error {
+	if err := in.Validate(); err != nil {
+		return fmt.Errorf("invalid inbound bandwidth: %w", err)
+	}
+	if err := out.Validate(); err != nil {
+		return fmt.Errorf("invalid outbound bandwidth: %w", err)
+	}
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	domain, err := m.domainXML(dom)
+	if err != nil {
+		return err
+	}
+	iface, ok := findInterface(domain, mac)
+	if !ok {
+		return fmt.Errorf("cannot set bandwidth on domain %s: MAC %s not found", name, mac)
+	}
+	flags, err := m.affectFlags(dom)
+	if err != nil {
+		return err
+	}
+
+	params := []libvirt.TypedParam{
+		uintParam("inbound.average", in.AverageKBps),
+		uintParam("inbound.peak", in.PeakKBps),
+		uintParam("inbound.burst", in.BurstKB),
+		uintParam("outbound.average", out.AverageKBps),
+		uintParam("outbound.peak", out.PeakKBps),
+		uintParam("outbound.burst", out.BurstKB),
+	}
+	// libvirt accepts the MAC in place of the target device name
+	if err := m.conn.DomainSetInterfaceParameters(dom, iface.MAC.Address, params, flags); err != nil {
+		return fmt.Errorf("failed to set bandwidth of interface %s on domain %s: %w", mac, name, err)
+	}
+	return nil
+}
+
+func uintParam(field string, value uint) libvirt.TypedParam {
+	return libvirt.TypedParam{Field: field, Value: *libvirt.NewTypedParamValueUint(uint32(value))}
+}
@@ -0,0 +1,217 @@
+package libvirt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// ErrBlockJobActive is returned by FlattenDisk when the disk already runs a
+// block job, such as a copy or another flatten.
+var ErrBlockJobActive = errors.New("a block job is already running on the disk")
+
+// FlattenMethod selects how FlattenDisk merges a backing chain.
+type FlattenMethod string
+
+const (
+	// FlattenPull copies the data of the backing chain up into the active
+	// layer, which then stands alone. The backing images are left untouched.
+	FlattenPull FlattenMethod = "pull"
+	// FlattenCommit merges the active layer down into the base of the chain
+	// and switches the disk over to it. Images shared with other domains must
+	// not be in the chain, since commit writes into them.
+	FlattenCommit FlattenMethod = "commit"
+)
+
+// FlattenOptions controls how FlattenDisk merges a disk's backing chain.
+type FlattenOptions struct {
+	Method         FlattenMethod // FlattenPull when empty
+	BandwidthMiBps uint64        // Unlimited when zero
+
+	// Progress is called every PollInterval while the block job runs.
+	Progress func(BlockJobProgress)
+}
+
+// BlockJobProgress is a snapshot of a running block job. Cur and End are in
+// an arbitrary unit, only their ratio is meaningful.
+type BlockJobProgress struct {
+	Cur uint64 `json:"cur"`
+	End uint64 `json:"end"`
+}
+
+// FlattenDisk merges the backing chain of the disk with target dev into its
+// active layer using a block pull. It blocks until the job has finished.
+func (m *DomainManager) FlattenDisk(name, dev string) error {
+	return m.FlattenDiskWithOptions(context.Background(), name, dev, FlattenOptions{})
+}
+
+// FlattenDiskWithOptions is FlattenDisk with a choice of method, bandwidth
+// and progress reporting. The domain must be running, block jobs are a
+// feature of the running qemu process. When ctx is cancelled the job is
+// aborted, which leaves the chain as it was for a pull and the disk on its
+// active layer for a commit.
+func (m *DomainManager) FlattenDiskWithOptions(ctx context.Context, name, dev string, opts FlattenOptions) error {
+	method := opts.Method
+	if method == "" {
+		method = FlattenPull
+	}
+	if method != FlattenPull && method != FlattenCommit {
+		return fmt.Errorf("invalid flatten method %q", method)
+	}
+
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	disk, err := m.blockJobDisk(dom, dev)
+	if err != nil {
+		return fmt.Errorf("cannot flatten disk %s of domain %s: %w", dev, name, err)
+	}
+	if !disk.BackingStore.hasBacking() {
+		return nil
+	}
+
+	if method == FlattenPull {
+		err = m.conn.DomainBlockPull(dom, dev, opts.BandwidthMiBps, 0)
+	} else {
+		err = m.conn.DomainBlockCommit(dom, dev, nil, nil, opts.BandwidthMiBps, libvirt.DomainBlockCommitActive)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to start block %s of disk %s of domain %s: %w", method, dev, name, err)
+	}
+	if err := m.waitForBlockJob(ctx, dom, dev, method == FlattenCommit, opts.Progress); err != nil {
+		return fmt.Errorf("block %s of disk %s of domain %s failed: %w", method, dev, name, err)
+	}
+
+	// A failed job disappears just like a finished one, so check the chain
+	if disk, err = m.blockJobDisk(dom, dev); err != nil {
+		return err
+	}
+	if disk.BackingStore.hasBacking() {
+		return fmt.Errorf("block %s of disk %s of domain %s did not complete, the disk still has a backing image", method, dev, name)
+	}
+	return nil
+}
+
+// blockJobDisk returns the disk with target dev from the live XML of the
+// domain after checking that a block job can be started on it.
+func (m *DomainManager) blockJobDisk(dom libvirt.Domain, dev string) (diskXML, error) {
+	active, err := m.conn.DomainIsActive(dom)
+	if err != nil {
+		return diskXML{}, fmt.Errorf("failed to get state of domain %s: %w", dom.Name, err)
+	}
+	if active != 1 {
+		return diskXML{}, errors.New("domain is not running")
+	}
+	domain, err := m.domainXML(dom)
+	if err != nil {
+		return diskXML{}, err
+	}
+	for _, disk := range domain.Devices.Disks {
+		if disk.Target.Dev != dev {
+			continue
+		}
+		if disk.Device != "disk" || disk.ReadOnly != nil {
+			return diskXML{}, fmt.Errorf("disk %s is not a writable disk", dev)
+		}
+		found, _, _, _, _, err := m.conn.DomainGetBlockJobInfo(dom, dev, 0)
+		if err != nil {
+			return diskXML{}, fmt.Errorf("failed to get block job of disk %s: %w", dev, err)
+		}
+		if found == 1 {
+			return diskXML{}, ErrBlockJobActive
+		}
+		return disk, nil
+	}
+	return diskXML{}, fmt.Errorf("disk %s not found", dev)
+}
+
+// waitForBlockJob polls the block job of the disk until it has finished or
+// ctx is cancelled, in which case the job is aborted. An active commit never
+// finishes by itself, so with pivot set the disk is switched over to the
+// base image once the job is ready.
+func (m *DomainManager) waitForBlockJob(ctx context.Context, dom libvirt.Domain, dev string, pivot bool, progress func(BlockJobProgress)) error {
+	m.blockJobs.add(dom, dev)
+	defer m.blockJobs.remove(dom, dev)
+
+	ticker := time.NewTicker(m.pollInterval())
+	defer ticker.Stop()
+
+	for {
+		found, jobType, _, cur, end, err := m.conn.DomainGetBlockJobInfo(dom, dev, 0)
+		if err != nil {
+			return fmt.Errorf("failed to get block job of disk %s: %w", dev, err)
+		}
+		if found == 0 {
+			return nil
+		}
+		if progress != nil {
+			progress(BlockJobProgress{Cur: cur, End: end})
+		}
+		if pivot && libvirt.DomainBlockJobType(jobType) == libvirt.DomainBlockJobTypeActiveCommit && end > 0 && cur == end {
+			err := m.conn.DomainBlockJobAbort(dom, dev, libvirt.DomainBlockJobAbortPivot)
+			// The job may still be catching up with new writes
+			if err != nil && !isLibvirtError(err, libvirt.ErrBlockCopyActive) {
+				return fmt.Errorf("failed to pivot disk %s: %w", dev, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if err := m.conn.DomainBlockJobAbort(dom, dev, 0); err != nil && !isLibvirtError(err, libvirt.ErrOperationInvalid) {
+				m.log().Error("failed to abort block job", "domain", dom.Name, "disk", dev, "err", err)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// blockJobs are the block jobs a DomainManager is waiting for.
+type blockJobs struct {
+	mu   sync.Mutex
+	jobs map[blockJobKey]libvirt.Domain
+}
+
+type blockJobKey struct {
+	domain string
+	dev    string
+}
+
+func (b *blockJobs) add(dom libvirt.Domain, dev string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.jobs == nil {
+		b.jobs = make(map[blockJobKey]libvirt.Domain)
+	}
+	b.jobs[blockJobKey{dom.Name, dev}] = dom
+}
+
+func (b *blockJobs) remove(dom libvirt.Domain, dev string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.jobs, blockJobKey{dom.Name, dev})
+}
+
+// AbortBlockJobs aborts the block jobs started by FlattenDisk that are still
+// running, so none is left behind in qemu when the controller exits. The
+// FlattenDisk calls waiting for them return an error.
+func (m *DomainManager) AbortBlockJobs() error {
+	m.blockJobs.mu.Lock()
+	jobs := maps.Clone(m.blockJobs.jobs)
+	m.blockJobs.mu.Unlock()
+
+	var errs []error
+	for key, dom := range jobs {
+		// The job may have finished since
+		if err := m.conn.DomainBlockJobAbort(dom, key.dev, 0); err != nil && !isLibvirtError(err, libvirt.ErrOperationInvalid) {
+			errs = append(errs, fmt.Errorf("failed to abort block job of disk %s of domain %s: %w", key.dev, key.domain, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,177 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// nextBootNamespace is the namespace of the domain metadata element that
+// records the device set with SetNextBootDevice.
+const nextBootNamespace = "https://libvirt-controller/xmlns/next-boot/1"
+
+type nextBootXML struct {
+	XMLName xml.Name `xml:"boot"`
+	Dev     string   `xml:"dev,attr"`
+}
+
+// SetNextBootDevice makes the next Start of the domain boot from dev, the
+// target of a disk such as "vda" or the MAC address of a NIC, with the other
+// devices following in their usual order. Only that boot uses the changed
+// order: Start boots the domain from a transient copy of its definition,
+// which lasts until the domain is powered off, so reboots from inside the
+// guest keep it. An empty dev cancels a pending one-time boot.
+func (m *DomainManager) SetNextBootDevice(name, dev string) error {
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	if dev == "" {
+		err := m.conn.DomainSetMetadata(dom, int32(libvirt.DomainMetadataElement), nil, nil, libvirt.OptString{nextBootNamespace}, libvirt.DomainAffectConfig)
+		if err != nil && !isLibvirtError(err, libvirt.ErrNoDomainMetadata) {
+			return fmt.Errorf("failed to clear next boot device of domain %s: %w", name, err)
+		}
+		return nil
+	}
+
+	// Check now that the order can be changed instead of failing the start
+	desc, err := m.GetXML(name)
+	if err != nil {
+		return err
+	}
+	spec, err := ParseDomainXML(desc)
+	if err != nil {
+		return err
+	}
+	if err := spec.bootFirst(dev); err != nil {
+		return fmt.Errorf("cannot boot domain %s from %s: %w", name, dev, err)
+	}
+
+	meta, err := xml.Marshal(nextBootXML{Dev: dev})
+	if err != nil {
+		return err
+	}
+	err = m.conn.DomainSetMetadata(dom, int32(libvirt.DomainMetadataElement), libvirt.OptString{string(meta)}, libvirt.OptString{"boot"}, libvirt.OptString{nextBootNamespace}, libvirt.DomainAffectConfig)
+	if err != nil {
+		return fmt.Errorf("failed to set next boot device of domain %s: %w", name, err)
+	}
+	return nil
+}
+
+// nextBootDevice returns the device set with SetNextBootDevice, or "".
+func (m *DomainManager) nextBootDevice(dom libvirt.Domain) (string, error) {
+	meta, err := m.conn.DomainGetMetadata(dom, int32(libvirt.DomainMetadataElement), libvirt.OptString{nextBootNamespace}, libvirt.DomainAffectConfig)
+	if isLibvirtError(err, libvirt.ErrNoDomainMetadata) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get next boot device of domain %s: %w", dom.Name, err)
+	}
+	var next nextBootXML
+	if err := xml.Unmarshal([]byte(meta), &next); err != nil {
+		return "", fmt.Errorf("invalid next boot device of domain %s: %w", dom.Name, err)
+	}
+	return next.Dev, nil
+}
+
+// startOnce boots the domain from a transient copy of its definition that
+// boots from dev first, then forgets dev.
+func (m *DomainManager) startOnce(dom libvirt.Domain, dev string) error {
+	desc, err := m.conn.DomainGetXMLDesc(dom, libvirt.DomainXMLInactive|libvirt.DomainXMLSecure)
+	if err != nil {
+		return fmt.Errorf("failed to get XML of domain %s: %w", dom.Name, err)
+	}
+	spec, err := ParseDomainXML(desc)
+	if err != nil {
+		return err
+	}
+	if err := spec.bootFirst(dev); err != nil {
+		return fmt.Errorf("cannot boot domain %s from %s: %w", dom.Name, dev, err)
+	}
+	once, err := BuildDomainXML(spec)
+	if err != nil {
+		return err
+	}
+	// An inactive persistent domain keeps its definition when started
+	// from transient XML
+	if _, err := m.conn.DomainCreateXML(once, 0); err != nil {
+		return fmt.Errorf("failed to start domain %s: %w", dom.Name, err)
+	}
+	if err := m.SetNextBootDevice(dom.Name, ""); err != nil {
+		m.log().Error("failed to clear next boot device", "domain", dom.Name, "err", err)
+	}
+	return nil
+}
+
+// bootFirst moves dev, a disk target or NIC MAC address, to the front of the
+// per-device boot order. A domain booting by device type is switched to the
+// per-device order, keeping the type order for the devices after dev.
+func (s *DomainSpec) bootFirst(dev string) error {
+	type bootable struct {
+		order *uint
+		kind  string // Boot device type of DomainSpec.BootOrder
+	}
+	var devices []bootable
+	var first *uint
+	for i := range s.Disks {
+		disk := &s.Disks[i]
+		kind := "hd"
+		if disk.Device == "cdrom" {
+			kind = "cdrom"
+		}
+		devices = append(devices, bootable{&disk.BootOrder, kind})
+		if disk.Target == dev {
+			first = &disk.BootOrder
+		}
+	}
+	for i := range s.NICs {
+		nic := &s.NICs[i]
+		devices = append(devices, bootable{&nic.BootOrder, "network"})
+		if strings.EqualFold(nic.MAC, dev) {
+			first = &nic.BootOrder
+		}
+	}
+	if first == nil {
+		return fmt.Errorf("no disk or NIC the controller manages is called %s", dev)
+	}
+
+	// Work out the current order of the devices
+	var ordered []*uint
+	if s.hasDeviceBootOrder() {
+		slices.SortStableFunc(devices, func(a, b bootable) int { return int(*a.order) - int(*b.order) })
+		for _, d := range devices {
+			if *d.order != 0 {
+				ordered = append(ordered, d.order)
+			}
+		}
+	} else {
+		kinds := s.BootOrder
+		if len(kinds) == 0 {
+			kinds = []string{"hd"}
+		}
+		for _, kind := range kinds {
+			for _, d := range devices {
+				if d.kind == kind {
+					ordered = append(ordered, d.order)
+				}
+			}
+		}
+		s.BootOrder = nil
+	}
+
+	for _, d := range devices {
+		*d.order = 0
+	}
+	*first = 1
+	next := uint(2)
+	for _, order := range ordered {
+		if order != first {
+			*order = next
+			next++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os/exec"
+	"slices"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// HostCaps describes what the hypervisor on the host can run.
+type HostCaps struct {
+	Arch     string `json:"arch"`
+	HostCPU  string `json:"host_cpu"`
+	Emulator string `json:"emulator"`
+	// VirtType is the domain type to use, "kvm" when KVM is available and
+	// "qemu" otherwise.
+	VirtType   string `json:"virt_type"`
+	KVM        bool   `json:"kvm"`
+	NestedVirt bool   `json:"nested_virt"`
+
+	// MachineTypes holds both aliases such as "q35" and the versioned
+	// machine types they point at. DefaultMachine is what libvirt picks
+	// when a domain does not name one.
+	MachineTypes   []string `json:"machine_types"`
+	DefaultMachine string   `json:"default_machine"`
+
+	// CPUModels are the named CPU models the host can run.
+	CPUModels []string `json:"cpu_models"`
+	DiskBuses []string `json:"disk_buses"`
+
+	// TPMEmulator reports whether swtpm is installed so domains can have
+	// an emulated TPM.
+	TPMEmulator bool `json:"tpm_emulator"`
+}
+
+// SupportsMachine reports whether machine is a known machine type.
+func (c HostCaps) SupportsMachine(machine string) bool {
+	return slices.Contains(c.MachineTypes, machine)
+}
+
+// SupportsCPUModel reports whether the CPU model can be used on the host.
+func (c HostCaps) SupportsCPUModel(model string) bool {
+	return slices.Contains(c.CPUModels, model)
+}
+
+// SupportsDiskBus reports whether disks can be attached on bus.
+func (c HostCaps) SupportsDiskBus(bus string) bool {
+	return slices.Contains(c.DiskBuses, bus)
+}
+
+// Capabilities returns the capabilities of the host's hypervisor for its
+// native architecture. They do not change while libvirtd runs, so the first
+// successful result is cached.
+func (m *HostManager) Capabilities() (HostCaps, error) {
+	m.capsMu.Lock()
+	defer m.capsMu.Unlock()
+
+	if m.caps != nil {
+		return *m.caps, nil
+	}
+
+	raw, err := m.conn.ConnectGetCapabilities()
+	if err != nil {
+		return HostCaps{}, fmt.Errorf("failed to get capabilities: %w", err)
+	}
+	var caps capabilitiesXML
+	if err := xml.Unmarshal([]byte(raw), &caps); err != nil {
+		return HostCaps{}, fmt.Errorf("failed to parse capabilities: %w", err)
+	}
+
+	hc := HostCaps{Arch: caps.Host.CPU.Arch, HostCPU: caps.Host.CPU.Model, VirtType: "qemu"}
+	for _, guest := range caps.Guests {
+		if guest.OSType != "hvm" || guest.Arch.Name != hc.Arch {
+			continue
+		}
+		hc.Emulator = guest.Arch.Emulator
+		for _, machine := range guest.Arch.Machines {
+			hc.MachineTypes = appendUnique(hc.MachineTypes, machine.Name)
+			if machine.Canonical != "" {
+				hc.MachineTypes = appendUnique(hc.MachineTypes, machine.Canonical)
+			}
+		}
+		for _, dom := range guest.Arch.Domains {
+			if dom.Type == "kvm" {
+				hc.KVM = true
+				hc.VirtType = "kvm"
+			}
+		}
+	}
+	if hc.Emulator == "" {
+		return HostCaps{}, fmt.Errorf("no hvm guest support for host arch %s", hc.Arch)
+	}
+
+	raw, err = m.conn.ConnectGetDomainCapabilities(
+		libvirt.OptString{hc.Emulator}, libvirt.OptString{hc.Arch}, nil, libvirt.OptString{hc.VirtType}, 0)
+	if err != nil {
+		return HostCaps{}, fmt.Errorf("failed to get domain capabilities: %w", err)
+	}
+	var domCaps domainCapabilitiesXML
+	if err := xml.Unmarshal([]byte(raw), &domCaps); err != nil {
+		return HostCaps{}, fmt.Errorf("failed to parse domain capabilities: %w", err)
+	}
+	hc.DefaultMachine = domCaps.Machine
+
+	for _, mode := range domCaps.CPU.Modes {
+		if mode.Supported != "yes" {
+			continue
+		}
+		switch mode.Name {
+		case "custom":
+			for _, model := range mode.Models {
+				if model.Usable != "no" {
+					hc.CPUModels = append(hc.CPUModels, model.Name)
+				}
+			}
+		case "host-model":
+			// KVM only hands the virtualization extensions to guests
+			// when nested virtualization is enabled in the kernel.
+			for _, feature := range mode.Features {
+				if (feature.Name == "vmx" || feature.Name == "svm") && feature.Policy != "disable" {
+					hc.NestedVirt = hc.KVM
+				}
+			}
+		}
+	}
+	if domCaps.Devices.Disk.Supported == "yes" {
+		for _, enum := range domCaps.Devices.Disk.Enums {
+			if enum.Name == "bus" {
+				hc.DiskBuses = enum.Values
+			}
+		}
+	}
+
+	if tpm := domCaps.Devices.TPM; tpm != nil {
+		for _, enum := range tpm.Enums {
+			if enum.Name == "backendModel" && tpm.Supported == "yes" {
+				hc.TPMEmulator = slices.Contains(enum.Values, "emulator")
+			}
+		}
+	} else {
+		// libvirt before 8.6 does not report TPM support, so look for
+		// swtpm on this host instead
+		_, err := exec.LookPath("swtpm")
+		hc.TPMEmulator = err == nil
+	}
+
+	m.caps = &hc
+	return hc, nil
+}
+
+func appendUnique(values []string, v string) []string {
+	if slices.Contains(values, v) {
+		return values
+	}
+	return append(values, v)
+}
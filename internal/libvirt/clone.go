@@ -0,0 +1,224 @@
+package libvirt
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"libvirt-controller/internal/filesystem"
+	"libvirt-controller/internal/helpers"
+	"libvirt-controller/internal/state"
+)
+
+// cloneUserData resets what makes a guest unique on the first boot of a
+// clone. cloud-init deletes and regenerates the SSH host keys and sets the
+// hostname since the clone has a new instance id; the machine-id is reset
+// once per instance before systemd services that use it start.
+const cloneUserData = `#cloud-config
+ssh_deletekeys: true
+bootcmd:
+  - [cloud-init-per, instance, reset-machine-id, sh, -c, "rm -f /etc/machine-id /var/lib/dbus/machine-id && systemd-machine-id-setup"]
+`
+
+// CloneOptions controls how CloneVM copies a domain.
+type CloneOptions struct {
+	Dir      string // Directory the disk images, NVRAM and seed of the clone are written to
+	Hostname string // Hostname of the clone, its domain name when empty
+
+	// Linked creates qcow2 overlays on top of the source disks instead of
+	// copying them. The source disks must not change afterwards, so the
+	// source VM must not be started again while the clone exists.
+	Linked bool
+}
+
+// CloneVM defines dst as a copy of the shut off domain src. The disks are
+// copied with a reflink where the filesystem supports it, and the clone
+// gets a new UUID, new MAC addresses and a new cloud-init seed, replacing
+// the one of src. Booting the seed resets the machine-id, hostname and SSH
+// host keys of the guest, which therefore needs cloud-init; the network
+// configuration of src is not carried over, so the clone falls back to
+// DHCP. Nothing is left behind when the clone fails.
+func (m *DomainManager) CloneVM(src, dst string, opts CloneOptions) (rec state.VMRecord, err error) {
+	if !filepath.IsAbs(opts.Dir) {
+		return state.VMRecord{}, fmt.Errorf("clone directory %q must be absolute", opts.Dir)
+	}
+	hostname := opts.Hostname
+	if hostname == "" {
+		hostname = dst
+	}
+	if err := (helpers.CloudInitConfig{Hostname: hostname}).Validate(); err != nil {
+		return state.VMRecord{}, fmt.Errorf("cannot clone domain %s: %w", src, err)
+	}
+	st, err := m.GetState(src)
+	if err != nil {
+		return state.VMRecord{}, err
+	}
+	if st != StateShutoff {
+		return state.VMRecord{}, fmt.Errorf("cannot clone domain %s: it is %s: %w", src, st, ErrDomainRunning)
+	}
+	if err := m.CheckNameAvailable(dst); err != nil {
+		return state.VMRecord{}, err
+	}
+	desc, err := m.GetXML(src)
+	if err != nil {
+		return state.VMRecord{}, err
+	}
+	spec, err := ParseDomainXML(desc)
+	if err != nil {
+		return state.VMRecord{}, fmt.Errorf("cannot clone domain %s: %w", src, err)
+	}
+	dom, err := m.lookup(src)
+	if err != nil {
+		return state.VMRecord{}, err
+	}
+	domain, err := m.domainXML(dom)
+	if err != nil {
+		return state.VMRecord{}, err
+	}
+	// Disks ParseDomainXML kept verbatim would be shared with src
+	for _, disk := range domain.Devices.Disks {
+		if disk.Source.File != "" && !slices.ContainsFunc(spec.Disks, func(d DiskSpec) bool { return d.Target == disk.Target.Dev }) {
+			return state.VMRecord{}, fmt.Errorf("cannot clone domain %s: disk %s has settings that cannot be cloned", src, disk.Target.Dev)
+		}
+	}
+
+	if err := os.MkdirAll(opts.Dir, filesystem.DirPerm); err != nil {
+		return state.VMRecord{}, fmt.Errorf("failed to create directory %s: %w", opts.Dir, err)
+	}
+	var created []string
+	defer func() {
+		if err != nil {
+			for _, p := range created {
+				os.Remove(p)
+			}
+		}
+	}()
+	claim := func(path string) error {
+		if pathExists(path) {
+			return fmt.Errorf("cannot clone domain %s: %s %w", src, path, ErrAlreadyExists)
+		}
+		created = append(created, path)
+		return nil
+	}
+
+	spec.Name = dst
+	spec.UUID = newUUID()
+	for i := range spec.NICs {
+		spec.NICs[i].MAC = GenerateMAC("")
+	}
+
+	// The seed of src is replaced, other cdroms such as installer media
+	// are shared
+	ds := helpers.DatasourceNoCloud
+	seedTarget := ""
+	disks := spec.Disks[:0]
+	for _, disk := range spec.Disks {
+		if disk.Device == "cdrom" {
+			switch filepath.Base(disk.Source) {
+			case helpers.ConfigDriveISOName:
+				ds = helpers.DatasourceConfigDrive
+				fallthrough
+			case helpers.SeedISOName:
+				seedTarget = disk.Target
+				continue
+			}
+			disks = append(disks, disk)
+			continue
+		}
+		path := filepath.Join(opts.Dir, disk.Target+".qcow2")
+		if err := claim(path); err != nil {
+			return state.VMRecord{}, err
+		}
+		if opts.Linked {
+			err = helpers.CreateOverlay(disk.Source, path, 0)
+			disk.Format = filesystem.FormatQcow2
+		} else {
+			_, err = filesystem.CopyFileReflink(disk.Source, path, 0600)
+		}
+		if err != nil {
+			return state.VMRecord{}, fmt.Errorf("failed to copy disk %s of domain %s: %w", disk.Target, src, err)
+		}
+		disk.Source = path
+		disks = append(disks, disk)
+	}
+	spec.Disks = disks
+
+	if fw := spec.Firmware; fw != nil && fw.NVRAM != "" {
+		path := filepath.Join(opts.Dir, nvramName)
+		if pathExists(fw.NVRAM) {
+			if err := claim(path); err != nil {
+				return state.VMRecord{}, err
+			}
+			if err := filesystem.CopyFile(fw.NVRAM, path, 0600); err != nil {
+				return state.VMRecord{}, fmt.Errorf("failed to copy nvram of domain %s: %w", src, err)
+			}
+		}
+		fw.NVRAM = path
+	}
+
+	seed, err := buildCloneSeed(opts.Dir, ds, spec.UUID, hostname, claim)
+	if err != nil {
+		return state.VMRecord{}, err
+	}
+	if seedTarget == "" {
+		seedTarget = freeCdromTarget(spec.Disks)
+	}
+	spec.Disks = append(spec.Disks, DiskSpec{Source: seed, Target: seedTarget, Device: "cdrom"})
+
+	spec.managed = true
+	domXML, err := BuildDomainXML(spec)
+	if err != nil {
+		return state.VMRecord{}, fmt.Errorf("cannot clone domain %s: %w", src, err)
+	}
+	if rec, err = defineRecorded(m.conn, m.Records, spec, domXML); err != nil {
+		return state.VMRecord{}, err
+	}
+	return rec, nil
+}
+
+// buildCloneSeed writes the cloud-init seed that gives a clone its own
+// identity. Every file it writes is passed to claim first.
+func buildCloneSeed(dir string, ds helpers.Datasource, instanceID, hostname string, claim func(string) error) (string, error) {
+	names := []string{"user-data", "meta-data", helpers.SeedISOName}
+	if ds == helpers.DatasourceConfigDrive {
+		names = []string{helpers.ConfigDriveISOName}
+	}
+	for _, name := range names {
+		if err := claim(filepath.Join(dir, name)); err != nil {
+			return "", err
+		}
+	}
+
+	if ds == helpers.DatasourceConfigDrive {
+		meta, err := json.Marshal(map[string]string{"uuid": instanceID, "hostname": hostname})
+		if err != nil {
+			return "", err
+		}
+		return helpers.BuildConfigDrive(dir, meta, []byte(cloneUserData), nil)
+	}
+	meta := fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", instanceID, hostname)
+	return helpers.BuildSeedISO(dir, []byte(cloneUserData), []byte(meta), nil)
+}
+
+// freeCdromTarget returns the first sdX target no disk uses.
+func freeCdromTarget(disks []DiskSpec) string {
+	for c := 'a'; c <= 'z'; c++ {
+		target := "sd" + string(c)
+		if !slices.ContainsFunc(disks, func(d DiskSpec) bool { return d.Target == target }) {
+			return target
+		}
+	}
+	return "sdz"
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() string {
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
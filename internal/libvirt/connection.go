@@ -2,7 +2,7 @@ package libvirt
 
 import (
 	"log"
-	"net"
+	"net/url"
 	"sync"
 
 	"github.com/digitalocean/go-libvirt"
@@ -14,17 +14,19 @@ var (
 	err  error
 )
 
-// GetConnection ensures only one connection is established
+// GetConnection ensures only one connection is established to the libvirt
+// URI configured in LIBVIRT_URI. Use ConnPool for a connection that survives
+// libvirtd restarts.
 func GetConnection() (*libvirt.Libvirt, error) {
 	once.Do(func() {
-		// Open a UNIX socket to libvirt
-		socket, err := net.Dial("unix", "/var/run/libvirt/libvirt-sock")
+		var uri *url.URL
+		uri, err = url.Parse(URIFromEnv())
 		if err != nil {
-			log.Fatalf("Failed to connect to libvirt socket: %v", err)
+			log.Fatalf("Invalid libvirt URI: %v", err)
 		}
 
-		conn = libvirt.New(socket)
-		if err := conn.Connect(); err != nil {
+		conn, err = libvirt.ConnectToURI(uri)
+		if err != nil {
 			log.Fatalf("Failed to establish libvirt connection: %v", err)
 		}
 	})
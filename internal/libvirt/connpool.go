@@ -0,0 +1,184 @@
+package libvirt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// DefaultURI is the libvirt URI used when none is configured.
+const DefaultURI = "qemu:///system"
+
+// Reconnect defaults used by ConnPool when its fields are zero.
+const (
+	DefaultReconnectAttempts = 5
+	DefaultReconnectDelay    = 500 * time.Millisecond
+	DefaultMaxReconnectDelay = 15 * time.Second
+)
+
+// ErrPoolClosed is returned by ConnPool.With after the pool was closed.
+var ErrPoolClosed = errors.New("libvirt connection pool is closed")
+
+// ConnPool hands out a libvirt connection and transparently reconnects when
+// libvirtd goes away, e.g. during an upgrade. A go-libvirt connection
+// multiplexes concurrent calls, so the pool keeps a single connection.
+type ConnPool struct {
+	uri *url.URL
+
+	// ReconnectAttempts is how often a connection is tried before giving up,
+	// DefaultReconnectAttempts is used when it is zero.
+	ReconnectAttempts int
+	// ReconnectDelay is the delay before the second attempt, it doubles on
+	// every further attempt up to MaxReconnectDelay.
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+
+	mu     sync.Mutex
+	conn   *libvirt.Libvirt
+	closed bool
+}
+
+// URIFromEnv returns the libvirt URI from LIBVIRT_URI, or DefaultURI.
+func URIFromEnv() string {
+	if uri := os.Getenv("LIBVIRT_URI"); uri != "" {
+		return uri
+	}
+	return DefaultURI
+}
+
+// NewConnPool creates a ConnPool for a libvirt URI such as "qemu:///system"
+// or "qemu+tls://host/system". No connection is made until it is first used.
+func NewConnPool(uri string) (*ConnPool, error) {
+	if uri == "" {
+		uri = DefaultURI
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid libvirt URI %q: %w", uri, err)
+	}
+	return &ConnPool{uri: u}, nil
+}
+
+// With runs fn with a live connection, reconnecting first if the previous
+// connection was lost. fn is not retried when the connection drops while it
+// runs since the call may already have taken effect.
+func (p *ConnPool) With(ctx context.Context, fn func(*libvirt.Libvirt) error) error {
+	conn, err := p.Get(ctx)
+	if err != nil {
+		return err
+	}
+	err = fn(conn)
+	if err != nil && (errors.Is(err, libvirt.ErrInterrupted) || !conn.IsConnected()) {
+		p.invalidate(conn)
+	}
+	return err
+}
+
+// Get returns a live connection, reconnecting with backoff if needed. The
+// pool is not locked while waiting between attempts, and waiting stops when
+// ctx is cancelled.
+func (p *ConnPool) Get(ctx context.Context) (*libvirt.Libvirt, error) {
+	attempts := p.ReconnectAttempts
+	if attempts <= 0 {
+		attempts = DefaultReconnectAttempts
+	}
+	var errs []error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(p.backoff(attempt))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, fmt.Errorf("gave up connecting to %s after %d attempts: %w", p.uri.Redacted(), attempt, errors.Join(append([]error{ctx.Err()}, errs...)...))
+			case <-timer.C:
+			}
+		}
+		conn, err := p.connect()
+		if err == nil {
+			return conn, nil
+		}
+		if errors.Is(err, ErrPoolClosed) {
+			return nil, err
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("failed to connect to %s after %d attempts: %w", p.uri.Redacted(), attempts, errors.Join(errs...))
+}
+
+// connect returns the pooled connection, dialing a new one if it was lost.
+// Dialing holds the lock, so concurrent callers share one connection.
+func (p *ConnPool) connect() (*libvirt.Libvirt, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+	if p.conn != nil && p.conn.IsConnected() {
+		return p.conn, nil
+	}
+	p.conn = nil
+
+	conn, err := libvirt.ConnectToURI(p.uri)
+	if err != nil {
+		return nil, err
+	}
+	p.conn = conn
+	return conn, nil
+}
+
+// Close disconnects the pooled connection. Later calls to With fail with
+// ErrPoolClosed.
+func (p *ConnPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	if p.conn == nil {
+		return nil
+	}
+	conn := p.conn
+	p.conn = nil
+	if !conn.IsConnected() {
+		return nil
+	}
+	return conn.Disconnect()
+}
+
+// invalidate drops conn so the next call reconnects, unless it was already
+// replaced by another caller.
+func (p *ConnPool) invalidate(conn *libvirt.Libvirt) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == conn {
+		p.conn = nil
+		conn.Disconnect()
+	}
+}
+
+// backoff returns the delay before the given reconnect attempt, with jitter so
+// several controllers don't hammer a restarting libvirtd in lockstep.
+func (p *ConnPool) backoff(attempt int) time.Duration {
+	delay, maxDelay := p.ReconnectDelay, p.MaxReconnectDelay
+	if delay <= 0 {
+		delay = DefaultReconnectDelay
+	}
+	if maxDelay <= 0 {
+		maxDelay = DefaultMaxReconnectDelay
+	}
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,62 @@
+package libvirt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConnPoolGetStopsWaitingOnCancel(t *testing.T) {
+	// Nothing listens on port 1, so every attempt fails right away
+	pool, err := NewConnPool("qemu+tcp://127.0.0.1:1/system")
+	if err != nil {
+		t.Fatalf("error creating pool. Err: %v", err)
+	}
+	pool.ReconnectDelay = time.Hour
+	pool.MaxReconnectDelay = time.Hour
+
+	get := func(ctx context.Context) <-chan error {
+		errc := make(chan error, 1)
+		go func() {
+			_, err := pool.Get(ctx)
+			errc <- err
+		}()
+		return errc
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := get(ctx)
+	time.Sleep(100 * time.Millisecond) // Let the first attempt fail
+	cancel()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled; got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Get to return once ctx is cancelled")
+	}
+
+	// The pool is not locked while Get waits for the next attempt
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	errc = get(ctx)
+	time.Sleep(100 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		pool.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Close not to wait for the reconnect backoff")
+	}
+	cancel()
+	<-errc
+
+	if _, err := pool.Get(context.Background()); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("expected ErrPoolClosed after Close; got %v", err)
+	}
+}
@@ -0,0 +1,291 @@
+package libvirt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/digitalocean/go-libvirt/socket"
+	"github.com/digitalocean/go-libvirt/socket/dialers"
+)
+
+// ErrConsoleBusy is returned by Console when another session already holds
+// the domain console.
+var ErrConsoleBusy = errors.New("console is already in use")
+
+// consoleOpenWait is how long Console waits for libvirt to reject the stream
+// before treating it as open.
+const consoleOpenWait = time.Second
+
+// maxConsoleBuffer is how much console output is kept until it is read.
+// Older output is dropped when the reader falls behind.
+const maxConsoleBuffer = 1 << 20
+
+// maxConsoleChunk bounds the stream packets console input is sent in, well
+// below the payload limit of libvirt's RPC protocol.
+const maxConsoleChunk = 64 << 10
+
+// Header fields of the libvirt RPC packets a console session sends itself.
+const (
+	remoteProgram         = 0x20008086
+	remoteProtocolVersion = 1
+	procOpenConsole       = 201
+	packetHeaderSize      = 28
+)
+
+// console is a duplex handle on a domain console. It has a connection of
+// its own, so output that is not read yet cannot hold up other calls and
+// closing the session ends the stream on the server. Output is received
+// over the stream by go-libvirt; input is sent over the same stream as
+// packets of the DomainOpenConsole call, which go-libvirt has no API for.
+type console struct {
+	conn *libvirt.Libvirt
+	raw  *consoleConn
+	out  *consoleBuffer
+	done chan struct{}
+	once sync.Once
+}
+
+// Console attaches to the serial console of a running domain. The session
+// uses a connection of its own, dialed with ConsoleDialer. Closing the
+// returned handle aborts the libvirt stream and releases the console.
+func (m *DomainManager) Console(name string) (io.ReadWriteCloser, error) {
+	dom, err := m.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	state, err := m.GetState(name)
+	if err != nil {
+		return nil, err
+	}
+	if state != StateRunning && state != StatePaused {
+		return nil, fmt.Errorf("cannot open console of domain %s: domain is %s", name, state)
+	}
+
+	d := m.ConsoleDialer
+	if d == nil {
+		if d, err = localDialer(URIFromEnv()); err != nil {
+			return nil, fmt.Errorf("cannot open console of domain %s: %w", name, err)
+		}
+	}
+	raw := &consoleConn{}
+	conn := libvirt.NewWithDialer(dialerFunc(func() (net.Conn, error) {
+		c, err := d.Dial()
+		raw.Conn = c
+		return raw, err
+	}))
+	if err := conn.Connect(); err != nil {
+		return nil, fmt.Errorf("failed to connect for console of domain %s: %w", name, err)
+	}
+
+	c := &console{conn: conn, raw: raw, out: newConsoleBuffer(), done: make(chan struct{})}
+	errc := make(chan error, 1)
+	go func() {
+		defer close(c.done)
+		err := conn.DomainOpenConsole(dom, nil, c.out, uint32(libvirt.DomainConsoleSafe))
+		if err == nil {
+			err = io.EOF
+		}
+		c.out.closeWithError(err)
+		errc <- err
+	}()
+
+	// libvirt rejects the stream right away when the console is busy
+	select {
+	case err := <-errc:
+		conn.Disconnect()
+		if isLibvirtError(err, libvirt.ErrOperationInvalid) {
+			return nil, fmt.Errorf("cannot open console of domain %s: %w", name, ErrConsoleBusy)
+		}
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("console of domain %s closed immediately", name)
+		}
+		return nil, fmt.Errorf("failed to open console of domain %s: %w", name, err)
+	case <-time.After(consoleOpenWait):
+	}
+	return c, nil
+}
+
+// localDialer returns a dialer for uri, which must name the local libvirtd.
+func localDialer(uri string) (socket.Dialer, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid libvirt URI %q: %w", uri, err)
+	}
+	if u.Host != "" {
+		return nil, fmt.Errorf("libvirt URI %q is remote, set ConsoleDialer", uri)
+	}
+	var opts []dialers.LocalOption
+	if s := u.Query().Get("socket"); s != "" {
+		opts = append(opts, dialers.WithSocket(s))
+	}
+	return dialers.NewLocal(opts...), nil
+}
+
+// dialerFunc adapts a function to socket.Dialer.
+type dialerFunc func() (net.Conn, error)
+
+func (f dialerFunc) Dial() (net.Conn, error) { return f() }
+
+func (c *console) Read(p []byte) (int, error) {
+	return c.out.Read(p)
+}
+
+// Write sends p to the console over the libvirt stream.
+func (c *console) Write(p []byte) (int, error) {
+	serial, ok := c.raw.consoleSerial()
+	if !ok {
+		return 0, errors.New("console stream is not open")
+	}
+	select {
+	case <-c.done:
+		return 0, errors.New("console stream is closed")
+	default:
+	}
+	var n int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxConsoleChunk)]
+		if err := c.raw.sendStream(serial, socket.StatusContinue, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// Close aborts the libvirt stream, so libvirt releases the console right
+// away, and closes the connection of the session.
+func (c *console) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.out.closeWithError(io.ErrClosedPipe)
+		if serial, ok := c.raw.consoleSerial(); ok {
+			select {
+			case <-c.done:
+			default:
+				err = c.raw.sendStream(serial, socket.StatusError, nil)
+			}
+		}
+		err = errors.Join(err, c.conn.Disconnect())
+		<-c.done
+	})
+	return err
+}
+
+// consoleConn is the connection of a console session. It notes the serial of
+// the DomainOpenConsole call and lets the session write stream packets of
+// that call in between the packets go-libvirt writes.
+type consoleConn struct {
+	net.Conn
+
+	mu      sync.Mutex // Held while a whole packet is written
+	pending []byte     // Start of a packet go-libvirt has not finished writing
+	serial  int32
+	opened  bool
+}
+
+// Write passes on the packets go-libvirt writes once they are complete, so
+// they never interleave with stream packets of the session.
+func (c *consoleConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = append(c.pending, p...)
+	for len(c.pending) >= packetHeaderSize {
+		size := int(binary.BigEndian.Uint32(c.pending[0:4]))
+		if size < packetHeaderSize || len(c.pending) < size {
+			break
+		}
+		header := c.pending[:packetHeaderSize]
+		if binary.BigEndian.Uint32(header[12:16]) == procOpenConsole && binary.BigEndian.Uint32(header[16:20]) == socket.Call {
+			c.serial, c.opened = int32(binary.BigEndian.Uint32(header[20:24])), true
+		}
+		if _, err := c.Conn.Write(c.pending[:size]); err != nil {
+			return 0, err
+		}
+		c.pending = c.pending[size:]
+	}
+	return len(p), nil
+}
+
+// consoleSerial returns the serial of the DomainOpenConsole call.
+func (c *consoleConn) consoleSerial() (int32, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.serial, c.opened
+}
+
+// sendStream writes one stream packet of the DomainOpenConsole call.
+func (c *consoleConn) sendStream(serial int32, status uint32, payload []byte) error {
+	var b bytes.Buffer
+	for _, v := range []uint32{uint32(packetHeaderSize + len(payload)), remoteProgram, remoteProtocolVersion, procOpenConsole, socket.Stream, uint32(serial), status} {
+		binary.Write(&b, binary.BigEndian, v)
+	}
+	b.Write(payload)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.Conn.Write(b.Bytes())
+	return err
+}
+
+// consoleBuffer holds console output until it is read, so receiving the
+// stream never waits for the reader.
+type consoleBuffer struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	err  error
+}
+
+func newConsoleBuffer() *consoleBuffer {
+	b := &consoleBuffer{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// Write keeps p, dropping the oldest output beyond maxConsoleBuffer. It
+// fails once the buffer is closed, which makes go-libvirt stop the stream.
+func (b *consoleBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return 0, b.err
+	}
+	b.buf.Write(p)
+	if over := b.buf.Len() - maxConsoleBuffer; over > 0 {
+		b.buf.Next(over)
+	}
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+// Read returns buffered output, waiting for more while there is none. The
+// output still buffered when the stream ends is read before its error.
+func (b *consoleBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.buf.Len() == 0 && b.err == nil {
+		b.cond.Wait()
+	}
+	if b.buf.Len() > 0 {
+		return b.buf.Read(p)
+	}
+	return 0, b.err
+}
+
+// closeWithError ends the output with err, keeping the first error.
+func (b *consoleBuffer) closeWithError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.cond.Broadcast()
+}
@@ -0,0 +1,91 @@
+package libvirt
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+func TestConsole(t *testing.T) {
+	f, conn := newFakeLibvirt(t)
+	f.define(`<domain type='kvm'><name>vm-1</name><memory>524288</memory><vcpu>1</vcpu></domain>`, true)
+
+	// The fake console holds the domain console until the stream is aborted
+	var mu sync.Mutex
+	busy := false
+	input := make(chan string, 10)
+	aborted := make(chan struct{}, 10)
+	f.handlers[procDomainOpenConsole] = func(c *fakeConn, serial int32, args *xdrReader, ret *xdrWriter) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if busy {
+			return fakeError{code: libvirt.ErrOperationInvalid, msg: "Operation not supported: Active console session exists for this domain"}
+		}
+		busy = true
+		c.send(procDomainOpenConsole, rpcReply, serial, rpcStatusOK, nil)
+		c.send(procDomainOpenConsole, rpcStream, serial, rpcContinue, []byte("login: "))
+		return errNoReply
+	}
+	f.streams = func(c *fakeConn, serial int32, status uint32, payload []byte) {
+		switch status {
+		case rpcContinue:
+			input <- string(payload)
+		case rpcStatusError:
+			mu.Lock()
+			busy = false
+			mu.Unlock()
+			aborted <- struct{}{}
+		}
+	}
+
+	m := NewDomainManager(conn)
+	m.ConsoleDialer = f
+	console, err := m.Console("vm-1")
+	if err != nil {
+		t.Fatalf("error opening console. Err: %v", err)
+	}
+	out := make([]byte, len("login: "))
+	if _, err := io.ReadFull(console, out); err != nil {
+		t.Fatalf("error reading console. Err: %v", err)
+	}
+	if string(out) != "login: " {
+		t.Errorf("expected output %q; got %q", "login: ", out)
+	}
+	if _, err := console.Write([]byte("root\n")); err != nil {
+		t.Fatalf("error writing console. Err: %v", err)
+	}
+	select {
+	case got := <-input:
+		if got != "root\n" {
+			t.Errorf("expected input %q over the stream; got %q", "root\n", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected input over the stream; got none")
+	}
+
+	if _, err := m.Console("vm-1"); !errors.Is(err, ErrConsoleBusy) {
+		t.Errorf("expected ErrConsoleBusy while the console is open; got %v", err)
+	}
+
+	if err := console.Close(); err != nil {
+		t.Fatalf("error closing console. Err: %v", err)
+	}
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Close to abort the stream")
+	}
+	if _, err := console.Read(out); err == nil {
+		t.Error("expected reading a closed console to fail")
+	}
+
+	console, err = m.Console("vm-1")
+	if err != nil {
+		t.Fatalf("error reopening console after Close. Err: %v", err)
+	}
+	console.Close()
+}
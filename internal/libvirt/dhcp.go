@@ -0,0 +1,213 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// ErrNoLease is returned by FindIPByMAC when the network has no lease for the MAC.
+var ErrNoLease = errors.New("no DHCP lease found")
+
+// Lease is a DHCP lease handed out by a libvirt network.
+type Lease struct {
+	MAC       string    `json:"mac"`
+	IP        string    `json:"ip"`
+	Prefix    uint32    `json:"prefix"`
+	Hostname  string    `json:"hostname,omitempty"`
+	Interface string    `json:"interface"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// GetDHCPLeases returns the current DHCP leases of a network.
+func (m *NetworkManager) GetDHCPLeases(network string) ([]Lease, error) {
+	nw, err := m.conn.NetworkLookupByName(network)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up network %s: %w", network, err)
+	}
+	raw, _, err := m.conn.NetworkGetDhcpLeases(nw, nil, 1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get DHCP leases of network %s: %w", network, err)
+	}
+
+	leases := make([]Lease, 0, len(raw))
+	for _, l := range raw {
+		lease := Lease{
+			IP:        l.Ipaddr,
+			Prefix:    l.Prefix,
+			Interface: l.Iface,
+			ExpiresAt: time.Unix(l.Expirytime, 0),
+		}
+		if len(l.Mac) > 0 {
+			lease.MAC = strings.ToLower(l.Mac[0])
+		}
+		if len(l.Hostname) > 0 {
+			lease.Hostname = l.Hostname[0]
+		}
+		leases = append(leases, lease)
+	}
+	return leases, nil
+}
+
+// FindIPByMAC returns the IP address leased to mac in a network. When the MAC
+// holds several leases, e.g. after the guest was rebuilt, the most recent one
+// wins.
+func (m *NetworkManager) FindIPByMAC(network, mac string) (string, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", fmt.Errorf("invalid MAC address %q: %w", mac, err)
+	}
+	leases, err := m.GetDHCPLeases(network)
+	if err != nil {
+		return "", err
+	}
+
+	var latest *Lease
+	for i, lease := range leases {
+		if lease.MAC != hw.String() {
+			continue
+		}
+		if latest == nil || lease.ExpiresAt.After(latest.ExpiresAt) {
+			latest = &leases[i]
+		}
+	}
+	if latest == nil {
+		return "", fmt.Errorf("cannot find IP of %s in network %s: %w", mac, network, ErrNoLease)
+	}
+	return latest.IP, nil
+}
+
+// AddDHCPHost binds mac to ip in the DHCP server of a network, so a domain
+// with that MAC always gets the same address. The change is applied to the
+// running network and persisted. The ip must be a host address of the network
+// that is neither reserved nor leased to another MAC.
+func (m *NetworkManager) AddDHCPHost(network, mac, ip, hostname string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return fmt.Errorf("invalid MAC address %q: %w", mac, err)
+	}
+	mac = hw.String()
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return fmt.Errorf("invalid IP address %q: %w", ip, err)
+	}
+
+	nw, parsed, err := m.lookupNetwork(network)
+	if err != nil {
+		return err
+	}
+	ipDef, prefix, ok := networkIPv4(parsed)
+	if !ok {
+		return fmt.Errorf("network %s has no IPv4 address", network)
+	}
+	if err := checkHostAddress(prefix, ipDef.Address, addr); err != nil {
+		return fmt.Errorf("cannot assign %s in network %s: %w", addr, network, err)
+	}
+
+	command := libvirt.NetworkUpdateCommandAddLast
+	if ipDef.DHCP != nil {
+		for _, host := range ipDef.DHCP.Hosts {
+			hostMAC := strings.ToLower(host.MAC)
+			switch {
+			case hostMAC == mac && host.IP == addr.String() && host.Name == hostname:
+				return nil
+			case hostMAC == mac:
+				command = libvirt.NetworkUpdateCommandModify
+			case host.IP == addr.String():
+				return fmt.Errorf("cannot assign %s in network %s: already assigned to %s", addr, network, host.MAC)
+			}
+		}
+	}
+
+	leases, _, err := m.conn.NetworkGetDhcpLeases(nw, nil, 1, 0)
+	if err != nil {
+		return fmt.Errorf("failed to get DHCP leases of network %s: %w", network, err)
+	}
+	for _, lease := range leases {
+		if lease.Ipaddr == addr.String() && len(lease.Mac) > 0 && strings.ToLower(lease.Mac[0]) != mac {
+			return fmt.Errorf("cannot assign %s in network %s: leased to %s", addr, network, lease.Mac[0])
+		}
+	}
+
+	host := dhcpHostXML{MAC: mac, Name: hostname, IP: addr.String()}
+	if err := m.updateDHCPHost(nw, command, host); err != nil {
+		return fmt.Errorf("failed to add DHCP host %s to network %s: %w", mac, network, err)
+	}
+	return nil
+}
+
+// RemoveDHCPHost removes the static DHCP entry of mac from a network.
+// Removing an entry that does not exist is not an error.
+func (m *NetworkManager) RemoveDHCPHost(network, mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return fmt.Errorf("invalid MAC address %q: %w", mac, err)
+	}
+	mac = hw.String()
+
+	nw, parsed, err := m.lookupNetwork(network)
+	if err != nil {
+		return err
+	}
+	ipDef, _, ok := networkIPv4(parsed)
+	if !ok || ipDef.DHCP == nil {
+		return nil
+	}
+	for _, host := range ipDef.DHCP.Hosts {
+		if strings.ToLower(host.MAC) != mac {
+			continue
+		}
+		if err := m.updateDHCPHost(nw, libvirt.NetworkUpdateCommandDelete, host); err != nil {
+			return fmt.Errorf("failed to remove DHCP host %s from network %s: %w", mac, network, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// updateDHCPHost applies a DHCP host change to the persistent definition of
+// the network and, when it is running, to the live network.
+func (m *NetworkManager) updateDHCPHost(nw libvirt.Network, command libvirt.NetworkUpdateCommand, host dhcpHostXML) error {
+	out, err := xml.Marshal(host)
+	if err != nil {
+		return fmt.Errorf("failed to build DHCP host XML: %w", err)
+	}
+	active, err := m.conn.NetworkIsActive(nw)
+	if err != nil {
+		return fmt.Errorf("failed to get state of network %s: %w", nw.Name, err)
+	}
+	flags := libvirt.NetworkUpdateAffectConfig
+	if active == 1 {
+		flags |= libvirt.NetworkUpdateAffectLive
+	}
+	return m.conn.NetworkUpdateCompat(nw, command, libvirt.NetworkSectionIPDhcpHost, -1, string(out), flags)
+}
+
+// lookupNetwork finds a network by name and parses its XML.
+func (m *NetworkManager) lookupNetwork(name string) (libvirt.Network, networkXML, error) {
+	nw, err := m.conn.NetworkLookupByName(name)
+	if err != nil {
+		return libvirt.Network{}, networkXML{}, fmt.Errorf("failed to look up network %s: %w", name, err)
+	}
+	parsed, err := m.networkXML(nw)
+	return nw, parsed, err
+}
+
+// checkHostAddress checks that addr is a usable host address of prefix, i.e.
+// not the network, broadcast or gateway address.
+func checkHostAddress(prefix netip.Prefix, gateway string, addr netip.Addr) error {
+	prefix = prefix.Masked()
+	if !prefix.Contains(addr) {
+		return fmt.Errorf("address is outside of %s", prefix)
+	}
+	if addr == prefix.Addr() || addr.String() == gateway || !prefix.Contains(addr.Next()) {
+		return fmt.Errorf("address is reserved")
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package libvirt
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+
+	"libvirt-controller/internal/helpers"
+)
+
+// ErrDiskShrink is returned by ResizeDisk when the new size is smaller than
+// the current one. Shrinking a qcow2 image can destroy guest data.
+var ErrDiskShrink = errors.New("shrinking a disk is not supported")
+
+// ErrDetachTimeout is returned when libvirt accepted a live detach but the
+// guest did not release the device in time. Unplugging needs the guest to
+// cooperate, e.g. the device may still be mounted.
+var ErrDetachTimeout = errors.New("guest did not release the device")
+
+// detachTimeout is how long a live detach waits for the guest to release the device.
+const detachTimeout = 30 * time.Second
+
+// hotplugBuses are the disk buses qemu can hot plug.
+var hotplugBuses = map[string]bool{"virtio": true, "scsi": true, "usb": true}
+
+// AttachDisk adds a disk to the domain. The disk is always added to the
+// persistent config, with live set it is also plugged into the running
+// domain.
+func (m *DomainManager) AttachDisk(name string, disk DiskSpec, live bool) error {
+	if err := disk.Validate(); err != nil {
+		return fmt.Errorf("invalid disk: %w", err)
+	}
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	domain, err := m.domainXML(dom)
+	if err != nil {
+		return err
+	}
+	for _, existing := range domain.Devices.Disks {
+		if existing.Target.Dev == disk.Target {
+			return fmt.Errorf("cannot attach disk to domain %s: target %s is already in use", name, disk.Target)
+		}
+	}
+
+	d := buildDiskXML(disk)
+	if live && !hotplugBuses[d.Target.Bus] {
+		return fmt.Errorf("cannot attach disk to domain %s live: bus %s does not support hotplug", name, d.Target.Bus)
+	}
+	out, err := xml.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("failed to build disk XML: %w", err)
+	}
+	if err := m.conn.DomainAttachDeviceFlags(dom, string(out), deviceFlags(live)); err != nil {
+		return fmt.Errorf("failed to attach disk %s to domain %s: %w", disk.Target, name, err)
+	}
+	return nil
+}
+
+// DetachDisk removes the disk with the given target from the domain's
+// persistent config and, with live set, from the running domain. A live
+// detach waits until the guest has released the disk and fails with
+// ErrDetachTimeout if it does not, or with ctx.Err() once ctx is cancelled.
+func (m *DomainManager) DetachDisk(ctx context.Context, name, targetDev string, live bool) error {
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	domain, err := m.domainXML(dom)
+	if err != nil {
+		return err
+	}
+	var found *diskXML
+	for i, disk := range domain.Devices.Disks {
+		if disk.Target.Dev == targetDev {
+			found = &domain.Devices.Disks[i]
+			break
+		}
+	}
+	if found == nil {
+		return fmt.Errorf("cannot detach disk from domain %s: disk %s not found", name, targetDev)
+	}
+
+	out, err := xml.Marshal(found)
+	if err != nil {
+		return fmt.Errorf("failed to build disk XML: %w", err)
+	}
+	if err := m.conn.DomainDetachDeviceFlags(dom, string(out), deviceFlags(live)); err != nil {
+		return fmt.Errorf("failed to detach disk %s from domain %s: %w", targetDev, name, err)
+	}
+	if !live {
+		return nil
+	}
+	return m.waitForDetach(ctx, dom, func(domain domainXML) bool {
+		for _, disk := range domain.Devices.Disks {
+			if disk.Target.Dev == targetDev {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// waitForDetach polls the live XML of the domain until gone reports the
+// device has been removed.
+func (m *DomainManager) waitForDetach(ctx context.Context, dom libvirt.Domain, gone func(domainXML) bool) error {
+	ok, err := m.waitFor(ctx, detachTimeout, func() (bool, error) {
+		domain, err := m.domainXML(dom)
+		if err != nil {
+			return false, err
+		}
+		return gone(domain), nil
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("failed to detach device from domain %s: %w", dom.Name, ErrDetachTimeout)
+	}
+	return nil
+}
+
+// deviceFlags returns the flags to change a device in the persistent config
+// and, with live set, in the running domain.
+func deviceFlags(live bool) uint32 {
+	flags := libvirt.DomainDeviceModifyConfig
+	if live {
+		flags |= libvirt.DomainDeviceModifyLive
+	}
+	return uint32(flags)
+}
+
+// affectFlags returns the flags to change a setting in the persistent config
+// and, when the domain is running, in the running domain as well.
+func (m *DomainManager) affectFlags(dom libvirt.Domain) (uint32, error) {
+	active, err := m.conn.DomainIsActive(dom)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check if domain %s is running: %w", dom.Name, err)
+	}
+	flags := libvirt.DomainAffectConfig
+	if active == 1 {
+		flags |= libvirt.DomainAffectLive
+	}
+	return uint32(flags), nil
+}
+
+// ResizeDisk grows the disk attached to the domain as targetDev, e.g. "vda".
+// When online is set the running domain is resized through libvirt so the
+// guest sees the new capacity right away, otherwise the domain must be shut
+// off and the image is resized with qemu-img.
+//
+// Only the block device grows. The guest still has to grow its partition and
+// filesystem, e.g. with growpart and resize2fs run through QemuAgentExec.
+func (m *DomainManager) ResizeDisk(name, targetDev string, newSizeBytes uint64, online bool) error {
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	disk, err := m.findDisk(dom, targetDev)
+	if err != nil {
+		return fmt.Errorf("failed to resize disk %s of domain %s: %w", targetDev, name, err)
+	}
+
+	state, err := m.GetState(name)
+	if err != nil {
+		return err
+	}
+	running := state != StateShutoff && state != StateCrashed
+	if online && !running {
+		return fmt.Errorf("cannot resize disk %s of domain %s online: domain is %s", targetDev, name, state)
+	}
+	if !online && running {
+		return fmt.Errorf("cannot resize disk %s of domain %s offline: it is %s: %w", targetDev, name, state, ErrDomainRunning)
+	}
+
+	var current uint64
+	if online {
+		_, current, _, err = m.conn.DomainGetBlockInfo(dom, targetDev, 0)
+	} else {
+		var info helpers.ImageInfo
+		info, err = helpers.CachedImageInfo(disk.Source.File)
+		current = info.VirtualSize
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get size of disk %s of domain %s: %w", targetDev, name, err)
+	}
+	if newSizeBytes < current {
+		return fmt.Errorf("cannot resize disk %s of domain %s from %d to %d bytes: %w",
+			targetDev, name, current, newSizeBytes, ErrDiskShrink)
+	}
+	if newSizeBytes == current {
+		return nil
+	}
+
+	if !online {
+		return helpers.ResizeImage(disk.Source.File, newSizeBytes)
+	}
+	// qemu grows the image itself and notifies the guest
+	if err := m.conn.DomainBlockResize(dom, targetDev, newSizeBytes, libvirt.DomainBlockResizeBytes); err != nil {
+		return fmt.Errorf("failed to resize disk %s of domain %s: %w", targetDev, name, err)
+	}
+	return nil
+}
+
+// validateDisks checks the backing chain of every file backed disk of the
+// domain.
+func (m *DomainManager) validateDisks(dom libvirt.Domain) error {
+	domain, err := m.domainXML(dom)
+	if err != nil {
+		return err
+	}
+	for _, disk := range domain.Devices.Disks {
+		if disk.Source.File == "" {
+			continue
+		}
+		if err := helpers.ValidateBackingChain(disk.Source.File); err != nil {
+			return fmt.Errorf("disk %s: %w", disk.Target.Dev, err)
+		}
+	}
+	return nil
+}
+
+// domainXML fetches and parses the current XML definition of the domain.
+func (m *DomainManager) domainXML(dom libvirt.Domain) (domainXML, error) {
+	return fetchDomainXML(m.conn, dom)
+}
+
+// fetchDomainXML fetches and parses the current XML definition of a domain.
+func fetchDomainXML(conn *libvirt.Libvirt, dom libvirt.Domain) (domainXML, error) {
+	desc, err := conn.DomainGetXMLDesc(dom, 0)
+	if err != nil {
+		return domainXML{}, fmt.Errorf("failed to get XML of domain %s: %w", dom.Name, err)
+	}
+	var domain domainXML
+	if err := xml.Unmarshal([]byte(desc), &domain); err != nil {
+		return domainXML{}, fmt.Errorf("failed to parse XML of domain %s: %w", dom.Name, err)
+	}
+	return domain, nil
+}
+
+// findDisk returns the file backed disk of the domain with the given target.
+func (m *DomainManager) findDisk(dom libvirt.Domain, targetDev string) (diskXML, error) {
+	domain, err := m.domainXML(dom)
+	if err != nil {
+		return diskXML{}, err
+	}
+	for _, disk := range domain.Devices.Disks {
+		if disk.Target.Dev != targetDev {
+			continue
+		}
+		if disk.Source.File == "" {
+			return diskXML{}, fmt.Errorf("disk %s is not backed by a file", targetDev)
+		}
+		return disk, nil
+	}
+	return diskXML{}, fmt.Errorf("disk %s not found", targetDev)
+}
@@ -0,0 +1,533 @@
+package libvirt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/digitalocean/go-libvirt/socket"
+
+	"libvirt-controller/internal/logging"
+	"libvirt-controller/internal/state"
+)
+
+// DomainState is the readable state of a domain, using the same names as virsh.
+type DomainState string
+
+const (
+	StateNoState     DomainState = "no state"
+	StateRunning     DomainState = "running"
+	StateBlocked     DomainState = "idle"
+	StatePaused      DomainState = "paused"
+	StateShutdown    DomainState = "in shutdown"
+	StateShutoff     DomainState = "shut off"
+	StateCrashed     DomainState = "crashed"
+	StatePMSuspended DomainState = "pmsuspended"
+)
+
+// domainStates maps libvirt's numeric domain states to readable names.
+var domainStates = map[libvirt.DomainState]DomainState{
+	libvirt.DomainNostate:     StateNoState,
+	libvirt.DomainRunning:     StateRunning,
+	libvirt.DomainBlocked:     StateBlocked,
+	libvirt.DomainPaused:      StatePaused,
+	libvirt.DomainShutdown:    StateShutdown,
+	libvirt.DomainShutoff:     StateShutoff,
+	libvirt.DomainCrashed:     StateCrashed,
+	libvirt.DomainPmsuspended: StatePMSuspended,
+}
+
+// DefaultPollInterval is how often GracefulStop checks whether the domain has stopped.
+const DefaultPollInterval = 500 * time.Millisecond
+
+// minPollInterval prevents a misconfigured poll interval from busy-spinning.
+const minPollInterval = 50 * time.Millisecond
+
+// ErrForcedShutdown is returned by GracefulStop when the guest did not power
+// off in time and had to be destroyed.
+var ErrForcedShutdown = errors.New("domain did not shut down in time and was destroyed")
+
+// ErrBalloonUnresponsive is returned by SetMemory when libvirt accepted a live
+// memory change but the guest balloon driver did not act on it.
+var ErrBalloonUnresponsive = errors.New("guest balloon driver did not respond")
+
+// balloonTimeout is how long SetMemory waits for the guest balloon to move.
+const balloonTimeout = 10 * time.Second
+
+// DomainManager controls the lifecycle of domains over a libvirt connection.
+type DomainManager struct {
+	conn *libvirt.Libvirt
+
+	// PollInterval is how often state is polled while waiting for a domain,
+	// DefaultPollInterval is used when it is zero.
+	PollInterval time.Duration
+
+	// Logger receives errors from cleanup work that cannot be returned,
+	// nothing is logged when it is nil.
+	Logger logging.Logger
+
+	// Observer is told about every start, shutdown, stop, destroy, reboot,
+	// delete and migration. It may be nil.
+	Observer OperationObserver
+
+	// CheckBackingChains makes Start validate the backing chain of every
+	// file backed disk first, so a missing base image is reported by name
+	// instead of as a QEMU error. The images must be reachable from this
+	// host.
+	CheckBackingChains bool
+
+	// Records, when set, gets a record of every domain CloneVM and
+	// ImportVM define, which Undefine deletes again.
+	Records *state.Store
+
+	// ConsoleDialer dials the connection of its own every Console session
+	// uses. When nil the local libvirtd of URIFromEnv is dialed.
+	ConsoleDialer socket.Dialer
+
+	events    lifecycleEvents
+	blockJobs blockJobs
+}
+
+// NewDomainManager creates a DomainManager using the given libvirt connection.
+func NewDomainManager(conn *libvirt.Libvirt) *DomainManager {
+	return &DomainManager{conn: conn}
+}
+
+func (m *DomainManager) log() logging.Logger {
+	return logging.OrNop(m.Logger)
+}
+
+// lookup finds a domain by name.
+func (m *DomainManager) lookup(name string) (libvirt.Domain, error) {
+	dom, err := m.conn.DomainLookupByName(name)
+	if isLibvirtError(err, libvirt.ErrNoDomain) {
+		return libvirt.Domain{}, fmt.Errorf("domain %s %w: %w", name, ErrNotFound, err)
+	}
+	if err != nil {
+		return libvirt.Domain{}, fmt.Errorf("failed to look up domain %s: %w", name, err)
+	}
+	return dom, nil
+}
+
+// Start boots a defined domain, from the device set with SetNextBootDevice
+// if there is one.
+func (m *DomainManager) Start(name string) (err error) {
+	defer observe(m.Observer, "start", time.Now(), &err)
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	if m.CheckBackingChains {
+		if err := m.validateDisks(dom); err != nil {
+			return fmt.Errorf("cannot start domain %s: %w", name, err)
+		}
+	}
+	next, err := m.nextBootDevice(dom)
+	if err != nil {
+		return err
+	}
+	if next != "" {
+		return m.startOnce(dom, next)
+	}
+	if err := m.conn.DomainCreate(dom); err != nil {
+		return fmt.Errorf("failed to start domain %s: %w", name, err)
+	}
+	return nil
+}
+
+// Shutdown sends an ACPI shutdown request to the domain. With a positive
+// timeout it behaves like GracefulStop.
+func (m *DomainManager) Shutdown(ctx context.Context, name string, timeout time.Duration) (err error) {
+	if timeout > 0 {
+		return m.GracefulStop(ctx, name, timeout)
+	}
+	defer observe(m.Observer, "shutdown", time.Now(), &err)
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	if err := m.conn.DomainShutdownFlags(dom, libvirt.DomainShutdownDefault); err != nil {
+		return fmt.Errorf("failed to shut down domain %s: %w", name, err)
+	}
+	return nil
+}
+
+// GracefulStop sends an ACPI shutdown request and waits up to timeout for the
+// domain to power off, then destroys it. When the forced kill was required
+// the returned error wraps ErrForcedShutdown. Cancelling ctx stops the wait
+// without destroying the domain and returns ctx.Err(); the guest keeps
+// shutting down on its own.
+func (m *DomainManager) GracefulStop(ctx context.Context, name string, timeout time.Duration) (err error) {
+	defer observe(m.Observer, "stop", time.Now(), &err)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	if err := m.conn.DomainShutdownFlags(dom, libvirt.DomainShutdownDefault); err != nil {
+		return fmt.Errorf("failed to shut down domain %s: %w", name, err)
+	}
+
+	requested := time.Now()
+	stopped, err := m.waitForState(ctx, name, StateShutoff, timeout)
+	if ctx.Err() != nil {
+		// The shutdown request cannot be taken back
+		state, _ := m.GetState(name)
+		m.log().Warn("stopped waiting for domain to shut down, the shutdown request is still pending",
+			"domain", name, "state", state, "waited", time.Since(requested).Round(time.Millisecond), "err", ctx.Err())
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	if stopped {
+		return nil
+	}
+
+	// The guest ignored the request, force it off
+	if err := m.Destroy(name); err != nil {
+		return err
+	}
+	return fmt.Errorf("domain %s: %w", name, ErrForcedShutdown)
+}
+
+// waitForState polls the domain until it reaches want, timeout elapses or
+// ctx is cancelled and reports whether the state was reached.
+func (m *DomainManager) waitForState(ctx context.Context, name string, want DomainState, timeout time.Duration) (bool, error) {
+	return m.waitFor(ctx, timeout, func() (bool, error) {
+		state, err := m.GetState(name)
+		return state == want, err
+	})
+}
+
+// pollInterval returns PollInterval, or its default when unset, clamped to
+// minPollInterval.
+func (m *DomainManager) pollInterval() time.Duration {
+	interval := m.PollInterval
+	if interval == 0 {
+		interval = DefaultPollInterval
+	}
+	return max(interval, minPollInterval)
+}
+
+// waitFor calls done every PollInterval until it returns true or timeout
+// elapses, and reports whether it returned true. It returns ctx.Err() once
+// ctx is cancelled.
+func (m *DomainManager) waitFor(ctx context.Context, timeout time.Duration, done func() (bool, error)) (bool, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(m.pollInterval())
+	defer ticker.Stop()
+
+	for {
+		ok, err := done()
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-deadline.C:
+			return false, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Destroy forcefully powers off the domain.
+func (m *DomainManager) Destroy(name string) (err error) {
+	defer observe(m.Observer, "destroy", time.Now(), &err)
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	if err := m.conn.DomainDestroy(dom); err != nil {
+		return fmt.Errorf("failed to destroy domain %s: %w", name, err)
+	}
+	return nil
+}
+
+// Reboot asks the guest to reboot.
+func (m *DomainManager) Reboot(name string) (err error) {
+	defer observe(m.Observer, "reboot", time.Now(), &err)
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	if err := m.conn.DomainReboot(dom, libvirt.DomainRebootDefault); err != nil {
+		return fmt.Errorf("failed to reboot domain %s: %w", name, err)
+	}
+	return nil
+}
+
+// Undefine removes the definition of a shut off domain along with its
+// managed save image, snapshot metadata and NVRAM, and deletes its
+// record. The domain's disks are left in place.
+func (m *DomainManager) Undefine(name string) (err error) {
+	defer observe(m.Observer, "delete", time.Now(), &err)
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	flags := libvirt.DomainUndefineManagedSave | libvirt.DomainUndefineSnapshotsMetadata | libvirt.DomainUndefineNvram
+	if err := m.conn.DomainUndefineFlags(dom, flags); err != nil {
+		return fmt.Errorf("failed to undefine domain %s: %w", name, err)
+	}
+	if m.Records != nil {
+		return m.Records.Delete(uuidString(dom.UUID))
+	}
+	return nil
+}
+
+// CountByState returns how many domains on the host are in each state.
+func (m *DomainManager) CountByState() (map[DomainState]int, error) {
+	doms, _, err := m.conn.ConnectListAllDomains(1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list domains: %w", err)
+	}
+	counts := make(map[DomainState]int)
+	for _, dom := range doms {
+		state, _, err := m.conn.DomainGetState(dom, 0)
+		if isLibvirtError(err, libvirt.ErrNoDomain) {
+			// Undefined since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get state of domain %s: %w", dom.Name, err)
+		}
+		s, ok := domainStates[libvirt.DomainState(state)]
+		if !ok {
+			s = StateNoState
+		}
+		counts[s]++
+	}
+	return counts, nil
+}
+
+// GetState returns the current state of the domain.
+func (m *DomainManager) GetState(name string) (DomainState, error) {
+	dom, err := m.lookup(name)
+	if err != nil {
+		return "", err
+	}
+	state, _, err := m.conn.DomainGetState(dom, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to get state of domain %s: %w", name, err)
+	}
+	if s, ok := domainStates[libvirt.DomainState(state)]; ok {
+		return s, nil
+	}
+	return StateNoState, nil
+}
+
+// SetAutostart sets whether libvirtd starts the domain when the host boots.
+// It applies to defined domains whether or not they are running.
+func (m *DomainManager) SetAutostart(name string, enabled bool) error {
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	var autostart int32
+	if enabled {
+		autostart = 1
+	}
+	if err := m.conn.DomainSetAutostart(dom, autostart); err != nil {
+		return fmt.Errorf("failed to set autostart of domain %s: %w", name, err)
+	}
+	return nil
+}
+
+// GetAutostart reports whether libvirtd starts the domain when the host boots.
+func (m *DomainManager) GetAutostart(name string) (bool, error) {
+	dom, err := m.lookup(name)
+	if err != nil {
+		return false, err
+	}
+	autostart, err := m.conn.DomainGetAutostart(dom)
+	if err != nil {
+		return false, fmt.Errorf("failed to get autostart of domain %s: %w", name, err)
+	}
+	return autostart == 1, nil
+}
+
+// VCPUInfo holds the current and maximum vCPU counts of a domain.
+type VCPUInfo struct {
+	Current uint `json:"current"`
+	Max     uint `json:"max"`
+}
+
+// GetVCPUs returns the current and maximum vCPU counts of the domain, so
+// callers can tell whether a change fits without a reboot.
+func (m *DomainManager) GetVCPUs(name string) (VCPUInfo, error) {
+	dom, err := m.lookup(name)
+	if err != nil {
+		return VCPUInfo{}, err
+	}
+	current, err := m.conn.DomainGetVcpusFlags(dom, uint32(libvirt.DomainVCPUCurrent))
+	if err != nil {
+		return VCPUInfo{}, fmt.Errorf("failed to get vcpus of domain %s: %w", name, err)
+	}
+	max, err := m.conn.DomainGetVcpusFlags(dom, uint32(libvirt.DomainVCPUMaximum))
+	if err != nil {
+		return VCPUInfo{}, fmt.Errorf("failed to get maximum vcpus of domain %s: %w", name, err)
+	}
+	return VCPUInfo{Current: uint(current), Max: uint(max)}, nil
+}
+
+// SetVCPUs changes the vCPU count of the domain. With live set the change is
+// hotplugged into the running guest and persisted to its config, otherwise
+// it only takes effect on the next boot.
+func (m *DomainManager) SetVCPUs(name string, count uint, live bool) error {
+	if count == 0 {
+		return errors.New("vcpu count must be greater than zero")
+	}
+	info, err := m.GetVCPUs(name)
+	if err != nil {
+		return err
+	}
+	if count > info.Max {
+		return fmt.Errorf("cannot set %d vcpus on domain %s: maximum is %d", count, name, info.Max)
+	}
+
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	flags := libvirt.DomainVCPUConfig
+	if live {
+		flags |= libvirt.DomainVCPULive
+	}
+	if err := m.conn.DomainSetVcpusFlags(dom, uint32(count), uint32(flags)); err != nil {
+		if live && isUnsupportedLive(err) {
+			return fmt.Errorf("cannot change vcpus of domain %s live, the guest lacks CPU hotplug support or its topology cannot grow; change the config and reboot instead: %w", name, err)
+		}
+		return fmt.Errorf("failed to set vcpus of domain %s: %w", name, err)
+	}
+	return nil
+}
+
+// MemoryStats holds the balloon statistics of a domain in KiB. Fields the
+// guest does not report are zero.
+type MemoryStats struct {
+	ActualKiB    uint64 `json:"actual"`    // Current balloon size
+	AvailableKiB uint64 `json:"available"` // Memory visible to the guest
+	UnusedKiB    uint64 `json:"unused"`    // Memory the guest is not using
+	UsableKiB    uint64 `json:"usable"`    // Memory the guest can reclaim without swapping
+	RSSKiB       uint64 `json:"rss"`       // Resident set size of the QEMU process
+}
+
+// GetMemoryStats returns the balloon statistics of the domain.
+func (m *DomainManager) GetMemoryStats(name string) (MemoryStats, error) {
+	dom, err := m.lookup(name)
+	if err != nil {
+		return MemoryStats{}, err
+	}
+	stats, err := m.conn.DomainMemoryStats(dom, uint32(libvirt.DomainMemoryStatNr), 0)
+	if err != nil {
+		return MemoryStats{}, fmt.Errorf("failed to get memory stats of domain %s: %w", name, err)
+	}
+
+	var ms MemoryStats
+	for _, stat := range stats {
+		switch libvirt.DomainMemoryStatTags(stat.Tag) {
+		case libvirt.DomainMemoryStatActualBalloon:
+			ms.ActualKiB = stat.Val
+		case libvirt.DomainMemoryStatAvailable:
+			ms.AvailableKiB = stat.Val
+		case libvirt.DomainMemoryStatUnused:
+			ms.UnusedKiB = stat.Val
+		case libvirt.DomainMemoryStatUsable:
+			ms.UsableKiB = stat.Val
+		case libvirt.DomainMemoryStatRss:
+			ms.RSSKiB = stat.Val
+		}
+	}
+	return ms, nil
+}
+
+// SetMemory changes the memory of the domain to memKiB. The value cannot
+// exceed the domain's configured maximum memory. With live set the balloon of
+// the running guest is resized as well and SetMemory waits for the guest to
+// act on it, returning an error wrapping ErrBalloonUnresponsive if it does not
+// and ctx.Err() once ctx is cancelled.
+func (m *DomainManager) SetMemory(ctx context.Context, name string, memKiB uint64, live bool) error {
+	if memKiB == 0 {
+		return errors.New("memory must be greater than zero")
+	}
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	maxKiB, err := m.conn.DomainGetMaxMemory(dom)
+	if err != nil {
+		return fmt.Errorf("failed to get maximum memory of domain %s: %w", name, err)
+	}
+	if memKiB > maxKiB {
+		return fmt.Errorf("cannot set memory of domain %s to %d KiB: maximum is %d KiB", name, memKiB, maxKiB)
+	}
+
+	flags := libvirt.DomainMemConfig
+	if live {
+		flags |= libvirt.DomainMemLive
+	}
+	if err := m.conn.DomainSetMemoryFlags(dom, memKiB, uint32(flags)); err != nil {
+		if live && isUnsupportedLive(err) {
+			return fmt.Errorf("cannot change memory of domain %s live: %w", name, err)
+		}
+		return fmt.Errorf("failed to set memory of domain %s: %w", name, err)
+	}
+	if !live {
+		return nil
+	}
+
+	// libvirt accepts the request even when the guest has no working balloon driver
+	moved, err := m.waitFor(ctx, balloonTimeout, func() (bool, error) {
+		stats, err := m.GetMemoryStats(name)
+		if err != nil {
+			return false, err
+		}
+		return stats.ActualKiB == memKiB, nil
+	})
+	if err != nil {
+		return err
+	}
+	if !moved {
+		return fmt.Errorf("domain %s: balloon did not reach %d KiB within %s: %w", name, memKiB, balloonTimeout, ErrBalloonUnresponsive)
+	}
+	return nil
+}
+
+// isLibvirtError reports whether err is a libvirt error with the given code.
+func isLibvirtError(err error, code libvirt.ErrorNumber) bool {
+	var lerr libvirt.Error
+	return errors.As(err, &lerr) && lerr.Code == uint32(code)
+}
+
+// IsNotFound reports whether err is libvirt failing to find a domain,
+// snapshot, storage pool, volume or network.
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound) ||
+		isLibvirtError(err, libvirt.ErrNoDomain) ||
+		isLibvirtError(err, libvirt.ErrNoDomainSnapshot) ||
+		isLibvirtError(err, libvirt.ErrNoStoragePool) ||
+		isLibvirtError(err, libvirt.ErrNoStorageVol) ||
+		isLibvirtError(err, libvirt.ErrNoNetwork)
+}
+
+// isUnsupportedLive reports whether err indicates that an operation cannot be
+// applied to the running domain.
+func isUnsupportedLive(err error) bool {
+	return isLibvirtError(err, libvirt.ErrOperationInvalid) ||
+		isLibvirtError(err, libvirt.ErrOperationUnsupported) ||
+		isLibvirtError(err, libvirt.ErrNoSupport) ||
+		isLibvirtError(err, libvirt.ErrArgumentUnsupported) ||
+		isLibvirtError(err, libvirt.ErrOperationFailed)
+}
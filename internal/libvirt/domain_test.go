@@ -0,0 +1,63 @@
+package libvirt
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	golibvirt "github.com/digitalocean/go-libvirt"
+	"github.com/digitalocean/go-libvirt/libvirttest"
+)
+
+// recordingLogger keeps the messages logged at warning level.
+type recordingLogger struct {
+	mu       sync.Mutex
+	warnings []string
+}
+
+func (l *recordingLogger) Debug(string, ...any) {}
+func (l *recordingLogger) Info(string, ...any)  {}
+func (l *recordingLogger) Error(string, ...any) {}
+
+func (l *recordingLogger) Warn(msg string, _ ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.warnings = append(l.warnings, msg)
+}
+
+func TestWaitForCancelled(t *testing.T) {
+	m := &DomainManager{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ok, err := m.waitFor(ctx, time.Minute, func() (bool, error) { return false, nil })
+	if ok || !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled wait to return context.Canceled; got %v, %v", ok, err)
+	}
+}
+
+func TestGracefulStopCancelled(t *testing.T) {
+	conn := golibvirt.NewWithDialer(libvirttest.New())
+	if err := conn.Connect(); err != nil {
+		t.Fatalf("error connecting to mock libvirt. Err: %v", err)
+	}
+	defer conn.Disconnect()
+	logger := &recordingLogger{}
+	m := &DomainManager{conn: conn, Logger: logger, PollInterval: minPollInterval}
+
+	// The mock domain keeps running, so only the context ends the wait
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := m.GracefulStop(ctx, "test", time.Minute)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded; got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the wait to stop with the context; took %v", elapsed)
+	}
+	if len(logger.warnings) != 1 {
+		t.Errorf("expected the pending shutdown to be logged; got %v", logger.warnings)
+	}
+}
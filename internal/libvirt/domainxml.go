@@ -0,0 +1,522 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// ErrUUIDMismatch is returned by UpdateXML when the edited XML does not
+// carry the UUID of the domain it replaces.
+var ErrUUIDMismatch = errors.New("domain XML must keep the uuid of the domain")
+
+// UpdateXMLFlags changes how UpdateXML defines the edited XML.
+type UpdateXMLFlags uint32
+
+// UpdateXMLValidate makes libvirt check the XML against its schema first.
+const UpdateXMLValidate = UpdateXMLFlags(libvirt.DomainDefineValidate)
+
+// GetXML returns the persistent definition of the domain. It includes
+// secrets such as the display password, so it can be edited and passed back
+// to UpdateXML without losing them.
+func (m *DomainManager) GetXML(name string) (string, error) {
+	dom, err := m.lookup(name)
+	if err != nil {
+		return "", err
+	}
+	desc, err := m.conn.DomainGetXMLDesc(dom, libvirt.DomainXMLInactive|libvirt.DomainXMLSecure)
+	if err != nil {
+		return "", fmt.Errorf("failed to get XML of domain %s: %w", name, err)
+	}
+	return desc, nil
+}
+
+// UpdateXML redefines the domain from desc, which must keep the name and
+// UUID of the domain so an edit cannot define a copy of it by accident. A
+// running domain picks the new definition up the next time it boots.
+func (m *DomainManager) UpdateXML(name, desc string, flags UpdateXMLFlags) error {
+	var edited struct {
+		Name string `xml:"name"`
+		UUID string `xml:"uuid"`
+	}
+	if err := xml.Unmarshal([]byte(desc), &edited); err != nil {
+		return fmt.Errorf("invalid domain XML: %w", err)
+	}
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	if edited.Name != name {
+		return fmt.Errorf("cannot update domain %s: the XML defines domain %q", name, edited.Name)
+	}
+	if normalizeUUID(edited.UUID) != normalizeUUID(uuidString(dom.UUID)) {
+		return fmt.Errorf("cannot update domain %s: %w, got %q", name, ErrUUIDMismatch, edited.UUID)
+	}
+	if _, err := m.conn.DomainDefineXMLFlags(desc, libvirt.DomainDefineFlags(flags)); err != nil {
+		return fmt.Errorf("failed to update domain %s: %w", name, err)
+	}
+	return nil
+}
+
+func normalizeUUID(uuid string) string {
+	return strings.ToLower(strings.ReplaceAll(uuid, "-", ""))
+}
+
+// domainExtras is what ParseDomainXML found in domain XML that a DomainSpec
+// does not describe. BuildDomainXML puts it back.
+type domainExtras struct {
+	typ      string
+	elements []rawXML // Top level elements
+	devices  []rawXML // Devices DomainSpec has no field for
+	// deviceOrder is the order of the devices in the devices element.
+	deviceOrder []deviceSlot
+	// children are the unmodeled attributes and children of elements that
+	// were mapped onto the spec, keyed by element.
+	children map[string]unmodeledXML
+}
+
+// specElements are the top level elements ParseDomainXML maps onto a
+// DomainSpec. cputune and numatune are kept as they are when they hold
+// nothing the spec describes.
+var specElements = map[string]bool{
+	"name": true, "uuid": true, "memory": true, "currentMemory": true, "vcpu": true,
+	"cputune": true, "numatune": true, "os": true, "features": true, "cpu": true, "devices": true,
+}
+
+// ParseDomainXML maps libvirt domain XML onto a DomainSpec, which can be
+// changed and rendered again with BuildDomainXML. Whatever the spec cannot
+// describe is kept: unknown elements and attributes, devices such as
+// controllers and consoles, and any device that BuildDomainXML would not
+// render exactly as it was. Those are written back unchanged and are not
+// affected by changes to the spec, and devices keep their order.
+//
+// The spec describes the domain as it is, so defaults BuildDomainXML adds to
+// new domains, like the serial console, are not added again. An empty
+// BootOrder leaves the boot order to per-device boot elements.
+func ParseDomainXML(desc string) (DomainSpec, error) {
+	var dom domainXML
+	if err := xml.Unmarshal([]byte(desc), &dom); err != nil {
+		return DomainSpec{}, fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+	var raw struct {
+		Elements []rawXML `xml:",any"`
+	}
+	if err := xml.Unmarshal([]byte(desc), &raw); err != nil {
+		return DomainSpec{}, fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+
+	x := &domainExtras{typ: dom.Type, children: make(map[string]unmodeledXML)}
+	spec := DomainSpec{
+		Name:    dom.Name,
+		UUID:    dom.UUID,
+		Arch:    dom.OS.Type.Arch,
+		Machine: dom.OS.Type.Machine,
+		extras:  x,
+	}
+
+	maxMiB, err := mebibytes(dom.Memory)
+	if err != nil {
+		return DomainSpec{}, err
+	}
+	spec.MemoryMiB = maxMiB
+	if dom.CurrentMemory != nil {
+		if spec.MemoryMiB, err = mebibytes(*dom.CurrentMemory); err != nil {
+			return DomainSpec{}, err
+		}
+	}
+	if maxMiB > spec.MemoryMiB {
+		spec.MaxMemoryMiB = maxMiB
+	}
+
+	spec.VCPUs = dom.VCPU.Value
+	if current := dom.VCPU.Current; current != 0 && current < dom.VCPU.Value {
+		spec.VCPUs, spec.MaxVCPUs = current, dom.VCPU.Value
+	}
+	x.keep("vcpu", dom.VCPU.unmodeledXML)
+
+	if t := dom.CPUTune; t != nil && len(t.VCPUPins) > 0 {
+		for _, pin := range t.VCPUPins {
+			spec.CPUPins = append(spec.CPUPins, CPUPin{VCPU: pin.VCPU, CPUSet: pin.CPUSet})
+		}
+		x.keep("cputune", t.unmodeledXML)
+	}
+	if t := dom.NUMATune; t != nil && t.Memory.Nodeset != "" {
+		spec.NUMA = &NUMATune{Nodeset: t.Memory.Nodeset, Mode: t.Memory.Mode}
+		x.keep("numatune", t.unmodeledXML)
+	}
+
+	if c := dom.CPU; c != nil {
+		switch {
+		case c.Mode == "host-passthrough" || c.Mode == "host-model":
+			spec.CPUModel = c.Mode
+		case c.Mode == "custom" && c.Model != nil:
+			spec.CPUModel = c.Model.Value
+		}
+		if spec.CPUModel != "" {
+			x.keep("cpu", c.unmodeledXML)
+		}
+	}
+
+	for _, boot := range dom.OS.Boot {
+		spec.BootOrder = append(spec.BootOrder, boot.Dev)
+	}
+	if o := dom.OS; o.Firmware == "efi" || o.Loader != nil {
+		fw := &FirmwareSpec{}
+		if o.Loader != nil {
+			fw.Loader, fw.SecureBoot = o.Loader.Path, o.Loader.Secure == "yes"
+			if o.NVRAM != nil {
+				fw.NVRAMTemplate, fw.NVRAM = o.NVRAM.Template, o.NVRAM.Path
+			}
+		}
+		if f := o.FirmwareFeatures; f != nil {
+			for _, feature := range f.Features {
+				if feature.Name == "secure-boot" && feature.Enabled == "yes" {
+					fw.SecureBoot = true
+				}
+			}
+		}
+		spec.Firmware = fw
+	}
+	x.keep("os", dom.OS.unmodeledXML)
+	if f := dom.Features; f != nil {
+		x.keep("features", f.unmodeledXML)
+	}
+
+	for _, e := range raw.Elements {
+		switch name := e.XMLName.Local; {
+		case name == "devices":
+			if err := spec.parseDevices(e, x); err != nil {
+				return DomainSpec{}, err
+			}
+		case name == "cputune" && len(spec.CPUPins) == 0,
+			name == "numatune" && spec.NUMA == nil,
+			name == "cpu" && spec.CPUModel == "",
+			!specElements[name]:
+			x.elements = append(x.elements, e)
+		}
+	}
+	return spec, nil
+}
+
+// parseDevices maps the devices in the devices element onto the spec and
+// keeps the rest in x.
+func (s *DomainSpec) parseDevices(devices rawXML, x *domainExtras) error {
+	var devs struct {
+		Elements []rawXML `xml:",any"`
+	}
+	if err := decodeRaw(devices, &devs); err != nil {
+		return err
+	}
+	for _, e := range devs.Elements {
+		ok, err := s.parseDevice(e, x)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			x.deviceOrder = append(x.deviceOrder, deviceSlot{extra: len(x.devices)})
+			x.devices = append(x.devices, e)
+			continue
+		}
+		x.deviceOrder = append(x.deviceOrder, deviceSlot{name: e.XMLName.Local, extra: -1})
+	}
+	return nil
+}
+
+// parseDevice adds the device to the spec and reports whether it did. A
+// device is only added when BuildDomainXML renders it back the same way.
+func (s *DomainSpec) parseDevice(e rawXML, x *domainExtras) (bool, error) {
+	switch e.XMLName.Local {
+	case "disk":
+		var d diskXML
+		if err := decodeRaw(e, &d); err != nil {
+			return false, err
+		}
+		if d.Type != "file" {
+			return false, nil
+		}
+		disk := DiskSpec{
+			Source:   d.Source.File,
+			Target:   d.Target.Dev,
+			Bus:      d.Target.Bus,
+			Format:   d.Driver.Type,
+			Device:   d.Device,
+			ReadOnly: d.ReadOnly != nil,
+			Cache:    d.Driver.Cache,
+			IO:       d.Driver.IO,
+			Discard:  d.Driver.Discard,
+		}
+		if d.Boot != nil {
+			disk.BootOrder = d.Boot.Order
+		}
+		if t := d.IOTune; t != nil {
+			disk.IOTune = &BlockIOLimits{
+				TotalBytesSec: t.TotalBytesSec,
+				ReadBytesSec:  t.ReadBytesSec,
+				WriteBytesSec: t.WriteBytesSec,
+				TotalIOPSSec:  t.TotalIOPSSec,
+				ReadIOPSSec:   t.ReadIOPSSec,
+				WriteIOPSSec:  t.WriteIOPSSec,
+			}
+		}
+		extra := d.unmodeledXML
+		d.XMLName, d.unmodeledXML, d.BackingStore = xml.Name{}, unmodeledXML{}, nil
+		if disk.Validate() != nil || !reflect.DeepEqual(buildDiskXML(disk), d) {
+			return false, nil
+		}
+		s.Disks = append(s.Disks, disk)
+		x.keep("disk/"+disk.Target, extra)
+
+	case "interface":
+		var i interfaceXML
+		if err := decodeRaw(e, &i); err != nil {
+			return false, err
+		}
+		if i.MAC == nil || i.Model == nil {
+			return false, nil
+		}
+		nic := NICSpec{MAC: i.MAC.Address, Model: i.Model.Type}
+		switch i.Type {
+		case "network":
+			nic.Network = i.Source.Network
+		case "bridge":
+			nic.Bridge = i.Source.Bridge
+		case "direct":
+			nic.Direct, nic.DirectMode = i.Source.Dev, i.Source.Mode
+		default:
+			return false, nil
+		}
+		if b := i.Bandwidth; b != nil {
+			nic.Inbound, nic.Outbound = b.Inbound.spec(), b.Outbound.spec()
+		}
+		if i.Boot != nil {
+			nic.BootOrder = i.Boot.Order
+		}
+		extra := i.unmodeledXML
+		i.XMLName, i.unmodeledXML = xml.Name{}, unmodeledXML{}
+		if nic.Validate() != nil || !reflect.DeepEqual(buildInterfaceXML(nic), i) {
+			return false, nil
+		}
+		s.NICs = append(s.NICs, nic)
+		x.keep("interface/"+nic.MAC, extra)
+
+	case "graphics":
+		var g graphicsXML
+		if err := decodeRaw(e, &g); err != nil || s.Graphics != nil || len(g.Listens) == 0 {
+			return false, err
+		}
+		spec := GraphicsSpec{Type: g.Type, Listen: g.Listens[0].Address, Password: g.Passwd}
+		// libvirt repeats the first listen address as an attribute and
+		// reports automatic ports as -1
+		if g.Listen == spec.Listen {
+			g.Listen = ""
+		}
+		if g.AutoPort == "yes" {
+			g.Port, g.TLSPort = 0, 0
+		} else {
+			spec.Port = g.Port
+		}
+		extra := g.unmodeledXML
+		g.unmodeledXML = unmodeledXML{}
+		if spec.Validate() != nil || !reflect.DeepEqual(buildGraphicsXML(spec), g) {
+			return false, nil
+		}
+		s.Graphics = &spec
+		x.keep("graphics", extra)
+
+	case "hostdev":
+		var h hostdevXML
+		if err := decodeRaw(e, &h); err != nil {
+			return false, err
+		}
+		d := HostDeviceSpec{Type: h.Type}
+		switch src := h.Source; {
+		case h.Type == "pci" && src.Address != nil:
+			a := src.Address
+			d.Device = fmt.Sprintf("%s:%s:%s.%s", hexPart(a.Domain), hexPart(a.Bus), hexPart(a.Slot), hexPart(a.Function))
+		case h.Type == "usb" && src.Vendor != nil && src.Product != nil:
+			d.Device = hexPart(src.Vendor.ID) + ":" + hexPart(src.Product.ID)
+		default:
+			return false, nil
+		}
+		extra := h.unmodeledXML
+		h.XMLName, h.unmodeledXML = xml.Name{}, unmodeledXML{}
+		if d.Validate() != nil || !reflect.DeepEqual(buildHostdevXML(d), h) {
+			return false, nil
+		}
+		s.HostDevices = append(s.HostDevices, d)
+		x.keep(hostdevKey(h), extra)
+
+	case "filesystem":
+		var f filesystemXML
+		if err := decodeRaw(e, &f); err != nil || f.Driver == nil {
+			return false, err
+		}
+		fs := FilesystemSpec{Driver: f.Driver.Type, Source: f.Source.Dir, Tag: f.Target.Dir, ReadOnly: f.ReadOnly != nil}
+		if fs.Driver == "path" {
+			fs.Driver = "9p"
+		}
+		if f.Binary != nil {
+			fs.Binary = f.Binary.Path
+		}
+		extra := f.unmodeledXML
+		f.XMLName, f.unmodeledXML = xml.Name{}, unmodeledXML{}
+		if fs.Validate() != nil || !reflect.DeepEqual(buildFilesystemXML(fs), f) {
+			return false, nil
+		}
+		s.Filesystems = append(s.Filesystems, fs)
+		x.keep("filesystem/"+fs.Tag, extra)
+
+	case "tpm":
+		var t tpmXML
+		if err := decodeRaw(e, &t); err != nil || s.TPM != nil {
+			return false, err
+		}
+		tpm := TPMSpec{Model: t.Model, Version: t.Backend.Version}
+		extra := t.unmodeledXML
+		t.unmodeledXML = unmodeledXML{}
+		if tpm.Validate() != nil || !reflect.DeepEqual(buildTPMXML(tpm), t) {
+			return false, nil
+		}
+		s.TPM = &tpm
+		x.keep("tpm", extra)
+
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// restore puts what ParseDomainXML kept back into dom, which BuildDomainXML
+// rendered from the spec.
+func (x *domainExtras) restore(dom *domainXML, spec DomainSpec) {
+	if x.typ != "" {
+		dom.Type = x.typ
+	}
+	// The domain keeps its own versions of what BuildDomainXML adds to new
+	// domains
+	dom.OnCrash = ""
+	dom.Devices.Serials, dom.Devices.Consoles, dom.Devices.Channels = nil, nil, nil
+	if len(spec.BootOrder) == 0 {
+		dom.OS.Boot = nil
+	}
+	for _, e := range x.elements {
+		switch e.XMLName.Local {
+		case "memoryBacking":
+			dom.MemoryBacking = nil
+		case "cpu":
+			dom.CPU = nil
+		case "cputune":
+			dom.CPUTune = nil
+		case "numatune":
+			dom.NUMATune = nil
+		}
+	}
+	for _, e := range x.devices {
+		if e.XMLName.Local == "controller" && e.attr("type") == "scsi" {
+			dom.Devices.Controllers = nil
+		}
+	}
+	dom.Extra = x.elements
+	dom.Devices.Extra = x.devices
+	dom.Devices.order = x.deviceOrder
+
+	dom.VCPU.unmodeledXML = x.children["vcpu"]
+	dom.OS.unmodeledXML = x.children["os"]
+	if dom.Features != nil {
+		dom.Features.unmodeledXML = x.children["features"]
+	}
+	if dom.CPU != nil {
+		dom.CPU.unmodeledXML = x.children["cpu"]
+	}
+	if dom.CPUTune != nil {
+		dom.CPUTune.unmodeledXML = x.children["cputune"]
+	}
+	if dom.NUMATune != nil {
+		dom.NUMATune.unmodeledXML = x.children["numatune"]
+	}
+	for i := range dom.Devices.Disks {
+		d := &dom.Devices.Disks[i]
+		d.unmodeledXML = x.children["disk/"+d.Target.Dev]
+	}
+	for i := range dom.Devices.Interfaces {
+		if iface := &dom.Devices.Interfaces[i]; iface.MAC != nil {
+			iface.unmodeledXML = x.children["interface/"+iface.MAC.Address]
+		}
+	}
+	for i := range dom.Devices.Graphics {
+		dom.Devices.Graphics[i].unmodeledXML = x.children["graphics"]
+	}
+	for i := range dom.Devices.HostDevs {
+		h := &dom.Devices.HostDevs[i]
+		h.unmodeledXML = x.children[hostdevKey(*h)]
+	}
+	for i := range dom.Devices.Filesystems {
+		f := &dom.Devices.Filesystems[i]
+		f.unmodeledXML = x.children["filesystem/"+f.Target.Dir]
+	}
+	for i := range dom.Devices.TPMs {
+		dom.Devices.TPMs[i].unmodeledXML = x.children["tpm"]
+	}
+}
+
+// keep records the unmodeled parts of the element called key.
+func (x *domainExtras) keep(key string, u unmodeledXML) {
+	if !u.isZero() {
+		x.children[key] = u
+	}
+}
+
+func hostdevKey(h hostdevXML) string {
+	if a := h.Source.Address; a != nil {
+		return "hostdev/" + a.Domain + a.Bus + a.Slot + a.Function
+	}
+	if h.Source.Vendor != nil && h.Source.Product != nil {
+		return "hostdev/" + h.Source.Vendor.ID + h.Source.Product.ID
+	}
+	return "hostdev"
+}
+
+// decodeRaw unmarshals an element kept as rawXML into v.
+func decodeRaw(r rawXML, v any) error {
+	data, err := xml.Marshal(r)
+	if err == nil {
+		err = xml.Unmarshal(data, v)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse %s element: %w", r.XMLName.Local, err)
+	}
+	return nil
+}
+
+// hexPart strips the 0x prefix libvirt puts on addresses and ids.
+func hexPart(s string) string {
+	return strings.TrimPrefix(strings.ToLower(s), "0x")
+}
+
+// mebibytes converts a libvirt memory size to MiB.
+func mebibytes(v unitValue) (uint64, error) {
+	switch v.Unit {
+	case "b", "bytes":
+		return v.Value / (1 << 20), nil
+	case "", "k", "KiB":
+		return v.Value / 1024, nil
+	case "M", "MiB":
+		return v.Value, nil
+	case "G", "GiB":
+		return v.Value * 1024, nil
+	case "T", "TiB":
+		return v.Value * (1 << 20), nil
+	}
+	return 0, fmt.Errorf("unsupported memory unit %q", v.Unit)
+}
+
+func (b *bandwidthLimitXML) spec() *Bandwidth {
+	if b == nil {
+		return nil
+	}
+	return &Bandwidth{AverageKBps: b.Average, PeakKBps: b.Peak, BurstKB: b.Burst}
+}
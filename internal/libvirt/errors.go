@@ -0,0 +1,23 @@
+package libvirt
+
+import (
+	"errors"
+
+	"libvirt-controller/internal/filesystem"
+)
+
+// Errors shared by the managers of this package, so callers can tell the
+// cause of a failure apart with errors.Is. Errors reported by libvirt wrap
+// the libvirt error as well.
+var (
+	// ErrNotFound means the domain, pool or job to act on does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrAlreadyExists means the object to create is already there.
+	ErrAlreadyExists = filesystem.ErrAlreadyExists
+	// ErrDomainRunning is returned by operations that need the domain to be
+	// shut off.
+	ErrDomainRunning = errors.New("domain must be shut off")
+	// ErrInsufficientSpace means a pool or filesystem lacks the space for
+	// the disks to create.
+	ErrInsufficientSpace = filesystem.ErrInsufficientSpace
+)
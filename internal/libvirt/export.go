@@ -0,0 +1,340 @@
+package libvirt
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"libvirt-controller/internal/filesystem"
+	"libvirt-controller/internal/helpers"
+)
+
+// Entries of an export archive. The domain XML comes first so ImportVM can
+// check the name before extracting any disk, the manifest last since it
+// holds the checksums of everything before it.
+const (
+	exportDomainEntry   = "domain.xml"
+	exportManifestEntry = "manifest.json"
+	exportNVRAMEntry    = "nvram.fd"
+	exportDiskDir       = "disks"
+	exportVersion       = 1
+)
+
+// exportManifest lists the files of an export archive.
+type exportManifest struct {
+	Version    int          `json:"version"`
+	Name       string       `json:"name"`
+	ExportedAt time.Time    `json:"exported_at"`
+	Files      []exportFile `json:"files"`
+}
+
+type exportFile struct {
+	Name      string `json:"name"`
+	SizeBytes int64  `json:"size_bytes"`
+	SHA256    string `json:"sha256"`
+}
+
+// ImportOptions controls how ImportVM recreates an exported VM.
+type ImportOptions struct {
+	Name string // Name of the new domain, the exported one when empty
+	Dir  string // Directory the disk images and NVRAM are written to
+}
+
+// ExportVM writes the shut off domain to destPath as a gzipped tarball
+// holding its definition, its disk images and a manifest with their
+// checksums. Disks are flattened into standalone qcow2 images, so the
+// archive does not depend on base images of this host; cdrom images are
+// copied as they are. Disk paths in the archived XML are relative to it.
+//
+// The archive is written to a temp file and renamed into place, and the
+// flattened images are staged next to destPath, which needs room for them.
+func (m *DomainManager) ExportVM(name, destPath string) error {
+	state, err := m.GetState(name)
+	if err != nil {
+		return err
+	}
+	if state != StateShutoff {
+		return fmt.Errorf("cannot export domain %s: it is %s: %w", name, state, ErrDomainRunning)
+	}
+	desc, err := m.GetXML(name)
+	if err != nil {
+		return err
+	}
+	spec, err := ParseDomainXML(desc)
+	if err != nil {
+		return fmt.Errorf("cannot export domain %s: %w", name, err)
+	}
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	domain, err := m.domainXML(dom)
+	if err != nil {
+		return err
+	}
+	// Disks ParseDomainXML kept verbatim would keep pointing at this host
+	for _, disk := range domain.Devices.Disks {
+		if disk.Source.File != "" && !slices.ContainsFunc(spec.Disks, func(d DiskSpec) bool { return d.Target == disk.Target.Dev }) {
+			return fmt.Errorf("cannot export domain %s: disk %s has settings that cannot be exported", name, disk.Target.Dev)
+		}
+	}
+
+	staging, err := os.MkdirTemp(filepath.Dir(destPath), ".export-*")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	// Flatten the disks first, the archive entries are named after them
+	files := map[string]string{}
+	var order []string
+	for i, disk := range spec.Disks {
+		if disk.Source == "" {
+			continue
+		}
+		src := disk.Source
+		entry := path.Join(exportDiskDir, disk.Target+".qcow2")
+		if disk.Device == "cdrom" {
+			entry = path.Join(exportDiskDir, disk.Target+".img")
+		} else {
+			src = filepath.Join(staging, disk.Target+".qcow2")
+			if err := helpers.ConvertImage(disk.Source, src, "", filesystem.FormatQcow2); err != nil {
+				return fmt.Errorf("cannot export domain %s: %w", name, err)
+			}
+			spec.Disks[i].Format = filesystem.FormatQcow2
+		}
+		spec.Disks[i].Source = entry
+		files[entry] = src
+		order = append(order, entry)
+	}
+	if spec.Firmware != nil && spec.Firmware.NVRAM != "" {
+		if _, err := os.Stat(spec.Firmware.NVRAM); err == nil {
+			files[exportNVRAMEntry] = spec.Firmware.NVRAM
+			order = append(order, exportNVRAMEntry)
+		}
+		spec.Firmware.NVRAM = ""
+	}
+
+	exported, err := BuildDomainXML(spec)
+	if err != nil {
+		return fmt.Errorf("cannot export domain %s: %w", name, err)
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := writeExport(pw, name, exported, order, files)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	_, err = filesystem.SaveFileStream(filepath.Dir(destPath), filepath.Base(destPath), pr, 0600)
+	pr.CloseWithError(errors.New("export aborted"))
+	if werr := <-done; werr != nil && err == nil {
+		err = werr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to export domain %s: %w", name, err)
+	}
+	return nil
+}
+
+// writeExport writes the archive of an export to w.
+func writeExport(w io.Writer, name, domainXML string, order []string, files map[string]string) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	manifest := exportManifest{Version: exportVersion, Name: name, ExportedAt: time.Now().UTC()}
+
+	if err := writeTarEntry(tw, exportDomainEntry, int64(len(domainXML)), strings.NewReader(domainXML)); err != nil {
+		return err
+	}
+	for _, entry := range order {
+		f, err := os.Open(files[entry])
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		h := sha256.New()
+		err = writeTarEntry(tw, entry, info.Size(), io.TeeReader(f, h))
+		f.Close()
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, exportFile{Name: entry, SizeBytes: info.Size(), SHA256: hex.EncodeToString(h.Sum(nil))})
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeTarEntry(tw, exportManifestEntry, int64(len(data)), bytes.NewReader(data)); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeTarEntry(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	hdr := &tar.Header{Name: name, Mode: 0600, Size: size, ModTime: time.Now(), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if _, err := io.Copy(tw, r); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+// ImportVM defines a new domain from an archive written by ExportVM. The
+// disk images are extracted into opts.Dir and checked against the manifest,
+// and the domain gets a fresh UUID and MAC addresses so it can run next to
+// the VM it was exported from. Nothing is left behind when the import fails.
+func (m *DomainManager) ImportVM(srcPath string, opts ImportOptions) (err error) {
+	if !filepath.IsAbs(opts.Dir) {
+		return fmt.Errorf("import directory %q must be absolute", opts.Dir)
+	}
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to open export %s: %w", srcPath, err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("failed to read export %s: %w", srcPath, err)
+	}
+	tr := tar.NewReader(zr)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != exportDomainEntry {
+		return fmt.Errorf("export %s does not start with %s", srcPath, exportDomainEntry)
+	}
+	desc, err := io.ReadAll(io.LimitReader(tr, 1<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read export %s: %w", srcPath, err)
+	}
+	spec, err := ParseDomainXML(string(desc))
+	if err != nil {
+		return fmt.Errorf("invalid domain in export %s: %w", srcPath, err)
+	}
+	if opts.Name != "" {
+		spec.Name = opts.Name
+	}
+	if err := ValidateDomainName(spec.Name); err != nil {
+		return err
+	}
+	if err := m.CheckNameAvailable(spec.Name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(opts.Dir, filesystem.DirPerm); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", opts.Dir, err)
+	}
+
+	var created []string
+	defer func() {
+		if err != nil {
+			for _, p := range created {
+				os.Remove(p)
+			}
+		}
+	}()
+
+	sums := map[string]string{}
+	var manifest *exportManifest
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read export %s: %w", srcPath, err)
+		}
+		if hdr.Name == exportManifestEntry {
+			manifest = &exportManifest{}
+			if err := json.NewDecoder(io.LimitReader(tr, 1<<20)).Decode(manifest); err != nil {
+				return fmt.Errorf("invalid manifest in export %s: %w", srcPath, err)
+			}
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg || !isExportFile(hdr.Name) {
+			return fmt.Errorf("unexpected entry %q in export %s", hdr.Name, srcPath)
+		}
+		dst := filepath.Join(opts.Dir, path.Base(hdr.Name))
+		out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+		}
+		created = append(created, dst)
+		h := sha256.New()
+		_, err = io.Copy(io.MultiWriter(out, h), tr)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+		}
+		sums[hdr.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	if manifest == nil || manifest.Version != exportVersion {
+		return fmt.Errorf("export %s has no supported manifest", srcPath)
+	}
+	if len(manifest.Files) != len(sums) {
+		return fmt.Errorf("export %s does not match its manifest", srcPath)
+	}
+	for _, file := range manifest.Files {
+		if sums[file.Name] != file.SHA256 {
+			return fmt.Errorf("%s in export %s does not match its checksum", file.Name, srcPath)
+		}
+	}
+
+	spec.UUID = newUUID()
+	for i := range spec.NICs {
+		spec.NICs[i].MAC = GenerateMAC("")
+	}
+	for i, disk := range spec.Disks {
+		if disk.Source == "" {
+			continue
+		}
+		if _, ok := sums[disk.Source]; !ok {
+			return fmt.Errorf("disk %s is missing from export %s", disk.Target, srcPath)
+		}
+		spec.Disks[i].Source = filepath.Join(opts.Dir, path.Base(disk.Source))
+	}
+	if _, ok := sums[exportNVRAMEntry]; ok && spec.Firmware != nil {
+		spec.Firmware.NVRAM = filepath.Join(opts.Dir, exportNVRAMEntry)
+	}
+
+	spec.managed = true
+	domXML, err := BuildDomainXML(spec)
+	if err != nil {
+		return fmt.Errorf("invalid domain in export %s: %w", srcPath, err)
+	}
+	_, err = defineRecorded(m.conn, m.Records, spec, domXML)
+	return err
+}
+
+// isExportFile reports whether name is a file entry ExportVM writes.
+func isExportFile(name string) bool {
+	if name == exportNVRAMEntry {
+		return true
+	}
+	dir, base := path.Split(name)
+	return dir == exportDiskDir+"/" && base != "" && base != "." && base != ".."
+}
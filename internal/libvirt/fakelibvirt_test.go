@@ -0,0 +1,375 @@
+package libvirt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Remote procedures served by fakeLibvirt, from libvirt's remote_protocol.x.
+const (
+	procConnectOpen            = 1
+	procConnectClose           = 2
+	procDomainDefineXML        = 11
+	procDomainGetXMLDesc       = 14
+	procDomainGetInfo          = 16
+	procDomainLookupByName     = 23
+	procAuthList               = 66
+	procStorageVolLookupByPath = 97
+	procDomainIsActive         = 150
+	procDomainOpenConsole      = 201
+	procDomainGetState         = 212
+	procDomainUndefineFlags    = 231
+	procConnectListAllDomains  = 273
+)
+
+// Packet types and statuses of the libvirt RPC protocol.
+const (
+	rpcReply       = 1
+	rpcStream      = 3
+	rpcStatusOK    = 0
+	rpcStatusError = 1
+	rpcContinue    = 2
+)
+
+// fakeDomain is a domain defined on a fakeLibvirt.
+type fakeDomain struct {
+	dom    libvirt.Domain
+	xml    string
+	active bool
+}
+
+// fakeLibvirt is an in-memory libvirtd speaking just enough of the RPC
+// protocol for the domain lifecycle the provisioner and reconciler use.
+// Procedures it does not know fail with an error reply.
+type fakeLibvirt struct {
+	mu      sync.Mutex
+	domains []*fakeDomain
+
+	// handlers override or extend the served procedures. A handler reads
+	// its arguments from args and writes its reply to ret, or returns an
+	// error to send an error reply.
+	handlers map[uint32]func(c *fakeConn, serial int32, args *xdrReader, ret *xdrWriter) error
+	// streams, when set, receives the stream packets clients send.
+	streams func(c *fakeConn, serial int32, status uint32, payload []byte)
+}
+
+// fakeError is sent as a libvirt error reply.
+type fakeError struct {
+	code libvirt.ErrorNumber
+	msg  string
+}
+
+func (e fakeError) Error() string { return e.msg }
+
+// errNoReply makes a handler send nothing, e.g. to reply later.
+var errNoReply = errors.New("no reply")
+
+// newFakeLibvirt starts a fakeLibvirt and returns a connection to it,
+// which is closed when the test ends.
+func newFakeLibvirt(t *testing.T) (*fakeLibvirt, *libvirt.Libvirt) {
+	t.Helper()
+	f := &fakeLibvirt{handlers: map[uint32]func(*fakeConn, int32, *xdrReader, *xdrWriter) error{}}
+	conn := libvirt.NewWithDialer(f)
+	if err := conn.Connect(); err != nil {
+		t.Fatalf("error connecting to fake libvirt. Err: %v", err)
+	}
+	t.Cleanup(func() { conn.Disconnect() })
+	return f, conn
+}
+
+// define adds a domain as if it was defined outside the controller.
+func (f *fakeLibvirt) define(xmlDesc string, active bool) libvirt.Domain {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d := f.defineLocked(xmlDesc)
+	d.active = active
+	return d.dom
+}
+
+func (f *fakeLibvirt) defineLocked(xmlDesc string) *fakeDomain {
+	var parsed struct {
+		Name string `xml:"name"`
+		UUID string `xml:"uuid"`
+	}
+	xml.Unmarshal([]byte(xmlDesc), &parsed)
+	for _, d := range f.domains {
+		if d.dom.Name == parsed.Name {
+			d.xml = xmlDesc
+			return d
+		}
+	}
+	d := &fakeDomain{dom: libvirt.Domain{Name: parsed.Name, ID: -1}, xml: xmlDesc}
+	if parsed.UUID == "" {
+		parsed.UUID = newUUID()
+	}
+	raw, _ := hex.DecodeString(strings.ReplaceAll(parsed.UUID, "-", ""))
+	copy(d.dom.UUID[:], raw)
+	f.domains = append(f.domains, d)
+	return d
+}
+
+// names returns the names of the defined domains.
+func (f *fakeLibvirt) names() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for _, d := range f.domains {
+		names = append(names, d.dom.Name)
+	}
+	return names
+}
+
+func (f *fakeLibvirt) find(name string) (*fakeDomain, error) {
+	for _, d := range f.domains {
+		if d.dom.Name == name {
+			return d, nil
+		}
+	}
+	return nil, fakeError{code: libvirt.ErrNoDomain, msg: "Domain not found: no domain with matching name '" + name + "'"}
+}
+
+// Dial implements socket.Dialer.
+func (f *fakeLibvirt) Dial() (net.Conn, error) {
+	server, client := net.Pipe()
+	go f.serve(&fakeConn{conn: server})
+	return client, nil
+}
+
+// fakeConn writes packets to one client of a fakeLibvirt.
+type fakeConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// send writes one packet with the given header fields and payload.
+func (c *fakeConn) send(proc uint32, typ uint32, serial int32, status uint32, payload []byte) error {
+	var b bytes.Buffer
+	for _, v := range []uint32{uint32(28 + len(payload)), 0x20008086, 1, proc, typ, uint32(serial), status} {
+		binary.Write(&b, binary.BigEndian, v)
+	}
+	b.Write(payload)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.conn.Write(b.Bytes())
+	return err
+}
+
+func (f *fakeLibvirt) serve(c *fakeConn) {
+	defer c.conn.Close()
+	for {
+		var header [28]byte
+		if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+			return
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		proc := binary.BigEndian.Uint32(header[12:16])
+		typ := binary.BigEndian.Uint32(header[16:20])
+		serial := int32(binary.BigEndian.Uint32(header[20:24]))
+		status := binary.BigEndian.Uint32(header[24:28])
+		payload := make([]byte, length-28)
+		if _, err := io.ReadFull(c.conn, payload); err != nil {
+			return
+		}
+		if typ == rpcStream {
+			f.mu.Lock()
+			streams := f.streams
+			f.mu.Unlock()
+			if streams != nil {
+				streams(c, serial, status, payload)
+			}
+			continue
+		}
+
+		var ret xdrWriter
+		err := f.handle(c, serial, proc, &xdrReader{b: payload}, &ret)
+		switch {
+		case errors.Is(err, errNoReply):
+		case err != nil:
+			code := libvirt.ErrInternalError
+			var ferr fakeError
+			if errors.As(err, &ferr) {
+				code = ferr.code
+			}
+			var e xdrWriter
+			e.u32(uint32(code))
+			e.u32(0)
+			e.u32(1)
+			e.str(err.Error())
+			e.u32(2)
+			c.send(proc, rpcReply, serial, rpcStatusError, e.Bytes())
+		default:
+			c.send(proc, rpcReply, serial, rpcStatusOK, ret.Bytes())
+		}
+		if proc == procConnectClose {
+			return
+		}
+	}
+}
+
+func (f *fakeLibvirt) handle(c *fakeConn, serial int32, proc uint32, args *xdrReader, ret *xdrWriter) error {
+	f.mu.Lock()
+	handler := f.handlers[proc]
+	f.mu.Unlock()
+	if handler != nil {
+		return handler(c, serial, args, ret)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch proc {
+	case procAuthList:
+		ret.u32(1)
+		ret.u32(0) // no authentication
+	case procConnectOpen, procConnectClose:
+	case procDomainLookupByName:
+		d, err := f.find(args.str())
+		if err != nil {
+			return err
+		}
+		ret.domain(d.dom)
+	case procDomainDefineXML:
+		ret.domain(f.defineLocked(args.str()).dom)
+	case procDomainGetXMLDesc:
+		d, err := f.find(args.domain().Name)
+		if err != nil {
+			return err
+		}
+		ret.str(d.xml)
+	case procDomainGetInfo:
+		d, err := f.find(args.domain().Name)
+		if err != nil {
+			return err
+		}
+		var parsed domainXML
+		xml.Unmarshal([]byte(d.xml), &parsed)
+		memMiB, _ := definedMemory(parsed)
+		ret.u32(uint32(d.state()))
+		ret.u64(memMiB * 1024)
+		ret.u64(memMiB * 1024)
+		ret.u32(uint32(parsed.VCPU.Value))
+		ret.u64(0)
+	case procDomainIsActive:
+		d, err := f.find(args.domain().Name)
+		if err != nil {
+			return err
+		}
+		if d.active {
+			ret.u32(1)
+		} else {
+			ret.u32(0)
+		}
+	case procDomainGetState:
+		d, err := f.find(args.domain().Name)
+		if err != nil {
+			return err
+		}
+		ret.u32(uint32(d.state()))
+		ret.u32(0)
+	case procDomainUndefineFlags:
+		name := args.domain().Name
+		if _, err := f.find(name); err != nil {
+			return err
+		}
+		for i, d := range f.domains {
+			if d.dom.Name == name {
+				f.domains = append(f.domains[:i], f.domains[i+1:]...)
+				break
+			}
+		}
+	case procStorageVolLookupByPath:
+		// The fake has no storage pools, every disk is a plain file
+		return fakeError{code: libvirt.ErrNoStorageVol, msg: "Storage volume not found: no storage vol with matching path '" + args.str() + "'"}
+	case procConnectListAllDomains:
+		ret.u32(uint32(len(f.domains)))
+		for _, d := range f.domains {
+			ret.domain(d.dom)
+		}
+		ret.u32(uint32(len(f.domains)))
+	default:
+		return fmt.Errorf("unknown procedure %d", proc)
+	}
+	return nil
+}
+
+func (d *fakeDomain) state() libvirt.DomainState {
+	if d.active {
+		return libvirt.DomainRunning
+	}
+	return libvirt.DomainShutoff
+}
+
+// xdrReader decodes the XDR arguments of a call.
+type xdrReader struct {
+	b []byte
+}
+
+func (r *xdrReader) u32() uint32 {
+	if len(r.b) < 4 {
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *xdrReader) fixed(n int) []byte {
+	padded := (n + 3) &^ 3
+	if len(r.b) < padded {
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[padded:]
+	return v
+}
+
+func (r *xdrReader) str() string {
+	return string(r.fixed(int(r.u32())))
+}
+
+func (r *xdrReader) domain() libvirt.Domain {
+	var d libvirt.Domain
+	d.Name = r.str()
+	copy(d.UUID[:], r.fixed(libvirt.UUIDBuflen))
+	d.ID = int32(r.u32())
+	return d
+}
+
+// xdrWriter encodes the XDR reply of a call.
+type xdrWriter struct {
+	bytes.Buffer
+}
+
+func (w *xdrWriter) u32(v uint32) {
+	binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *xdrWriter) u64(v uint64) {
+	binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *xdrWriter) fixed(b []byte) {
+	w.Write(b)
+	w.Write(make([]byte, (4-len(b)%4)%4))
+}
+
+func (w *xdrWriter) str(s string) {
+	w.u32(uint32(len(s)))
+	w.fixed([]byte(s))
+}
+
+func (w *xdrWriter) domain(d libvirt.Domain) {
+	w.str(d.Name)
+	w.fixed(d.UUID[:])
+	w.u32(uint32(d.ID))
+}
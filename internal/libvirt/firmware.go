@@ -0,0 +1,167 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ErrFirmwareNotInstalled is returned when the OVMF UEFI firmware a domain
+// needs is missing on the host.
+var ErrFirmwareNotInstalled = errors.New("OVMF firmware is not installed, install the ovmf (Debian, Ubuntu) or edk2-ovmf (Fedora, RHEL) package")
+
+// ErrSwtpmUnavailable is returned when a domain needs an emulated TPM but
+// swtpm is not installed on the host.
+var ErrSwtpmUnavailable = errors.New("swtpm is not installed, install the swtpm package to emulate a TPM")
+
+// FirmwareSpec boots the domain with OVMF UEFI firmware. When Loader is
+// empty libvirt picks the firmware and keeps the NVRAM itself; a
+// Provisioner instead resolves the installed OVMF files and creates the
+// NVRAM in the VM directory.
+type FirmwareSpec struct {
+	SecureBoot    bool   // Requires the q35 machine type, SMM is enabled for it
+	Loader        string // Path of the OVMF code file
+	NVRAMTemplate string // Path of the OVMF variables file copied into NVRAM
+	NVRAM         string // Path of the domain's own variable store
+}
+
+// TPMSpec adds a TPM emulated by swtpm.
+type TPMSpec struct {
+	Model   string // "tpm-crb" (default) or "tpm-tis"
+	Version string // "2.0" (default) or "1.2"
+}
+
+// ovmfFiles is an OVMF code file with the variable template matching it.
+type ovmfFiles struct {
+	loader, template string
+}
+
+// ovmfCandidates are the places distributions install OVMF, in order of
+// preference. The secure boot templates have Microsoft's keys enrolled.
+var ovmfCandidates = map[bool][]ovmfFiles{
+	true: {
+		{"/usr/share/OVMF/OVMF_CODE_4M.secboot.fd", "/usr/share/OVMF/OVMF_VARS_4M.ms.fd"},
+		{"/usr/share/OVMF/OVMF_CODE.secboot.fd", "/usr/share/OVMF/OVMF_VARS.ms.fd"},
+		{"/usr/share/edk2/ovmf/OVMF_CODE.secboot.fd", "/usr/share/edk2/ovmf/OVMF_VARS.secboot.fd"},
+	},
+	false: {
+		{"/usr/share/OVMF/OVMF_CODE_4M.fd", "/usr/share/OVMF/OVMF_VARS_4M.fd"},
+		{"/usr/share/OVMF/OVMF_CODE.fd", "/usr/share/OVMF/OVMF_VARS.fd"},
+		{"/usr/share/edk2/ovmf/OVMF_CODE.fd", "/usr/share/edk2/ovmf/OVMF_VARS.fd"},
+	},
+}
+
+// Validate checks that the paths are absolute and set together.
+func (f FirmwareSpec) Validate() error {
+	for _, p := range []string{f.Loader, f.NVRAMTemplate, f.NVRAM} {
+		if p != "" && !filepath.IsAbs(p) {
+			return fmt.Errorf("firmware path %q must be absolute", p)
+		}
+	}
+	if f.Loader == "" && (f.NVRAMTemplate != "" || f.NVRAM != "") {
+		return errors.New("nvram requires an explicit loader")
+	}
+	return nil
+}
+
+// Validate checks the TPM model and version.
+func (t TPMSpec) Validate() error {
+	if t.Model != "" && t.Model != "tpm-crb" && t.Model != "tpm-tis" {
+		return fmt.Errorf("invalid model %q", t.Model)
+	}
+	if t.Version != "" && t.Version != "2.0" && t.Version != "1.2" {
+		return fmt.Errorf("invalid version %q", t.Version)
+	}
+	if t.Model == "tpm-crb" && t.Version == "1.2" {
+		return errors.New("tpm-crb requires version 2.0")
+	}
+	return nil
+}
+
+// withDefaults fills in the installed OVMF files for a firmware without a
+// loader and places the NVRAM at nvram. It leaves f unchanged when no OVMF
+// is installed, CheckFirmware reports that.
+func (f FirmwareSpec) withDefaults(nvram string) FirmwareSpec {
+	if f.Loader == "" {
+		for _, c := range ovmfCandidates[f.SecureBoot] {
+			if pathExists(c.loader) && pathExists(c.template) {
+				f.Loader, f.NVRAMTemplate = c.loader, c.template
+				break
+			}
+		}
+	}
+	if f.Loader != "" && f.NVRAM == "" {
+		f.NVRAM = nvram
+	}
+	return f
+}
+
+// CheckFirmware checks that the firmware files spec boots with are installed
+// and that swtpm is available when it has a TPM.
+func (m *HostManager) CheckFirmware(spec DomainSpec) error {
+	var errs []error
+	if f := spec.Firmware; f != nil {
+		if f.Loader == "" {
+			// The Provisioner resolves a loader whenever OVMF is installed
+			errs = append(errs, ErrFirmwareNotInstalled)
+		}
+		for _, p := range []string{f.Loader, f.NVRAMTemplate} {
+			if p != "" && !pathExists(p) {
+				errs = append(errs, fmt.Errorf("firmware file %s does not exist: %w", p, ErrFirmwareNotInstalled))
+			}
+		}
+	}
+	if spec.TPM != nil {
+		caps, err := m.Capabilities()
+		if err != nil {
+			return err
+		}
+		if !caps.TPMEmulator {
+			errs = append(errs, ErrSwtpmUnavailable)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// buildFirmware adds the loader, NVRAM and secure boot requirements of the
+// firmware to dom.
+func buildFirmware(f FirmwareSpec, dom *domainXML) {
+	o := &dom.OS
+	secure := ""
+	if f.SecureBoot {
+		secure = "yes"
+		dom.Features.SMM = &featureStateXML{State: "on"}
+	}
+	if f.Loader == "" {
+		o.Firmware = "efi"
+		if f.SecureBoot {
+			o.FirmwareFeatures = &osFirmwareXML{Features: []osFirmwareFeatureXML{
+				{Enabled: "yes", Name: "secure-boot"},
+				{Enabled: "yes", Name: "enrolled-keys"},
+			}}
+		}
+		return
+	}
+	o.Loader = &osLoaderXML{ReadOnly: "yes", Secure: secure, Type: "pflash", Path: f.Loader}
+	if f.NVRAM != "" || f.NVRAMTemplate != "" {
+		o.NVRAM = &osNVRAMXML{Template: f.NVRAMTemplate, Path: f.NVRAM}
+	}
+}
+
+func buildTPMXML(t TPMSpec) tpmXML {
+	model := t.Model
+	if model == "" {
+		model = "tpm-crb"
+	}
+	version := t.Version
+	if version == "" {
+		version = "2.0"
+	}
+	return tpmXML{Model: model, Backend: tpmBackendXML{Type: "emulator", Version: version}}
+}
+
+// isQ35 reports whether machine is a q35 machine type such as "pc-q35-8.2".
+func isQ35(machine string) bool {
+	return strings.Contains(machine, "q35")
+}
@@ -0,0 +1,116 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// GraphicsSpec describes the VNC or SPICE display of a domain. The port is
+// picked by libvirt from its free range unless Port is set.
+type GraphicsSpec struct {
+	Type     string // "vnc" (default) or "spice"
+	Listen   string // Host address to listen on, "127.0.0.1" when empty
+	Port     int    // Fixed port, libvirt allocates one when zero
+	Password string // Password clients must give; VNC only uses the first 8 characters
+}
+
+// vncPasswordMax is the longest password the VNC authentication scheme uses.
+const vncPasswordMax = 8
+
+// Validate checks the display type, listen address, port and password.
+func (g GraphicsSpec) Validate() error {
+	if g.Type != "" && g.Type != "vnc" && g.Type != "spice" {
+		return fmt.Errorf("invalid type %q", g.Type)
+	}
+	if g.Listen != "" && net.ParseIP(g.Listen) == nil {
+		return fmt.Errorf("listen address %q is not an IP address", g.Listen)
+	}
+	if g.Port != 0 && (g.Port < 1024 || g.Port > 65535) {
+		return fmt.Errorf("port %d is outside 1024-65535", g.Port)
+	}
+	if g.Type != "spice" && len(g.Password) > vncPasswordMax {
+		return fmt.Errorf("vnc password is longer than %d characters", vncPasswordMax)
+	}
+	return nil
+}
+
+func buildGraphicsXML(g GraphicsSpec) graphicsXML {
+	typ := g.Type
+	if typ == "" {
+		typ = "vnc"
+	}
+	listen := g.Listen
+	if listen == "" {
+		listen = "127.0.0.1"
+	}
+
+	x := graphicsXML{
+		Type:    typ,
+		Passwd:  g.Password,
+		Listens: []graphicsListenXML{{Type: "address", Address: listen}},
+	}
+	if g.Port == 0 {
+		x.AutoPort = "yes"
+	} else {
+		x.Port = g.Port
+		x.AutoPort = "no"
+	}
+	return x
+}
+
+// GraphicsInfo describes where the display of a running domain can be
+// reached.
+type GraphicsInfo struct {
+	Type    string `json:"type"`
+	Listen  string `json:"listen"`
+	Port    int    `json:"port"`
+	TLSPort int    `json:"tls_port,omitempty"`
+}
+
+// URI returns the address of the display as a vnc:// or spice:// URI.
+func (g GraphicsInfo) URI() string {
+	u := url.URL{Scheme: g.Type, Host: net.JoinHostPort(g.Listen, strconv.Itoa(g.Port))}
+	if g.TLSPort > 0 {
+		u.RawQuery = url.Values{"tls-port": {strconv.Itoa(g.TLSPort)}}.Encode()
+	}
+	return u.String()
+}
+
+// ErrNoGraphics is returned by GraphicsInfo for a domain without a display.
+var ErrNoGraphics = errors.New("domain has no graphics device")
+
+// GraphicsInfo returns the display of the domain with the port libvirt
+// assigned to it. The domain must be running, an automatically allocated
+// port is only known once it has started.
+func (m *DomainManager) GraphicsInfo(name string) (GraphicsInfo, error) {
+	dom, err := m.lookup(name)
+	if err != nil {
+		return GraphicsInfo{}, err
+	}
+	domain, err := m.domainXML(dom)
+	if err != nil {
+		return GraphicsInfo{}, err
+	}
+	if len(domain.Devices.Graphics) == 0 {
+		return GraphicsInfo{}, fmt.Errorf("cannot get graphics of domain %s: %w", name, ErrNoGraphics)
+	}
+
+	g := domain.Devices.Graphics[0]
+	if g.Port <= 0 {
+		return GraphicsInfo{}, fmt.Errorf("cannot get graphics of domain %s: no port assigned, the domain is not running", name)
+	}
+	info := GraphicsInfo{Type: g.Type, Listen: g.Listen, Port: g.Port}
+	if g.TLSPort > 0 {
+		info.TLSPort = g.TLSPort
+	}
+	for _, listen := range g.Listens {
+		if listen.Type == "address" && listen.Address != "" {
+			info.Listen = listen.Address
+			break
+		}
+	}
+	return info, nil
+}
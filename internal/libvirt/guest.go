@@ -0,0 +1,128 @@
+package libvirt
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+
+	"libvirt-controller/internal/qemu"
+)
+
+// ErrAgentUnavailable is returned when the QEMU guest agent of a domain is
+// not configured, not installed in the guest or not responding. Callers can
+// fall back to looking up addresses in the DHCP leases.
+var ErrAgentUnavailable = errors.New("guest agent is not available")
+
+// agentCommand is a QEMU guest agent request.
+type agentCommand struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+// GuestExec runs cmd in the guest through the guest agent and waits up to
+// timeout for it to exit or ctx to be cancelled. A command that does not exit
+// in time keeps running in the guest.
+func (m *DomainManager) GuestExec(ctx context.Context, name string, cmd []string, timeout time.Duration) (stdout, stderr []byte, exitCode int, err error) {
+	if len(cmd) == 0 {
+		return nil, nil, -1, errors.New("command is required")
+	}
+	dom, err := m.lookup(name)
+	if err != nil {
+		return nil, nil, -1, err
+	}
+
+	var started qemu.GuestExecResponse
+	err = m.agentRun(dom, agentCommand{
+		Execute: "guest-exec",
+		Arguments: map[string]interface{}{
+			"path":           cmd[0],
+			"arg":            cmd[1:],
+			"capture-output": true,
+		},
+	}, &started)
+	if err != nil {
+		return nil, nil, -1, err
+	}
+
+	var status qemu.GuestExecStatusResponse
+	exited, err := m.waitFor(ctx, timeout, func() (bool, error) {
+		err := m.agentRun(dom, agentCommand{
+			Execute:   "guest-exec-status",
+			Arguments: map[string]int{"pid": started.Return.PID},
+		}, &status)
+		return status.Return.Exited, err
+	})
+	if err != nil {
+		return nil, nil, -1, err
+	}
+	if !exited {
+		return nil, nil, -1, fmt.Errorf("command %s in domain %s did not exit within %s", cmd[0], name, timeout)
+	}
+
+	if stdout, err = base64.StdEncoding.DecodeString(status.Return.OutData); err != nil {
+		return nil, nil, -1, fmt.Errorf("failed to decode command output: %w", err)
+	}
+	if stderr, err = base64.StdEncoding.DecodeString(status.Return.ErrData); err != nil {
+		return nil, nil, -1, fmt.Errorf("failed to decode command error output: %w", err)
+	}
+	exitCode = status.Return.ExitCode
+	if status.Return.Signal != 0 {
+		exitCode = 128 + status.Return.Signal
+	}
+	return stdout, stderr, exitCode, nil
+}
+
+// GuestGetInterfaces returns the network interfaces and addresses the guest
+// agent reports.
+func (m *DomainManager) GuestGetInterfaces(name string) ([]qemu.NetworkInterface, error) {
+	dom, err := m.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	var res qemu.NetInfoResponse
+	if err := m.agentRun(dom, agentCommand{Execute: "guest-network-get-interfaces"}, &res); err != nil {
+		return nil, err
+	}
+	return res.Return, nil
+}
+
+// agentRun sends a command to the guest agent and decodes the response into out.
+func (m *DomainManager) agentRun(dom libvirt.Domain, cmd agentCommand, out interface{}) error {
+	return m.agentRunTimeout(dom, cmd, int32(libvirt.DomainAgentResponseTimeoutDefault), out)
+}
+
+// agentRunTimeout is agentRun waiting up to timeout seconds for the
+// response, for commands that take longer than libvirt's default.
+func (m *DomainManager) agentRunTimeout(dom libvirt.Domain, cmd agentCommand, timeout int32, out interface{}) error {
+	req, err := json.Marshal(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to encode agent command %s: %w", cmd.Execute, err)
+	}
+	res, err := m.conn.QEMUDomainAgentCommand(dom, string(req), timeout, 0)
+	if err != nil {
+		if isAgentUnavailable(err) {
+			return fmt.Errorf("failed to run %s in domain %s: %w: %w", cmd.Execute, dom.Name, ErrAgentUnavailable, err)
+		}
+		return fmt.Errorf("failed to run %s in domain %s: %w", cmd.Execute, dom.Name, err)
+	}
+	if len(res) == 0 {
+		return fmt.Errorf("empty response to %s from domain %s", cmd.Execute, dom.Name)
+	}
+	if err := json.Unmarshal([]byte(res[0]), out); err != nil {
+		return fmt.Errorf("failed to parse response to %s: %w", cmd.Execute, err)
+	}
+	return nil
+}
+
+// isAgentUnavailable reports whether err means the guest agent can't be reached.
+func isAgentUnavailable(err error) bool {
+	return isLibvirtError(err, libvirt.ErrAgentUnresponsive) ||
+		isLibvirtError(err, libvirt.ErrAgentUnsynced) ||
+		// returned when the domain has no guest agent channel
+		isLibvirtError(err, libvirt.ErrArgumentUnsupported)
+}
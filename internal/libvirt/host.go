@@ -0,0 +1,171 @@
+package libvirt
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/shirou/gopsutil/v3/load"
+
+	"libvirt-controller/internal/logging"
+)
+
+// HostInfo describes the capacity and health of the hypervisor host.
+type HostInfo struct {
+	Connected bool    `json:"connected"`
+	Hostname  string  `json:"hostname,omitempty"`
+	CPUs      int     `json:"cpus"`
+	Load1     float64 `json:"load1"`
+	Load5     float64 `json:"load5"`
+	Load15    float64 `json:"load15"`
+
+	// MemoryTotalKiB and MemoryFreeKiB are reported by the host. Memory
+	// committed to running domains counts against MemoryAvailableKiB even
+	// when the guests have not touched it yet.
+	MemoryTotalKiB     uint64 `json:"memory_total_kib"`
+	MemoryFreeKiB      uint64 `json:"memory_free_kib"`
+	MemoryCommittedKiB uint64 `json:"memory_committed_kib"`
+	MemoryAvailableKiB uint64 `json:"memory_available_kib"`
+	VCPUsCommitted     int    `json:"vcpus_committed"`
+
+	Pools []PoolCapacity `json:"pools"`
+}
+
+// PoolCapacity describes the space in an active storage pool.
+type PoolCapacity struct {
+	Name           string `json:"name"`
+	CapacityBytes  uint64 `json:"capacity_bytes"`
+	AllocatedBytes uint64 `json:"allocated_bytes"`
+	AvailableBytes uint64 `json:"available_bytes"`
+}
+
+// Resources are the resources a new domain needs on the host. DiskBytes
+// is checked against Pool and ignored when Pool is empty.
+type Resources struct {
+	VCPUs     int    `json:"vcpus"`
+	MemoryMiB uint64 `json:"memory_mib"`
+	DiskBytes uint64 `json:"disk_bytes"`
+	Pool      string `json:"pool,omitempty"`
+}
+
+// HostManager reports on the hypervisor host over a libvirt connection.
+type HostManager struct {
+	conn *libvirt.Libvirt
+
+	// Logger receives errors CanSchedule cannot return, nothing is logged
+	// when it is nil.
+	Logger logging.Logger
+
+	capsMu sync.Mutex
+	caps   *HostCaps
+}
+
+// NewHostManager creates a HostManager using the given libvirt connection.
+func NewHostManager(conn *libvirt.Libvirt) *HostManager {
+	return &HostManager{conn: conn}
+}
+
+// HostInfo collects the current capacity of the host. When libvirtd cannot
+// be reached the returned info has Connected unset along with the error.
+func (m *HostManager) HostInfo() (HostInfo, error) {
+	info := HostInfo{Connected: m.conn.IsConnected()}
+	if !info.Connected {
+		return info, fmt.Errorf("not connected to libvirt")
+	}
+
+	_, memKiB, cpus, _, _, _, _, _, err := m.conn.NodeGetInfo()
+	if err != nil {
+		info.Connected = false
+		return info, fmt.Errorf("failed to get node info: %w", err)
+	}
+	info.CPUs = int(cpus)
+	info.MemoryTotalKiB = memKiB
+
+	freeBytes, err := m.conn.NodeGetFreeMemory()
+	if err != nil {
+		return info, fmt.Errorf("failed to get free memory: %w", err)
+	}
+	info.MemoryFreeKiB = freeBytes / 1024
+
+	if hostname, err := m.conn.ConnectGetHostname(); err == nil {
+		info.Hostname = hostname
+	}
+
+	// Load is read locally, so it is only meaningful for a local libvirtd.
+	if avg, err := load.Avg(); err == nil {
+		info.Load1, info.Load5, info.Load15 = avg.Load1, avg.Load5, avg.Load15
+	}
+
+	domains, _, err := m.conn.ConnectListAllDomains(1, libvirt.ConnectListDomainsActive)
+	if err != nil {
+		return info, fmt.Errorf("failed to list domains: %w", err)
+	}
+	for _, dom := range domains {
+		_, maxMem, _, vcpus, _, err := m.conn.DomainGetInfo(dom)
+		if err != nil {
+			// The domain may have stopped since it was listed.
+			if isLibvirtError(err, libvirt.ErrNoDomain) {
+				continue
+			}
+			return info, fmt.Errorf("failed to get info for domain %s: %w", dom.Name, err)
+		}
+		info.MemoryCommittedKiB += maxMem
+		info.VCPUsCommitted += int(vcpus)
+	}
+	if info.MemoryCommittedKiB < info.MemoryTotalKiB {
+		info.MemoryAvailableKiB = info.MemoryTotalKiB - info.MemoryCommittedKiB
+	}
+
+	pools, _, err := m.conn.ConnectListAllStoragePools(1, libvirt.ConnectListStoragePoolsActive)
+	if err != nil {
+		return info, fmt.Errorf("failed to list storage pools: %w", err)
+	}
+	info.Pools = make([]PoolCapacity, 0, len(pools))
+	for _, pool := range pools {
+		_, capacity, allocation, available, err := m.conn.StoragePoolGetInfo(pool)
+		if err != nil {
+			return info, fmt.Errorf("failed to get info for pool %s: %w", pool.Name, err)
+		}
+		info.Pools = append(info.Pools, PoolCapacity{
+			Name:           pool.Name,
+			CapacityBytes:  capacity,
+			AllocatedBytes: allocation,
+			AvailableBytes: available,
+		})
+	}
+
+	return info, nil
+}
+
+// CanSchedule reports whether the host can take a domain needing required.
+// Memory is checked against what is left after the memory committed to
+// running domains, and the host must be reachable.
+func (m *HostManager) CanSchedule(required Resources) bool {
+	info, err := m.HostInfo()
+	if err != nil {
+		logging.OrNop(m.Logger).Error("failed to check host capacity", "err", err)
+		return false
+	}
+	return info.fits(required)
+}
+
+func (info HostInfo) fits(required Resources) bool {
+	if !info.Connected {
+		return false
+	}
+	if required.VCPUs > info.CPUs {
+		return false
+	}
+	if required.MemoryMiB*1024 > info.MemoryAvailableKiB {
+		return false
+	}
+	if required.Pool == "" {
+		return true
+	}
+	for _, pool := range info.Pools {
+		if pool.Name == required.Pool {
+			return required.DiskBytes <= pool.AvailableBytes
+		}
+	}
+	return false
+}
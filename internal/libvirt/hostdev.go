@@ -0,0 +1,250 @@
+package libvirt
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// ErrIOMMUDisabled is returned when a PCI device cannot be passed through
+// because the host has no IOMMU enabled.
+var ErrIOMMUDisabled = errors.New("IOMMU is not enabled on the host, boot it with intel_iommu=on or amd_iommu=on")
+
+// HostDeviceSpec describes a host PCI or USB device passed through to the
+// guest. PCI devices must be bound to vfio-pci beforehand; libvirt does not
+// rebind them.
+type HostDeviceSpec struct {
+	Type   string // "pci" or "usb"
+	Device string // PCI address "0000:01:00.0" (domain optional) or USB "vendor:product", e.g. "1050:0407"
+}
+
+var (
+	pciAddressPattern = regexp.MustCompile(`^(?:([0-9a-fA-F]{4}):)?([0-9a-fA-F]{2}):([0-9a-fA-F]{2})\.([0-7])$`)
+	usbIDPattern      = regexp.MustCompile(`^([0-9a-fA-F]{4}):([0-9a-fA-F]{4})$`)
+)
+
+// Validate checks the device type and address syntax.
+func (d HostDeviceSpec) Validate() error {
+	switch d.Type {
+	case "pci":
+		if !pciAddressPattern.MatchString(d.Device) {
+			return fmt.Errorf("invalid pci address %q, expected domain:bus:slot.function", d.Device)
+		}
+	case "usb":
+		if !usbIDPattern.MatchString(d.Device) {
+			return fmt.Errorf("invalid usb device %q, expected vendor:product", d.Device)
+		}
+	default:
+		return fmt.Errorf("invalid type %q", d.Type)
+	}
+	return nil
+}
+
+func buildHostdevXML(d HostDeviceSpec) hostdevXML {
+	x := hostdevXML{Mode: "subsystem", Type: d.Type}
+	switch d.Type {
+	case "pci":
+		x.Managed = "no"
+		x.Source.Address = pciAddress(d.Device)
+	case "usb":
+		m := usbIDPattern.FindStringSubmatch(d.Device)
+		x.Source.Vendor = &usbIDXML{ID: "0x" + strings.ToLower(m[1])}
+		x.Source.Product = &usbIDXML{ID: "0x" + strings.ToLower(m[2])}
+	}
+	return x
+}
+
+// pciAddress splits a validated PCI address, defaulting the domain to 0000.
+func pciAddress(device string) *pciAddressXML {
+	m := pciAddressPattern.FindStringSubmatch(strings.ToLower(device))
+	domain := m[1]
+	if domain == "" {
+		domain = "0000"
+	}
+	return &pciAddressXML{Domain: "0x" + domain, Bus: "0x" + m[2], Slot: "0x" + m[3], Function: "0x" + m[4]}
+}
+
+// sameHostdev reports whether the hostdev XML of a domain refers to d.
+func sameHostdev(x hostdevXML, d HostDeviceSpec) bool {
+	if x.Type != d.Type {
+		return false
+	}
+	want := buildHostdevXML(d).Source
+	switch d.Type {
+	case "pci":
+		return x.Source.Address != nil && normalizePCI(*x.Source.Address) == *want.Address
+	default:
+		return x.Source.Vendor != nil && x.Source.Product != nil &&
+			strings.EqualFold(x.Source.Vendor.ID, want.Vendor.ID) &&
+			strings.EqualFold(x.Source.Product.ID, want.Product.ID)
+	}
+}
+
+// normalizePCI pads the address fields as libvirt may write them, e.g. "0x1"
+// instead of "0x01".
+func normalizePCI(a pciAddressXML) pciAddressXML {
+	pad := func(v string, width int) string {
+		v = strings.TrimPrefix(strings.ToLower(v), "0x")
+		return "0x" + strings.Repeat("0", max(0, width-len(v))) + v
+	}
+	return pciAddressXML{Domain: pad(a.Domain, 4), Bus: pad(a.Bus, 2), Slot: pad(a.Slot, 2), Function: pad(a.Function, 1)}
+}
+
+// checkHostDevice checks that the device exists on the host and can be
+// passed through: PCI devices need an IOMMU group and the vfio-pci driver.
+func checkHostDevice(conn *libvirt.Libvirt, d HostDeviceSpec) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	if d.Type == "usb" {
+		return checkUSBDevice(conn, d)
+	}
+
+	a := pciAddress(d.Device)
+	name := fmt.Sprintf("pci_%s_%s_%s_%s", a.Domain[2:], a.Bus[2:], a.Slot[2:], a.Function[2:])
+	raw, err := conn.NodeDeviceGetXMLDesc(name, 0)
+	if isLibvirtError(err, libvirt.ErrNoNodeDevice) {
+		return fmt.Errorf("pci device %s does not exist on the host", d.Device)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get pci device %s: %w", d.Device, err)
+	}
+	var dev nodeDeviceXML
+	if err := xml.Unmarshal([]byte(raw), &dev); err != nil {
+		return fmt.Errorf("failed to parse pci device %s: %w", d.Device, err)
+	}
+	if dev.Capability.IOMMUGroup == nil {
+		return fmt.Errorf("cannot pass through pci device %s: %w", d.Device, ErrIOMMUDisabled)
+	}
+	switch dev.Driver {
+	case "vfio-pci":
+		return nil
+	case "":
+		return fmt.Errorf("pci device %s is not bound to any driver, bind it to vfio-pci first", d.Device)
+	default:
+		return fmt.Errorf("pci device %s is bound to the host driver %s, bind it to vfio-pci first, e.g. with driverctl set-override %s vfio-pci", d.Device, dev.Driver, d.Device)
+	}
+}
+
+func checkUSBDevice(conn *libvirt.Libvirt, d HostDeviceSpec) error {
+	devs, _, err := conn.ConnectListAllNodeDevices(1, uint32(libvirt.ConnectListNodeDevicesCapUsbDev))
+	if err != nil {
+		return fmt.Errorf("failed to list usb devices: %w", err)
+	}
+	want := buildHostdevXML(d).Source
+	found := 0
+	for _, dev := range devs {
+		raw, err := conn.NodeDeviceGetXMLDesc(dev.Name, 0)
+		if err != nil {
+			continue // Unplugged since it was listed
+		}
+		var x nodeDeviceXML
+		if err := xml.Unmarshal([]byte(raw), &x); err != nil {
+			return fmt.Errorf("failed to parse usb device %s: %w", dev.Name, err)
+		}
+		if strings.EqualFold(x.Capability.Vendor.ID, want.Vendor.ID) && strings.EqualFold(x.Capability.Product.ID, want.Product.ID) {
+			found++
+		}
+	}
+	switch found {
+	case 0:
+		return fmt.Errorf("usb device %s is not plugged into the host", d.Device)
+	case 1:
+		return nil
+	default:
+		return fmt.Errorf("usb device %s is ambiguous, %d devices with that id are plugged in", d.Device, found)
+	}
+}
+
+// CheckHostDevices checks that every host device in spec can be passed
+// through on this host.
+func (m *HostManager) CheckHostDevices(spec DomainSpec) error {
+	var errs []error
+	for _, d := range spec.HostDevices {
+		if err := checkHostDevice(m.conn, d); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AttachHostDevice passes a host device through to the domain's persistent
+// config and, with live set, to the running domain.
+func (m *DomainManager) AttachHostDevice(name string, d HostDeviceSpec, live bool) error {
+	if err := checkHostDevice(m.conn, d); err != nil {
+		return fmt.Errorf("cannot attach host device to domain %s: %w", name, err)
+	}
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	domain, err := m.domainXML(dom)
+	if err != nil {
+		return err
+	}
+	for _, existing := range domain.Devices.HostDevs {
+		if sameHostdev(existing, d) {
+			return fmt.Errorf("cannot attach host device to domain %s: %s is already attached", name, d.Device)
+		}
+	}
+
+	out, err := xml.Marshal(buildHostdevXML(d))
+	if err != nil {
+		return fmt.Errorf("failed to build hostdev XML: %w", err)
+	}
+	if err := m.conn.DomainAttachDeviceFlags(dom, string(out), deviceFlags(live)); err != nil {
+		return fmt.Errorf("failed to attach host device %s to domain %s: %w", d.Device, name, err)
+	}
+	return nil
+}
+
+// DetachHostDevice removes a passed through host device from the domain's
+// persistent config and, with live set, from the running domain. A live
+// detach waits until the guest has released the device or ctx is cancelled.
+func (m *DomainManager) DetachHostDevice(ctx context.Context, name string, d HostDeviceSpec, live bool) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	domain, err := m.domainXML(dom)
+	if err != nil {
+		return err
+	}
+	var found *hostdevXML
+	for i, existing := range domain.Devices.HostDevs {
+		if sameHostdev(existing, d) {
+			found = &domain.Devices.HostDevs[i]
+			break
+		}
+	}
+	if found == nil {
+		return fmt.Errorf("cannot detach host device from domain %s: %s is not attached", name, d.Device)
+	}
+
+	out, err := xml.Marshal(found)
+	if err != nil {
+		return fmt.Errorf("failed to build hostdev XML: %w", err)
+	}
+	if err := m.conn.DomainDetachDeviceFlags(dom, string(out), deviceFlags(live)); err != nil {
+		return fmt.Errorf("failed to detach host device %s from domain %s: %w", d.Device, name, err)
+	}
+	if !live {
+		return nil
+	}
+	return m.waitForDetach(ctx, dom, func(domain domainXML) bool {
+		for _, existing := range domain.Devices.HostDevs {
+			if sameHostdev(existing, d) {
+				return false
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,123 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// BlockIOLimits throttles a disk. Zero fields are unlimited. A total limit
+// cannot be combined with the read or write limit of the same kind.
+type BlockIOLimits struct {
+	TotalBytesSec uint64 `json:"total_bytes_sec,omitempty"`
+	ReadBytesSec  uint64 `json:"read_bytes_sec,omitempty"`
+	WriteBytesSec uint64 `json:"write_bytes_sec,omitempty"`
+	TotalIOPSSec  uint64 `json:"total_iops_sec,omitempty"`
+	ReadIOPSSec   uint64 `json:"read_iops_sec,omitempty"`
+	WriteIOPSSec  uint64 `json:"write_iops_sec,omitempty"`
+}
+
+// Validate rejects limits libvirt would refuse.
+func (l BlockIOLimits) Validate() error {
+	var errs []error
+	if l.TotalBytesSec != 0 && (l.ReadBytesSec != 0 || l.WriteBytesSec != 0) {
+		errs = append(errs, errors.New("total_bytes_sec cannot be combined with read_bytes_sec or write_bytes_sec"))
+	}
+	if l.TotalIOPSSec != 0 && (l.ReadIOPSSec != 0 || l.WriteIOPSSec != 0) {
+		errs = append(errs, errors.New("total_iops_sec cannot be combined with read_iops_sec or write_iops_sec"))
+	}
+	return errors.Join(errs...)
+}
+
+// IsZero reports whether no limit is set.
+func (l BlockIOLimits) IsZero() bool {
+	return l == BlockIOLimits{}
+}
+
+func (l BlockIOLimits) xml() *iotuneXML {
+	return &iotuneXML{
+		TotalBytesSec: l.TotalBytesSec,
+		ReadBytesSec:  l.ReadBytesSec,
+		WriteBytesSec: l.WriteBytesSec,
+		TotalIOPSSec:  l.TotalIOPSSec,
+		ReadIOPSSec:   l.ReadIOPSSec,
+		WriteIOPSSec:  l.WriteIOPSSec,
+	}
+}
+
+// SetBlockIOTune replaces the limits of the disk attached as dev, e.g.
+// "vda". Fields left zero remove that limit. The limits are written to the
+// domain config and, when the domain is running, applied to it immediately.
+func (m *DomainManager) SetBlockIOTune(name, dev string, limits BlockIOLimits) error {
+	if err := limits.Validate(); err != nil {
+		return fmt.Errorf("invalid limits for disk %s: %w", dev, err)
+	}
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	if _, err := m.findDisk(dom, dev); err != nil {
+		return err
+	}
+	flags, err := m.affectFlags(dom)
+	if err != nil {
+		return err
+	}
+
+	// Every field is sent so limits that were set before are cleared
+	params := []libvirt.TypedParam{
+		ullongParam("total_bytes_sec", limits.TotalBytesSec),
+		ullongParam("read_bytes_sec", limits.ReadBytesSec),
+		ullongParam("write_bytes_sec", limits.WriteBytesSec),
+		ullongParam("total_iops_sec", limits.TotalIOPSSec),
+		ullongParam("read_iops_sec", limits.ReadIOPSSec),
+		ullongParam("write_iops_sec", limits.WriteIOPSSec),
+	}
+	if err := m.conn.DomainSetBlockIOTune(dom, dev, params, flags); err != nil {
+		return fmt.Errorf("failed to set io limits of disk %s on domain %s: %w", dev, name, err)
+	}
+	return nil
+}
+
+// GetBlockIOTune returns the current limits of the disk attached as dev,
+// from the running domain when it is running and its config otherwise.
+func (m *DomainManager) GetBlockIOTune(name, dev string) (BlockIOLimits, error) {
+	dom, err := m.lookup(name)
+	if err != nil {
+		return BlockIOLimits{}, err
+	}
+	// The first call only returns how many parameters there are
+	_, count, err := m.conn.DomainGetBlockIOTune(dom, libvirt.OptString{dev}, 0, 0)
+	if err != nil {
+		return BlockIOLimits{}, fmt.Errorf("failed to get io limits of disk %s on domain %s: %w", dev, name, err)
+	}
+	params, _, err := m.conn.DomainGetBlockIOTune(dom, libvirt.OptString{dev}, count, 0)
+	if err != nil {
+		return BlockIOLimits{}, fmt.Errorf("failed to get io limits of disk %s on domain %s: %w", dev, name, err)
+	}
+
+	var limits BlockIOLimits
+	for _, param := range params {
+		value := paramUint(param.Value.I)
+		switch param.Field {
+		case "total_bytes_sec":
+			limits.TotalBytesSec = value
+		case "read_bytes_sec":
+			limits.ReadBytesSec = value
+		case "write_bytes_sec":
+			limits.WriteBytesSec = value
+		case "total_iops_sec":
+			limits.TotalIOPSSec = value
+		case "read_iops_sec":
+			limits.ReadIOPSSec = value
+		case "write_iops_sec":
+			limits.WriteIOPSSec = value
+		}
+	}
+	return limits, nil
+}
+
+func ullongParam(field string, value uint64) libvirt.TypedParam {
+	return libvirt.TypedParam{Field: field, Value: *libvirt.NewTypedParamValueUllong(value)}
+}
@@ -0,0 +1,307 @@
+package libvirt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"libvirt-controller/internal/logging"
+	"libvirt-controller/internal/state"
+)
+
+// ErrJobNotFound is returned for a job id the JobManager does not know. It
+// wraps ErrNotFound.
+var ErrJobNotFound = fmt.Errorf("job %w", ErrNotFound)
+
+// defaultJobRetention is how long finished jobs are kept when
+// JobManager.Retention is not set.
+const defaultJobRetention = 24 * time.Hour
+
+// JobID identifies a job submitted to a JobManager.
+type JobID string
+
+// JobState is the lifecycle state of a job.
+type JobState string
+
+const (
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+// Finished reports whether the job has stopped running.
+func (s JobState) Finished() bool {
+	return s != JobRunning
+}
+
+// JobStatus is a snapshot of a job. Progress is a percentage and stays zero
+// for jobs that do not report any.
+type JobStatus struct {
+	ID         JobID     `json:"id"`
+	State      JobState  `json:"state"`
+	Progress   float64   `json:"progress"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	FinishedAt time.Time `json:"finished_at,omitzero"`
+}
+
+// JobFunc is the work of a job. It should return once ctx is cancelled and
+// may report its progress as a percentage.
+type JobFunc func(ctx context.Context, progress JobProgress) error
+
+// JobProgress reports the progress of a job as a percentage.
+type JobProgress func(percent float64)
+
+// Download adapts p to filesystem.DownloadOptions.Progress.
+func (p JobProgress) Download() func(bytesDone, bytesTotal int64) {
+	return func(done, total int64) {
+		if total > 0 {
+			p(100 * float64(done) / float64(total))
+		}
+	}
+}
+
+// Migration adapts p to MigrateOptions.Progress.
+func (p JobProgress) Migration() func(MigrationProgress) {
+	return func(mp MigrationProgress) {
+		if mp.DataTotal > 0 {
+			p(100 * float64(mp.DataProcessed) / float64(mp.DataTotal))
+		}
+	}
+}
+
+// BlockJob adapts p to FlattenOptions.Progress.
+func (p JobProgress) BlockJob() func(BlockJobProgress) {
+	return func(bp BlockJobProgress) {
+		if bp.End > 0 {
+			p(100 * float64(bp.Cur) / float64(bp.End))
+		}
+	}
+}
+
+// JobManager runs long operations in the background so callers can poll
+// their status instead of blocking on them.
+//
+// With a store, the status of every job is saved when it starts and
+// finishes. A job that was still running when the process exited is
+// reported as failed afterwards, since its work was interrupted.
+type JobManager struct {
+	store *state.Store
+
+	// Logger receives errors saving job records, nothing is logged when
+	// it is nil.
+	Logger logging.Logger
+
+	// Retention is how long finished jobs can still be queried, 24 hours
+	// when zero.
+	Retention time.Duration
+
+	ctx    context.Context // Parent of the job contexts, cancelled by Shutdown
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu   sync.Mutex
+	jobs map[JobID]*job
+}
+
+type job struct {
+	status JobStatus
+	cancel context.CancelFunc
+}
+
+// NewJobManager creates a JobManager saving job records in store, which may
+// be nil to keep jobs in memory only.
+func NewJobManager(store *state.Store) *JobManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &JobManager{store: store, ctx: ctx, cancel: cancel, jobs: make(map[JobID]*job)}
+}
+
+// Submit starts fn in a new goroutine and returns the id of its job. After
+// Shutdown the job is cancelled right away.
+func (m *JobManager) Submit(fn JobFunc) JobID {
+	id := newJobID()
+	ctx, cancel := context.WithCancel(m.ctx)
+	j := &job{
+		status: JobStatus{ID: id, State: JobRunning, CreatedAt: time.Now().UTC()},
+		cancel: cancel,
+	}
+
+	m.mu.Lock()
+	m.prune()
+	m.jobs[id] = j
+	m.mu.Unlock()
+	m.save(j.status)
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer cancel()
+		err := fn(ctx, func(percent float64) {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			j.status.Progress = min(max(percent, j.status.Progress), 100)
+		})
+
+		m.mu.Lock()
+		if j.status.State.Finished() {
+			// Shutdown gave up on the job and has already saved it
+			m.mu.Unlock()
+			return
+		}
+		switch {
+		case err == nil:
+			j.status.State = JobSucceeded
+			j.status.Progress = 100
+		case ctx.Err() != nil:
+			j.status.State = JobCancelled
+			j.status.Error = err.Error()
+		default:
+			j.status.State = JobFailed
+			j.status.Error = err.Error()
+		}
+		j.status.FinishedAt = time.Now().UTC()
+		status := j.status
+		m.mu.Unlock()
+		m.save(status)
+	}()
+	return id
+}
+
+// Shutdown cancels every running job and waits for their functions to
+// return, so downloads remove their partial files and block jobs are
+// aborted. Jobs still running when ctx is done are saved as failed and
+// ctx.Err() is returned.
+func (m *JobManager) Shutdown(ctx context.Context) error {
+	m.cancel()
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	var abandoned []JobStatus
+	m.mu.Lock()
+	for _, j := range m.jobs {
+		if j.status.State.Finished() {
+			continue
+		}
+		j.status.State = JobFailed
+		j.status.Error = "job was interrupted by a shutdown of the controller"
+		j.status.FinishedAt = time.Now().UTC()
+		abandoned = append(abandoned, j.status)
+	}
+	m.mu.Unlock()
+	for _, status := range abandoned {
+		m.save(status)
+	}
+	return ctx.Err()
+}
+
+// Status returns the status of the job, or an error wrapping ErrJobNotFound.
+func (m *JobManager) Status(id JobID) (JobStatus, error) {
+	m.mu.Lock()
+	j, ok := m.jobs[id]
+	if ok {
+		status := j.status
+		m.mu.Unlock()
+		return status, nil
+	}
+	m.mu.Unlock()
+
+	if _, err := hex.DecodeString(string(id)); m.store == nil || err != nil || len(id) != 32 {
+		return JobStatus{}, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	rec, err := m.store.GetJob(string(id))
+	if errors.Is(err, state.ErrNotFound) {
+		return JobStatus{}, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	if err != nil {
+		return JobStatus{}, err
+	}
+	status := JobStatus{
+		ID:         JobID(rec.ID),
+		State:      JobState(rec.State),
+		Progress:   rec.Progress,
+		Error:      rec.Error,
+		CreatedAt:  rec.CreatedAt,
+		FinishedAt: rec.FinishedAt,
+	}
+	// Running jobs are all in memory, so this one died with its process
+	if !status.State.Finished() {
+		status.State = JobFailed
+		status.Error = "job was interrupted by a restart of the controller"
+		status.FinishedAt = rec.UpdatedAt
+		m.save(status)
+	}
+	return status, nil
+}
+
+// Cancel cancels the context of a running job. The job keeps running until
+// its function returns and is then reported as cancelled. Cancelling a
+// finished job does nothing.
+func (m *JobManager) Cancel(id JobID) error {
+	m.mu.Lock()
+	j, ok := m.jobs[id]
+	m.mu.Unlock()
+	if ok {
+		j.cancel()
+		return nil
+	}
+	// A job from before a restart has nothing left to cancel
+	_, err := m.Status(id)
+	return err
+}
+
+// prune forgets jobs that finished longer than Retention ago. The caller
+// must hold m.mu.
+func (m *JobManager) prune() {
+	retention := m.Retention
+	if retention <= 0 {
+		retention = defaultJobRetention
+	}
+	for id, j := range m.jobs {
+		if !j.status.State.Finished() || time.Since(j.status.FinishedAt) < retention {
+			continue
+		}
+		delete(m.jobs, id)
+		if m.store != nil {
+			if err := m.store.DeleteJob(string(id)); err != nil {
+				logging.OrNop(m.Logger).Error("failed to delete job record", "job", id, "err", err)
+			}
+		}
+	}
+}
+
+// save writes status to the store, if there is one.
+func (m *JobManager) save(status JobStatus) {
+	if m.store == nil {
+		return
+	}
+	err := m.store.PutJob(state.JobRecord{
+		ID:         string(status.ID),
+		State:      string(status.State),
+		Progress:   status.Progress,
+		Error:      status.Error,
+		CreatedAt:  status.CreatedAt,
+		FinishedAt: status.FinishedAt,
+	})
+	if err != nil {
+		logging.OrNop(m.Logger).Error("failed to save job record", "job", status.ID, "err", err)
+	}
+}
+
+func newJobID() JobID {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return JobID(hex.EncodeToString(b))
+}
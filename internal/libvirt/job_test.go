@@ -0,0 +1,131 @@
+package libvirt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"libvirt-controller/internal/state"
+)
+
+func TestJobManager(t *testing.T) {
+	dir := t.TempDir()
+	store, err := state.NewStore(dir)
+	if err != nil {
+		t.Fatalf("error opening store. Err: %v", err)
+	}
+	jobs := NewJobManager(store)
+
+	wait := func(id JobID) JobStatus {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			status, err := jobs.Status(id)
+			if err != nil {
+				t.Fatalf("error getting job status. Err: %v", err)
+			}
+			if status.State.Finished() {
+				return status
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("job %s did not finish", id)
+		return JobStatus{}
+	}
+
+	ok := jobs.Submit(func(ctx context.Context, progress JobProgress) error {
+		progress.Download()(50, 200)
+		return nil
+	})
+	if status := wait(ok); status.State != JobSucceeded || status.Progress != 100 {
+		t.Errorf("expected succeeded job at 100%%; got %s at %v", status.State, status.Progress)
+	}
+
+	failed := jobs.Submit(func(context.Context, JobProgress) error {
+		return errors.New("disk full")
+	})
+	if status := wait(failed); status.State != JobFailed || status.Error != "disk full" {
+		t.Errorf("expected failed job with error %q; got %s with %q", "disk full", status.State, status.Error)
+	}
+
+	started := make(chan struct{})
+	blocked := jobs.Submit(func(ctx context.Context, _ JobProgress) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	<-started
+	if err := jobs.Cancel(blocked); err != nil {
+		t.Fatalf("error cancelling job. Err: %v", err)
+	}
+	if status := wait(blocked); status.State != JobCancelled {
+		t.Errorf("expected cancelled job; got %s", status.State)
+	}
+
+	// A job still running when the process stopped is reported as failed
+	if err := store.PutJob(state.JobRecord{ID: "0123456789abcdef0123456789abcdef", State: string(JobRunning)}); err != nil {
+		t.Fatalf("error saving job. Err: %v", err)
+	}
+	restarted := NewJobManager(store)
+	status, err := restarted.Status("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatalf("error getting interrupted job. Err: %v", err)
+	}
+	if status.State != JobFailed || status.Error == "" {
+		t.Errorf("expected interrupted job to be failed; got %s", status.State)
+	}
+	if status, err := restarted.Status(ok); err != nil || status.State != JobSucceeded {
+		t.Errorf("expected finished job to survive a restart; got %s, %v", status.State, err)
+	}
+	if _, err := restarted.Status("missing"); !errors.Is(err, ErrJobNotFound) {
+		t.Errorf("expected ErrJobNotFound; got %v", err)
+	}
+}
+
+func TestJobManagerShutdown(t *testing.T) {
+	jobs := NewJobManager(nil)
+
+	started := make(chan struct{}, 2)
+	cooperative := jobs.Submit(func(ctx context.Context, _ JobProgress) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	release := make(chan struct{})
+	defer close(release)
+	stuck := jobs.Submit(func(context.Context, JobProgress) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+	<-started
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := jobs.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected shutdown to give up on the stuck job; got %v", err)
+	}
+	if status, _ := jobs.Status(cooperative); status.State != JobCancelled {
+		t.Errorf("expected cancelled job; got %s", status.State)
+	}
+	if status, _ := jobs.Status(stuck); status.State != JobFailed || status.Error == "" {
+		t.Errorf("expected stuck job to be failed; got %s", status.State)
+	}
+
+	late := jobs.Submit(func(ctx context.Context, _ JobProgress) error {
+		return ctx.Err()
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if status, _ := jobs.Status(late); status.State.Finished() {
+			if status.State != JobCancelled {
+				t.Errorf("expected job submitted after shutdown to be cancelled; got %s", status.State)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("job submitted after shutdown did not finish")
+}
@@ -0,0 +1,95 @@
+package libvirt
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"libvirt-controller/internal/helpers"
+)
+
+// Layout is where the controller keeps the files of its VMs: one directory
+// per VM below Base, named after the VM id, holding the domain XML, the disk
+// overlays, the cloud-init seed and the UEFI variable store. Provisioner
+// writes the same names into VMSpec.Dir, so a VMSpec built from a Layout
+// and the files it creates line up.
+type Layout struct {
+	Base string
+}
+
+// VMDir returns the directory of the VM. vmID must be a single path element,
+// so it can never name a directory outside of Base.
+func (l Layout) VMDir(vmID string) (string, error) {
+	if !filepath.IsAbs(l.Base) {
+		return "", fmt.Errorf("VM base directory %q must be absolute", l.Base)
+	}
+	if err := checkPathElement("VM id", vmID); err != nil {
+		return "", err
+	}
+	return filepath.Join(l.Base, vmID), nil
+}
+
+// ConfigDir returns the directory holding the domain XML of the VM.
+func (l Layout) ConfigDir(vmID string) (string, error) {
+	return l.VMDir(vmID)
+}
+
+// ConfigPath returns the path of the domain XML of the VM.
+func (l Layout) ConfigPath(vmID string) (string, error) {
+	return l.file(vmID, domainXMLName)
+}
+
+// DiskPath returns the path of the qcow2 overlay for the disk with target
+// dev.
+func (l Layout) DiskPath(vmID, dev string) (string, error) {
+	if err := checkPathElement("disk target", dev); err != nil {
+		return "", err
+	}
+	return l.file(vmID, dev+".qcow2")
+}
+
+// SeedISOPath returns the path of the cloud-init seed ISO for ds.
+func (l Layout) SeedISOPath(vmID string, ds helpers.Datasource) (string, error) {
+	return l.file(vmID, ds.ISOName())
+}
+
+// NVRAMPath returns the path of the UEFI variable store of the VM.
+func (l Layout) NVRAMPath(vmID string) (string, error) {
+	return l.file(vmID, nvramName)
+}
+
+// Files returns every file the controller may create for the VM with the
+// given disk targets, whether or not it exists.
+func (l Layout) Files(vmID string, devs []string) ([]string, error) {
+	files := []string{domainXMLName, nvramName, helpers.DatasourceNoCloud.ISOName(), helpers.DatasourceConfigDrive.ISOName()}
+	for _, dev := range devs {
+		if err := checkPathElement("disk target", dev); err != nil {
+			return nil, err
+		}
+		files = append(files, dev+".qcow2")
+	}
+	dir, err := l.VMDir(vmID)
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range files {
+		files[i] = filepath.Join(dir, name)
+	}
+	return files, nil
+}
+
+func (l Layout) file(vmID, name string) (string, error) {
+	dir, err := l.VMDir(vmID)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// checkPathElement rejects values that would not stay a single path element
+// when joined to a directory, such as "..", ".", "a/b" or "".
+func checkPathElement(what, v string) error {
+	if v == "" || v == "." || v != filepath.Base(v) || !filepath.IsLocal(v) {
+		return fmt.Errorf("invalid %s %q", what, v)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package libvirt
+
+import "testing"
+
+func TestLayoutRejectsEscapes(t *testing.T) {
+	layout := Layout{Base: "/var/lib/vms"}
+
+	got, err := layout.DiskPath("web1", "vda")
+	if err != nil {
+		t.Fatalf("error building disk path. Err: %v", err)
+	}
+	if got != "/var/lib/vms/web1/vda.qcow2" {
+		t.Errorf("expected /var/lib/vms/web1/vda.qcow2; got %s", got)
+	}
+
+	for _, id := range []string{"", ".", "..", "../etc", "a/b", "/abs"} {
+		if _, err := layout.VMDir(id); err == nil {
+			t.Errorf("expected VM id %q to be rejected", id)
+		}
+	}
+	if _, err := layout.DiskPath("web1", "../../x"); err == nil {
+		t.Errorf("expected disk target escaping the VM directory to be rejected")
+	}
+}
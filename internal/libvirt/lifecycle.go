@@ -0,0 +1,127 @@
+package libvirt
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// DomainEvent is a lifecycle transition of a domain.
+type DomainEvent string
+
+const (
+	EventStarted   DomainEvent = "started"
+	EventStopped   DomainEvent = "stopped"
+	EventCrashed   DomainEvent = "crashed"
+	EventSuspended DomainEvent = "suspended"
+	EventResumed   DomainEvent = "resumed"
+)
+
+// LifecycleHandler is called for every lifecycle event of any domain.
+type LifecycleHandler func(name string, event DomainEvent)
+
+// lifecycleEvents is the event loop state of a DomainManager.
+type lifecycleEvents struct {
+	mu       sync.Mutex
+	handlers []LifecycleHandler
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// OnLifecycleEvent registers fn to be called when a domain starts, stops,
+// crashes, is suspended or resumes. The event loop is started with the first
+// handler. Handlers run one at a time on the event loop and must not block.
+func (m *DomainManager) OnLifecycleEvent(fn LifecycleHandler) error {
+	m.events.mu.Lock()
+	defer m.events.mu.Unlock()
+
+	if m.events.cancel == nil {
+		if err := m.startEventLoop(); err != nil {
+			return err
+		}
+	}
+	m.events.handlers = append(m.events.handlers, fn)
+	return nil
+}
+
+// Close stops the event loop and waits for it to exit. Registered handlers
+// are removed.
+func (m *DomainManager) Close() error {
+	m.events.mu.Lock()
+	cancel, done := m.events.cancel, m.events.done
+	m.events.cancel, m.events.done = nil, nil
+	m.events.handlers = nil
+	m.events.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	return nil
+}
+
+// startEventLoop subscribes to lifecycle events. It must be called with
+// events.mu held.
+func (m *DomainManager) startEventLoop() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := m.conn.LifecycleEvents(ctx)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to subscribe to lifecycle events: %w", err)
+	}
+	done := make(chan struct{})
+	m.events.cancel, m.events.done = cancel, done
+
+	go func() {
+		defer close(done)
+		// go-libvirt closes the channel once ctx is cancelled or the
+		// connection is lost
+		for msg := range ch {
+			event, ok := lifecycleEvent(msg)
+			if !ok {
+				continue
+			}
+			m.events.mu.Lock()
+			handlers := append([]LifecycleHandler(nil), m.events.handlers...)
+			m.events.mu.Unlock()
+			for _, fn := range handlers {
+				fn(msg.Dom.Name, event)
+			}
+		}
+
+		if ctx.Err() == nil {
+			m.log().Warn("lifecycle event stream closed, the next handler registration resubscribes")
+			m.events.mu.Lock()
+			if m.events.done == done {
+				m.events.cancel, m.events.done = nil, nil
+			}
+			m.events.mu.Unlock()
+			cancel()
+		}
+	}()
+	return nil
+}
+
+// lifecycleEvent maps a libvirt lifecycle event to a DomainEvent. Events
+// that don't change whether a domain runs, like defined, are skipped.
+func lifecycleEvent(msg libvirt.DomainEventLifecycleMsg) (DomainEvent, bool) {
+	switch libvirt.DomainEventType(msg.Event) {
+	case libvirt.DomainEventStarted:
+		return EventStarted, true
+	case libvirt.DomainEventStopped:
+		if libvirt.DomainEventStoppedDetailType(msg.Detail) == libvirt.DomainEventStoppedCrashed {
+			return EventCrashed, true
+		}
+		return EventStopped, true
+	case libvirt.DomainEventCrashed:
+		return EventCrashed, true
+	case libvirt.DomainEventSuspended, libvirt.DomainEventPmsuspended:
+		return EventSuspended, true
+	case libvirt.DomainEventResumed:
+		return EventResumed, true
+	default:
+		return "", false
+	}
+}
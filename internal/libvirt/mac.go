@@ -0,0 +1,155 @@
+package libvirt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// DefaultMACPrefix is the OUI QEMU uses for guest NICs.
+const DefaultMACPrefix = "52:54:00"
+
+// macAllocateAttempts is how often MACAllocator picks a new address before
+// giving up on finding an unused one.
+const macAllocateAttempts = 16
+
+// GenerateMAC returns a random MAC address starting with prefix, which is
+// DefaultMACPrefix when empty or invalid. The first octet always has the
+// locally-administered bit set and the multicast bit cleared.
+func GenerateMAC(prefix string) string {
+	return buildMAC(prefix, func(b []byte) {
+		// crypto/rand never returns an error on supported platforms
+		rand.Read(b)
+	})
+}
+
+// GenerateMACFromSeed returns the MAC address for seed, e.g. a VM UUID, so
+// the same VM always gets the same MAC across rebuilds.
+func GenerateMACFromSeed(prefix, seed string) string {
+	sum := sha256.Sum256([]byte(seed))
+	return buildMAC(prefix, func(b []byte) {
+		copy(b, sum[:])
+	})
+}
+
+// buildMAC combines the octets of prefix with octets from fill.
+func buildMAC(prefix string, fill func([]byte)) string {
+	head, ok := parseMACPrefix(prefix)
+	if !ok {
+		head, _ = parseMACPrefix(DefaultMACPrefix)
+	}
+	mac := make(net.HardwareAddr, 6)
+	copy(mac, head)
+	fill(mac[len(head):])
+	mac[0] = (mac[0] | 0x02) &^ 0x01
+	return mac.String()
+}
+
+// parseMACPrefix parses one to five colon separated octets.
+func parseMACPrefix(prefix string) ([]byte, bool) {
+	parts := strings.Split(prefix, ":")
+	if prefix == "" || len(parts) > 5 {
+		return nil, false
+	}
+	octets := make([]byte, len(parts))
+	for i, part := range parts {
+		v, err := strconv.ParseUint(part, 16, 8)
+		if err != nil || len(part) != 2 {
+			return nil, false
+		}
+		octets[i] = byte(v)
+	}
+	return octets, true
+}
+
+// MACAllocator hands out MAC addresses that are not used by any other domain
+// on the host.
+type MACAllocator struct {
+	conn *libvirt.Libvirt
+
+	// Prefix of allocated addresses, DefaultMACPrefix is used when it is empty.
+	Prefix string
+
+	mu sync.Mutex
+	// allocated holds addresses handed out but possibly not yet defined
+	allocated map[string]string
+}
+
+// NewMACAllocator creates a MACAllocator using the given libvirt connection.
+func NewMACAllocator(conn *libvirt.Libvirt) *MACAllocator {
+	return &MACAllocator{conn: conn, allocated: make(map[string]string)}
+}
+
+// Allocate returns a MAC address for the domain. With a seed the address is
+// derived from it and stays the same across rebuilds unless another domain
+// already uses it. Addresses used by the domain itself are not collisions.
+func (a *MACAllocator) Allocate(domainName, seed string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	used, err := a.usedMACs(domainName)
+	if err != nil {
+		return "", err
+	}
+	for mac, owner := range a.allocated {
+		if owner != domainName {
+			used[mac] = struct{}{}
+		}
+	}
+
+	for attempt := 0; attempt < macAllocateAttempts; attempt++ {
+		var mac string
+		switch {
+		case seed == "":
+			mac = GenerateMAC(a.Prefix)
+		case attempt == 0:
+			mac = GenerateMACFromSeed(a.Prefix, seed)
+		default:
+			mac = GenerateMACFromSeed(a.Prefix, seed+"/"+strconv.Itoa(attempt))
+		}
+		if _, taken := used[mac]; !taken {
+			a.allocated[mac] = domainName
+			return mac, nil
+		}
+	}
+	return "", fmt.Errorf("failed to find an unused MAC address for domain %s", domainName)
+}
+
+// Release forgets an address handed out by Allocate, e.g. after the domain
+// was undefined.
+func (a *MACAllocator) Release(mac string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.allocated, strings.ToLower(mac))
+}
+
+// usedMACs returns the MAC addresses of all domains except domainName.
+func (a *MACAllocator) usedMACs(domainName string) (map[string]struct{}, error) {
+	doms, _, err := a.conn.ConnectListAllDomains(1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list domains: %w", err)
+	}
+	used := make(map[string]struct{})
+	for _, dom := range doms {
+		if dom.Name == domainName {
+			continue
+		}
+		domain, err := fetchDomainXML(a.conn, dom)
+		if err != nil {
+			return nil, err
+		}
+		for _, iface := range domain.Devices.Interfaces {
+			if iface.MAC != nil {
+				used[strings.ToLower(iface.MAC.Address)] = struct{}{}
+			}
+		}
+	}
+	return used, nil
+}
@@ -0,0 +1,36 @@
+package libvirt
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestGenerateMAC(t *testing.T) {
+	for _, mac := range []string{
+		GenerateMAC(""),
+		GenerateMAC("02:00"),
+		GenerateMAC("01:23:45"),
+		GenerateMACFromSeed("", "4c4c4544-0042-3510-8052-b4c04f4e3232"),
+	} {
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			t.Fatalf("error parsing generated MAC %s. Err: %v", mac, err)
+		}
+		if hw[0]&0x02 == 0 {
+			t.Errorf("expected locally-administered bit to be set; got %s", mac)
+		}
+		if hw[0]&0x01 != 0 {
+			t.Errorf("expected multicast bit to be clear; got %s", mac)
+		}
+	}
+
+	if mac := GenerateMAC(""); !strings.HasPrefix(mac, DefaultMACPrefix+":") {
+		t.Errorf("expected MAC to start with %s; got %s", DefaultMACPrefix, mac)
+	}
+
+	seed := "4c4c4544-0042-3510-8052-b4c04f4e3232"
+	if a, b := GenerateMACFromSeed("", seed), GenerateMACFromSeed("", seed); a != b {
+		t.Errorf("expected seeded MACs to match; got %s and %s", a, b)
+	}
+}
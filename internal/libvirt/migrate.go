@@ -0,0 +1,194 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// ErrSharedStorageRequired is returned by Migrate when the destination
+// cannot open the domain's disks because they are not on storage both hosts
+// share. Such domains can be moved with MigrateWithStorage.
+var ErrSharedStorageRequired = errors.New("destination cannot access the domain's disks, they must be on shared storage")
+
+// defaultProgressInterval is how often Migrate reports progress when
+// MigrateOptions.ProgressInterval is not set.
+const defaultProgressInterval = time.Second
+
+// MigrateOptions controls how Migrate moves a domain.
+type MigrateOptions struct {
+	Live           bool // Keep the domain running while its memory is copied
+	PersistOnDest  bool // Define the domain persistently on the destination
+	UndefineSource bool // Remove the domain definition from this host afterwards
+	Tunnelled      bool // Send migration data through the libvirtd connection
+	TLS            bool // Encrypt the migration data stream with TLS
+	BandwidthMiBps uint64
+
+	// Progress is called from another goroutine every ProgressInterval
+	// while the migration runs.
+	Progress         func(MigrationProgress)
+	ProgressInterval time.Duration
+}
+
+// MigrationProgress is a snapshot of a running migration job. The Data
+// fields cover everything being transferred, the Memory and Disk fields each
+// part of it; the Disk fields stay zero unless storage is copied.
+type MigrationProgress struct {
+	DataTotal       uint64        `json:"data_total"`
+	DataProcessed   uint64        `json:"data_processed"`
+	DataRemaining   uint64        `json:"data_remaining"`
+	MemoryTotal     uint64        `json:"memory_total"`
+	MemoryProcessed uint64        `json:"memory_processed"`
+	MemoryRemaining uint64        `json:"memory_remaining"`
+	MemoryBps       uint64        `json:"memory_bps"`
+	DiskTotal       uint64        `json:"disk_total"`
+	DiskProcessed   uint64        `json:"disk_processed"`
+	DiskRemaining   uint64        `json:"disk_remaining"`
+	DiskBps         uint64        `json:"disk_bps"`
+	Elapsed         time.Duration `json:"elapsed"`
+}
+
+// Migrate moves the domain to the libvirt daemon at destURI, e.g.
+// "qemu+tls://host2/system". The source daemon connects to the destination
+// itself, so destURI must be reachable from this host. Migrate blocks until
+// the migration has finished.
+func (m *DomainManager) Migrate(name, destURI string, opts MigrateOptions) (err error) {
+	defer observe(m.Observer, "migrate", time.Now(), &err)
+	flags, params, err := opts.migrateFlags()
+	if err != nil {
+		return err
+	}
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	return m.migrate(dom, destURI, params, flags, opts)
+}
+
+// migrateFlags returns the migration flags and parameters for the options.
+func (opts MigrateOptions) migrateFlags() (libvirt.DomainMigrateFlags, []libvirt.TypedParam, error) {
+	if opts.Tunnelled && opts.TLS {
+		return 0, nil, errors.New("tunnelled migration cannot use TLS, the libvirtd connection already carries the data")
+	}
+
+	flags := libvirt.MigratePeer2peer
+	if opts.Live {
+		flags |= libvirt.MigrateLive
+	}
+	if opts.PersistOnDest {
+		flags |= libvirt.MigratePersistDest
+	}
+	if opts.UndefineSource {
+		flags |= libvirt.MigrateUndefineSource
+	}
+	if opts.Tunnelled {
+		flags |= libvirt.MigrateTunnelled
+	}
+	if opts.TLS {
+		flags |= libvirt.MigrateTLS
+	}
+	var params []libvirt.TypedParam
+	if opts.BandwidthMiBps > 0 {
+		params = append(params, ullongParam(libvirt.MigrateParamBandwidth, opts.BandwidthMiBps))
+	}
+	return flags, params, nil
+}
+
+// migrate runs the migration job and reports its progress to opts.Progress.
+func (m *DomainManager) migrate(dom libvirt.Domain, destURI string, params []libvirt.TypedParam, flags libvirt.DomainMigrateFlags, opts MigrateOptions) error {
+	if opts.Progress != nil {
+		done := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			m.reportMigration(dom, opts, done)
+		}()
+		defer func() {
+			close(done)
+			<-stopped
+		}()
+	}
+
+	_, err := m.conn.DomainMigratePerform3Params(dom, libvirt.OptString{destURI}, params, nil, flags)
+	if err != nil {
+		if flags&libvirt.MigrateNonSharedDisk == 0 && isSharedStorageError(err) {
+			return fmt.Errorf("failed to migrate domain %s to %s: %w: %v", dom.Name, destURI, ErrSharedStorageRequired, err)
+		}
+		return fmt.Errorf("failed to migrate domain %s to %s: %w", dom.Name, destURI, err)
+	}
+	return nil
+}
+
+// reportMigration polls the job stats of the domain until done is closed.
+func (m *DomainManager) reportMigration(dom libvirt.Domain, opts MigrateOptions, done <-chan struct{}) {
+	interval := opts.ProgressInterval
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		jobType, params, err := m.conn.DomainGetJobStats(dom, 0)
+		if err != nil || libvirt.DomainJobType(jobType) == libvirt.DomainJobNone {
+			// The job has not started yet or just finished
+			continue
+		}
+
+		var p MigrationProgress
+		for _, param := range params {
+			value := paramUint(param.Value.I)
+			switch param.Field {
+			case libvirt.DomainJobDataTotal:
+				p.DataTotal = value
+			case libvirt.DomainJobDataProcessed:
+				p.DataProcessed = value
+			case libvirt.DomainJobDataRemaining:
+				p.DataRemaining = value
+			case libvirt.DomainJobMemoryTotal:
+				p.MemoryTotal = value
+			case libvirt.DomainJobMemoryProcessed:
+				p.MemoryProcessed = value
+			case libvirt.DomainJobMemoryRemaining:
+				p.MemoryRemaining = value
+			case libvirt.DomainJobMemoryBps:
+				p.MemoryBps = value
+			case libvirt.DomainJobDiskTotal:
+				p.DiskTotal = value
+			case libvirt.DomainJobDiskProcessed:
+				p.DiskProcessed = value
+			case libvirt.DomainJobDiskRemaining:
+				p.DiskRemaining = value
+			case libvirt.DomainJobDiskBps:
+				p.DiskBps = value
+			case libvirt.DomainJobTimeElapsed:
+				p.Elapsed = time.Duration(value) * time.Millisecond
+			}
+		}
+		opts.Progress(p)
+	}
+}
+
+// isSharedStorageError reports whether a migration failed because the
+// destination could not open the domain's disks. libvirt refuses a migration
+// as unsafe when it cannot tell the disks are shared, and qemu on the
+// destination fails to open image files that only exist on the source.
+func isSharedStorageError(err error) bool {
+	if isLibvirtError(err, libvirt.ErrMigrateUnsafe) {
+		return true
+	}
+	var lerr libvirt.Error
+	if !errors.As(err, &lerr) {
+		return false
+	}
+	return strings.Contains(lerr.Message, "Cannot access storage file") ||
+		strings.Contains(lerr.Message, "No such file or directory")
+}
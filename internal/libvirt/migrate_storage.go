@@ -0,0 +1,166 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// migratedDisk is a disk copied to the destination by MigrateWithStorage.
+type migratedDisk struct {
+	target   string
+	path     string
+	format   string
+	capacity uint64
+}
+
+// MigrateWithStorage moves the domain to destURI like Migrate, copying its
+// writable disks as well for hosts without shared storage. The destination
+// files are created up front in destPool, which must store its volumes in
+// the same directory the disks use on this host since qemu writes them at
+// the same path. The pool needs room for the full capacity of every disk.
+// Volumes created on the destination are deleted again if the migration
+// fails.
+//
+// destURI is also used to connect to the destination from here to prepare
+// the volumes, so it must be reachable from this process as well.
+func (m *DomainManager) MigrateWithStorage(name, destURI, destPool string, opts MigrateOptions) (err error) {
+	defer observe(m.Observer, "migrate", time.Now(), &err)
+	flags, params, err := opts.migrateFlags()
+	if err != nil {
+		return err
+	}
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	disks, err := m.migratedDisks(dom)
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(destURI)
+	if err != nil {
+		return fmt.Errorf("invalid destination URI %q: %w", destURI, err)
+	}
+	dest, err := libvirt.ConnectToURI(u)
+	if err != nil {
+		return fmt.Errorf("failed to connect to destination %s: %w", destURI, err)
+	}
+	defer dest.Disconnect()
+
+	destVols := NewStoragePoolManager(dest)
+	if err := destVols.checkMigrationTarget(destPool, disks); err != nil {
+		return fmt.Errorf("cannot migrate domain %s to %s: %w", name, destURI, err)
+	}
+
+	var created []string
+	cleanup := func() {
+		for _, vol := range created {
+			if err := destVols.DeleteVolume(destPool, vol); err != nil {
+				m.log().Error("failed to delete volume on migration destination", "domain", name, "dest", destURI, "volume", vol, "err", err)
+			}
+		}
+	}
+	for _, disk := range disks {
+		vol := filepath.Base(disk.path)
+		if _, err := destVols.CreateVolume(destPool, vol, disk.capacity, disk.format); err != nil {
+			cleanup()
+			return err
+		}
+		created = append(created, vol)
+		params = append(params, libvirt.TypedParam{
+			Field: libvirt.MigrateParamMigrateDisks,
+			Value: *libvirt.NewTypedParamValueString(disk.target),
+		})
+	}
+
+	// The whole backing chain is copied into each destination file
+	flags |= libvirt.MigrateNonSharedDisk
+	if err := m.migrate(dom, destURI, params, flags, opts); err != nil {
+		cleanup()
+		return err
+	}
+	return nil
+}
+
+// migratedDisks returns the writable file disks of the domain.
+func (m *DomainManager) migratedDisks(dom libvirt.Domain) ([]migratedDisk, error) {
+	domain, err := m.domainXML(dom)
+	if err != nil {
+		return nil, err
+	}
+	var disks []migratedDisk
+	for _, disk := range domain.Devices.Disks {
+		if disk.Device != "disk" || disk.ReadOnly != nil || disk.Source.File == "" {
+			continue
+		}
+		_, capacity, _, err := m.conn.DomainGetBlockInfo(dom, disk.Target.Dev, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get size of disk %s of domain %s: %w", disk.Target.Dev, dom.Name, err)
+		}
+		format := disk.Driver.Type
+		if format == "" {
+			format = "raw"
+		}
+		disks = append(disks, migratedDisk{
+			target:   disk.Target.Dev,
+			path:     disk.Source.File,
+			format:   format,
+			capacity: capacity,
+		})
+	}
+	if len(disks) == 0 {
+		return nil, fmt.Errorf("domain %s has no writable disks to copy, use Migrate instead", dom.Name)
+	}
+	return disks, nil
+}
+
+// checkMigrationTarget checks that the pool stores volumes at the paths of
+// disks, has none of them yet and has room for all of them.
+func (m *StoragePoolManager) checkMigrationTarget(poolName string, disks []migratedDisk) error {
+	pool, err := m.lookupPool(poolName)
+	if err != nil {
+		return err
+	}
+	desc, err := m.conn.StoragePoolGetXMLDesc(pool, 0)
+	if err != nil {
+		return fmt.Errorf("failed to get XML of pool %s: %w", poolName, err)
+	}
+	var px poolXML
+	if err := xml.Unmarshal([]byte(desc), &px); err != nil {
+		return fmt.Errorf("failed to parse XML of pool %s: %w", poolName, err)
+	}
+	if err := m.conn.StoragePoolRefresh(pool, 0); err != nil {
+		return fmt.Errorf("failed to refresh pool %s: %w", poolName, err)
+	}
+
+	var required uint64
+	for _, disk := range disks {
+		if filepath.Clean(filepath.Dir(disk.path)) != filepath.Clean(px.Target.Path) {
+			return fmt.Errorf("disk %s is stored in %s but pool %s stores volumes in %s",
+				disk.target, filepath.Dir(disk.path), poolName, px.Target.Path)
+		}
+		_, err := m.conn.StorageVolLookupByName(pool, filepath.Base(disk.path))
+		if err == nil {
+			return fmt.Errorf("volume %s %w in pool %s", filepath.Base(disk.path), ErrAlreadyExists, poolName)
+		}
+		if !isLibvirtError(err, libvirt.ErrNoStorageVol) {
+			return fmt.Errorf("failed to look up volume %s in pool %s: %w", filepath.Base(disk.path), poolName, err)
+		}
+		required += disk.capacity
+	}
+
+	_, _, _, available, err := m.conn.StoragePoolGetInfo(pool)
+	if err != nil {
+		return fmt.Errorf("failed to get info for pool %s: %w", poolName, err)
+	}
+	if required > available {
+		return fmt.Errorf("%w in pool %s: it has %d bytes free, the disks need %d", ErrInsufficientSpace, poolName, available, required)
+	}
+	return nil
+}
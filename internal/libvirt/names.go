@@ -0,0 +1,54 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// maxDomainNameLength keeps domain names usable as file and interface names.
+const maxDomainNameLength = 64
+
+// ErrDomainExists is returned when a domain with the requested name is
+// already defined. It wraps ErrAlreadyExists.
+var ErrDomainExists = fmt.Errorf("domain %w", ErrAlreadyExists)
+
+// ValidateDomainName checks that name only holds letters, digits, dashes and
+// underscores, starts with a letter or digit and is at most 64 characters, so
+// it is safe to use in domain XML and in file paths.
+func ValidateDomainName(name string) error {
+	if name == "" {
+		return errors.New("domain name is required")
+	}
+	if len(name) > maxDomainNameLength {
+		return fmt.Errorf("domain name %q is longer than %d characters", name, maxDomainNameLength)
+	}
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case (r == '-' || r == '_') && i > 0:
+		case r == '/' || r == '\\':
+			return fmt.Errorf("domain name %q must not contain path separator %q", name, r)
+		default:
+			return fmt.Errorf("domain name %q contains invalid character %q at position %d", name, r, i)
+		}
+	}
+	return nil
+}
+
+// CheckNameAvailable returns ErrDomainExists if a domain called name is
+// already defined, so callers can fail before writing any files.
+func (m *DomainManager) CheckNameAvailable(name string) error {
+	if err := ValidateDomainName(name); err != nil {
+		return err
+	}
+	_, err := m.conn.DomainLookupByName(name)
+	if err == nil {
+		return fmt.Errorf("cannot create domain %s: %w", name, ErrDomainExists)
+	}
+	if !isLibvirtError(err, libvirt.ErrNoDomain) {
+		return fmt.Errorf("failed to look up domain %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// NetworkInfo describes a libvirt virtual network.
+type NetworkInfo struct {
+	Name      string `json:"name"`
+	Mode      string `json:"mode"`
+	Bridge    string `json:"bridge,omitempty"`
+	CIDR      string `json:"cidr,omitempty"`
+	Gateway   string `json:"gateway,omitempty"`
+	DHCPStart string `json:"dhcp_start,omitempty"`
+	DHCPEnd   string `json:"dhcp_end,omitempty"`
+	Active    bool   `json:"active"`
+}
+
+// NetworkManager manages libvirt virtual networks over a libvirt connection.
+type NetworkManager struct {
+	conn *libvirt.Libvirt
+}
+
+// NewNetworkManager creates a NetworkManager using the given libvirt connection.
+func NewNetworkManager(conn *libvirt.Libvirt) *NetworkManager {
+	return &NetworkManager{conn: conn}
+}
+
+// EnsureNATNetwork makes sure a NAT network for the IPv4 cidr exists, is
+// active and is started on boot. The first address of the cidr is used as the
+// gateway and, when dhcp is set, the rest of it is handed out over DHCP. A
+// network that already exists must have the same mode and cidr.
+func (m *NetworkManager) EnsureNATNetwork(name, cidr string, dhcp bool) (NetworkInfo, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return NetworkInfo{}, fmt.Errorf("invalid network cidr %q: %w", cidr, err)
+	}
+	gateway, start, end, err := networkAddresses(prefix)
+	if err != nil {
+		return NetworkInfo{}, err
+	}
+
+	ip := networkIPXML{Address: gateway.String(), Prefix: prefix.Bits()}
+	if dhcp {
+		ip.DHCP = &networkDHCPXML{Ranges: []dhcpRangeXML{{Start: start.String(), End: end.String()}}}
+	}
+	want := networkXML{
+		Name:    name,
+		Forward: &networkForwardXML{Mode: "nat"},
+		IPs:     []networkIPXML{ip},
+	}
+	return m.ensure(want, func(existing NetworkInfo) error {
+		if existing.Mode != "nat" || existing.CIDR != prefix.Masked().String() {
+			return fmt.Errorf("network %s already exists as %s network %s", name, existing.Mode, existing.CIDR)
+		}
+		return nil
+	})
+}
+
+// EnsureBridge makes sure a network that attaches domains to the existing
+// host bridge iface exists, is active and is started on boot.
+func (m *NetworkManager) EnsureBridge(name, iface string) (NetworkInfo, error) {
+	if iface == "" {
+		return NetworkInfo{}, fmt.Errorf("bridge interface of network %s is required", name)
+	}
+	want := networkXML{
+		Name:    name,
+		Forward: &networkForwardXML{Mode: "bridge"},
+		Bridge:  &networkBridgeXML{Name: iface},
+	}
+	return m.ensure(want, func(existing NetworkInfo) error {
+		if existing.Mode != "bridge" || existing.Bridge != iface {
+			return fmt.Errorf("network %s already exists as %s network on %s", name, existing.Mode, existing.Bridge)
+		}
+		return nil
+	})
+}
+
+// ListNetworks lists all networks defined on the host.
+func (m *NetworkManager) ListNetworks() ([]NetworkInfo, error) {
+	nets, _, err := m.conn.ConnectListAllNetworks(1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %w", err)
+	}
+	infos := make([]NetworkInfo, 0, len(nets))
+	for _, nw := range nets {
+		info, err := m.networkInfo(nw)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// DeleteNetwork stops and undefines a network. Deleting a network that does
+// not exist is not an error.
+func (m *NetworkManager) DeleteNetwork(name string) error {
+	nw, err := m.conn.NetworkLookupByName(name)
+	if isLibvirtError(err, libvirt.ErrNoNetwork) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up network %s: %w", name, err)
+	}
+	active, err := m.conn.NetworkIsActive(nw)
+	if err != nil {
+		return fmt.Errorf("failed to get state of network %s: %w", name, err)
+	}
+	if active == 1 {
+		if err := m.conn.NetworkDestroy(nw); err != nil {
+			return fmt.Errorf("failed to stop network %s: %w", name, err)
+		}
+	}
+	if err := m.conn.NetworkUndefine(nw); err != nil {
+		return fmt.Errorf("failed to undefine network %s: %w", name, err)
+	}
+	return nil
+}
+
+// ensure defines want if no network of that name exists, or checks the
+// existing one with matches, and then makes sure it is active.
+func (m *NetworkManager) ensure(want networkXML, matches func(NetworkInfo) error) (NetworkInfo, error) {
+	nw, err := m.conn.NetworkLookupByName(want.Name)
+	switch {
+	case err == nil:
+		existing, err := m.networkInfo(nw)
+		if err != nil {
+			return NetworkInfo{}, err
+		}
+		if err := matches(existing); err != nil {
+			return NetworkInfo{}, err
+		}
+	case isLibvirtError(err, libvirt.ErrNoNetwork):
+		out, err := xml.Marshal(want)
+		if err != nil {
+			return NetworkInfo{}, fmt.Errorf("failed to build XML of network %s: %w", want.Name, err)
+		}
+		if nw, err = m.conn.NetworkDefineXML(string(out)); err != nil {
+			return NetworkInfo{}, fmt.Errorf("failed to define network %s: %w", want.Name, err)
+		}
+		if err := m.conn.NetworkSetAutostart(nw, 1); err != nil {
+			return NetworkInfo{}, fmt.Errorf("failed to enable autostart of network %s: %w", want.Name, err)
+		}
+	default:
+		return NetworkInfo{}, fmt.Errorf("failed to look up network %s: %w", want.Name, err)
+	}
+
+	active, err := m.conn.NetworkIsActive(nw)
+	if err != nil {
+		return NetworkInfo{}, fmt.Errorf("failed to get state of network %s: %w", want.Name, err)
+	}
+	if active != 1 {
+		if err := m.conn.NetworkCreate(nw); err != nil {
+			return NetworkInfo{}, fmt.Errorf("failed to start network %s: %w", want.Name, err)
+		}
+	}
+	return m.networkInfo(nw)
+}
+
+func (m *NetworkManager) networkXML(nw libvirt.Network) (networkXML, error) {
+	desc, err := m.conn.NetworkGetXMLDesc(nw, 0)
+	if err != nil {
+		return networkXML{}, fmt.Errorf("failed to get XML of network %s: %w", nw.Name, err)
+	}
+	var parsed networkXML
+	if err := xml.Unmarshal([]byte(desc), &parsed); err != nil {
+		return networkXML{}, fmt.Errorf("failed to parse XML of network %s: %w", nw.Name, err)
+	}
+	return parsed, nil
+}
+
+func (m *NetworkManager) networkInfo(nw libvirt.Network) (NetworkInfo, error) {
+	parsed, err := m.networkXML(nw)
+	if err != nil {
+		return NetworkInfo{}, err
+	}
+	active, err := m.conn.NetworkIsActive(nw)
+	if err != nil {
+		return NetworkInfo{}, fmt.Errorf("failed to get state of network %s: %w", nw.Name, err)
+	}
+
+	// networks without a forward element are isolated
+	info := NetworkInfo{Name: parsed.Name, Mode: "isolated", Active: active == 1}
+	if parsed.Forward != nil {
+		info.Mode = parsed.Forward.Mode
+	}
+	if parsed.Bridge != nil {
+		info.Bridge = parsed.Bridge.Name
+	}
+	if ip, prefix, ok := networkIPv4(parsed); ok {
+		info.Gateway = ip.Address
+		info.CIDR = prefix.Masked().String()
+		if ip.DHCP != nil && len(ip.DHCP.Ranges) > 0 {
+			info.DHCPStart = ip.DHCP.Ranges[0].Start
+			info.DHCPEnd = ip.DHCP.Ranges[0].End
+		}
+	}
+	return info, nil
+}
+
+// networkIPv4 returns the first IPv4 address block of a network.
+func networkIPv4(parsed networkXML) (networkIPXML, netip.Prefix, bool) {
+	for _, ip := range parsed.IPs {
+		addr, err := netip.ParseAddr(ip.Address)
+		if err != nil || !addr.Is4() {
+			continue
+		}
+		bits := ip.Prefix
+		if ip.Netmask != "" {
+			mask := net.ParseIP(ip.Netmask).To4()
+			if mask == nil {
+				continue
+			}
+			bits, _ = net.IPMask(mask).Size()
+		}
+		if bits == 0 {
+			bits = 24
+		}
+		return ip, netip.PrefixFrom(addr, bits), true
+	}
+	return networkIPXML{}, netip.Prefix{}, false
+}
+
+// networkAddresses returns the gateway and DHCP range of an IPv4 prefix: the
+// gateway is its first host address and the range spans the remaining hosts.
+func networkAddresses(prefix netip.Prefix) (gateway, start, end netip.Addr, err error) {
+	prefix = prefix.Masked()
+	if !prefix.Addr().Is4() {
+		return gateway, start, end, fmt.Errorf("network %s is not IPv4", prefix)
+	}
+	if prefix.Bits() > 29 {
+		return gateway, start, end, fmt.Errorf("network %s is too small, at least a /29 is required", prefix)
+	}
+
+	gateway = prefix.Addr().Next()
+	start = gateway.Next()
+	broadcast := prefix.Addr().As4()
+	hostBits := 32 - prefix.Bits()
+	for i := 3; i >= 0 && hostBits > 0; i-- {
+		n := min(hostBits, 8)
+		broadcast[i] |= byte(1<<n - 1)
+		hostBits -= n
+	}
+	end = netip.AddrFrom4(broadcast).Prev()
+	return gateway, start, end, nil
+}
@@ -0,0 +1,99 @@
+package libvirt
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// hotplugNICModels are the NIC models whose guest drivers handle hot plug.
+var hotplugNICModels = map[string]bool{"virtio": true, "e1000": true, "e1000e": true, "rtl8139": true}
+
+// AttachNIC adds a network interface to the domain. The interface is always
+// added to the persistent config, with live set it is also plugged into the
+// running domain.
+func (m *DomainManager) AttachNIC(name string, nic NICSpec, live bool) error {
+	if err := nic.Validate(); err != nil {
+		return fmt.Errorf("invalid NIC: %w", err)
+	}
+	iface := buildInterfaceXML(nic)
+	if live && !hotplugNICModels[iface.Model.Type] {
+		return fmt.Errorf("cannot attach NIC to domain %s live: model %s does not support hotplug", name, iface.Model.Type)
+	}
+
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	if iface.MAC != nil {
+		domain, err := m.domainXML(dom)
+		if err != nil {
+			return err
+		}
+		if _, ok := findInterface(domain, iface.MAC.Address); ok {
+			return fmt.Errorf("cannot attach NIC to domain %s: MAC %s is already in use", name, iface.MAC.Address)
+		}
+	}
+
+	out, err := xml.Marshal(iface)
+	if err != nil {
+		return fmt.Errorf("failed to build interface XML: %w", err)
+	}
+	if err := m.conn.DomainAttachDeviceFlags(dom, string(out), deviceFlags(live)); err != nil {
+		return fmt.Errorf("failed to attach NIC to domain %s: %w", name, err)
+	}
+	return nil
+}
+
+// DetachNIC removes the network interface with the given MAC from the
+// domain's persistent config and, with live set, from the running domain. A
+// live detach waits until the guest has released the interface and fails
+// with ErrDetachTimeout if it does not, or with ctx.Err() once ctx is
+// cancelled.
+func (m *DomainManager) DetachNIC(ctx context.Context, name, mac string, live bool) error {
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	domain, err := m.domainXML(dom)
+	if err != nil {
+		return err
+	}
+	iface, ok := findInterface(domain, mac)
+	if !ok {
+		return fmt.Errorf("cannot detach NIC from domain %s: MAC %s not found", name, mac)
+	}
+
+	out, err := xml.Marshal(iface)
+	if err != nil {
+		return fmt.Errorf("failed to build interface XML: %w", err)
+	}
+	if err := m.conn.DomainDetachDeviceFlags(dom, string(out), deviceFlags(live)); err != nil {
+		return fmt.Errorf("failed to detach NIC %s from domain %s: %w", mac, name, err)
+	}
+	if !live {
+		return nil
+	}
+	return m.waitForDetach(ctx, dom, func(domain domainXML) bool {
+		_, ok := findInterface(domain, mac)
+		return !ok
+	})
+}
+
+// findInterface returns the interface of the domain with the given MAC.
+// MACs are matched since target device names are assigned by libvirt and
+// change across restarts.
+func findInterface(domain domainXML, mac string) (interfaceXML, bool) {
+	want := strings.ToLower(mac)
+	if hw, err := net.ParseMAC(mac); err == nil {
+		want = hw.String()
+	}
+	for _, iface := range domain.Devices.Interfaces {
+		if iface.MAC != nil && strings.ToLower(iface.MAC.Address) == want {
+			return iface, true
+		}
+	}
+	return interfaceXML{}, false
+}
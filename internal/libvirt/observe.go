@@ -0,0 +1,29 @@
+package libvirt
+
+import (
+	"time"
+)
+
+// OperationObserver receives the outcome of VM operations such as "create",
+// "start" or "delete", e.g. to export metrics. Operations are observed once
+// they finish, after any waiting they do.
+type OperationObserver interface {
+	ObserveOperation(op string, duration time.Duration, err error)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) ObserveOperation(string, time.Duration, error) {}
+
+func orNopObserver(o OperationObserver) OperationObserver {
+	if o == nil {
+		return nopObserver{}
+	}
+	return o
+}
+
+// observe reports op, started at start, with the error *err once the
+// calling function returns. It is meant to be deferred with a named result.
+func observe(o OperationObserver, op string, start time.Time, err *error) {
+	orNopObserver(o).ObserveOperation(op, time.Since(start), *err)
+}
@@ -0,0 +1,209 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// CPUPin restricts a vCPU to a set of host CPUs.
+type CPUPin struct {
+	VCPU   uint
+	CPUSet string // Host CPUs in libvirt cpuset syntax, e.g. "2-3" or "0-7,^4"
+}
+
+// NUMATune binds guest memory to host NUMA nodes.
+type NUMATune struct {
+	Nodeset string // Host NUMA nodes in cpuset syntax, e.g. "0" or "0-1"
+	Mode    string // "strict" (default), "preferred", "interleave" or "restrictive"
+}
+
+var validNUMAModes = map[string]bool{"strict": true, "preferred": true, "interleave": true, "restrictive": true}
+
+// Validate checks the mode and nodeset syntax.
+func (n NUMATune) Validate() error {
+	if n.Mode != "" && !validNUMAModes[n.Mode] {
+		return fmt.Errorf("invalid mode %q", n.Mode)
+	}
+	if _, err := parseCPUSet(n.Nodeset); err != nil {
+		return fmt.Errorf("invalid nodeset: %w", err)
+	}
+	return nil
+}
+
+// maxCPUSetID bounds the ids accepted in a cpuset, matching libvirt's own
+// cpumask limit.
+const maxCPUSetID = 16383
+
+// parseCPUSet expands a libvirt cpuset such as "0-3,^2,8" into sorted ids.
+func parseCPUSet(s string) ([]uint, error) {
+	include := make(map[uint]bool)
+	var exclude []uint
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		negate := strings.HasPrefix(part, "^")
+		part = strings.TrimPrefix(part, "^")
+
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := parseCPUID(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpuset %q: %w", s, err)
+		}
+		last := first
+		if isRange {
+			if negate {
+				return nil, fmt.Errorf("invalid cpuset %q: ranges cannot be excluded", s)
+			}
+			if last, err = parseCPUID(hi); err != nil {
+				return nil, fmt.Errorf("invalid cpuset %q: %w", s, err)
+			}
+			if last < first {
+				return nil, fmt.Errorf("invalid cpuset %q: range %s is reversed", s, part)
+			}
+		}
+
+		if negate {
+			exclude = append(exclude, first)
+			continue
+		}
+		for id := first; id <= last; id++ {
+			include[id] = true
+		}
+	}
+	for _, id := range exclude {
+		delete(include, id)
+	}
+	if len(include) == 0 {
+		return nil, fmt.Errorf("cpuset %q is empty", s)
+	}
+
+	ids := make([]uint, 0, len(include))
+	for id := range include {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+func parseCPUID(s string) (uint, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a cpu id", s)
+	}
+	if id > maxCPUSetID {
+		return 0, fmt.Errorf("cpu id %d is above %d", id, maxCPUSetID)
+	}
+	return uint(id), nil
+}
+
+// onlineCPUs returns which host CPUs are online, indexed by CPU id.
+func onlineCPUs(conn *libvirt.Libvirt) ([]bool, error) {
+	cpumap, _, total, err := conn.NodeGetCPUMap(1, 1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get host cpu map: %w", err)
+	}
+	online := make([]bool, total)
+	for id := range online {
+		online[id] = id/8 < len(cpumap) && cpumap[id/8]&(1<<(id%8)) != 0
+	}
+	return online, nil
+}
+
+// checkCPUSet checks that every CPU in ids is online on the host.
+func checkCPUSet(ids []uint, online []bool) error {
+	for _, id := range ids {
+		if int(id) >= len(online) {
+			return fmt.Errorf("host cpu %d does not exist, the host has %d cpus", id, len(online))
+		}
+		if !online[id] {
+			return fmt.Errorf("host cpu %d is offline", id)
+		}
+	}
+	return nil
+}
+
+// CheckPlacement checks the CPU pins and NUMA nodes of spec against the
+// host: every pinned CPU must exist and be online and every NUMA node must
+// exist. libvirt does not treat pins as exclusive, so CPUs shared with other
+// domains are allowed.
+func (m *HostManager) CheckPlacement(spec DomainSpec) error {
+	var errs []error
+	if len(spec.CPUPins) > 0 {
+		online, err := onlineCPUs(m.conn)
+		if err != nil {
+			return err
+		}
+		for _, pin := range spec.CPUPins {
+			ids, err := parseCPUSet(pin.CPUSet)
+			if err == nil {
+				err = checkCPUSet(ids, online)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("vcpu %d: %w", pin.VCPU, err))
+			}
+		}
+	}
+
+	if spec.NUMA != nil {
+		_, _, _, _, nodes, _, _, _, err := m.conn.NodeGetInfo()
+		if err != nil {
+			return fmt.Errorf("failed to get node info: %w", err)
+		}
+		ids, err := parseCPUSet(spec.NUMA.Nodeset)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("numa: %w", err))
+		}
+		for _, id := range ids {
+			if int(id) >= int(nodes) {
+				errs = append(errs, fmt.Errorf("numa: host node %d does not exist, the host has %d nodes", id, nodes))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// PinVCPU restricts vcpu of the domain to the host CPUs in cpuset. The pin
+// is written to the domain config and, when the domain is running, applied
+// to it immediately.
+func (m *DomainManager) PinVCPU(name string, vcpu uint, cpuset string) error {
+	ids, err := parseCPUSet(cpuset)
+	if err != nil {
+		return err
+	}
+	online, err := onlineCPUs(m.conn)
+	if err != nil {
+		return err
+	}
+	if err := checkCPUSet(ids, online); err != nil {
+		return fmt.Errorf("cannot pin vcpu %d of domain %s: %w", vcpu, name, err)
+	}
+	info, err := m.GetVCPUs(name)
+	if err != nil {
+		return err
+	}
+	if vcpu >= info.Max {
+		return fmt.Errorf("cannot pin vcpu %d of domain %s: it has %d vcpus", vcpu, name, info.Max)
+	}
+
+	dom, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+	flags, err := m.affectFlags(dom)
+	if err != nil {
+		return err
+	}
+
+	cpumap := make([]byte, (len(online)+7)/8)
+	for _, id := range ids {
+		cpumap[id/8] |= 1 << (id % 8)
+	}
+	if err := m.conn.DomainPinVcpuFlags(dom, uint32(vcpu), cpumap, flags); err != nil {
+		return fmt.Errorf("failed to pin vcpu %d of domain %s: %w", vcpu, name, err)
+	}
+	return nil
+}
@@ -0,0 +1,591 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+
+	"libvirt-controller/internal/filesystem"
+	"libvirt-controller/internal/helpers"
+	"libvirt-controller/internal/logging"
+	"libvirt-controller/internal/state"
+)
+
+// domainXMLName is the file the domain XML is saved to in the VM directory.
+const domainXMLName = "server.xml"
+
+// nvramName is the UEFI variable store created in the VM directory.
+const nvramName = "nvram.fd"
+
+// VMSpec describes a VM to provision: its domain, the directory holding its
+// files, the overlays to create for its disks and an optional cloud-init seed.
+// Tenant names the quota the VM counts against and may be empty.
+type VMSpec struct {
+	Domain    DomainSpec
+	Dir       string
+	Overlays  []OverlaySpec
+	CloudInit *CloudInitSpec
+	Tenant    string
+}
+
+// OverlaySpec is a qcow2 overlay on top of a base image. A disk of the domain
+// uses it by setting its source to Path.
+type OverlaySpec struct {
+	Path      string `json:"path"`
+	BasePath  string `json:"base_path"`
+	SizeBytes uint64 `json:"size_bytes"`
+
+	// Preallocation is one of the filesystem.Prealloc modes, off when
+	// empty.
+	Preallocation string `json:"preallocation,omitempty"`
+}
+
+// virtualSize returns the size the overlay will have: SizeBytes, or the
+// virtual size of the base image when that is zero. An unreadable base
+// image counts as zero, PlanCreate reports it as a conflict.
+func (o OverlaySpec) virtualSize() uint64 {
+	if o.SizeBytes > 0 {
+		return o.SizeBytes
+	}
+	info, err := helpers.CachedImageInfo(o.BasePath)
+	if err != nil {
+		return 0
+	}
+	return info.VirtualSize
+}
+
+// CloudInitSpec is the content of a cloud-init seed ISO, which is attached to
+// the domain as a cdrom. For a ConfigDrive MetaData is meta_data.json and
+// NetworkConfig is network_data.json.
+type CloudInitSpec struct {
+	UserData      []byte
+	MetaData      []byte
+	NetworkConfig []byte
+	Target        string             // Target device of the cdrom, "sda" when empty
+	Datasource    helpers.Datasource // NoCloud when empty
+}
+
+// PlanConflictError is returned by CreateVM when the plan of the spec has
+// conflicts, such as files that already exist. It wraps ErrAlreadyExists.
+type PlanConflictError struct {
+	Name      string
+	Conflicts []string
+}
+
+func (e *PlanConflictError) Error() string {
+	return fmt.Sprintf("cannot create VM %s: %s", e.Name, strings.Join(e.Conflicts, "; "))
+}
+
+func (e *PlanConflictError) Unwrap() error {
+	return ErrAlreadyExists
+}
+
+// DomainConflictError is returned by CreateVM when a domain with the name of
+// the spec is already defined but differs from it. It wraps ErrDomainExists.
+type DomainConflictError struct {
+	Name        string
+	Differences []string // What the existing domain has, one entry per mismatch
+}
+
+func (e *DomainConflictError) Error() string {
+	return fmt.Sprintf("domain %s already exists with a different definition: %s", e.Name, strings.Join(e.Differences, "; "))
+}
+
+func (e *DomainConflictError) Unwrap() error {
+	return ErrDomainExists
+}
+
+// Plan describes what provisioning a VMSpec would do.
+type Plan struct {
+	DomainXML string        `json:"domain_xml"`
+	Files     []string      `json:"files"`
+	Overlays  []OverlaySpec `json:"overlays"`
+	Conflicts []string      `json:"conflicts,omitempty"`
+}
+
+// HasConflicts reports whether provisioning the plan would fail.
+func (p Plan) HasConflicts() bool {
+	return len(p.Conflicts) > 0
+}
+
+// Provisioner creates VMs from a VMSpec over a libvirt connection.
+type Provisioner struct {
+	conn *libvirt.Libvirt
+
+	// Logger receives rollback failures, nothing is logged when it is nil.
+	Logger logging.Logger
+
+	// Observer is told about every CreateVM call. It may be nil.
+	Observer OperationObserver
+
+	// Admission, when set, rejects VMs that would overcommit the host with
+	// an error wrapping ErrInsufficientResources.
+	Admission *AdmissionControl
+
+	// Records, when set, gets a record of every domain CreateVM defines.
+	// DomainManager.Undefine deletes it when it shares the store.
+	Records *state.Store
+
+	// Quotas, when set, reserves the resources of every VM with a Tenant
+	// and rejects VMs that would exceed the tenant's quota with an error
+	// wrapping ErrQuotaExceeded. Deleting a VM does not release its
+	// reservation, callers do that with Quotas.ReleaseVM.
+	Quotas *QuotaManager
+
+	// creates serializes the CreateVM calls for each domain name
+	creates filesystem.KeyedMutex
+}
+
+// NewProvisioner creates a Provisioner using the given libvirt connection.
+func NewProvisioner(conn *libvirt.Libvirt) *Provisioner {
+	return &Provisioner{conn: conn}
+}
+
+// PlanCreate works out the domain XML, files and overlays for spec and flags
+// anything that would make provisioning fail, without changing the host. An
+// invalid spec is returned as an error.
+func (p *Provisioner) PlanCreate(spec VMSpec) (Plan, error) {
+	if spec.Dir == "" || !filepath.IsAbs(spec.Dir) {
+		return Plan{}, fmt.Errorf("VM directory %q must be an absolute path", spec.Dir)
+	}
+	if spec.CloudInit != nil {
+		if err := spec.CloudInit.Datasource.Validate(); err != nil {
+			return Plan{}, err
+		}
+	}
+	domain := spec.domainSpec()
+	domainXML, err := BuildDomainXML(domain)
+	if err != nil {
+		return Plan{}, err
+	}
+
+	plan := Plan{DomainXML: domainXML, Overlays: spec.Overlays}
+	for _, name := range spec.fileNames() {
+		plan.Files = append(plan.Files, filepath.Join(spec.Dir, name))
+	}
+
+	if _, err := p.conn.DomainLookupByName(domain.Name); err == nil {
+		plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("domain %s already exists", domain.Name))
+	} else if !isLibvirtError(err, libvirt.ErrNoDomain) {
+		return Plan{}, fmt.Errorf("failed to look up domain %s: %w", domain.Name, err)
+	}
+
+	for _, file := range plan.Files {
+		if pathExists(file) {
+			plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("file %s already exists", file))
+		}
+	}
+	created := make(map[string]bool)
+	prealloc := make(map[string]uint64) // Bytes preallocated per directory
+	for _, overlay := range spec.Overlays {
+		if err := filesystem.ValidatePreallocation(overlay.Preallocation, filesystem.FormatQcow2); err != nil {
+			return Plan{}, fmt.Errorf("overlay %s: %w", overlay.Path, err)
+		}
+		if filesystem.NeedsSpace(overlay.Preallocation) {
+			prealloc[filepath.Dir(overlay.Path)] += overlay.virtualSize()
+		}
+		created[overlay.Path] = true
+		if pathExists(overlay.Path) {
+			plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("overlay %s already exists", overlay.Path))
+		}
+		if !pathExists(overlay.BasePath) {
+			plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("base image %s does not exist", overlay.BasePath))
+		}
+	}
+	for _, dir := range slices.Sorted(maps.Keys(prealloc)) {
+		size := prealloc[dir]
+		// The VM directory may not exist yet
+		for !pathExists(dir) && filepath.Dir(dir) != dir {
+			dir = filepath.Dir(dir)
+		}
+		if err := filesystem.CheckFreeSpace(dir, size); err != nil {
+			plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("overlays cannot be preallocated: %v", err))
+		}
+	}
+	for _, file := range plan.Files {
+		created[file] = true
+	}
+	for _, disk := range domain.Disks {
+		if !created[disk.Source] && !pathExists(disk.Source) {
+			plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("disk source %s does not exist", disk.Source))
+		}
+	}
+	if err := NewHostManager(p.conn).CheckPlacement(domain); err != nil {
+		plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("cpu or numa placement does not fit the host: %v", err))
+	}
+	if err := NewHostManager(p.conn).CheckFirmware(domain); err != nil {
+		plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("firmware is not available: %v", err))
+	}
+	if err := NewHostManager(p.conn).CheckHostDevices(domain); err != nil {
+		plan.Conflicts = append(plan.Conflicts, fmt.Sprintf("host devices cannot be passed through: %v", err))
+	}
+	for _, f := range domain.Filesystems {
+		if err := f.checkSource(); err != nil {
+			plan.Conflicts = append(plan.Conflicts, err.Error())
+		}
+	}
+	return plan, nil
+}
+
+// rollbackStep undoes one resource created by CreateVM.
+type rollbackStep struct {
+	desc string
+	undo func() error
+}
+
+// CreateVM provisions spec: it creates the VM directory and overlays, builds
+// the cloud-init seed, saves the domain XML, records the VM in Records and
+// defines the domain. If any step fails, everything created so far is
+// removed in reverse order and the original error is returned. Failed
+// rollback steps are logged. A plan with conflicts fails with a
+// *PlanConflictError.
+//
+// Calls for the same domain name run one at a time, and every file is
+// created exclusively, so CreateVM never takes over a file created by
+// someone else in the meantime.
+//
+// CreateVM can be retried after a failure that left the domain defined: it
+// succeeds without changing anything when the domain matches spec and its
+// disks exist, and fails with a *DomainConflictError otherwise.
+func (p *Provisioner) CreateVM(spec VMSpec) (err error) {
+	defer observe(p.Observer, "create", time.Now(), &err)
+	defer p.creates.Lock(spec.Domain.Name)()
+	plan, err := p.PlanCreate(spec)
+	if err != nil {
+		return err
+	}
+	if exists, err := p.checkExisting(spec, plan); exists || err != nil {
+		return err
+	}
+	if plan.HasConflicts() {
+		return &PlanConflictError{Name: spec.Domain.Name, Conflicts: plan.Conflicts}
+	}
+
+	// The record is saved before the domain is defined, so the UUID is
+	// picked here rather than by libvirt
+	domain := spec.domainSpec()
+	if domain.UUID == "" {
+		domain.UUID = newUUID()
+		if plan.DomainXML, err = BuildDomainXML(domain); err != nil {
+			return err
+		}
+	}
+
+	if p.Admission != nil {
+		release, err := p.Admission.Reserve(spec.resources())
+		if err != nil {
+			return fmt.Errorf("cannot create VM %s: %w", spec.Domain.Name, err)
+		}
+		// Once defined the domain itself counts as committed
+		defer release()
+	}
+
+	var steps []rollbackStep
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(steps) - 1; i >= 0; i-- {
+			if rerr := steps[i].undo(); rerr != nil {
+				logging.OrNop(p.Logger).Error("failed to roll back VM creation", "domain", spec.Domain.Name, "step", steps[i].desc, "err", rerr)
+			}
+		}
+	}()
+
+	if p.Quotas != nil && spec.Tenant != "" {
+		if err := p.Quotas.ReserveVM(spec.Tenant, spec.Domain.Name, spec.resources()); err != nil {
+			return fmt.Errorf("cannot create VM %s: %w", spec.Domain.Name, err)
+		}
+		steps = append(steps, rollbackStep{"quota of tenant " + spec.Tenant, func() error {
+			return p.Quotas.ReleaseVM(spec.Domain.Name)
+		}})
+	}
+	deleteFile := func(path string) func() error {
+		return func() error {
+			_, err := filesystem.DeleteFileIfExists(filepath.Dir(path), filepath.Base(path))
+			return err
+		}
+	}
+	// claim creates an empty file at path for a writer to replace, failing
+	// when anything is there already
+	claim := func(path string) error {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("cannot create VM %s: file %s %w", spec.Domain.Name, path, ErrAlreadyExists)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", path, err)
+		}
+		steps = append(steps, rollbackStep{"file " + filepath.Base(path), deleteFile(path)})
+		return f.Close()
+	}
+
+	if !pathExists(spec.Dir) {
+		// MkdirAll may create parents too, the rollback removes those it left empty
+		existing := filepath.Dir(spec.Dir)
+		for !pathExists(existing) && filepath.Dir(existing) != existing {
+			existing = filepath.Dir(existing)
+		}
+		if err := os.MkdirAll(spec.Dir, filesystem.DirPerm); err != nil {
+			return fmt.Errorf("failed to create VM directory %s: %w", spec.Dir, err)
+		}
+		steps = append(steps, rollbackStep{"directory " + spec.Dir, func() error {
+			return filesystem.PruneEmptyDirs(existing, spec.Dir)
+		}})
+	}
+
+	for _, overlay := range spec.Overlays {
+		opts := helpers.OverlayOptions{SizeBytes: overlay.SizeBytes, Preallocation: overlay.Preallocation}
+		if _, err := helpers.CreateOverlayWithOptions(overlay.BasePath, overlay.Path, opts); err != nil {
+			return err
+		}
+		steps = append(steps, rollbackStep{"overlay " + overlay.Path, deleteFile(overlay.Path)})
+	}
+
+	if ci := spec.CloudInit; ci != nil {
+		// claim the files first since BuildSeedISO may fail after writing some
+		for _, name := range spec.seedFileNames() {
+			if err := claim(filepath.Join(spec.Dir, name)); err != nil {
+				return err
+			}
+		}
+		if ci.Datasource == helpers.DatasourceConfigDrive {
+			_, err = helpers.BuildConfigDrive(spec.Dir, ci.MetaData, ci.UserData, ci.NetworkConfig)
+		} else {
+			_, err = helpers.BuildSeedISO(spec.Dir, ci.UserData, ci.MetaData, ci.NetworkConfig)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if fw := domain.Firmware; fw != nil && fw.NVRAMTemplate != "" && !pathExists(fw.NVRAM) {
+		if err := claim(fw.NVRAM); err != nil {
+			return err
+		}
+		if err := filesystem.CopyFile(fw.NVRAMTemplate, fw.NVRAM, 0600); err != nil {
+			return fmt.Errorf("failed to create nvram %s: %w", fw.NVRAM, err)
+		}
+	}
+
+	if err := claim(filepath.Join(spec.Dir, domainXMLName)); err != nil {
+		return err
+	}
+	if err := filesystem.SaveFile(spec.Dir, domainXMLName, []byte(plan.DomainXML)); err != nil {
+		return fmt.Errorf("failed to save domain XML: %w", err)
+	}
+
+	// Defining the domain comes last, so it never has to be undone
+	_, err = defineRecorded(p.conn, p.Records, domain, plan.DomainXML)
+	return err
+}
+
+// checkExisting reports whether the domain of spec is already defined, and
+// returns a *DomainConflictError when it does not match the plan.
+func (p *Provisioner) checkExisting(spec VMSpec, plan Plan) (bool, error) {
+	name := spec.Domain.Name
+	dom, err := p.conn.DomainLookupByName(name)
+	if isLibvirtError(err, libvirt.ErrNoDomain) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to look up domain %s: %w", name, err)
+	}
+	desc, err := p.conn.DomainGetXMLDesc(dom, libvirt.DomainXMLInactive)
+	if err != nil {
+		return true, fmt.Errorf("failed to get XML of domain %s: %w", name, err)
+	}
+	var existing, want domainXML
+	if err := xml.Unmarshal([]byte(desc), &existing); err != nil {
+		return true, fmt.Errorf("failed to parse XML of domain %s: %w", name, err)
+	}
+	if err := xml.Unmarshal([]byte(plan.DomainXML), &want); err != nil {
+		return true, fmt.Errorf("failed to parse domain XML: %w", err)
+	}
+	diffs := definitionDiff(existing, want)
+	// A matching definition is no use when the rollback removed its disks
+	for _, disk := range want.Devices.Disks {
+		if disk.Source.File != "" && !pathExists(disk.Source.File) {
+			diffs = append(diffs, fmt.Sprintf("disk source %s does not exist", disk.Source.File))
+		}
+	}
+	if len(diffs) > 0 {
+		return true, fmt.Errorf("cannot create VM %s: %w", name, &DomainConflictError{Name: name, Differences: diffs})
+	}
+	logging.OrNop(p.Logger).Info("domain is already defined as requested", "domain", name)
+	return true, nil
+}
+
+// machineAliases are the machine types libvirt expands to a versioned one
+// when the domain is defined.
+var machineAliases = map[string]string{"pc": "pc-i440fx-", "q35": "pc-q35-"}
+
+// definitionDiff compares what CreateVM would define with an existing
+// definition, ignoring what libvirt fills in on its own such as the UUID,
+// MAC addresses, device addresses and the machine version.
+func definitionDiff(existing, want domainXML) []string {
+	var diffs []string
+	differs := func(what string, got, expected any) {
+		diffs = append(diffs, fmt.Sprintf("%s is %v, not %v", what, got, expected))
+	}
+
+	if want.UUID != "" && normalizeUUID(existing.UUID) != normalizeUUID(want.UUID) {
+		differs("uuid", existing.UUID, want.UUID)
+	}
+	gotMax, gotCur := definedMemory(existing)
+	wantMax, wantCur := definedMemory(want)
+	if gotMax != wantMax || gotCur != wantCur {
+		differs("memory (MiB)", fmt.Sprintf("%d of %d", gotCur, gotMax), fmt.Sprintf("%d of %d", wantCur, wantMax))
+	}
+	if existing.VCPU.Value != want.VCPU.Value || existing.VCPU.Current != want.VCPU.Current {
+		differs("vcpus", existing.VCPU.Value, want.VCPU.Value)
+	}
+	if got, expected := existing.OS.Type.Arch, want.OS.Type.Arch; expected != "" && got != expected {
+		differs("arch", got, expected)
+	}
+	if got, expected := existing.OS.Type.Machine, want.OS.Type.Machine; expected != "" && got != expected &&
+		!(machineAliases[expected] != "" && strings.HasPrefix(got, machineAliases[expected])) {
+		differs("machine", got, expected)
+	}
+	if got, expected := usesUEFI(existing), usesUEFI(want); got != expected {
+		differs("uefi", got, expected)
+	}
+
+	disks := map[string]diskXML{}
+	for _, disk := range existing.Devices.Disks {
+		disks[disk.Target.Dev] = disk
+	}
+	if len(existing.Devices.Disks) != len(want.Devices.Disks) {
+		differs("disk count", len(existing.Devices.Disks), len(want.Devices.Disks))
+	}
+	for _, disk := range want.Devices.Disks {
+		got, ok := disks[disk.Target.Dev]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("disk %s is missing", disk.Target.Dev))
+		case got.Source.File != disk.Source.File:
+			differs("source of disk "+disk.Target.Dev, got.Source.File, disk.Source.File)
+		case got.Device != disk.Device:
+			differs("device of disk "+disk.Target.Dev, got.Device, disk.Device)
+		}
+	}
+
+	if len(existing.Devices.Interfaces) != len(want.Devices.Interfaces) {
+		differs("interface count", len(existing.Devices.Interfaces), len(want.Devices.Interfaces))
+	} else {
+		for i, iface := range want.Devices.Interfaces {
+			got := existing.Devices.Interfaces[i]
+			// Attributes the definition does not model are ignored
+			got.Source.unmodeledXML = unmodeledXML{}
+			if got.Type != iface.Type || !reflect.DeepEqual(got.Source, iface.Source) {
+				differs(fmt.Sprintf("interface %d", i), got.Type+" "+interfaceSourceName(got.Source), iface.Type+" "+interfaceSourceName(iface.Source))
+			}
+			if iface.MAC != nil {
+				var mac string
+				if got.MAC != nil {
+					mac = got.MAC.Address
+				}
+				if !strings.EqualFold(mac, iface.MAC.Address) {
+					differs(fmt.Sprintf("mac of interface %d", i), mac, iface.MAC.Address)
+				}
+			}
+		}
+	}
+	return diffs
+}
+
+// definedMemory returns the maximum and current memory of a definition in
+// MiB, units libvirt does not know count as zero.
+func definedMemory(d domainXML) (maxMiB, curMiB uint64) {
+	maxMiB, _ = mebibytes(d.Memory)
+	curMiB = maxMiB
+	if d.CurrentMemory != nil {
+		curMiB, _ = mebibytes(*d.CurrentMemory)
+	}
+	return maxMiB, curMiB
+}
+
+func usesUEFI(d domainXML) bool {
+	return d.OS.Loader != nil || d.OS.Firmware == "efi"
+}
+
+func interfaceSourceName(s interfaceSourceXML) string {
+	return s.Network + s.Bridge + s.Dev
+}
+
+// resources returns what the VM commits on the host. Memory counts at its
+// balloon ceiling and disk is the size of the overlays, which admission does
+// not check since overlays are plain files outside any pool.
+func (s VMSpec) resources() Resources {
+	memMiB := max(s.Domain.MemoryMiB, s.Domain.MaxMemoryMiB)
+	var diskBytes uint64
+	for _, overlay := range s.Overlays {
+		diskBytes += overlay.virtualSize()
+	}
+	return Resources{VCPUs: int(s.Domain.VCPUs), MemoryMiB: memMiB, DiskBytes: diskBytes}
+}
+
+// domainSpec returns the domain spec with the cloud-init cdrom attached and
+// the UEFI firmware resolved to the installed OVMF files, keeping the NVRAM
+// in Dir. The domain is tagged as defined by the controller.
+func (s VMSpec) domainSpec() DomainSpec {
+	domain := s.Domain
+	domain.managed = true
+	if domain.Firmware != nil {
+		fw := domain.Firmware.withDefaults(filepath.Join(s.Dir, nvramName))
+		domain.Firmware = &fw
+	}
+	if s.CloudInit == nil {
+		return domain
+	}
+	target := s.CloudInit.Target
+	if target == "" {
+		target = "sda"
+	}
+	domain.Disks = append(append([]DiskSpec(nil), domain.Disks...), DiskSpec{
+		Source: filepath.Join(s.Dir, s.CloudInit.Datasource.ISOName()),
+		Target: target,
+		Device: "cdrom",
+	})
+	return domain
+}
+
+// fileNames returns the names of the files provisioning writes into Dir.
+func (s VMSpec) fileNames() []string {
+	names := append([]string{domainXMLName}, s.seedFileNames()...)
+	if fw := s.domainSpec().Firmware; fw != nil && fw.NVRAM == filepath.Join(s.Dir, nvramName) {
+		names = append(names, nvramName)
+	}
+	return names
+}
+
+// seedFileNames returns the names of the cloud-init files written into Dir.
+func (s VMSpec) seedFileNames() []string {
+	if s.CloudInit == nil {
+		return nil
+	}
+	if s.CloudInit.Datasource == helpers.DatasourceConfigDrive {
+		// the ConfigDrive files are staged outside Dir
+		return []string{helpers.ConfigDriveISOName}
+	}
+	names := []string{"user-data", "meta-data"}
+	if len(s.CloudInit.NetworkConfig) > 0 {
+		names = append(names, "network-config")
+	}
+	return append(names, helpers.SeedISOName)
+}
+
+// pathExists reports whether anything exists at path.
+func pathExists(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, os.ErrNotExist)
+}
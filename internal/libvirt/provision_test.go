@@ -0,0 +1,166 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"libvirt-controller/internal/state"
+)
+
+// definedXML is how libvirt returns the domain of redefineSpec: with a UUID,
+// a MAC address, device addresses and a versioned machine type filled in.
+const definedXML = `<domain type='kvm'>
+  <name>vm-123</name>
+  <uuid>0f8fad5b-d9cb-469f-a165-70867728950e</uuid>
+  <memory unit='KiB'>2097152</memory>
+  <currentMemory unit='KiB'>2097152</currentMemory>
+  <vcpu placement='static'>2</vcpu>
+  <os>
+    <type arch='x86_64' machine='pc-q35-8.2'>hvm</type>
+    <boot dev='hd'/>
+  </os>
+  <devices>
+    <disk type='file' device='disk'>
+      <driver name='qemu' type='qcow2' cache='none' discard='unmap'/>
+      <source file='/data/vm/vm-123/vda.qcow2'/>
+      <target dev='vda' bus='virtio'/>
+      <address type='pci' domain='0x0000' bus='0x04' slot='0x00' function='0x0'/>
+    </disk>
+    <interface type='network'>
+      <mac address='52:54:00:12:34:56'/>
+      <source network='default'/>
+      <model type='virtio'/>
+    </interface>
+  </devices>
+</domain>`
+
+func redefineSpec() DomainSpec {
+	return DomainSpec{
+		Name:      "vm-123",
+		VCPUs:     2,
+		MemoryMiB: 2048,
+		Machine:   "q35",
+		Disks:     []DiskSpec{{Source: "/data/vm/vm-123/vda.qcow2", Target: "vda"}},
+		NICs:      []NICSpec{{Network: "default"}},
+	}
+}
+
+func diffDefinition(t *testing.T, spec DomainSpec) []string {
+	t.Helper()
+	desc, err := BuildDomainXML(spec)
+	if err != nil {
+		t.Fatalf("error building domain XML. Err: %v", err)
+	}
+	var existing, want domainXML
+	if err := xml.Unmarshal([]byte(definedXML), &existing); err != nil {
+		t.Fatalf("error parsing defined XML. Err: %v", err)
+	}
+	if err := xml.Unmarshal([]byte(desc), &want); err != nil {
+		t.Fatalf("error parsing built XML. Err: %v", err)
+	}
+	return definitionDiff(existing, want)
+}
+
+func TestDefinitionDiffIdenticalRedefine(t *testing.T) {
+	if diffs := diffDefinition(t, redefineSpec()); len(diffs) != 0 {
+		t.Errorf("expected the defined domain to match; got %v", diffs)
+	}
+
+	spec := redefineSpec()
+	spec.UUID = "0F8FAD5B-D9CB-469F-A165-70867728950E"
+	spec.NICs[0].MAC = "52:54:00:12:34:56"
+	if diffs := diffDefinition(t, spec); len(diffs) != 0 {
+		t.Errorf("expected the defined domain to match its UUID and MAC; got %v", diffs)
+	}
+}
+
+func TestDefinitionDiffConflictingRedefine(t *testing.T) {
+	spec := redefineSpec()
+	spec.VCPUs = 4
+	spec.UUID = "6a1e2f4c-0000-4000-8000-000000000000"
+	spec.Disks[0].Source = "/data/vm/vm-123/other.qcow2"
+	spec.NICs[0] = NICSpec{Bridge: "br0"}
+
+	diffs := diffDefinition(t, spec)
+	for _, expected := range []string{"uuid", "vcpus", "source of disk vda", "interface 0"} {
+		if !strings.Contains(strings.Join(diffs, "\n"), expected) {
+			t.Errorf("expected a difference in %s; got %v", expected, diffs)
+		}
+	}
+
+	err := error(&DomainConflictError{Name: spec.Name, Differences: diffs})
+	if !errors.Is(err, ErrDomainExists) {
+		t.Errorf("expected DomainConflictError to wrap ErrDomainExists")
+	}
+}
+
+// recordedSpec is a VM whose only disk is an existing raw image in dir.
+func recordedSpec(t *testing.T, dir string) VMSpec {
+	t.Helper()
+	disk := filepath.Join(dir, "disk.img")
+	if err := os.WriteFile(disk, nil, 0600); err != nil {
+		t.Fatalf("error writing disk. Err: %v", err)
+	}
+	return VMSpec{
+		Domain: DomainSpec{Name: "vm-1", VCPUs: 1, MemoryMiB: 512, Disks: []DiskSpec{{Source: disk, Target: "vda", Format: "raw"}}},
+		Dir:    filepath.Join(dir, "vm-1"),
+	}
+}
+
+func TestCreateVMKeepsRecord(t *testing.T) {
+	_, conn := newFakeLibvirt(t)
+	store, err := state.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("error opening store. Err: %v", err)
+	}
+	p := NewProvisioner(conn)
+	p.Records = store
+	if err := p.CreateVM(recordedSpec(t, t.TempDir())); err != nil {
+		t.Fatalf("error creating VM. Err: %v", err)
+	}
+
+	records, err := store.List()
+	if err != nil {
+		t.Fatalf("error listing records. Err: %v", err)
+	}
+	dom, err := conn.DomainLookupByName("vm-1")
+	if err != nil {
+		t.Fatalf("error looking up domain. Err: %v", err)
+	}
+	if len(records) != 1 || records[0].UUID != uuidString(dom.UUID) || records[0].Name != "vm-1" {
+		t.Fatalf("expected a record of the defined domain; got %+v", records)
+	}
+
+	domains := NewDomainManager(conn)
+	domains.Records = store
+	if err := domains.Undefine("vm-1"); err != nil {
+		t.Fatalf("error undefining domain. Err: %v", err)
+	}
+	if records, _ := store.List(); len(records) != 0 {
+		t.Errorf("expected the record to be deleted with the domain; got %+v", records)
+	}
+}
+
+func TestCreateVMConflictsAlreadyExist(t *testing.T) {
+	_, conn := newFakeLibvirt(t)
+	spec := recordedSpec(t, t.TempDir())
+	if err := os.MkdirAll(spec.Dir, 0755); err != nil {
+		t.Fatalf("error creating VM directory. Err: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(spec.Dir, domainXMLName), nil, 0600); err != nil {
+		t.Fatalf("error writing domain XML. Err: %v", err)
+	}
+
+	err := NewProvisioner(conn).CreateVM(spec)
+	var conflict *PlanConflictError
+	if !errors.As(err, &conflict) || !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("expected a PlanConflictError wrapping ErrAlreadyExists; got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(spec.Dir, domainXMLName)); err != nil {
+		t.Errorf("expected the existing file to be kept. Err: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+
+	"libvirt-controller/internal/state"
+)
+
+// ErrQuotaExceeded is wrapped by the *QuotaExceededError returned when a
+// reservation would take a tenant over its quota.
+var ErrQuotaExceeded = errors.New("tenant quota exceeded")
+
+// QuotaExceededError names the first dimension of a tenant quota a
+// reservation would exceed. It matches ErrQuotaExceeded with errors.Is.
+type QuotaExceededError struct {
+	Tenant    string
+	Dimension string // "vms", "vcpus", "memory_mib" or "disk_bytes"
+	Limit     uint64
+	Used      uint64
+	Requested uint64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%v: tenant %s requested %d %s with %d in use, the limit is %d", ErrQuotaExceeded, e.Tenant, e.Requested, e.Dimension, e.Used, e.Limit)
+}
+
+func (e *QuotaExceededError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// QuotaManager caps the VMs, vCPUs, memory and disk each tenant may
+// reserve. Limits and usage are kept in the state store, so they survive a
+// restart of the controller.
+type QuotaManager struct {
+	store *state.Store
+}
+
+// NewQuotaManager creates a QuotaManager keeping quotas in store.
+func NewQuotaManager(store *state.Store) *QuotaManager {
+	return &QuotaManager{store: store}
+}
+
+// SetLimits replaces the limits of the tenant, keeping its usage. Lowering
+// a limit below the usage only blocks new reservations.
+func (q *QuotaManager) SetLimits(tenant string, limits state.QuotaLimits) error {
+	return q.store.UpdateQuota(tenant, func(quota *state.TenantQuota) error {
+		quota.Limits = limits
+		return nil
+	})
+}
+
+// Quota returns the limits and usage of the tenant. A tenant without a
+// quota has no limits and nothing in use.
+func (q *QuotaManager) Quota(tenant string) (state.TenantQuota, error) {
+	quota, err := q.store.GetQuota(tenant)
+	if errors.Is(err, state.ErrNotFound) {
+		return state.TenantQuota{Tenant: tenant}, nil
+	}
+	return quota, err
+}
+
+// CheckAndReserve reserves one VM using r for the tenant. When that would
+// exceed a limit nothing is reserved and a *QuotaExceededError is returned.
+// The Pool of r is ignored.
+func (q *QuotaManager) CheckAndReserve(tenant string, r Resources) error {
+	return q.store.UpdateQuota(tenant, func(quota *state.TenantQuota) error {
+		limits, used := quota.Limits, quota.Used
+		check := func(dimension string, limit, used, requested uint64) error {
+			if limit == 0 || used+requested <= limit {
+				return nil
+			}
+			return &QuotaExceededError{Tenant: tenant, Dimension: dimension, Limit: limit, Used: used, Requested: requested}
+		}
+		if err := check("vms", uint64(limits.VMs), uint64(used.VMs), 1); err != nil {
+			return err
+		}
+		if err := check("vcpus", uint64(limits.VCPUs), uint64(used.VCPUs), uint64(r.VCPUs)); err != nil {
+			return err
+		}
+		if err := check("memory_mib", limits.MemoryMiB, used.MemoryMiB, r.MemoryMiB); err != nil {
+			return err
+		}
+		if err := check("disk_bytes", limits.DiskBytes, used.DiskBytes, r.DiskBytes); err != nil {
+			return err
+		}
+
+		quota.Used.VMs++
+		quota.Used.VCPUs += r.VCPUs
+		quota.Used.MemoryMiB += r.MemoryMiB
+		quota.Used.DiskBytes += r.DiskBytes
+		return nil
+	})
+}
+
+// Release returns one VM using r to the quota of the tenant. Usage never
+// drops below zero, so releasing twice cannot free more than was reserved.
+func (q *QuotaManager) Release(tenant string, r Resources) error {
+	return q.store.UpdateQuota(tenant, func(quota *state.TenantQuota) error {
+		used := &quota.Used
+		used.VMs = max(used.VMs-1, 0)
+		used.VCPUs = max(used.VCPUs-r.VCPUs, 0)
+		used.MemoryMiB -= min(used.MemoryMiB, r.MemoryMiB)
+		used.DiskBytes -= min(used.DiskBytes, r.DiskBytes)
+		return nil
+	})
+}
+
+// ReserveVM reserves r for the VM like CheckAndReserve and records the
+// reservation, so ReleaseVM can return it knowing only the VM. A
+// reservation left behind by an earlier VM of the same name is released
+// first.
+func (q *QuotaManager) ReserveVM(tenant, vm string, r Resources) error {
+	if err := q.ReleaseVM(vm); err != nil {
+		return err
+	}
+	if err := q.CheckAndReserve(tenant, r); err != nil {
+		return err
+	}
+	rec := state.QuotaReservation{VM: vm, Tenant: tenant, Used: state.QuotaUsage{
+		VMs: 1, VCPUs: r.VCPUs, MemoryMiB: r.MemoryMiB, DiskBytes: r.DiskBytes,
+	}}
+	if err := q.store.PutReservation(rec); err != nil {
+		return errors.Join(fmt.Errorf("failed to record reservation of VM %s: %w", vm, err), q.Release(tenant, r))
+	}
+	return nil
+}
+
+// ReleaseVM returns what ReserveVM reserved for the VM. A VM without a
+// reservation is not an error, so it is safe to call for every deleted VM.
+func (q *QuotaManager) ReleaseVM(vm string) error {
+	rec, err := q.store.GetReservation(vm)
+	if errors.Is(err, state.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Forget the reservation first: a crash in between leaks it instead of
+	// releasing it twice
+	if err := q.store.DeleteReservation(vm); err != nil {
+		return err
+	}
+	return q.Release(rec.Tenant, Resources{VCPUs: rec.Used.VCPUs, MemoryMiB: rec.Used.MemoryMiB, DiskBytes: rec.Used.DiskBytes})
+}
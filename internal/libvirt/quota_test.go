@@ -0,0 +1,81 @@
+package libvirt
+
+import (
+	"errors"
+	"testing"
+
+	"libvirt-controller/internal/state"
+)
+
+func TestQuotaManager(t *testing.T) {
+	dir := t.TempDir()
+	store, err := state.NewStore(dir)
+	if err != nil {
+		t.Fatalf("error opening store. Err: %v", err)
+	}
+	quotas := NewQuotaManager(store)
+	if err := quotas.SetLimits("acme", state.QuotaLimits{VMs: 2, MemoryMiB: 4096}); err != nil {
+		t.Fatalf("error setting limits. Err: %v", err)
+	}
+
+	vm := Resources{VCPUs: 2, MemoryMiB: 2048}
+	if err := quotas.CheckAndReserve("acme", vm); err != nil {
+		t.Fatalf("error reserving first VM. Err: %v", err)
+	}
+	err = quotas.CheckAndReserve("acme", Resources{VCPUs: 1, MemoryMiB: 4096})
+	var qerr *QuotaExceededError
+	if !errors.As(err, &qerr) || !errors.Is(err, ErrQuotaExceeded) || qerr.Dimension != "memory_mib" {
+		t.Errorf("expected memory_mib quota exceeded; got %v", err)
+	}
+
+	// Usage must survive a restart
+	store, err = state.NewStore(dir)
+	if err != nil {
+		t.Fatalf("error reopening store. Err: %v", err)
+	}
+	quotas = NewQuotaManager(store)
+	if err := quotas.Release("acme", vm); err != nil {
+		t.Fatalf("error releasing VM. Err: %v", err)
+	}
+	got, err := quotas.Quota("acme")
+	if err != nil {
+		t.Fatalf("error getting quota. Err: %v", err)
+	}
+	if got.Used != (state.QuotaUsage{}) || got.Limits.VMs != 2 {
+		t.Errorf("expected limits kept and nothing in use; got %+v", got)
+	}
+	if err := quotas.CheckAndReserve("../etc", vm); err == nil {
+		t.Errorf("expected error for invalid tenant; got nil")
+	}
+}
+
+func TestQuotaManagerReleaseVM(t *testing.T) {
+	store, err := state.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("error opening store. Err: %v", err)
+	}
+	quotas := NewQuotaManager(store)
+	if err := quotas.ReserveVM("acme", "vm-1", Resources{VCPUs: 2, MemoryMiB: 2048, DiskBytes: 1 << 30}); err != nil {
+		t.Fatalf("error reserving VM. Err: %v", err)
+	}
+	// Reserving again replaces the reservation instead of adding to it
+	if err := quotas.ReserveVM("acme", "vm-1", Resources{VCPUs: 1, MemoryMiB: 1024}); err != nil {
+		t.Fatalf("error reserving VM again. Err: %v", err)
+	}
+	got, err := quotas.Quota("acme")
+	if err != nil {
+		t.Fatalf("error getting quota. Err: %v", err)
+	}
+	if expected := (state.QuotaUsage{VMs: 1, VCPUs: 1, MemoryMiB: 1024}); got.Used != expected {
+		t.Errorf("expected %+v in use; got %+v", expected, got.Used)
+	}
+
+	for range 2 {
+		if err := quotas.ReleaseVM("vm-1"); err != nil {
+			t.Fatalf("error releasing VM. Err: %v", err)
+		}
+	}
+	if got, _ := quotas.Quota("acme"); got.Used != (state.QuotaUsage{}) {
+		t.Errorf("expected nothing in use; got %+v", got.Used)
+	}
+}
@@ -0,0 +1,317 @@
+package libvirt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+
+	"libvirt-controller/internal/helpers"
+	"libvirt-controller/internal/state"
+)
+
+// Drift is one difference between the host and the state store.
+type Drift struct {
+	Kind   string `json:"kind"` // "domain", "volume" or "network"
+	ID     string `json:"id"`   // Domain UUID, volume path or network name
+	Name   string `json:"name,omitempty"`
+	Detail string `json:"detail"`
+}
+
+// Report lists the drift found by Reconcile. Orphans exist on the host
+// without a record, phantoms are recorded but gone from the host and
+// mismatches exist in both with different properties.
+type Report struct {
+	Orphans    []Drift `json:"orphans"`
+	Phantoms   []Drift `json:"phantoms"`
+	Mismatches []Drift `json:"mismatches"`
+	// Remediated describes what Reconcile fixed when Remediate is set.
+	Remediated []string  `json:"remediated,omitempty"`
+	CheckedAt  time.Time `json:"checked_at"`
+}
+
+// Clean reports whether no drift was found.
+func (r Report) Clean() bool {
+	return len(r.Orphans) == 0 && len(r.Phantoms) == 0 && len(r.Mismatches) == 0
+}
+
+// recordGracePeriod is how old a record must be before Reconcile deletes it
+// for a missing domain.
+const recordGracePeriod = time.Minute
+
+// Reconciler compares the domains, volumes and networks on the host with
+// the records in a state store.
+type Reconciler struct {
+	conn  *libvirt.Libvirt
+	store *state.Store
+
+	// Remediate makes Reconcile fix what it safely can: records of domains
+	// that are gone are deleted once they are older than a minute, orphaned domains the controller defined
+	// that are shut off are undefined and orphaned volumes in VM
+	// directories the controller created are deleted when no domain uses
+	// them or any image they back. Domains the controller did not define,
+	// running domains and mismatches are only reported.
+	Remediate bool
+}
+
+// NewReconciler creates a Reconciler that only reports drift.
+func NewReconciler(conn *libvirt.Libvirt, store *state.Store) *Reconciler {
+	return &Reconciler{conn: conn, store: store}
+}
+
+// Reconcile compares the host with the state store. Volumes are only
+// checked in pools that hold a recorded disk, so pools the controller does
+// not manage, like an image cache, are never reported.
+func (r *Reconciler) Reconcile() (Report, error) {
+	report := Report{CheckedAt: time.Now().UTC()}
+	// Domains are listed before the records: the controller saves a record
+	// before it defines the domain, so every domain it defined in the
+	// meantime is among the records
+	doms, _, err := r.conn.ConnectListAllDomains(1, 0)
+	if err != nil {
+		return report, fmt.Errorf("failed to list domains: %w", err)
+	}
+	records, err := r.store.List()
+	if err != nil {
+		return report, err
+	}
+
+	if err := r.reconcileDomains(doms, records, &report); err != nil {
+		return report, err
+	}
+	if err := r.reconcileVolumes(records, &report); err != nil {
+		return report, err
+	}
+	if err := r.reconcileNetworks(records, &report); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// Run reconciles every interval until ctx is cancelled and passes each
+// report to fn.
+func (r *Reconciler) Run(ctx context.Context, interval time.Duration, fn func(Report, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		fn(r.Reconcile())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Reconciler) reconcileDomains(doms []libvirt.Domain, records []state.VMRecord, report *Report) error {
+	onHost := make(map[string]libvirt.Domain, len(doms))
+	for _, dom := range doms {
+		onHost[uuidString(dom.UUID)] = dom
+	}
+
+	recorded := make(map[string]bool, len(records))
+	for _, rec := range records {
+		recorded[rec.UUID] = true
+		dom, ok := onHost[rec.UUID]
+		if !ok {
+			report.Phantoms = append(report.Phantoms, Drift{Kind: "domain", ID: rec.UUID, Name: rec.Name, Detail: "domain no longer exists"})
+			// A new record may belong to a domain being defined right now
+			if r.Remediate && report.CheckedAt.Sub(rec.CreatedAt) > recordGracePeriod {
+				if err := r.store.Delete(rec.UUID); err != nil {
+					return err
+				}
+				report.Remediated = append(report.Remediated, fmt.Sprintf("deleted record of domain %s", rec.Name))
+			}
+			continue
+		}
+
+		_, maxMemKiB, _, vcpus, _, err := r.conn.DomainGetInfo(dom)
+		if err != nil {
+			return fmt.Errorf("failed to get info for domain %s: %w", dom.Name, err)
+		}
+		if dom.Name != rec.Name {
+			report.Mismatches = append(report.Mismatches, Drift{Kind: "domain", ID: rec.UUID, Name: rec.Name, Detail: fmt.Sprintf("name is %s on the host", dom.Name)})
+		}
+		if rec.VCPUs != 0 && uint(vcpus) != rec.VCPUs {
+			report.Mismatches = append(report.Mismatches, Drift{Kind: "domain", ID: rec.UUID, Name: rec.Name, Detail: fmt.Sprintf("has %d vcpus, recorded %d", vcpus, rec.VCPUs)})
+		}
+		if rec.MemoryMiB != 0 && maxMemKiB != rec.MemoryMiB*1024 {
+			report.Mismatches = append(report.Mismatches, Drift{Kind: "domain", ID: rec.UUID, Name: rec.Name, Detail: fmt.Sprintf("has %d MiB memory, recorded %d MiB", maxMemKiB/1024, rec.MemoryMiB)})
+		}
+	}
+
+	for uuid, dom := range onHost {
+		if recorded[uuid] {
+			continue
+		}
+		report.Orphans = append(report.Orphans, Drift{Kind: "domain", ID: uuid, Name: dom.Name, Detail: "domain has no record"})
+		if !r.Remediate {
+			continue
+		}
+		domain, err := fetchDomainXML(r.conn, dom)
+		if err != nil {
+			return err
+		}
+		if !isManaged(domain) {
+			continue
+		}
+		active, err := r.conn.DomainIsActive(dom)
+		if err != nil {
+			return fmt.Errorf("failed to get state of domain %s: %w", dom.Name, err)
+		}
+		if active == 1 {
+			continue
+		}
+		if err := r.conn.DomainUndefineFlags(dom, libvirt.DomainUndefineManagedSave|libvirt.DomainUndefineSnapshotsMetadata|libvirt.DomainUndefineNvram); err != nil {
+			return fmt.Errorf("failed to undefine domain %s: %w", dom.Name, err)
+		}
+		report.Remediated = append(report.Remediated, fmt.Sprintf("undefined domain %s", dom.Name))
+	}
+	return nil
+}
+
+func (r *Reconciler) reconcileVolumes(records []state.VMRecord, report *Report) error {
+	recorded := make(map[string]state.VMRecord)
+	pools := make(map[string]bool)
+	for _, rec := range records {
+		for _, disk := range rec.Disks {
+			recorded[disk.Path] = rec
+			if disk.Pool != "" {
+				pools[disk.Pool] = true
+			}
+		}
+	}
+
+	sizes := make(map[string]uint64)
+	var inUse map[string]bool
+	for poolName := range pools {
+		vols, err := NewStoragePoolManager(r.conn).ListVolumes(poolName)
+		if isLibvirtError(err, libvirt.ErrNoStoragePool) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, vol := range vols {
+			sizes[vol.Path] = vol.CapacityBytes
+			if _, ok := recorded[vol.Path]; ok {
+				continue
+			}
+			report.Orphans = append(report.Orphans, Drift{Kind: "volume", ID: vol.Path, Name: vol.Name, Detail: fmt.Sprintf("volume in pool %s has no record", poolName)})
+			if r.Remediate && inUse == nil {
+				if inUse, err = r.diskPathsInUse(); err != nil {
+					return err
+				}
+			}
+			if r.Remediate && !inUse[vol.Path] && inVMDir(vol.Path) {
+				if err := NewStoragePoolManager(r.conn).DeleteVolume(poolName, vol.Name); err != nil {
+					return err
+				}
+				report.Remediated = append(report.Remediated, fmt.Sprintf("deleted volume %s", vol.Path))
+			}
+		}
+	}
+
+	for _, rec := range records {
+		for _, disk := range rec.Disks {
+			size, ok := sizes[disk.Path]
+			if !ok {
+				// Disks outside managed pools are looked up one by one
+				vol, err := r.conn.StorageVolLookupByPath(disk.Path)
+				if err == nil {
+					_, size, _, err = r.conn.StorageVolGetInfo(vol)
+				}
+				if isLibvirtError(err, libvirt.ErrNoStorageVol) {
+					// Files outside any pool cannot be sized by libvirt
+					if pathExists(disk.Path) {
+						continue
+					}
+					report.Phantoms = append(report.Phantoms, Drift{Kind: "volume", ID: disk.Path, Name: rec.Name, Detail: fmt.Sprintf("disk %s no longer exists", disk.Target)})
+					continue
+				}
+				if err != nil {
+					return fmt.Errorf("failed to look up volume %s: %w", disk.Path, err)
+				}
+			}
+			if disk.SizeBytes != 0 && size != disk.SizeBytes {
+				report.Mismatches = append(report.Mismatches, Drift{Kind: "volume", ID: disk.Path, Name: rec.Name, Detail: fmt.Sprintf("disk %s is %d bytes, recorded %d", disk.Target, size, disk.SizeBytes)})
+			}
+		}
+	}
+	return nil
+}
+
+// diskPathsInUse returns the disk files of every domain on the host and the
+// images backing them, so volumes of orphaned domains and base images are
+// not deleted from under them. The backing chain of a running domain is
+// the one libvirt reports, that of a shut off domain is read from the
+// images.
+func (r *Reconciler) diskPathsInUse() (map[string]bool, error) {
+	doms, _, err := r.conn.ConnectListAllDomains(1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list domains: %w", err)
+	}
+	inUse := make(map[string]bool)
+	for _, dom := range doms {
+		domain, err := fetchDomainXML(r.conn, dom)
+		if err != nil {
+			return nil, err
+		}
+		for _, disk := range domain.Devices.Disks {
+			if disk.Source.File == "" {
+				continue
+			}
+			inUse[disk.Source.File] = true
+			for b := disk.BackingStore; b.hasBacking(); b = b.BackingStore {
+				inUse[b.Source.File] = true
+			}
+			chain, err := helpers.BackingChain(disk.Source.File)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read backing chain of disk %s of domain %s: %w", disk.Target.Dev, dom.Name, err)
+			}
+			for _, layer := range chain {
+				inUse[filepath.Clean(layer.Filename)] = true
+			}
+		}
+	}
+	return inUse, nil
+}
+
+// inVMDir reports whether path is in a VM directory, which the controller
+// proves it created by saving the domain XML there.
+func inVMDir(path string) bool {
+	return pathExists(filepath.Join(filepath.Dir(path), domainXMLName))
+}
+
+func (r *Reconciler) reconcileNetworks(records []state.VMRecord, report *Report) error {
+	checked := make(map[string]bool)
+	for _, rec := range records {
+		for _, nic := range rec.NICs {
+			if nic.Network == "" || checked[nic.Network] {
+				continue
+			}
+			checked[nic.Network] = true
+			_, err := r.conn.NetworkLookupByName(nic.Network)
+			if isLibvirtError(err, libvirt.ErrNoNetwork) {
+				report.Phantoms = append(report.Phantoms, Drift{Kind: "network", ID: nic.Network, Name: rec.Name, Detail: "network no longer exists"})
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to look up network %s: %w", nic.Network, err)
+			}
+		}
+	}
+	return nil
+}
+
+// uuidString formats a libvirt UUID in its canonical text form.
+func uuidString(u libvirt.UUID) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
@@ -0,0 +1,90 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"slices"
+	"strings"
+	"testing"
+
+	"libvirt-controller/internal/state"
+)
+
+func TestReconcileRemediatesManagedOrphansOnly(t *testing.T) {
+	f, conn := newFakeLibvirt(t)
+	store, err := state.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("error opening store. Err: %v", err)
+	}
+	p := NewProvisioner(conn)
+	p.Records = store
+	if err := p.CreateVM(recordedSpec(t, t.TempDir())); err != nil {
+		t.Fatalf("error creating VM. Err: %v", err)
+	}
+
+	// A domain defined outside the controller and one whose record is lost
+	f.define(`<domain type='kvm'><name>foreign</name><memory>524288</memory><vcpu>1</vcpu></domain>`, false)
+	lost, err := BuildDomainXML(DomainSpec{Name: "lost", VCPUs: 1, MemoryMiB: 512, managed: true})
+	if err != nil {
+		t.Fatalf("error building domain XML. Err: %v", err)
+	}
+	f.define(lost, false)
+
+	r := NewReconciler(conn, store)
+	r.Remediate = true
+	report, err := r.Reconcile()
+	if err != nil {
+		t.Fatalf("error reconciling. Err: %v", err)
+	}
+	if len(report.Orphans) != 2 {
+		t.Errorf("expected 2 orphans; got %+v", report.Orphans)
+	}
+	names := f.names()
+	if !slices.Contains(names, "vm-1") {
+		t.Errorf("expected the VM created by the provisioner to survive; got %v", names)
+	}
+	if !slices.Contains(names, "foreign") {
+		t.Errorf("expected the domain defined outside the controller to survive; got %v", names)
+	}
+	if slices.Contains(names, "lost") {
+		t.Errorf("expected the managed orphan to be undefined; got %v", names)
+	}
+}
+
+func TestIsManaged(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    DomainSpec
+		managed bool
+	}{
+		{name: "new", spec: DomainSpec{Name: "vm-1", VCPUs: 1, MemoryMiB: 512, managed: true}, managed: true},
+		{name: "unmanaged", spec: DomainSpec{Name: "vm-1", VCPUs: 1, MemoryMiB: 512}, managed: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			domXML, err := BuildDomainXML(tt.spec)
+			if err != nil {
+				t.Fatalf("error building domain XML. Err: %v", err)
+			}
+			spec, err := ParseDomainXML(domXML)
+			if err != nil {
+				t.Fatalf("error parsing domain XML. Err: %v", err)
+			}
+			// A parsed domain keeps its metadata and is tagged only once
+			spec.managed = true
+			rebuilt, err := BuildDomainXML(spec)
+			if err != nil {
+				t.Fatalf("error building domain XML. Err: %v", err)
+			}
+			var dom domainXML
+			if err := xml.Unmarshal([]byte(domXML), &dom); err != nil {
+				t.Fatalf("error parsing domain XML. Err: %v", err)
+			}
+			if got := isManaged(dom); got != tt.managed {
+				t.Errorf("expected managed %v; got %v", tt.managed, got)
+			}
+			if n := strings.Count(rebuilt, managedNamespace); n != 1 {
+				t.Errorf("expected one managed element; got %d in %s", n, rebuilt)
+			}
+		})
+	}
+}
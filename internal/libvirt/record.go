@@ -0,0 +1,110 @@
+package libvirt
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/digitalocean/go-libvirt"
+
+	"libvirt-controller/internal/helpers"
+	"libvirt-controller/internal/state"
+)
+
+// newVMRecord describes the domain defined from spec for the state store.
+// Disk sizes are the virtual sizes of the images, left zero when an image
+// cannot be read.
+func newVMRecord(spec DomainSpec) state.VMRecord {
+	rec := state.VMRecord{
+		UUID:      spec.UUID,
+		Name:      spec.Name,
+		VCPUs:     spec.VCPUs,
+		MemoryMiB: max(spec.MemoryMiB, spec.MaxMemoryMiB),
+	}
+	for _, disk := range spec.Disks {
+		if disk.Device == "cdrom" {
+			continue
+		}
+		var size uint64
+		if info, err := helpers.CachedImageInfo(disk.Source); err == nil {
+			size = info.VirtualSize
+		}
+		rec.Disks = append(rec.Disks, state.DiskRecord{Target: disk.Target, Path: disk.Source, SizeBytes: size})
+	}
+	for _, nic := range spec.NICs {
+		rec.NICs = append(rec.NICs, state.NICRecord{MAC: nic.MAC, Network: nic.Network, Bridge: nic.Bridge})
+	}
+	return rec
+}
+
+// defineRecorded defines domXML, built from spec, and keeps its record in
+// store. The record is saved first and deleted again when the define
+// fails, so a domain never exists without its record; spec must therefore
+// have a UUID. Nothing is saved when store is nil.
+func defineRecorded(conn *libvirt.Libvirt, store *state.Store, spec DomainSpec, domXML string) (state.VMRecord, error) {
+	rec := newVMRecord(spec)
+	if store != nil {
+		if err := store.Put(rec); err != nil {
+			return rec, fmt.Errorf("failed to record domain %s: %w", spec.Name, err)
+		}
+	}
+	if _, err := conn.DomainDefineXML(domXML); err != nil {
+		err = fmt.Errorf("failed to define domain %s: %w", spec.Name, err)
+		if store != nil {
+			if derr := store.Delete(rec.UUID); derr != nil {
+				return rec, errors.Join(err, derr)
+			}
+		}
+		return rec, err
+	}
+	return rec, nil
+}
+
+// managedNamespace is the namespace of the domain metadata element that
+// marks the domains the controller defined.
+const managedNamespace = "https://libvirt-controller/xmlns/managed/1"
+
+// managedElement is added to the metadata of the domains the controller
+// defines.
+const managedElement = `<managed xmlns="` + managedNamespace + `"></managed>`
+
+// isManaged reports whether the controller defined dom: only those domains
+// carry the managed metadata element, which libvirt keeps as it was
+// defined.
+func isManaged(dom domainXML) bool {
+	for _, e := range dom.Extra {
+		if e.XMLName.Local != "metadata" {
+			continue
+		}
+		d := xml.NewDecoder(bytes.NewReader(e.Inner))
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				break
+			}
+			if start, ok := tok.(xml.StartElement); ok && start.Name.Space == managedNamespace && start.Name.Local == "managed" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// markManaged adds the managed element to the metadata of dom, creating
+// the metadata element when dom has none.
+func markManaged(dom *domainXML) {
+	if isManaged(*dom) {
+		return
+	}
+	// The elements may be shared with the extras of a parsed spec
+	dom.Extra = slices.Clone(dom.Extra)
+	for i, e := range dom.Extra {
+		if e.XMLName.Local == "metadata" {
+			dom.Extra[i].Inner = append(slices.Clip(e.Inner), managedElement...)
+			return
+		}
+	}
+	dom.Extra = append(dom.Extra, rawXML{XMLName: xml.Name{Local: "metadata"}, Inner: []byte(managedElement)})
+}
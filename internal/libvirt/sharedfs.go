@@ -0,0 +1,105 @@
+package libvirt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// FilesystemSpec shares a host directory with the guest. With virtiofs,
+// libvirt starts a virtiofsd daemon for the domain and connects it to qemu
+// over a vhost-user socket; the guest memory is then backed by shared memfd
+// pages, which virtiofs requires. 9p needs no daemon but is much slower.
+//
+// The guest mounts the share by its tag:
+//
+//	mount -t virtiofs <tag> /mnt/share
+//	mount -t 9p -o trans=virtio,version=9p2000.L <tag> /mnt/share
+type FilesystemSpec struct {
+	Driver   string // "virtiofs" (default) or "9p"
+	Source   string // Absolute path of the host directory
+	Tag      string // Mount tag in the guest, derived from the directory name when empty
+	ReadOnly bool
+	Binary   string // Path of virtiofsd, libvirt's default when empty
+}
+
+// maxMountTagLen is the size of the tag field in the virtio-fs device
+// config. 9p allows longer tags but is held to the same limit.
+const maxMountTagLen = 36
+
+var (
+	validMountTag   = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+	invalidTagChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+)
+
+// Validate checks the driver, source path and tag.
+func (f FilesystemSpec) Validate() error {
+	if f.Driver != "" && f.Driver != "virtiofs" && f.Driver != "9p" {
+		return fmt.Errorf("invalid driver %q", f.Driver)
+	}
+	if !filepath.IsAbs(f.Source) {
+		return fmt.Errorf("source %q must be an absolute path", f.Source)
+	}
+	if f.Binary != "" && f.Driver == "9p" {
+		return fmt.Errorf("binary is only used by virtiofs")
+	}
+	tag := f.mountTag()
+	if len(tag) > maxMountTagLen || !validMountTag.MatchString(tag) {
+		return fmt.Errorf("invalid mount tag %q, use up to %d letters, digits, '.', '_' or '-'", tag, maxMountTagLen)
+	}
+	return nil
+}
+
+// mountTag returns the tag, or the sanitized directory name when no tag is
+// set, e.g. "data-set" for /srv/data set.
+func (f FilesystemSpec) mountTag() string {
+	if f.Tag != "" {
+		return f.Tag
+	}
+	tag := strings.Trim(invalidTagChars.ReplaceAllString(filepath.Base(f.Source), "-"), "-")
+	if len(tag) > maxMountTagLen {
+		tag = tag[:maxMountTagLen]
+	}
+	if tag == "" || tag == "." {
+		tag = "share"
+	}
+	return tag
+}
+
+// checkSource checks that the source exists on the host and is a directory.
+func (f FilesystemSpec) checkSource() error {
+	info, err := os.Stat(f.Source)
+	if err != nil {
+		return fmt.Errorf("filesystem source %s is not accessible: %w", f.Source, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("filesystem source %s is not a directory", f.Source)
+	}
+	return nil
+}
+
+func buildFilesystemXML(f FilesystemSpec) filesystemXML {
+	x := filesystemXML{
+		Type:   "mount",
+		Source: filesystemSourceXML{Dir: f.Source},
+		Target: filesystemTargetXML{Dir: f.mountTag()},
+	}
+	if f.Driver == "9p" {
+		// Mapped stores guest ownership in xattrs instead of needing
+		// qemu to run as root
+		x.AccessMode = "mapped"
+		x.Driver = &filesystemDriverXML{Type: "path"}
+	} else {
+		x.AccessMode = "passthrough"
+		x.Driver = &filesystemDriverXML{Type: "virtiofs"}
+		if f.Binary != "" {
+			x.Binary = &filesystemBinaryXML{Path: f.Binary}
+		}
+	}
+	if f.ReadOnly {
+		x.ReadOnly = &struct{}{}
+	}
+	return x
+}
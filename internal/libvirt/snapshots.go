@@ -1,6 +1,15 @@
 package libvirt
 
 import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+
 	"libvirt-controller/internal/cmdutil"
 )
 
@@ -45,3 +54,206 @@ func DeleteSnapshot(domainName string, snapshotName string) (string, error) {
 	}
 	return cmdutil.Execute("virsh", cmd...)
 }
+
+// ErrRevertRequiresForce is returned by SnapshotManager.RevertSnapshot when
+// the domain is running and force was not set. Reverting discards the
+// current state of the running domain.
+var ErrRevertRequiresForce = errors.New("reverting a running domain requires force")
+
+// SnapshotInfo describes a snapshot of a domain.
+type SnapshotInfo struct {
+	Name      string    `json:"name"`
+	Parent    string    `json:"parent,omitempty"`
+	State     string    `json:"state"`
+	CreatedAt time.Time `json:"created_at"`
+	Memory    bool      `json:"memory"`
+	External  bool      `json:"external"`
+}
+
+// SnapshotManager manages domain snapshots over a libvirt connection.
+type SnapshotManager struct {
+	conn *libvirt.Libvirt
+}
+
+// NewSnapshotManager creates a SnapshotManager using the given libvirt connection.
+func NewSnapshotManager(conn *libvirt.Libvirt) *SnapshotManager {
+	return &SnapshotManager{conn: conn}
+}
+
+// CreateSnapshot takes an external snapshot of the domain. Every writable
+// disk gets a new qcow2 overlay next to it, named after the snapshot, so the
+// original image stays untouched. With memory set the RAM of a running domain
+// is saved as well, otherwise only the disks are captured.
+func (m *SnapshotManager) CreateSnapshot(domainName, name string, memory bool) (SnapshotInfo, error) {
+	if name == "" || strings.ContainsAny(name, "/ ") {
+		return SnapshotInfo{}, fmt.Errorf("invalid snapshot name %q", name)
+	}
+	dom, err := m.conn.DomainLookupByName(domainName)
+	if err != nil {
+		return SnapshotInfo{}, fmt.Errorf("failed to look up domain %s: %w", domainName, err)
+	}
+	domain, err := fetchDomainXML(m.conn, dom)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	snap := domainSnapshotXML{Name: name, Disks: &snapshotDisksXML{}}
+	var memDir string
+	for _, disk := range domain.Devices.Disks {
+		if disk.Device == "cdrom" || disk.ReadOnly != nil || disk.Source.File == "" {
+			snap.Disks.Disks = append(snap.Disks.Disks, snapshotDiskXML{Name: disk.Target.Dev, Snapshot: "no"})
+			continue
+		}
+		snap.Disks.Disks = append(snap.Disks.Disks, snapshotDiskXML{
+			Name:     disk.Target.Dev,
+			Snapshot: "external",
+			Driver:   &snapshotDiskDriverXML{Type: "qcow2"},
+			Source:   &diskSourceXML{File: snapshotPath(disk.Source.File, name)},
+		})
+		if memDir == "" {
+			memDir = filepath.Dir(disk.Source.File)
+		}
+	}
+	if memDir == "" {
+		return SnapshotInfo{}, fmt.Errorf("domain %s has no writable disks to snapshot", domainName)
+	}
+
+	flags := libvirt.DomainSnapshotCreateAtomic
+	if memory {
+		active, err := m.conn.DomainIsActive(dom)
+		if err != nil {
+			return SnapshotInfo{}, fmt.Errorf("failed to get state of domain %s: %w", domainName, err)
+		}
+		if active != 1 {
+			return SnapshotInfo{}, fmt.Errorf("cannot save memory of domain %s: domain is not running", domainName)
+		}
+		snap.Memory = &snapshotMemoryXML{
+			Snapshot: "external",
+			File:     filepath.Join(memDir, domainName+"."+name+".mem"),
+		}
+	} else {
+		snap.Memory = &snapshotMemoryXML{Snapshot: "no"}
+		flags |= libvirt.DomainSnapshotCreateDiskOnly
+	}
+
+	out, err := xml.Marshal(snap)
+	if err != nil {
+		return SnapshotInfo{}, fmt.Errorf("failed to build snapshot XML: %w", err)
+	}
+	created, err := m.conn.DomainSnapshotCreateXML(dom, string(out), uint32(flags))
+	if err != nil {
+		return SnapshotInfo{}, fmt.Errorf("failed to create snapshot %s of domain %s: %w", name, domainName, err)
+	}
+	return m.snapshotInfo(created)
+}
+
+// ListSnapshots lists the snapshots of the domain.
+func (m *SnapshotManager) ListSnapshots(domainName string) ([]SnapshotInfo, error) {
+	dom, err := m.conn.DomainLookupByName(domainName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up domain %s: %w", domainName, err)
+	}
+	snaps, _, err := m.conn.DomainListAllSnapshots(dom, 1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots of domain %s: %w", domainName, err)
+	}
+
+	infos := make([]SnapshotInfo, 0, len(snaps))
+	for _, snap := range snaps {
+		info, err := m.snapshotInfo(snap)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// RevertSnapshot reverts the domain to a snapshot. Reverting a running
+// domain throws away its current state, so it fails with
+// ErrRevertRequiresForce unless force is set.
+func (m *SnapshotManager) RevertSnapshot(domainName, name string, force bool) error {
+	dom, snap, err := m.lookup(domainName, name)
+	if err != nil {
+		return err
+	}
+	active, err := m.conn.DomainIsActive(dom)
+	if err != nil {
+		return fmt.Errorf("failed to get state of domain %s: %w", domainName, err)
+	}
+
+	var flags libvirt.DomainSnapshotRevertFlags
+	if active == 1 {
+		if !force {
+			return fmt.Errorf("cannot revert domain %s to snapshot %s: %w", domainName, name, ErrRevertRequiresForce)
+		}
+		flags |= libvirt.DomainSnapshotRevertForce
+	}
+	if err := m.conn.DomainRevertToSnapshot(snap, uint32(flags)); err != nil {
+		return fmt.Errorf("failed to revert domain %s to snapshot %s: %w", domainName, name, err)
+	}
+	return nil
+}
+
+// DeleteSnapshot deletes a snapshot of the domain.
+func (m *SnapshotManager) DeleteSnapshot(domainName, name string) error {
+	_, snap, err := m.lookup(domainName, name)
+	if err != nil {
+		return err
+	}
+	if err := m.conn.DomainSnapshotDelete(snap, 0); err != nil {
+		return fmt.Errorf("failed to delete snapshot %s of domain %s: %w", name, domainName, err)
+	}
+	return nil
+}
+
+// lookup finds a domain and one of its snapshots by name.
+func (m *SnapshotManager) lookup(domainName, name string) (libvirt.Domain, libvirt.DomainSnapshot, error) {
+	dom, err := m.conn.DomainLookupByName(domainName)
+	if err != nil {
+		return libvirt.Domain{}, libvirt.DomainSnapshot{}, fmt.Errorf("failed to look up domain %s: %w", domainName, err)
+	}
+	snap, err := m.conn.DomainSnapshotLookupByName(dom, name, 0)
+	if err != nil {
+		return libvirt.Domain{}, libvirt.DomainSnapshot{}, fmt.Errorf("failed to look up snapshot %s of domain %s: %w", name, domainName, err)
+	}
+	return dom, snap, nil
+}
+
+func (m *SnapshotManager) snapshotInfo(snap libvirt.DomainSnapshot) (SnapshotInfo, error) {
+	desc, err := m.conn.DomainSnapshotGetXMLDesc(snap, 0)
+	if err != nil {
+		return SnapshotInfo{}, fmt.Errorf("failed to get XML of snapshot %s: %w", snap.Name, err)
+	}
+	var parsed domainSnapshotXML
+	if err := xml.Unmarshal([]byte(desc), &parsed); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("failed to parse XML of snapshot %s: %w", snap.Name, err)
+	}
+
+	info := SnapshotInfo{
+		Name:      parsed.Name,
+		State:     parsed.State,
+		CreatedAt: time.Unix(parsed.CreationTime, 0),
+	}
+	if parsed.Parent != nil {
+		info.Parent = parsed.Parent.Name
+	}
+	if parsed.Memory != nil && parsed.Memory.Snapshot != "no" {
+		info.Memory = true
+	}
+	if parsed.Disks != nil {
+		for _, disk := range parsed.Disks.Disks {
+			if disk.Snapshot == "external" {
+				info.External = true
+			}
+		}
+	}
+	return info, nil
+}
+
+// snapshotPath returns the overlay path for a disk image and snapshot, e.g.
+// "/data/vm/disk.qcow2" and "nightly" give "/data/vm/disk.nightly.qcow2".
+func snapshotPath(imagePath, snapshotName string) string {
+	base := strings.TrimSuffix(imagePath, filepath.Ext(imagePath))
+	return base + "." + snapshotName + ".qcow2"
+}
@@ -0,0 +1,520 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// DomainSpec describes a domain to be built into libvirt domain XML.
+type DomainSpec struct {
+	Name         string
+	UUID         string // Optional, libvirt generates one when empty
+	VCPUs        uint
+	MaxVCPUs     uint // Maximum for vCPU hotplug, equal to VCPUs when zero
+	MemoryMiB    uint64
+	MaxMemoryMiB uint64           // Balloon ceiling for live memory resize, equal to MemoryMiB when zero
+	CPUModel     string           // "host-passthrough" (default), "host-model" or a named CPU model
+	Machine      string           // Machine type, e.g. "q35"; libvirt's default when empty
+	Arch         string           // Guest architecture, "x86_64" when empty
+	BootOrder    []string         // Boot devices in order: "hd", "cdrom", "network"; "hd" when empty and no device sets one
+	CPUPins      []CPUPin         // Host CPUs each vCPU may run on; unpinned vCPUs float
+	NUMA         *NUMATune        // Host NUMA nodes to take guest memory from
+	Graphics     *GraphicsSpec    // Remote display, none when nil
+	HostDevices  []HostDeviceSpec // PCI and USB devices passed through from the host
+	Filesystems  []FilesystemSpec // Host directories shared with the guest
+	Firmware     *FirmwareSpec    // UEFI firmware, legacy BIOS when nil
+	TPM          *TPMSpec         // Emulated TPM, none when nil
+	Disks        []DiskSpec
+	NICs         []NICSpec
+
+	// extras holds what ParseDomainXML could not map onto the fields above.
+	extras *domainExtras
+	// managed makes BuildDomainXML tag the domain as defined by the
+	// controller, see isManaged.
+	managed bool
+}
+
+// DiskSpec describes a file-backed disk or cdrom. The IO tuning defaults
+// suit disks on SSD-backed storage: no host page cache and trim passed down
+// to the image.
+type DiskSpec struct {
+	Source   string // Path of the image on the host
+	Target   string // Target device name in the guest, e.g. "vda"
+	Bus      string // "virtio" (default), "virtio-scsi", "scsi", "sata", "ide" or "usb"
+	Format   string // Image format, "qcow2" when empty
+	Device   string // "disk" (default) or "cdrom"
+	ReadOnly bool
+	Cache    string // "none" (default), "writeback", "writethrough", "directsync" or "unsafe"
+	IO       string // "native" or "threads"; libvirt's default when empty
+	Discard  string // "unmap" (default for writable disks) or "ignore"
+	IOTune   *BlockIOLimits
+
+	// BootOrder is the position of the disk among the devices booted
+	// from, starting at 1. Zero leaves the disk out unless the domain
+	// uses DomainSpec.BootOrder.
+	BootOrder uint
+}
+
+// NICSpec describes a network interface attached to a libvirt network, a host
+// bridge or directly to a host interface through macvtap. Exactly one of
+// Network, Bridge and Direct must be set.
+type NICSpec struct {
+	Network    string     // libvirt network name
+	Bridge     string     // Host bridge name
+	Direct     string     // Host interface for a macvtap device
+	DirectMode string     // macvtap mode, "bridge" when empty
+	MAC        string     // Fixed MAC address, libvirt generates one when empty
+	Model      string     // Device model, "virtio" when empty
+	Inbound    *Bandwidth // Traffic into the guest
+	Outbound   *Bandwidth // Traffic out of the guest
+	BootOrder  uint       // Position among the devices booted from, like DiskSpec.BootOrder
+}
+
+var validBootDevices = map[string]bool{"hd": true, "cdrom": true, "network": true, "fd": true}
+
+// Validate checks the spec for missing required fields and invalid combinations.
+func (s DomainSpec) Validate() error {
+	var errs []error
+	if err := ValidateDomainName(s.Name); err != nil {
+		errs = append(errs, err)
+	}
+	if s.VCPUs == 0 {
+		errs = append(errs, errors.New("vcpus must be greater than zero"))
+	}
+	if s.MaxVCPUs != 0 && s.MaxVCPUs < s.VCPUs {
+		errs = append(errs, fmt.Errorf("max vcpus %d is less than vcpus %d", s.MaxVCPUs, s.VCPUs))
+	}
+	if s.MemoryMiB == 0 {
+		errs = append(errs, errors.New("memory must be greater than zero"))
+	}
+	if s.MaxMemoryMiB != 0 && s.MaxMemoryMiB < s.MemoryMiB {
+		errs = append(errs, fmt.Errorf("max memory %d MiB is less than memory %d MiB", s.MaxMemoryMiB, s.MemoryMiB))
+	}
+	for _, dev := range s.BootOrder {
+		if !validBootDevices[dev] {
+			errs = append(errs, fmt.Errorf("invalid boot device %q", dev))
+		}
+	}
+	errs = append(errs, s.validateDeviceBootOrder()...)
+
+	pinned := make(map[uint]bool)
+	for i, pin := range s.CPUPins {
+		if pin.VCPU >= max(s.VCPUs, s.MaxVCPUs) {
+			errs = append(errs, fmt.Errorf("cpu pin %d: vcpu %d does not exist", i, pin.VCPU))
+		}
+		if pinned[pin.VCPU] {
+			errs = append(errs, fmt.Errorf("cpu pin %d: vcpu %d is pinned more than once", i, pin.VCPU))
+		}
+		pinned[pin.VCPU] = true
+		if _, err := parseCPUSet(pin.CPUSet); err != nil {
+			errs = append(errs, fmt.Errorf("cpu pin %d: %w", i, err))
+		}
+	}
+	if s.NUMA != nil {
+		if err := s.NUMA.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("numa: %w", err))
+		}
+	}
+	if s.Graphics != nil {
+		if err := s.Graphics.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("graphics: %w", err))
+		}
+	}
+	for i, d := range s.HostDevices {
+		if err := d.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("host device %d: %w", i, err))
+		}
+	}
+	if s.Firmware != nil {
+		if err := s.Firmware.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("firmware: %w", err))
+		}
+		if s.Firmware.SecureBoot && s.Machine != "" && !isQ35(s.Machine) {
+			errs = append(errs, fmt.Errorf("firmware: secure boot requires a q35 machine type, not %s", s.Machine))
+		}
+	}
+	if s.TPM != nil {
+		if err := s.TPM.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("tpm: %w", err))
+		}
+	}
+	tags := make(map[string]bool)
+	for i, f := range s.Filesystems {
+		if err := f.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("filesystem %d: %w", i, err))
+			continue
+		}
+		if tags[f.mountTag()] {
+			errs = append(errs, fmt.Errorf("filesystem %d: duplicate mount tag %s", i, f.mountTag()))
+		}
+		tags[f.mountTag()] = true
+	}
+
+	targets := make(map[string]bool)
+	for i, disk := range s.Disks {
+		if err := disk.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("disk %d: %w", i, err))
+			continue
+		}
+		if targets[disk.Target] {
+			errs = append(errs, fmt.Errorf("disk %d: duplicate target %s", i, disk.Target))
+		}
+		targets[disk.Target] = true
+	}
+
+	for i, nic := range s.NICs {
+		if err := nic.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("nic %d: %w", i, err))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid domain spec: %w", err)
+	}
+	return nil
+}
+
+// validateDeviceBootOrder checks that no two devices share a boot order and
+// that the per-device order is not mixed with BootOrder, which libvirt
+// rejects.
+func (s DomainSpec) validateDeviceBootOrder() []error {
+	var errs []error
+	used := make(map[uint]string)
+	claim := func(order uint, dev string) {
+		if order == 0 {
+			return
+		}
+		if other, ok := used[order]; ok {
+			errs = append(errs, fmt.Errorf("boot order %d is used by both %s and %s", order, other, dev))
+		}
+		used[order] = dev
+	}
+	for _, disk := range s.Disks {
+		claim(disk.BootOrder, "disk "+disk.Target)
+	}
+	for i, nic := range s.NICs {
+		claim(nic.BootOrder, fmt.Sprintf("nic %d", i))
+	}
+	if len(used) > 0 && len(s.BootOrder) > 0 {
+		errs = append(errs, errors.New("boot order of devices cannot be combined with the boot order of the domain"))
+	}
+	return errs
+}
+
+// hasDeviceBootOrder reports whether a disk or NIC sets a boot order.
+func (s DomainSpec) hasDeviceBootOrder() bool {
+	for _, disk := range s.Disks {
+		if disk.BootOrder != 0 {
+			return true
+		}
+	}
+	for _, nic := range s.NICs {
+		if nic.BootOrder != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the disk for missing required fields.
+func (d DiskSpec) Validate() error {
+	if d.Source == "" {
+		return errors.New("source is required")
+	}
+	if d.Target == "" {
+		return errors.New("target is required")
+	}
+	if d.Device != "" && d.Device != "disk" && d.Device != "cdrom" {
+		return fmt.Errorf("invalid device %q", d.Device)
+	}
+	if d.Bus != "" && !validDiskBuses[d.Bus] {
+		return fmt.Errorf("invalid bus %q", d.Bus)
+	}
+	if d.Cache != "" && !validCacheModes[d.Cache] {
+		return fmt.Errorf("invalid cache mode %q", d.Cache)
+	}
+	if d.IO != "" && d.IO != "native" && d.IO != "threads" {
+		return fmt.Errorf("invalid io mode %q", d.IO)
+	}
+	if d.Discard != "" && d.Discard != "unmap" && d.Discard != "ignore" {
+		return fmt.Errorf("invalid discard mode %q", d.Discard)
+	}
+	// QEMU only does native AIO on files opened with O_DIRECT
+	if d.IO == "native" && d.Cache != "" && d.Cache != "none" && d.Cache != "directsync" {
+		return fmt.Errorf("io mode native requires cache mode none or directsync, not %s", d.Cache)
+	}
+	if d.Discard == "unmap" && (d.ReadOnly || d.Device == "cdrom") {
+		return errors.New("discard unmap cannot be used on a read-only disk")
+	}
+	if d.IOTune != nil {
+		if err := d.IOTune.Validate(); err != nil {
+			return fmt.Errorf("invalid iotune: %w", err)
+		}
+	}
+	return nil
+}
+
+var (
+	validDiskBuses  = map[string]bool{"virtio": true, "virtio-scsi": true, "scsi": true, "sata": true, "ide": true, "usb": true}
+	validCacheModes = map[string]bool{"none": true, "writeback": true, "writethrough": true, "directsync": true, "unsafe": true}
+)
+
+var validDirectModes = map[string]bool{"bridge": true, "vepa": true, "private": true, "passthrough": true}
+
+// Validate checks that the NIC is attached to exactly one network, bridge or
+// host interface.
+func (n NICSpec) Validate() error {
+	set := 0
+	for _, v := range []string{n.Network, n.Bridge, n.Direct} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("exactly one of network, bridge or direct is required")
+	}
+	if n.DirectMode != "" && !validDirectModes[n.DirectMode] {
+		return fmt.Errorf("invalid direct mode %q", n.DirectMode)
+	}
+	if n.MAC != "" {
+		if _, err := net.ParseMAC(n.MAC); err != nil {
+			return fmt.Errorf("invalid MAC address %q", n.MAC)
+		}
+	}
+	if n.Inbound != nil {
+		if err := n.Inbound.Validate(); err != nil {
+			return fmt.Errorf("invalid inbound bandwidth: %w", err)
+		}
+	}
+	if n.Outbound != nil {
+		if err := n.Outbound.Validate(); err != nil {
+			return fmt.Errorf("invalid outbound bandwidth: %w", err)
+		}
+	}
+	return nil
+}
+
+// BuildDomainXML validates the spec and renders it as libvirt domain XML.
+func BuildDomainXML(spec DomainSpec) (string, error) {
+	if err := spec.Validate(); err != nil {
+		return "", err
+	}
+
+	dom := domainXML{
+		Type:          "kvm",
+		Name:          spec.Name,
+		UUID:          spec.UUID,
+		Memory:        unitValue{Unit: "MiB", Value: max(spec.MemoryMiB, spec.MaxMemoryMiB)},
+		CurrentMemory: &unitValue{Unit: "MiB", Value: spec.MemoryMiB},
+		VCPU:          buildVCPUXML(spec),
+		CPUTune:       buildCPUTuneXML(spec.CPUPins),
+		NUMATune:      buildNUMATuneXML(spec.NUMA),
+		OS:            buildOSXML(spec),
+		CPU:           buildCPUXML(spec.CPUModel),
+		OnCrash:       "restart",
+		Features: &featuresXML{
+			ACPI: &struct{}{},
+			APIC: &struct{}{},
+		},
+	}
+
+	for _, disk := range spec.Disks {
+		dom.Devices.Disks = append(dom.Devices.Disks, buildDiskXML(disk))
+		if disk.Bus == "virtio-scsi" && len(dom.Devices.Controllers) == 0 {
+			dom.Devices.Controllers = append(dom.Devices.Controllers, controllerXML{Type: "scsi", Model: "virtio-scsi"})
+		}
+	}
+	for _, nic := range spec.NICs {
+		dom.Devices.Interfaces = append(dom.Devices.Interfaces, buildInterfaceXML(nic))
+	}
+
+	// Serial console and guest agent channel
+	dom.Devices.Serials = []serialXML{{Type: "pty", Target: &serialTargetXML{Port: 0}}}
+	dom.Devices.Consoles = []consoleXML{{Type: "pty", Target: consoleTargetXML{Type: "serial", Port: 0}}}
+	dom.Devices.Channels = []channelXML{{Type: "unix", Target: channelTargetXML{Type: "virtio", Name: "org.qemu.guest_agent.0"}}}
+	if spec.Graphics != nil {
+		dom.Devices.Graphics = []graphicsXML{buildGraphicsXML(*spec.Graphics)}
+	}
+	for _, d := range spec.HostDevices {
+		dom.Devices.HostDevs = append(dom.Devices.HostDevs, buildHostdevXML(d))
+	}
+	if spec.Firmware != nil {
+		buildFirmware(*spec.Firmware, &dom)
+	}
+	if spec.TPM != nil {
+		dom.Devices.TPMs = []tpmXML{buildTPMXML(*spec.TPM)}
+	}
+	for _, f := range spec.Filesystems {
+		dom.Devices.Filesystems = append(dom.Devices.Filesystems, buildFilesystemXML(f))
+		if f.Driver != "9p" && dom.MemoryBacking == nil {
+			// virtiofsd maps guest memory, so it must be shared
+			dom.MemoryBacking = &memoryBackingXML{
+				Source: &memoryBackingSourceXML{Type: "memfd"},
+				Access: &memoryBackingAccessXML{Mode: "shared"},
+			}
+		}
+	}
+
+	if spec.extras != nil {
+		spec.extras.restore(&dom, spec)
+	}
+	if spec.managed {
+		markManaged(&dom)
+	}
+
+	out, err := xml.MarshalIndent(dom, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal domain XML: %w", err)
+	}
+	return string(out), nil
+}
+
+func buildVCPUXML(spec DomainSpec) vcpuXML {
+	if spec.MaxVCPUs > spec.VCPUs {
+		return vcpuXML{Placement: "static", Current: spec.VCPUs, Value: spec.MaxVCPUs}
+	}
+	return vcpuXML{Placement: "static", Value: spec.VCPUs}
+}
+
+func buildCPUTuneXML(pins []CPUPin) *cputuneXML {
+	if len(pins) == 0 {
+		return nil
+	}
+	tune := &cputuneXML{}
+	for _, pin := range pins {
+		tune.VCPUPins = append(tune.VCPUPins, vcpupinXML{VCPU: pin.VCPU, CPUSet: pin.CPUSet})
+	}
+	return tune
+}
+
+func buildNUMATuneXML(numa *NUMATune) *numatuneXML {
+	if numa == nil {
+		return nil
+	}
+	mode := numa.Mode
+	if mode == "" {
+		mode = "strict"
+	}
+	return &numatuneXML{Memory: numaMemoryXML{Mode: mode, Nodeset: numa.Nodeset}}
+}
+
+func buildOSXML(spec DomainSpec) osXML {
+	arch := spec.Arch
+	if arch == "" {
+		arch = "x86_64"
+	}
+	machine := spec.Machine
+	if machine == "" && spec.Firmware != nil && spec.Firmware.SecureBoot {
+		machine = "q35"
+	}
+	o := osXML{Type: osTypeXML{Arch: arch, Machine: machine, Value: "hvm"}}
+
+	bootOrder := spec.BootOrder
+	if len(bootOrder) == 0 && !spec.hasDeviceBootOrder() {
+		bootOrder = []string{"hd"}
+	}
+	for _, dev := range bootOrder {
+		o.Boot = append(o.Boot, osBootXML{Dev: dev})
+	}
+	return o
+}
+
+func buildCPUXML(model string) *cpuXML {
+	switch model {
+	case "", "host-passthrough":
+		return &cpuXML{Mode: "host-passthrough"}
+	case "host-model":
+		return &cpuXML{Mode: "host-model"}
+	default:
+		return &cpuXML{Mode: "custom", Match: "exact", Model: &cpuModelXML{Fallback: "allow", Value: model}}
+	}
+}
+
+func buildDiskXML(disk DiskSpec) diskXML {
+	device := disk.Device
+	if device == "" {
+		device = "disk"
+	}
+	bus := disk.Bus
+	switch bus {
+	case "":
+		bus = "virtio"
+		if device == "cdrom" {
+			bus = "sata"
+		}
+	case "virtio-scsi":
+		// The disk sits on the scsi bus of a virtio-scsi controller
+		bus = "scsi"
+	}
+	format := disk.Format
+	if format == "" {
+		format = "qcow2"
+		if device == "cdrom" {
+			format = "raw"
+		}
+	}
+
+	readOnly := disk.ReadOnly || device == "cdrom"
+	cache := disk.Cache
+	if cache == "" {
+		cache = "none"
+	}
+	discard := disk.Discard
+	if discard == "" && !readOnly {
+		discard = "unmap"
+	}
+
+	d := diskXML{
+		Type:   "file",
+		Device: device,
+		Driver: diskDriverXML{Name: "qemu", Type: format, Cache: cache, IO: disk.IO, Discard: discard},
+		Source: diskSourceXML{File: disk.Source},
+		Target: diskTargetXML{Dev: disk.Target, Bus: bus},
+	}
+	if readOnly {
+		d.ReadOnly = &struct{}{}
+	}
+	if disk.IOTune != nil && !disk.IOTune.IsZero() {
+		d.IOTune = disk.IOTune.xml()
+	}
+	if disk.BootOrder != 0 {
+		d.Boot = &deviceBootXML{Order: disk.BootOrder}
+	}
+	return d
+}
+
+func buildInterfaceXML(nic NICSpec) interfaceXML {
+	model := nic.Model
+	if model == "" {
+		model = "virtio"
+	}
+
+	iface := interfaceXML{Model: &interfaceModelXML{Type: model}}
+	switch {
+	case nic.Network != "":
+		iface.Type = "network"
+		iface.Source.Network = nic.Network
+	case nic.Direct != "":
+		iface.Type = "direct"
+		iface.Source.Dev = nic.Direct
+		iface.Source.Mode = nic.DirectMode
+		if iface.Source.Mode == "" {
+			iface.Source.Mode = "bridge"
+		}
+	default:
+		iface.Type = "bridge"
+		iface.Source.Bridge = nic.Bridge
+	}
+	if nic.MAC != "" {
+		iface.MAC = &macXML{Address: nic.MAC}
+	}
+	if in, out := nic.Inbound.xml(), nic.Outbound.xml(); in != nil || out != nil {
+		iface.Bandwidth = &bandwidthXML{Inbound: in, Outbound: out}
+	}
+	if nic.BootOrder != 0 {
+		iface.Boot = &deviceBootXML{Order: nic.BootOrder}
+	}
+	return iface
+}
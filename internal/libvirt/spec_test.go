@@ -0,0 +1,496 @@
+package libvirt
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestBuildDomainXML(t *testing.T) {
+	spec := DomainSpec{
+		Name:      "vm-123",
+		VCPUs:     2,
+		MemoryMiB: 2048,
+		Disks: []DiskSpec{
+			{Source: "/data/vm/vm-123/disk.qcow2", Target: "vda"},
+			{Source: "/data/vm/vm-123/cloud-init.iso", Target: "sda", Device: "cdrom"},
+		},
+		NICs: []NICSpec{{Network: "default", MAC: "52:54:00:12:34:56", Inbound: &Bandwidth{AverageKBps: 1000, PeakKBps: 2000}}},
+	}
+
+	out, err := BuildDomainXML(spec)
+	if err != nil {
+		t.Fatalf("error building domain XML. Err: %v", err)
+	}
+
+	for _, expected := range []string{
+		`<name>vm-123</name>`,
+		`<memory unit="MiB">2048</memory>`,
+		`<vcpu placement="static">2</vcpu>`,
+		`<source file="/data/vm/vm-123/disk.qcow2"></source>`,
+		`<target dev="vda" bus="virtio"></target>`,
+		`<driver name="qemu" type="qcow2" cache="none" discard="unmap"></driver>`,
+		`<driver name="qemu" type="raw" cache="none"></driver>`,
+		`<mac address="52:54:00:12:34:56"></mac>`,
+		`<inbound average="1000" peak="2000"></inbound>`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected domain XML to contain %s; got %s", expected, out)
+		}
+	}
+}
+
+func TestDomainSpecValidate(t *testing.T) {
+	spec := DomainSpec{
+		Name:      "vm-123",
+		MemoryMiB: 1024,
+		Disks: []DiskSpec{
+			{Source: "/a.qcow2", Target: "vda"},
+			{Source: "/b.qcow2", Target: "vda"},
+		},
+	}
+
+	err := spec.Validate()
+	if err == nil {
+		t.Fatal("expected validation error; got nil")
+	}
+	for _, expected := range []string{"vcpus must be greater than zero", "duplicate target vda"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected error to contain %q; got %v", expected, err)
+		}
+	}
+}
+
+func TestValidateDomainName(t *testing.T) {
+	for _, name := range []string{"vm-123", "web_01", "A"} {
+		if err := ValidateDomainName(name); err != nil {
+			t.Errorf("expected %q to be valid; got %v", name, err)
+		}
+	}
+
+	for name, char := range map[string]string{
+		"vm/123":  `'/'`,
+		"my vm":   `' '`,
+		"-vm":     `'-'`,
+		"vm.prod": `'.'`,
+	} {
+		err := ValidateDomainName(name)
+		if err == nil || !strings.Contains(err.Error(), char) {
+			t.Errorf("expected error naming %s for %q; got %v", char, name, err)
+		}
+	}
+
+	if err := ValidateDomainName(strings.Repeat("a", 65)); err == nil {
+		t.Errorf("expected error for name longer than 64 characters; got nil")
+	}
+}
+
+func TestBuildDomainXMLPinning(t *testing.T) {
+	spec := DomainSpec{
+		Name:      "vm-123",
+		VCPUs:     2,
+		MemoryMiB: 1024,
+		CPUPins:   []CPUPin{{VCPU: 0, CPUSet: "2"}, {VCPU: 1, CPUSet: "3-5,^4"}},
+		NUMA:      &NUMATune{Nodeset: "0"},
+	}
+
+	out, err := BuildDomainXML(spec)
+	if err != nil {
+		t.Fatalf("error building domain XML. Err: %v", err)
+	}
+	for _, expected := range []string{
+		`<vcpupin vcpu="0" cpuset="2"></vcpupin>`,
+		`<vcpupin vcpu="1" cpuset="3-5,^4"></vcpupin>`,
+		`<memory mode="strict" nodeset="0"></memory>`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected domain XML to contain %s; got %s", expected, out)
+		}
+	}
+
+	spec.CPUPins = []CPUPin{{VCPU: 2, CPUSet: "1"}, {VCPU: 0, CPUSet: "3-1"}}
+	if err := spec.Validate(); err == nil {
+		t.Errorf("expected validation error for vcpu 2 and reversed range; got nil")
+	}
+
+	ids, err := parseCPUSet("0-3,^2,8")
+	if err != nil {
+		t.Fatalf("error parsing cpuset. Err: %v", err)
+	}
+	if fmt.Sprint(ids) != "[0 1 3 8]" {
+		t.Errorf("expected cpus [0 1 3 8]; got %v", ids)
+	}
+}
+
+func TestBuildDomainXMLIOTune(t *testing.T) {
+	spec := DomainSpec{
+		Name:      "vm-123",
+		VCPUs:     1,
+		MemoryMiB: 1024,
+		Disks: []DiskSpec{{
+			Source: "/data/vm/vm-123/disk.qcow2",
+			Target: "vda",
+			IOTune: &BlockIOLimits{ReadBytesSec: 1048576, TotalIOPSSec: 500},
+		}},
+	}
+
+	out, err := BuildDomainXML(spec)
+	if err != nil {
+		t.Fatalf("error building domain XML. Err: %v", err)
+	}
+	for _, expected := range []string{
+		`<read_bytes_sec>1048576</read_bytes_sec>`,
+		`<total_iops_sec>500</total_iops_sec>`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected domain XML to contain %s; got %s", expected, out)
+		}
+	}
+
+	spec.Disks[0].IOTune.TotalBytesSec = 2097152
+	if err := spec.Validate(); err == nil || !strings.Contains(err.Error(), "total_bytes_sec cannot be combined") {
+		t.Errorf("expected error combining total and read limits; got %v", err)
+	}
+}
+
+func TestBuildDomainXMLGraphics(t *testing.T) {
+	spec := DomainSpec{
+		Name:      "vm-123",
+		VCPUs:     1,
+		MemoryMiB: 1024,
+		Graphics:  &GraphicsSpec{Password: "secret"},
+	}
+
+	out, err := BuildDomainXML(spec)
+	if err != nil {
+		t.Fatalf("error building domain XML. Err: %v", err)
+	}
+	expected := `<graphics type="vnc" autoport="yes" passwd="secret">`
+	if !strings.Contains(out, expected) {
+		t.Errorf("expected domain XML to contain %s; got %s", expected, out)
+	}
+
+	info := GraphicsInfo{Type: "spice", Listen: "10.0.0.5", Port: 5900, TLSPort: 5901}
+	if uri := info.URI(); uri != "spice://10.0.0.5:5900?tls-port=5901" {
+		t.Errorf("expected spice://10.0.0.5:5900?tls-port=5901; got %s", uri)
+	}
+}
+
+func TestBuildDomainXMLHostDevices(t *testing.T) {
+	spec := DomainSpec{
+		Name:      "vm-123",
+		VCPUs:     1,
+		MemoryMiB: 1024,
+		HostDevices: []HostDeviceSpec{
+			{Type: "pci", Device: "01:00.0"},
+			{Type: "usb", Device: "1050:0407"},
+		},
+	}
+
+	out, err := BuildDomainXML(spec)
+	if err != nil {
+		t.Fatalf("error building domain XML. Err: %v", err)
+	}
+	for _, expected := range []string{
+		`<hostdev mode="subsystem" type="pci" managed="no">`,
+		`<address domain="0x0000" bus="0x01" slot="0x00" function="0x0"></address>`,
+		`<vendor id="0x1050"></vendor>`,
+		`<product id="0x0407"></product>`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected domain XML to contain %s; got %s", expected, out)
+		}
+	}
+
+	if !sameHostdev(hostdevXML{Type: "pci", Source: hostdevSourceXML{Address: &pciAddressXML{Domain: "0x0", Bus: "0x1", Slot: "0x0", Function: "0x0"}}}, spec.HostDevices[0]) {
+		t.Errorf("expected unpadded pci address to match %s", spec.HostDevices[0].Device)
+	}
+
+	spec.HostDevices = []HostDeviceSpec{{Type: "pci", Device: "1:0.0"}}
+	if _, err := BuildDomainXML(spec); err == nil {
+		t.Errorf("expected invalid pci address to be rejected")
+	}
+}
+
+func TestBuildDomainXMLFilesystems(t *testing.T) {
+	spec := DomainSpec{
+		Name:      "vm-123",
+		VCPUs:     1,
+		MemoryMiB: 1024,
+		Filesystems: []FilesystemSpec{
+			{Source: "/srv/data set"},
+			{Driver: "9p", Source: "/srv/logs", Tag: "logs", ReadOnly: true},
+		},
+	}
+
+	out, err := BuildDomainXML(spec)
+	if err != nil {
+		t.Fatalf("error building domain XML. Err: %v", err)
+	}
+	for _, expected := range []string{
+		`<source type="memfd"></source>`,
+		`<access mode="shared"></access>`,
+		`<driver type="virtiofs"></driver>`,
+		`<target dir="data-set"></target>`,
+		`<filesystem type="mount" accessmode="mapped">`,
+		`<readonly></readonly>`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected domain XML to contain %s; got %s", expected, out)
+		}
+	}
+
+	spec.Filesystems = append(spec.Filesystems, FilesystemSpec{Source: "/mnt/logs"})
+	if _, err := BuildDomainXML(spec); err == nil {
+		t.Errorf("expected duplicate mount tags to be rejected")
+	}
+}
+
+func TestBuildDomainXMLFirmware(t *testing.T) {
+	spec := DomainSpec{
+		Name:      "vm-123",
+		VCPUs:     2,
+		MemoryMiB: 4096,
+		Firmware: &FirmwareSpec{
+			SecureBoot:    true,
+			Loader:        "/usr/share/OVMF/OVMF_CODE_4M.secboot.fd",
+			NVRAMTemplate: "/usr/share/OVMF/OVMF_VARS_4M.ms.fd",
+			NVRAM:         "/var/lib/vms/vm-123/nvram.fd",
+		},
+		TPM: &TPMSpec{},
+	}
+
+	out, err := BuildDomainXML(spec)
+	if err != nil {
+		t.Fatalf("error building domain XML. Err: %v", err)
+	}
+	for _, expected := range []string{
+		`machine="q35"`,
+		`<loader readonly="yes" secure="yes" type="pflash">/usr/share/OVMF/OVMF_CODE_4M.secboot.fd</loader>`,
+		`<nvram template="/usr/share/OVMF/OVMF_VARS_4M.ms.fd">/var/lib/vms/vm-123/nvram.fd</nvram>`,
+		`<smm state="on"></smm>`,
+		`<tpm model="tpm-crb">`,
+		`<backend type="emulator" version="2.0"></backend>`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected domain XML to contain %s; got %s", expected, out)
+		}
+	}
+
+	spec.Firmware = &FirmwareSpec{}
+	out, err = BuildDomainXML(spec)
+	if err != nil {
+		t.Fatalf("error building domain XML. Err: %v", err)
+	}
+	if !strings.Contains(out, `<os firmware="efi">`) {
+		t.Errorf("expected firmware autoselection without a loader; got %s", out)
+	}
+
+	spec.Machine = "pc"
+	spec.Firmware = &FirmwareSpec{SecureBoot: true}
+	if _, err := BuildDomainXML(spec); err == nil {
+		t.Errorf("expected secure boot on the pc machine type to be rejected")
+	}
+}
+
+func TestParseDomainXML(t *testing.T) {
+	desc := `<domain type='kvm'>
+  <name>vm-123</name>
+  <uuid>0f8fad5b-d9cb-469f-a165-70867728950e</uuid>
+  <metadata><app:owner xmlns:app="http://example.com/app">team-a</app:owner></metadata>
+  <memory unit='KiB'>4194304</memory>
+  <currentMemory unit='KiB'>2097152</currentMemory>
+  <vcpu placement='static'>2</vcpu>
+  <os>
+    <type arch='x86_64' machine='pc-q35-8.2'>hvm</type>
+    <bootmenu enable='yes'/>
+  </os>
+  <features><acpi/><apic/><vmport state='off'/></features>
+  <cpu mode='host-passthrough' check='none' migratable='on'/>
+  <clock offset='utc'/>
+  <on_crash>restart</on_crash>
+  <devices>
+    <emulator>/usr/bin/qemu-system-x86_64</emulator>
+    <disk type='file' device='disk'>
+      <driver name='qemu' type='qcow2' cache='none' discard='unmap'/>
+      <source file='/data/vm/vm-123/disk.qcow2'/>
+      <target dev='vda' bus='virtio'/>
+      <boot order='1'/>
+      <address type='pci' domain='0x0000' bus='0x04' slot='0x00' function='0x0'/>
+    </disk>
+    <disk type='block' device='disk'>
+      <driver name='qemu' type='raw'/>
+      <source dev='/dev/vg0/data'/>
+      <target dev='vdb' bus='virtio'/>
+    </disk>
+    <controller type='usb' index='0' model='qemu-xhci'/>
+    <interface type='network'>
+      <mac address='52:54:00:12:34:56'/>
+      <source network='default'/>
+      <model type='virtio'/>
+      <address type='pci' domain='0x0000' bus='0x01' slot='0x00' function='0x0'/>
+    </interface>
+    <serial type='pty'><target type='isa-serial' port='0'><model name='isa-serial'/></target></serial>
+    <graphics type='vnc' port='-1' autoport='yes' listen='127.0.0.1' passwd='secret'>
+      <listen type='address' address='127.0.0.1'/>
+    </graphics>
+  </devices>
+</domain>`
+
+	spec, err := ParseDomainXML(desc)
+	if err != nil {
+		t.Fatalf("error parsing domain XML. Err: %v", err)
+	}
+	if spec.MemoryMiB != 2048 || spec.MaxMemoryMiB != 4096 || spec.VCPUs != 2 || spec.CPUModel != "host-passthrough" {
+		t.Errorf("expected 2 vcpus and 2048 of 4096 MiB; got %+v", spec)
+	}
+	if len(spec.Disks) != 1 || len(spec.NICs) != 1 || spec.Graphics == nil || spec.Graphics.Password != "secret" {
+		t.Fatalf("expected the file disk, nic and graphics in the spec; got %+v", spec)
+	}
+
+	spec.VCPUs = 4
+	spec.NICs[0].Model = "virtio"
+	out, err := BuildDomainXML(spec)
+	if err != nil {
+		t.Fatalf("error building domain XML. Err: %v", err)
+	}
+	for _, expected := range []string{
+		`<vcpu placement="static">4</vcpu>`,
+		`<uuid>0f8fad5b-d9cb-469f-a165-70867728950e</uuid>`,
+		`team-a</app:owner>`,
+		`<bootmenu enable="yes"></bootmenu>`,
+		`<vmport state="off"></vmport>`,
+		`migratable="on"`,
+		`<clock offset="utc"></clock>`,
+		`<on_crash>restart</on_crash>`,
+		`<emulator>/usr/bin/qemu-system-x86_64</emulator>`,
+		`<boot order="1"></boot>`,
+		`<address type="pci" domain="0x0000" bus="0x04" slot="0x00" function="0x0"></address>`,
+		`<source dev='/dev/vg0/data'/>`,
+		`<controller type="usb" index="0" model="qemu-xhci"></controller>`,
+		`<model name='isa-serial'/>`,
+		`passwd="secret"`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected domain XML to contain %s; got %s", expected, out)
+		}
+	}
+	for _, unexpected := range []string{`<boot dev=`, `org.qemu.guest_agent.0`} {
+		if strings.Contains(out, unexpected) {
+			t.Errorf("expected domain XML not to contain %s; got %s", unexpected, out)
+		}
+	}
+
+	// Rendering the result again must not change it
+	again, err := ParseDomainXML(out)
+	if err != nil {
+		t.Fatalf("error parsing rendered domain XML. Err: %v", err)
+	}
+	if out2, err := BuildDomainXML(again); err != nil || out2 != out {
+		t.Errorf("expected stable round trip; got %v\n%s\n%s", err, out, out2)
+	}
+}
+
+func TestParseDomainXMLKeepsDeviceDetails(t *testing.T) {
+	desc := `<domain type='kvm'>
+  <name>vm-123</name>
+  <memory unit='KiB'>1048576</memory>
+  <vcpu>1</vcpu>
+  <os><type arch='x86_64'>hvm</type></os>
+  <devices>
+    <emulator>/usr/bin/qemu-system-x86_64</emulator>
+    <disk type='file' device='disk'>
+      <driver name='qemu' type='qcow2' cache='none' discard='unmap' iothread='1' copy_on_read='on' detect_zeroes='unmap'/>
+      <source file='/data/vm/vm-123/vda.qcow2'/>
+      <target dev='vda' bus='virtio'/>
+    </disk>
+    <disk type='file' device='disk'>
+      <driver name='qemu' type='qcow2' cache='none' discard='unmap'/>
+      <source file='/data/vm/vm-123/vdb.qcow2'/>
+      <target dev='vdb' bus='virtio'/>
+    </disk>
+    <controller type='usb' index='0' model='qemu-xhci'/>
+    <interface type='network'>
+      <mac address='52:54:00:12:34:56'/>
+      <source network='default' portgroup='web'/>
+      <model type='virtio'/>
+    </interface>
+  </devices>
+</domain>`
+	spec, err := ParseDomainXML(desc)
+	if err != nil {
+		t.Fatalf("error parsing domain XML. Err: %v", err)
+	}
+	if len(spec.Disks) != 1 || spec.Disks[0].Target != "vdb" || len(spec.NICs) != 0 {
+		t.Errorf("expected only the plain disk in the spec; got %+v", spec)
+	}
+
+	spec.VCPUs = 2
+	out, err := BuildDomainXML(spec)
+	if err != nil {
+		t.Fatalf("error building domain XML. Err: %v", err)
+	}
+	for _, expected := range []string{`iothread='1'`, `copy_on_read='on'`, `detect_zeroes='unmap'`, `portgroup='web'`} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected domain XML to contain %s; got %s", expected, out)
+		}
+	}
+	last := -1
+	for _, device := range []string{`<emulator>`, `vda.qcow2`, `vdb.qcow2`, `<controller`, `<interface`} {
+		i := strings.Index(out, device)
+		if i < last {
+			t.Errorf("expected %s in its original place; got %s", device, out)
+		}
+		last = i
+	}
+
+	again, err := ParseDomainXML(out)
+	if err != nil {
+		t.Fatalf("error parsing rendered domain XML. Err: %v", err)
+	}
+	if out2, err := BuildDomainXML(again); err != nil || out2 != out {
+		t.Errorf("expected stable round trip; got %v\n%s\n%s", err, out, out2)
+	}
+}
+
+func TestDeviceBootOrder(t *testing.T) {
+	spec := DomainSpec{
+		Name:      "vm-123",
+		VCPUs:     1,
+		MemoryMiB: 1024,
+		Disks:     []DiskSpec{{Source: "/data/vm/vm-123/vda.qcow2", Target: "vda", BootOrder: 1}},
+		NICs:      []NICSpec{{Network: "default", MAC: "52:54:00:12:34:56", BootOrder: 2}},
+	}
+	out, err := BuildDomainXML(spec)
+	if err != nil {
+		t.Fatalf("error building domain XML. Err: %v", err)
+	}
+	if strings.Contains(out, "<boot dev=") || strings.Count(out, "<boot order=") != 2 {
+		t.Errorf("expected per-device boot order only; got %s", out)
+	}
+
+	conflicting := spec
+	conflicting.NICs = []NICSpec{{Network: "default", BootOrder: 1}}
+	if err := conflicting.Validate(); err == nil {
+		t.Errorf("expected duplicate boot order to be rejected")
+	}
+	mixed := spec
+	mixed.BootOrder = []string{"hd"}
+	if err := mixed.Validate(); err == nil {
+		t.Errorf("expected device boot order mixed with the domain boot order to be rejected")
+	}
+
+	// A one-time network boot keeps the disk as a fallback
+	byType := spec
+	byType.Disks = []DiskSpec{{Source: "/data/vm/vm-123/vda.qcow2", Target: "vda"}}
+	byType.NICs = []NICSpec{{Network: "default", MAC: "52:54:00:12:34:56"}}
+	if err := byType.bootFirst("52:54:00:12:34:56"); err != nil {
+		t.Fatalf("error moving nic to the front. Err: %v", err)
+	}
+	if byType.NICs[0].BootOrder != 1 || byType.Disks[0].BootOrder != 2 || len(byType.BootOrder) != 0 {
+		t.Errorf("expected nic then disk; got nic %d, disk %d, domain %v", byType.NICs[0].BootOrder, byType.Disks[0].BootOrder, byType.BootOrder)
+	}
+	if err := spec.bootFirst("vdb"); err == nil {
+		t.Errorf("expected unknown boot device to be rejected")
+	}
+}
@@ -0,0 +1,197 @@
+package libvirt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// DomainStats holds raw counters of a domain at the time they were collected.
+// Callers compute rates from two samples.
+type DomainStats struct {
+	Name       string           `json:"name"`
+	Timestamp  time.Time        `json:"timestamp"`
+	State      DomainState      `json:"state"`
+	CPUTimeNs  uint64           `json:"cpu_time_ns"`
+	CPUUserNs  uint64           `json:"cpu_user_ns"`
+	CPUSysNs   uint64           `json:"cpu_system_ns"`
+	Memory     MemoryStats      `json:"memory"`
+	Disks      []DiskStats      `json:"disks"`
+	Interfaces []InterfaceStats `json:"interfaces"`
+}
+
+// DiskStats holds I/O counters of a domain block device.
+type DiskStats struct {
+	Name       string `json:"name"`
+	ReadBytes  uint64 `json:"read_bytes"`
+	ReadReqs   uint64 `json:"read_reqs"`
+	WriteBytes uint64 `json:"write_bytes"`
+	WriteReqs  uint64 `json:"write_reqs"`
+}
+
+// InterfaceStats holds traffic counters of a domain network interface.
+type InterfaceStats struct {
+	Name      string `json:"name"`
+	RxBytes   uint64 `json:"rx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	TxPackets uint64 `json:"tx_packets"`
+}
+
+// statsTypes are the stats groups requested from libvirt.
+const statsTypes = libvirt.DomainStatsState | libvirt.DomainStatsCPUTotal |
+	libvirt.DomainStatsBalloon | libvirt.DomainStatsBlock | libvirt.DomainStatsInterface
+
+// Stats collects CPU, memory, disk and network counters of the domain.
+func (m *DomainManager) Stats(name string) (DomainStats, error) {
+	dom, err := m.lookup(name)
+	if err != nil {
+		return DomainStats{}, err
+	}
+	records, err := m.conn.ConnectGetAllDomainStats([]libvirt.Domain{dom}, uint32(statsTypes), 0)
+	if err != nil {
+		return DomainStats{}, fmt.Errorf("failed to get stats of domain %s: %w", name, err)
+	}
+	if len(records) == 0 {
+		return DomainStats{}, fmt.Errorf("no stats returned for domain %s", name)
+	}
+	return parseDomainStats(records[0], time.Now()), nil
+}
+
+// AllStats collects the counters of every domain on the host in a single call.
+func (m *DomainManager) AllStats() ([]DomainStats, error) {
+	records, err := m.conn.ConnectGetAllDomainStats(nil, uint32(statsTypes), 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain stats: %w", err)
+	}
+	now := time.Now()
+	stats := make([]DomainStats, 0, len(records))
+	for _, record := range records {
+		stats = append(stats, parseDomainStats(record, now))
+	}
+	return stats, nil
+}
+
+// parseDomainStats converts the typed parameters of a stats record, e.g.
+// "cpu.time" or "block.0.rd.bytes", into a DomainStats.
+func parseDomainStats(record libvirt.DomainStatsRecord, timestamp time.Time) DomainStats {
+	stats := DomainStats{Name: record.Dom.Name, Timestamp: timestamp, State: StateNoState}
+	disks := make(map[int]*DiskStats)
+	ifaces := make(map[int]*InterfaceStats)
+
+	for _, param := range record.Params {
+		field, value := param.Field, param.Value.I
+		switch field {
+		case "state.state":
+			if s, ok := domainStates[libvirt.DomainState(paramUint(value))]; ok {
+				stats.State = s
+			}
+		case "cpu.time":
+			stats.CPUTimeNs = paramUint(value)
+		case "cpu.user":
+			stats.CPUUserNs = paramUint(value)
+		case "cpu.system":
+			stats.CPUSysNs = paramUint(value)
+		case "balloon.current":
+			stats.Memory.ActualKiB = paramUint(value)
+		case "balloon.available":
+			stats.Memory.AvailableKiB = paramUint(value)
+		case "balloon.unused":
+			stats.Memory.UnusedKiB = paramUint(value)
+		case "balloon.usable":
+			stats.Memory.UsableKiB = paramUint(value)
+		case "balloon.rss":
+			stats.Memory.RSSKiB = paramUint(value)
+		}
+
+		group, index, key, ok := splitIndexedField(field)
+		if !ok {
+			continue
+		}
+		switch group {
+		case "block":
+			d, ok := disks[index]
+			if !ok {
+				d = &DiskStats{}
+				disks[index] = d
+			}
+			switch key {
+			case "name":
+				d.Name, _ = value.(string)
+			case "rd.bytes":
+				d.ReadBytes = paramUint(value)
+			case "rd.reqs":
+				d.ReadReqs = paramUint(value)
+			case "wr.bytes":
+				d.WriteBytes = paramUint(value)
+			case "wr.reqs":
+				d.WriteReqs = paramUint(value)
+			}
+		case "net":
+			n, ok := ifaces[index]
+			if !ok {
+				n = &InterfaceStats{}
+				ifaces[index] = n
+			}
+			switch key {
+			case "name":
+				n.Name, _ = value.(string)
+			case "rx.bytes":
+				n.RxBytes = paramUint(value)
+			case "rx.pkts":
+				n.RxPackets = paramUint(value)
+			case "tx.bytes":
+				n.TxBytes = paramUint(value)
+			case "tx.pkts":
+				n.TxPackets = paramUint(value)
+			}
+		}
+	}
+
+	for i := 0; i < len(disks); i++ {
+		if d, ok := disks[i]; ok {
+			stats.Disks = append(stats.Disks, *d)
+		}
+	}
+	for i := 0; i < len(ifaces); i++ {
+		if n, ok := ifaces[i]; ok {
+			stats.Interfaces = append(stats.Interfaces, *n)
+		}
+	}
+	return stats
+}
+
+// splitIndexedField splits a field like "block.0.rd.bytes" into its group,
+// index and key.
+func splitIndexedField(field string) (string, int, string, bool) {
+	parts := strings.SplitN(field, ".", 3)
+	if len(parts) != 3 {
+		return "", 0, "", false
+	}
+	index, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, "", false
+	}
+	return parts[0], index, parts[2], true
+}
+
+// paramUint converts a numeric typed parameter value to uint64.
+func paramUint(v interface{}) uint64 {
+	switch n := v.(type) {
+	case int32:
+		return uint64(n)
+	case uint32:
+		return uint64(n)
+	case int64:
+		return uint64(n)
+	case uint64:
+		return n
+	case float64:
+		return uint64(n)
+	default:
+		return 0
+	}
+}
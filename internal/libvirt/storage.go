@@ -0,0 +1,431 @@
+package libvirt
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/digitalocean/go-libvirt"
+
+	"libvirt-controller/internal/filesystem"
+	"libvirt-controller/internal/helpers"
+)
+
+// VolumeInfo describes a volume in a storage pool.
+type VolumeInfo struct {
+	Name            string `json:"name"`
+	Path            string `json:"path"`
+	CapacityBytes   uint64 `json:"capacity_bytes"`
+	AllocationBytes uint64 `json:"allocation_bytes"`
+}
+
+// StoragePoolManager manages storage pools and their volumes over a libvirt
+// connection.
+type StoragePoolManager struct {
+	conn *libvirt.Libvirt
+
+	// Cache is used to download images for CreateVolumeFromURL. The cache
+	// configured by the environment is used when nil.
+	Cache *filesystem.Cache
+}
+
+// NewStoragePoolManager creates a StoragePoolManager using the given libvirt connection.
+func NewStoragePoolManager(conn *libvirt.Libvirt) *StoragePoolManager {
+	return &StoragePoolManager{conn: conn}
+}
+
+// EnsureDirPool makes sure a directory backed pool with the given name exists,
+// is active and is started on boot. A pool that already exists must point at
+// the same path.
+func (m *StoragePoolManager) EnsureDirPool(name, path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("pool path %q must be absolute", path)
+	}
+
+	pool, err := m.conn.StoragePoolLookupByName(name)
+	switch {
+	case err == nil:
+		desc, err := m.conn.StoragePoolGetXMLDesc(pool, 0)
+		if err != nil {
+			return fmt.Errorf("failed to get XML of pool %s: %w", name, err)
+		}
+		var existing poolXML
+		if err := xml.Unmarshal([]byte(desc), &existing); err != nil {
+			return fmt.Errorf("failed to parse XML of pool %s: %w", name, err)
+		}
+		if filepath.Clean(existing.Target.Path) != filepath.Clean(path) {
+			return fmt.Errorf("pool %s already exists with path %s", name, existing.Target.Path)
+		}
+	case isLibvirtError(err, libvirt.ErrNoStoragePool):
+		out, err := xml.Marshal(poolXML{Type: "dir", Name: name, Target: poolTargetXML{Path: path}})
+		if err != nil {
+			return fmt.Errorf("failed to build XML of pool %s: %w", name, err)
+		}
+		if pool, err = m.conn.StoragePoolDefineXML(string(out), 0); err != nil {
+			return fmt.Errorf("failed to define pool %s: %w", name, err)
+		}
+		if err := m.conn.StoragePoolBuild(pool, libvirt.StoragePoolBuildNew); err != nil {
+			return fmt.Errorf("failed to build pool %s: %w", name, err)
+		}
+		if err := m.conn.StoragePoolSetAutostart(pool, 1); err != nil {
+			return fmt.Errorf("failed to enable autostart of pool %s: %w", name, err)
+		}
+	default:
+		return fmt.Errorf("failed to look up pool %s: %w", name, err)
+	}
+
+	active, err := m.conn.StoragePoolIsActive(pool)
+	if err != nil {
+		return fmt.Errorf("failed to get state of pool %s: %w", name, err)
+	}
+	if active == 1 {
+		return nil
+	}
+	if err := m.conn.StoragePoolCreate(pool, 0); err != nil {
+		return fmt.Errorf("failed to start pool %s: %w", name, err)
+	}
+	return nil
+}
+
+// ListVolumes lists the volumes in a pool. The pool is refreshed first so
+// files added outside of libvirt are included.
+func (m *StoragePoolManager) ListVolumes(poolName string) ([]VolumeInfo, error) {
+	pool, err := m.lookupPool(poolName)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.conn.StoragePoolRefresh(pool, 0); err != nil {
+		return nil, fmt.Errorf("failed to refresh pool %s: %w", poolName, err)
+	}
+	vols, _, err := m.conn.StoragePoolListAllVolumes(pool, 1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volumes of pool %s: %w", poolName, err)
+	}
+
+	infos := make([]VolumeInfo, 0, len(vols))
+	for _, vol := range vols {
+		info, err := m.volumeInfo(vol)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// CreateVolume creates an empty volume of the given format, "qcow2" when
+// empty, in a pool.
+func (m *StoragePoolManager) CreateVolume(poolName, name string, capacityBytes uint64, format string) (VolumeInfo, error) {
+	return m.CreateVolumeWithOptions(poolName, name, capacityBytes, VolumeOptions{Format: format})
+}
+
+// VolumeOptions controls CreateVolumeWithOptions.
+type VolumeOptions struct {
+	Format        string // "qcow2" when empty
+	Preallocation string // One of the filesystem.Prealloc modes, off when empty
+}
+
+// CreateVolumeWithOptions is CreateVolume with preallocation, for workloads
+// such as databases that should not pay for allocating blocks on write. A
+// preallocated qcow2 volume is created with qemu-img in the directory of the
+// pool; a raw volume is created sparse and then allocated with fallocate, or
+// zero-filled for PreallocFull. Falloc and full fail up front when the pool
+// has less space available than the capacity. AllocationBytes of the
+// returned info is the space the volume takes on the host.
+func (m *StoragePoolManager) CreateVolumeWithOptions(poolName, name string, capacityBytes uint64, opts VolumeOptions) (VolumeInfo, error) {
+	format := opts.Format
+	if format == "" {
+		format = filesystem.FormatQcow2
+	}
+	if format != filesystem.FormatQcow2 && format != filesystem.FormatRaw {
+		return VolumeInfo{}, fmt.Errorf("unsupported volume format %q", format)
+	}
+	if err := filesystem.ValidatePreallocation(opts.Preallocation, format); err != nil {
+		return VolumeInfo{}, err
+	}
+	vol := volumeXML{
+		Name:     name,
+		Capacity: unitValue{Unit: "bytes", Value: capacityBytes},
+		Target:   volumeTargetXML{Format: formatXML{Type: format}},
+	}
+	if opts.Preallocation == "" || opts.Preallocation == filesystem.PreallocOff {
+		return m.createVolume(poolName, vol)
+	}
+
+	pool, err := m.lookupPool(poolName)
+	if err != nil {
+		return VolumeInfo{}, err
+	}
+	if filesystem.NeedsSpace(opts.Preallocation) {
+		_, _, _, available, err := m.conn.StoragePoolGetInfo(pool)
+		if err != nil {
+			return VolumeInfo{}, fmt.Errorf("failed to get info for pool %s: %w", poolName, err)
+		}
+		if capacityBytes > available {
+			return VolumeInfo{}, fmt.Errorf("cannot preallocate volume %s: %w in pool %s: %d bytes needed, %d available",
+				name, ErrInsufficientSpace, poolName, capacityBytes, available)
+		}
+	}
+	if format == filesystem.FormatQcow2 {
+		return m.createPreallocatedQcow2(pool, vol, opts.Preallocation)
+	}
+
+	created, err := m.createVol(poolName, vol)
+	if err != nil {
+		return VolumeInfo{}, err
+	}
+	path, err := m.conn.StorageVolGetPath(created)
+	if err == nil {
+		err = filesystem.PreallocateFile(path, int64(capacityBytes), opts.Preallocation)
+	}
+	if err != nil {
+		if derr := m.conn.StorageVolDelete(created, 0); derr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to delete volume %s: %w", name, derr))
+		}
+		return VolumeInfo{}, fmt.Errorf("failed to preallocate volume %s in pool %s: %w", name, poolName, err)
+	}
+	return m.volumeInfo(created)
+}
+
+// createPreallocatedQcow2 creates vol with qemu-img, since libvirt only
+// knows metadata preallocation, and makes the pool pick it up. Only pools
+// backed by a directory are supported.
+func (m *StoragePoolManager) createPreallocatedQcow2(pool libvirt.StoragePool, vol volumeXML, mode string) (VolumeInfo, error) {
+	desc, err := m.conn.StoragePoolGetXMLDesc(pool, 0)
+	if err != nil {
+		return VolumeInfo{}, fmt.Errorf("failed to get XML of pool %s: %w", pool.Name, err)
+	}
+	var px poolXML
+	if err := xml.Unmarshal([]byte(desc), &px); err != nil {
+		return VolumeInfo{}, fmt.Errorf("failed to parse XML of pool %s: %w", pool.Name, err)
+	}
+	if px.Type != "dir" && px.Type != "fs" && px.Type != "netfs" {
+		return VolumeInfo{}, fmt.Errorf("cannot preallocate qcow2 volumes in %s pool %s", px.Type, pool.Name)
+	}
+	if vol.Name == "." || vol.Name == ".." || filepath.Base(vol.Name) != vol.Name {
+		return VolumeInfo{}, fmt.Errorf("invalid volume name %q", vol.Name)
+	}
+	if vol.Capacity.Value == 0 {
+		return VolumeInfo{}, fmt.Errorf("capacity of volume %s must be greater than zero", vol.Name)
+	}
+
+	path := filepath.Join(px.Target.Path, vol.Name)
+	if pathExists(path) {
+		return VolumeInfo{}, fmt.Errorf("volume %s %w in pool %s", vol.Name, ErrAlreadyExists, pool.Name)
+	}
+	opts := helpers.CreateImageOptions{Format: filesystem.FormatQcow2, SizeBytes: vol.Capacity.Value, Preallocation: mode}
+	if err := helpers.DefaultQemuImg.Create(path, opts); err != nil {
+		os.Remove(path)
+		return VolumeInfo{}, fmt.Errorf("failed to create volume %s in pool %s: %w", vol.Name, pool.Name, err)
+	}
+	if err := m.conn.StoragePoolRefresh(pool, 0); err != nil {
+		return VolumeInfo{}, fmt.Errorf("failed to refresh pool %s: %w", pool.Name, err)
+	}
+	created, err := m.conn.StorageVolLookupByName(pool, vol.Name)
+	if err != nil {
+		return VolumeInfo{}, fmt.Errorf("failed to look up volume %s in pool %s: %w", vol.Name, pool.Name, err)
+	}
+	return m.volumeInfo(created)
+}
+
+// CreateVolumeWithBacking creates a qcow2 volume in a pool that uses the
+// image at backingPath, typically a cached base image, as its backing store.
+// Only changes are written to the new volume, so clones are thin.
+func (m *StoragePoolManager) CreateVolumeWithBacking(poolName, name string, capacityBytes uint64, backingPath string) (VolumeInfo, error) {
+	if !filepath.IsAbs(backingPath) {
+		return VolumeInfo{}, fmt.Errorf("backing path %q must be absolute", backingPath)
+	}
+	backingFormat, err := filesystem.DetectImageFormat(backingPath)
+	if err != nil {
+		return VolumeInfo{}, fmt.Errorf("failed to detect format of backing image %s: %w", backingPath, err)
+	}
+	return m.createVolume(poolName, volumeXML{
+		Name:     name,
+		Capacity: unitValue{Unit: "bytes", Value: capacityBytes},
+		Target:   volumeTargetXML{Format: formatXML{Type: filesystem.FormatQcow2}},
+		BackingStore: &backingStoreXML{
+			Path:   backingPath,
+			Format: formatXML{Type: backingFormat},
+		},
+	})
+}
+
+// CreateVolumeFromURL creates a volume in a pool holding the disk image at
+// url. The image is downloaded through the cache, and the volume gets the
+// image's format and virtual size.
+func (m *StoragePoolManager) CreateVolumeFromURL(poolName, name, url string) (VolumeInfo, error) {
+	return m.CreateVolumeFromURLWithOptions(context.Background(), poolName, name, url, filesystem.DownloadOptions{})
+}
+
+// CreateVolumeFromURLWithOptions is CreateVolumeFromURL applying the
+// verification configured in opts, so an image failing its checksum never
+// becomes a volume. Only qcow2 images without a backing file and raw images
+// can be imported. A volume that cannot be filled completely is deleted again.
+func (m *StoragePoolManager) CreateVolumeFromURLWithOptions(ctx context.Context, poolName, name, url string, opts filesystem.DownloadOptions) (VolumeInfo, error) {
+	cache := m.Cache
+	if cache == nil {
+		cache = filesystem.NewCache(filesystem.CacheConfigFromEnv())
+	}
+	var info VolumeInfo
+	err := cache.Use(ctx, url, opts, func(path string) error {
+		var err error
+		info, err = m.importVolume(ctx, poolName, name, path)
+		return err
+	})
+	if err != nil {
+		return VolumeInfo{}, fmt.Errorf("failed to import %s as volume %s in pool %s: %w", url, name, poolName, err)
+	}
+	return info, nil
+}
+
+// importVolume creates a volume sized for the image at path and uploads the
+// image into it.
+func (m *StoragePoolManager) importVolume(ctx context.Context, poolName, name, path string) (VolumeInfo, error) {
+	format, err := filesystem.DetectImageFormat(path)
+	if err != nil {
+		return VolumeInfo{}, fmt.Errorf("failed to detect format of image: %w", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return VolumeInfo{}, err
+	}
+	capacity := uint64(fi.Size())
+	switch format {
+	case filesystem.FormatQcow2:
+		img, err := helpers.GetImageInfo(path)
+		if err != nil {
+			return VolumeInfo{}, err
+		}
+		if img.BackingFilename != "" {
+			return VolumeInfo{}, fmt.Errorf("image has backing file %s", img.BackingFilename)
+		}
+		capacity = img.VirtualSize
+	case filesystem.FormatRaw:
+	default:
+		return VolumeInfo{}, fmt.Errorf("unsupported image format %q", format)
+	}
+
+	vol, err := m.createVol(poolName, volumeXML{
+		Name:     name,
+		Capacity: unitValue{Unit: "bytes", Value: capacity},
+		Target:   volumeTargetXML{Format: formatXML{Type: format}},
+	})
+	if err != nil {
+		return VolumeInfo{}, err
+	}
+	info, err := m.uploadVolume(ctx, vol, path, uint64(fi.Size()))
+	if err != nil {
+		if derr := m.conn.StorageVolDelete(vol, 0); derr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to delete volume %s: %w", name, derr))
+		}
+		return VolumeInfo{}, err
+	}
+	return info, nil
+}
+
+// uploadVolume writes size bytes of the file at path to the start of vol.
+func (m *StoragePoolManager) uploadVolume(ctx context.Context, vol libvirt.StorageVol, path string, size uint64) (VolumeInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return VolumeInfo{}, err
+	}
+	defer f.Close()
+	if err := m.conn.StorageVolUpload(vol, &contextReader{ctx: ctx, r: f}, 0, size, 0); err != nil {
+		return VolumeInfo{}, fmt.Errorf("failed to upload image to volume %s: %w", vol.Name, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return VolumeInfo{}, err
+	}
+	return m.volumeInfo(vol)
+}
+
+// contextReader stops reading once its context is cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// DeleteVolume deletes a volume from a pool. Deleting a volume that does not
+// exist is not an error.
+func (m *StoragePoolManager) DeleteVolume(poolName, name string) error {
+	pool, err := m.lookupPool(poolName)
+	if err != nil {
+		return err
+	}
+	vol, err := m.conn.StorageVolLookupByName(pool, name)
+	if isLibvirtError(err, libvirt.ErrNoStorageVol) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up volume %s in pool %s: %w", name, poolName, err)
+	}
+	if err := m.conn.StorageVolDelete(vol, 0); err != nil {
+		return fmt.Errorf("failed to delete volume %s in pool %s: %w", name, poolName, err)
+	}
+	return nil
+}
+
+func (m *StoragePoolManager) createVolume(poolName string, vol volumeXML) (VolumeInfo, error) {
+	created, err := m.createVol(poolName, vol)
+	if err != nil {
+		return VolumeInfo{}, err
+	}
+	return m.volumeInfo(created)
+}
+
+func (m *StoragePoolManager) createVol(poolName string, vol volumeXML) (libvirt.StorageVol, error) {
+	if vol.Name == "" {
+		return libvirt.StorageVol{}, fmt.Errorf("volume name is required")
+	}
+	if vol.Capacity.Value == 0 {
+		return libvirt.StorageVol{}, fmt.Errorf("capacity of volume %s must be greater than zero", vol.Name)
+	}
+	pool, err := m.lookupPool(poolName)
+	if err != nil {
+		return libvirt.StorageVol{}, err
+	}
+	out, err := xml.Marshal(vol)
+	if err != nil {
+		return libvirt.StorageVol{}, fmt.Errorf("failed to build XML of volume %s: %w", vol.Name, err)
+	}
+	created, err := m.conn.StorageVolCreateXML(pool, string(out), 0)
+	if err != nil {
+		return libvirt.StorageVol{}, fmt.Errorf("failed to create volume %s in pool %s: %w", vol.Name, poolName, err)
+	}
+	return created, nil
+}
+
+// lookupPool finds a pool by name.
+func (m *StoragePoolManager) lookupPool(name string) (libvirt.StoragePool, error) {
+	pool, err := m.conn.StoragePoolLookupByName(name)
+	if isLibvirtError(err, libvirt.ErrNoStoragePool) {
+		return libvirt.StoragePool{}, fmt.Errorf("pool %s %w: %w", name, ErrNotFound, err)
+	}
+	if err != nil {
+		return libvirt.StoragePool{}, fmt.Errorf("failed to look up pool %s: %w", name, err)
+	}
+	return pool, nil
+}
+
+func (m *StoragePoolManager) volumeInfo(vol libvirt.StorageVol) (VolumeInfo, error) {
+	path, err := m.conn.StorageVolGetPath(vol)
+	if err != nil {
+		return VolumeInfo{}, fmt.Errorf("failed to get path of volume %s: %w", vol.Name, err)
+	}
+	_, capacity, allocation, err := m.conn.StorageVolGetInfo(vol)
+	if err != nil {
+		return VolumeInfo{}, fmt.Errorf("failed to get info of volume %s: %w", vol.Name, err)
+	}
+	return VolumeInfo{Name: vol.Name, Path: path, CapacityBytes: capacity, AllocationBytes: allocation}, nil
+}
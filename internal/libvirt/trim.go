@@ -0,0 +1,178 @@
+package libvirt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+
+	"libvirt-controller/internal/helpers"
+	"libvirt-controller/internal/qemu"
+)
+
+// ErrDiscardUnsupported is returned by Fstrim when no writable disk of the
+// domain passes discards on to its image, so a trim would free nothing on
+// the host.
+var ErrDiscardUnsupported = errors.New("no disk of the domain has discard enabled")
+
+// fstrimTimeout is how long Fstrim waits for the guest agent, trimming a
+// large filesystem for the first time can take minutes.
+const fstrimTimeout = 30 * time.Minute
+
+// FstrimOptions controls what Fstrim reports.
+type FstrimOptions struct {
+	// MeasureReclaimed inspects the file backed disk images with qemu-img
+	// before and after the trim to report the space given back to the
+	// host. The images must be reachable from this host.
+	MeasureReclaimed bool
+}
+
+// TrimReport is the outcome of Fstrim. Disks is only filled in when
+// FstrimOptions.MeasureReclaimed is set.
+type TrimReport struct {
+	Filesystems []TrimmedFilesystem `json:"filesystems"`
+	Disks       []DiskReclaim       `json:"disks,omitempty"`
+}
+
+// TrimmedFilesystem is one filesystem the guest trimmed. Guests report the
+// bytes they trimmed, not what the host can reclaim, and some report zero.
+type TrimmedFilesystem struct {
+	Path         string `json:"path"`
+	TrimmedBytes uint64 `json:"trimmed_bytes"`
+	Error        string `json:"error,omitempty"`
+}
+
+// DiskReclaim is the host allocation of a disk image around a trim.
+type DiskReclaim struct {
+	Target         string `json:"target"`
+	Path           string `json:"path"`
+	BeforeBytes    uint64 `json:"before_bytes"`
+	AfterBytes     uint64 `json:"after_bytes"`
+	ReclaimedBytes uint64 `json:"reclaimed_bytes"`
+}
+
+// Fstrim asks the guest agent of the running domain to discard the unused
+// blocks of every mounted filesystem, so thin disk images shrink on the
+// host. It fails with ErrAgentUnavailable when the agent cannot be reached
+// and with ErrDiscardUnsupported when no disk would pass the discards on.
+func (m *DomainManager) Fstrim(name string) error {
+	_, err := m.FstrimWithOptions(name, FstrimOptions{})
+	return err
+}
+
+// FstrimWithOptions is Fstrim returning what was trimmed. Filesystems the
+// guest failed to trim are listed with their error, an error is only
+// returned when none could be trimmed.
+func (m *DomainManager) FstrimWithOptions(name string, opts FstrimOptions) (TrimReport, error) {
+	dom, err := m.lookup(name)
+	if err != nil {
+		return TrimReport{}, err
+	}
+	domain, err := m.domainXML(dom)
+	if err != nil {
+		return TrimReport{}, err
+	}
+	var disks []DiskReclaim
+	for _, disk := range domain.Devices.Disks {
+		if disk.Device == "disk" && disk.ReadOnly == nil && disk.Driver.Discard == "unmap" {
+			disks = append(disks, DiskReclaim{Target: disk.Target.Dev, Path: disk.Source.File})
+		}
+	}
+	if len(disks) == 0 {
+		return TrimReport{}, fmt.Errorf("cannot trim domain %s: %w", name, ErrDiscardUnsupported)
+	}
+
+	if opts.MeasureReclaimed {
+		for i := range disks {
+			if disks[i].Path == "" {
+				continue
+			}
+			if disks[i].BeforeBytes, err = imageAllocation(disks[i].Path); err != nil {
+				return TrimReport{}, err
+			}
+		}
+	}
+
+	var res qemu.FstrimResponse
+	if err := m.agentRunTimeout(dom, agentCommand{Execute: "guest-fstrim"}, int32(fstrimTimeout/time.Second), &res); err != nil {
+		return TrimReport{}, err
+	}
+	report := TrimReport{Filesystems: make([]TrimmedFilesystem, 0, len(res.Return.Paths))}
+	failed := 0
+	for _, path := range res.Return.Paths {
+		report.Filesystems = append(report.Filesystems, TrimmedFilesystem{Path: path.Path, TrimmedBytes: path.Trimmed, Error: path.Error})
+		if path.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 && failed == len(res.Return.Paths) {
+		return report, fmt.Errorf("guest of domain %s failed to trim its filesystems: %s", name, res.Return.Paths[0].Error)
+	}
+
+	if opts.MeasureReclaimed {
+		for i := range disks {
+			if disks[i].Path == "" {
+				continue
+			}
+			if disks[i].AfterBytes, err = imageAllocation(disks[i].Path); err != nil {
+				return report, err
+			}
+			if disks[i].AfterBytes < disks[i].BeforeBytes {
+				disks[i].ReclaimedBytes = disks[i].BeforeBytes - disks[i].AfterBytes
+			}
+		}
+		report.Disks = disks
+	}
+	return report, nil
+}
+
+// FstrimAll trims every running domain in turn and passes each outcome to
+// fn. Domains are trimmed one at a time to spread the I/O.
+func (m *DomainManager) FstrimAll(opts FstrimOptions, fn func(name string, report TrimReport, err error)) error {
+	doms, _, err := m.conn.ConnectListAllDomains(1, libvirt.ConnectListDomainsActive)
+	if err != nil {
+		return fmt.Errorf("failed to list domains: %w", err)
+	}
+	for _, dom := range doms {
+		report, err := m.FstrimWithOptions(dom.Name, opts)
+		fn(dom.Name, report, err)
+	}
+	return nil
+}
+
+// RunNightlyFstrim calls FstrimAll every day at the given hour of local
+// time until ctx is cancelled.
+func (m *DomainManager) RunNightlyFstrim(ctx context.Context, hour int, opts FstrimOptions, fn func(name string, report TrimReport, err error)) {
+	for {
+		timer := time.NewTimer(time.Until(nextHour(time.Now(), hour)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := m.FstrimAll(opts, fn); err != nil {
+			m.log().Error("failed to trim domains", "err", err)
+		}
+	}
+}
+
+// nextHour returns the next time after now that the clock shows hour:00.
+func nextHour(now time.Time, hour int) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// imageAllocation returns the space the image at path takes up on the host.
+func imageAllocation(path string) (uint64, error) {
+	info, err := helpers.GetImageInfo(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.ActualSize, nil
+}
@@ -0,0 +1,752 @@
+package libvirt
+
+import "encoding/xml"
+
+// The types below mirror the subset of libvirt's domain XML schema that
+// DomainSpec can express. See https://libvirt.org/formatdomain.html.
+
+type domainXML struct {
+	XMLName       xml.Name          `xml:"domain"`
+	Type          string            `xml:"type,attr"`
+	Name          string            `xml:"name"`
+	UUID          string            `xml:"uuid,omitempty"`
+	Memory        unitValue         `xml:"memory"`
+	CurrentMemory *unitValue        `xml:"currentMemory,omitempty"`
+	MemoryBacking *memoryBackingXML `xml:"memoryBacking,omitempty"`
+	VCPU          vcpuXML           `xml:"vcpu"`
+	CPUTune       *cputuneXML       `xml:"cputune,omitempty"`
+	NUMATune      *numatuneXML      `xml:"numatune,omitempty"`
+	OS            osXML             `xml:"os"`
+	Features      *featuresXML      `xml:"features,omitempty"`
+	CPU           *cpuXML           `xml:"cpu,omitempty"`
+	OnCrash       string            `xml:"on_crash,omitempty"`
+	Devices       devicesXML        `xml:"devices"`
+	Extra         []rawXML          `xml:",any"`
+}
+
+// rawXML is an element kept as it was read, so it survives a parse and
+// marshal unchanged.
+type rawXML struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   []byte     `xml:",innerxml"`
+}
+
+// attr returns the value of the attribute called name.
+func (r rawXML) attr(name string) string {
+	for _, a := range r.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// unmodeledXML is embedded in the structs of elements ParseDomainXML maps
+// onto a DomainSpec. It collects the attributes and children the struct does
+// not model, so BuildDomainXML can put them back.
+type unmodeledXML struct {
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Elements []rawXML   `xml:",any"`
+}
+
+func (u unmodeledXML) isZero() bool {
+	return len(u.Attrs) == 0 && len(u.Elements) == 0
+}
+
+type unitValue struct {
+	Unit  string `xml:"unit,attr,omitempty"`
+	Value uint64 `xml:",chardata"`
+}
+
+type memoryBackingXML struct {
+	Source *memoryBackingSourceXML `xml:"source,omitempty"`
+	Access *memoryBackingAccessXML `xml:"access,omitempty"`
+}
+
+type memoryBackingSourceXML struct {
+	Type string `xml:"type,attr"`
+}
+
+type memoryBackingAccessXML struct {
+	Mode string `xml:"mode,attr"`
+}
+
+type vcpuXML struct {
+	Placement string `xml:"placement,attr,omitempty"`
+	Current   uint   `xml:"current,attr,omitempty"`
+	Value     uint   `xml:",chardata"`
+	unmodeledXML
+}
+
+type cputuneXML struct {
+	VCPUPins []vcpupinXML `xml:"vcpupin"`
+	unmodeledXML
+}
+
+type vcpupinXML struct {
+	VCPU   uint   `xml:"vcpu,attr"`
+	CPUSet string `xml:"cpuset,attr"`
+}
+
+type numatuneXML struct {
+	Memory numaMemoryXML `xml:"memory"`
+	unmodeledXML
+}
+
+type numaMemoryXML struct {
+	Mode    string `xml:"mode,attr"`
+	Nodeset string `xml:"nodeset,attr"`
+}
+
+type osXML struct {
+	Firmware         string         `xml:"firmware,attr,omitempty"`
+	Type             osTypeXML      `xml:"type"`
+	FirmwareFeatures *osFirmwareXML `xml:"firmware,omitempty"`
+	Loader           *osLoaderXML   `xml:"loader,omitempty"`
+	NVRAM            *osNVRAMXML    `xml:"nvram,omitempty"`
+	Boot             []osBootXML    `xml:"boot"`
+	unmodeledXML
+}
+
+type osFirmwareXML struct {
+	Features []osFirmwareFeatureXML `xml:"feature"`
+}
+
+type osFirmwareFeatureXML struct {
+	Enabled string `xml:"enabled,attr"`
+	Name    string `xml:"name,attr"`
+}
+
+type osLoaderXML struct {
+	ReadOnly string `xml:"readonly,attr,omitempty"`
+	Secure   string `xml:"secure,attr,omitempty"`
+	Type     string `xml:"type,attr,omitempty"`
+	Path     string `xml:",chardata"`
+}
+
+type osNVRAMXML struct {
+	Template string `xml:"template,attr,omitempty"`
+	Path     string `xml:",chardata"`
+}
+
+type osTypeXML struct {
+	Arch    string `xml:"arch,attr,omitempty"`
+	Machine string `xml:"machine,attr,omitempty"`
+	Value   string `xml:",chardata"`
+}
+
+type osBootXML struct {
+	Dev string `xml:"dev,attr"`
+}
+
+type featuresXML struct {
+	ACPI *struct{}        `xml:"acpi"`
+	APIC *struct{}        `xml:"apic"`
+	SMM  *featureStateXML `xml:"smm,omitempty"`
+	unmodeledXML
+}
+
+type featureStateXML struct {
+	State string `xml:"state,attr"`
+}
+
+type cpuXML struct {
+	Mode  string       `xml:"mode,attr"`
+	Match string       `xml:"match,attr,omitempty"`
+	Model *cpuModelXML `xml:"model,omitempty"`
+	unmodeledXML
+}
+
+type cpuModelXML struct {
+	Fallback string `xml:"fallback,attr,omitempty"`
+	Value    string `xml:",chardata"`
+}
+
+type devicesXML struct {
+	Disks       []diskXML       `xml:"disk"`
+	Controllers []controllerXML `xml:"controller"`
+	Interfaces  []interfaceXML  `xml:"interface"`
+	Serials     []serialXML     `xml:"serial"`
+	Consoles    []consoleXML    `xml:"console"`
+	Channels    []channelXML    `xml:"channel"`
+	Graphics    []graphicsXML   `xml:"graphics"`
+	HostDevs    []hostdevXML    `xml:"hostdev"`
+	Filesystems []filesystemXML `xml:"filesystem"`
+	TPMs        []tpmXML        `xml:"tpm"`
+	Extra       []rawXML        `xml:",any"`
+
+	// order, when set, is the order of the devices in parsed domain XML,
+	// which MarshalXML keeps.
+	order []deviceSlot
+}
+
+// deviceSlot is the place of one device in parsed domain XML: the next
+// device of the spec called name, or Extra[extra] when extra is not -1.
+type deviceSlot struct {
+	name  string
+	extra int
+}
+
+// MarshalXML writes the devices in order. The devices that have no slot,
+// such as those added to a parsed spec, follow in the usual order.
+func (d devicesXML) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type plain devicesXML
+	if d.order == nil {
+		return e.EncodeElement(plain(d), start)
+	}
+
+	modeled := map[string][]any{}
+	var names []string
+	add := func(name string, v any) {
+		if _, ok := modeled[name]; !ok {
+			names = append(names, name)
+		}
+		modeled[name] = append(modeled[name], v)
+	}
+	for _, v := range d.Disks {
+		add("disk", v)
+	}
+	for _, v := range d.Controllers {
+		add("controller", v)
+	}
+	for _, v := range d.Interfaces {
+		add("interface", v)
+	}
+	for _, v := range d.Serials {
+		add("serial", v)
+	}
+	for _, v := range d.Consoles {
+		add("console", v)
+	}
+	for _, v := range d.Channels {
+		add("channel", v)
+	}
+	for _, v := range d.Graphics {
+		add("graphics", v)
+	}
+	for _, v := range d.HostDevs {
+		add("hostdev", v)
+	}
+	for _, v := range d.Filesystems {
+		add("filesystem", v)
+	}
+	for _, v := range d.TPMs {
+		add("tpm", v)
+	}
+
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	encode := func(name string, v any) error {
+		return e.EncodeElement(v, xml.StartElement{Name: xml.Name{Local: name}})
+	}
+	for _, slot := range d.order {
+		if slot.extra != -1 {
+			if err := e.Encode(d.Extra[slot.extra]); err != nil {
+				return err
+			}
+			continue
+		}
+		if q := modeled[slot.name]; len(q) > 0 {
+			if err := encode(slot.name, q[0]); err != nil {
+				return err
+			}
+			modeled[slot.name] = q[1:]
+		}
+	}
+	for _, name := range names {
+		for _, v := range modeled[name] {
+			if err := encode(name, v); err != nil {
+				return err
+			}
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+type tpmXML struct {
+	Model   string        `xml:"model,attr"`
+	Backend tpmBackendXML `xml:"backend"`
+	unmodeledXML
+}
+
+type tpmBackendXML struct {
+	Type    string `xml:"type,attr"`
+	Version string `xml:"version,attr,omitempty"`
+}
+
+type filesystemXML struct {
+	XMLName    xml.Name             `xml:"filesystem"`
+	Type       string               `xml:"type,attr"`
+	AccessMode string               `xml:"accessmode,attr,omitempty"`
+	Driver     *filesystemDriverXML `xml:"driver,omitempty"`
+	Binary     *filesystemBinaryXML `xml:"binary,omitempty"`
+	Source     filesystemSourceXML  `xml:"source"`
+	Target     filesystemTargetXML  `xml:"target"`
+	ReadOnly   *struct{}            `xml:"readonly,omitempty"`
+	unmodeledXML
+}
+
+type filesystemDriverXML struct {
+	Type string `xml:"type,attr"`
+}
+
+type filesystemBinaryXML struct {
+	Path string `xml:"path,attr"`
+}
+
+type filesystemSourceXML struct {
+	Dir string `xml:"dir,attr"`
+}
+
+type filesystemTargetXML struct {
+	Dir string `xml:"dir,attr"`
+}
+
+type hostdevXML struct {
+	XMLName xml.Name         `xml:"hostdev"`
+	Mode    string           `xml:"mode,attr"`
+	Type    string           `xml:"type,attr"`
+	Managed string           `xml:"managed,attr,omitempty"`
+	Source  hostdevSourceXML `xml:"source"`
+	unmodeledXML
+}
+
+type hostdevSourceXML struct {
+	Address *pciAddressXML `xml:"address,omitempty"`
+	Vendor  *usbIDXML      `xml:"vendor,omitempty"`
+	Product *usbIDXML      `xml:"product,omitempty"`
+}
+
+type pciAddressXML struct {
+	Domain   string `xml:"domain,attr"`
+	Bus      string `xml:"bus,attr"`
+	Slot     string `xml:"slot,attr"`
+	Function string `xml:"function,attr"`
+}
+
+type usbIDXML struct {
+	ID string `xml:"id,attr"`
+}
+
+type graphicsXML struct {
+	Type     string              `xml:"type,attr"`
+	Port     int                 `xml:"port,attr,omitempty"`
+	TLSPort  int                 `xml:"tlsPort,attr,omitempty"`
+	AutoPort string              `xml:"autoport,attr,omitempty"`
+	Listen   string              `xml:"listen,attr,omitempty"`
+	Passwd   string              `xml:"passwd,attr,omitempty"`
+	Listens  []graphicsListenXML `xml:"listen"`
+	unmodeledXML
+}
+
+type graphicsListenXML struct {
+	Type    string `xml:"type,attr"`
+	Address string `xml:"address,attr,omitempty"`
+}
+
+type diskXML struct {
+	XMLName  xml.Name       `xml:"disk"`
+	Type     string         `xml:"type,attr"`
+	Device   string         `xml:"device,attr"`
+	Driver   diskDriverXML  `xml:"driver"`
+	Source   diskSourceXML  `xml:"source"`
+	Target   diskTargetXML  `xml:"target"`
+	ReadOnly *struct{}      `xml:"readonly,omitempty"`
+	IOTune   *iotuneXML     `xml:"iotune,omitempty"`
+	Boot     *deviceBootXML `xml:"boot,omitempty"`
+
+	// BackingStore is only reported in the live XML of a running domain.
+	BackingStore *diskBackingStoreXML `xml:"backingStore,omitempty"`
+	unmodeledXML
+}
+
+// diskBackingStoreXML is one image of a disk's backing chain. The end of
+// the chain is an empty element without a source.
+type diskBackingStoreXML struct {
+	Type         string               `xml:"type,attr,omitempty"`
+	Format       *formatXML           `xml:"format,omitempty"`
+	Source       *diskSourceXML       `xml:"source,omitempty"`
+	BackingStore *diskBackingStoreXML `xml:"backingStore,omitempty"`
+}
+
+// hasBacking reports whether the chain holds at least one backing image.
+func (b *diskBackingStoreXML) hasBacking() bool {
+	return b != nil && b.Source != nil
+}
+
+type iotuneXML struct {
+	TotalBytesSec uint64 `xml:"total_bytes_sec,omitempty"`
+	ReadBytesSec  uint64 `xml:"read_bytes_sec,omitempty"`
+	WriteBytesSec uint64 `xml:"write_bytes_sec,omitempty"`
+	TotalIOPSSec  uint64 `xml:"total_iops_sec,omitempty"`
+	ReadIOPSSec   uint64 `xml:"read_iops_sec,omitempty"`
+	WriteIOPSSec  uint64 `xml:"write_iops_sec,omitempty"`
+}
+
+type controllerXML struct {
+	Type  string `xml:"type,attr"`
+	Model string `xml:"model,attr,omitempty"`
+}
+
+type diskDriverXML struct {
+	Name    string `xml:"name,attr"`
+	Type    string `xml:"type,attr"`
+	Cache   string `xml:"cache,attr,omitempty"`
+	IO      string `xml:"io,attr,omitempty"`
+	Discard string `xml:"discard,attr,omitempty"`
+	unmodeledXML
+}
+
+type diskSourceXML struct {
+	File string `xml:"file,attr"`
+	unmodeledXML
+}
+
+type diskTargetXML struct {
+	Dev string `xml:"dev,attr"`
+	Bus string `xml:"bus,attr,omitempty"`
+	unmodeledXML
+}
+
+type interfaceXML struct {
+	XMLName   xml.Name           `xml:"interface"`
+	Type      string             `xml:"type,attr"`
+	MAC       *macXML            `xml:"mac,omitempty"`
+	Source    interfaceSourceXML `xml:"source"`
+	Model     *interfaceModelXML `xml:"model,omitempty"`
+	Bandwidth *bandwidthXML      `xml:"bandwidth,omitempty"`
+	Boot      *deviceBootXML     `xml:"boot,omitempty"`
+	unmodeledXML
+}
+
+// deviceBootXML places a disk or interface in the boot order.
+type deviceBootXML struct {
+	Order uint `xml:"order,attr"`
+}
+
+type bandwidthXML struct {
+	Inbound  *bandwidthLimitXML `xml:"inbound,omitempty"`
+	Outbound *bandwidthLimitXML `xml:"outbound,omitempty"`
+}
+
+type bandwidthLimitXML struct {
+	Average uint `xml:"average,attr"`
+	Peak    uint `xml:"peak,attr,omitempty"`
+	Burst   uint `xml:"burst,attr,omitempty"`
+}
+
+type macXML struct {
+	Address string `xml:"address,attr"`
+}
+
+type interfaceSourceXML struct {
+	Network string `xml:"network,attr,omitempty"`
+	Bridge  string `xml:"bridge,attr,omitempty"`
+	Dev     string `xml:"dev,attr,omitempty"`
+	Mode    string `xml:"mode,attr,omitempty"`
+	unmodeledXML
+}
+
+type interfaceModelXML struct {
+	Type string `xml:"type,attr"`
+	unmodeledXML
+}
+
+type serialXML struct {
+	Type   string           `xml:"type,attr"`
+	Target *serialTargetXML `xml:"target,omitempty"`
+}
+
+type serialTargetXML struct {
+	Port uint `xml:"port,attr"`
+}
+
+type consoleXML struct {
+	Type   string            `xml:"type,attr"`
+	Source *consoleSourceXML `xml:"source,omitempty"`
+	Target consoleTargetXML  `xml:"target"`
+}
+
+type consoleSourceXML struct {
+	Path string `xml:"path,attr,omitempty"`
+}
+
+type consoleTargetXML struct {
+	Type string `xml:"type,attr"`
+	Port uint   `xml:"port,attr"`
+}
+
+type channelXML struct {
+	Type   string           `xml:"type,attr"`
+	Target channelTargetXML `xml:"target"`
+}
+
+type channelTargetXML struct {
+	Type string `xml:"type,attr"`
+	Name string `xml:"name,attr"`
+}
+
+// The types below mirror the subset of libvirt's storage pool and volume XML
+// used by StoragePoolManager. See https://libvirt.org/formatstorage.html.
+
+type poolXML struct {
+	XMLName xml.Name      `xml:"pool"`
+	Type    string        `xml:"type,attr"`
+	Name    string        `xml:"name"`
+	Target  poolTargetXML `xml:"target"`
+}
+
+type poolTargetXML struct {
+	Path string `xml:"path"`
+}
+
+type volumeXML struct {
+	XMLName      xml.Name         `xml:"volume"`
+	Name         string           `xml:"name"`
+	Capacity     unitValue        `xml:"capacity"`
+	Target       volumeTargetXML  `xml:"target"`
+	BackingStore *backingStoreXML `xml:"backingStore,omitempty"`
+}
+
+type volumeTargetXML struct {
+	Format formatXML `xml:"format"`
+}
+
+type backingStoreXML struct {
+	Path   string    `xml:"path"`
+	Format formatXML `xml:"format"`
+}
+
+type formatXML struct {
+	Type string `xml:"type,attr"`
+}
+
+// The types below mirror the subset of libvirt's snapshot XML used by
+// SnapshotManager. See https://libvirt.org/formatsnapshot.html.
+
+type domainSnapshotXML struct {
+	XMLName      xml.Name           `xml:"domainsnapshot"`
+	Name         string             `xml:"name"`
+	Description  string             `xml:"description,omitempty"`
+	State        string             `xml:"state,omitempty"`
+	CreationTime int64              `xml:"creationTime,omitempty"`
+	Parent       *snapshotParentXML `xml:"parent,omitempty"`
+	Memory       *snapshotMemoryXML `xml:"memory,omitempty"`
+	Disks        *snapshotDisksXML  `xml:"disks,omitempty"`
+}
+
+type snapshotParentXML struct {
+	Name string `xml:"name"`
+}
+
+type snapshotMemoryXML struct {
+	Snapshot string `xml:"snapshot,attr"`
+	File     string `xml:"file,attr,omitempty"`
+}
+
+type snapshotDisksXML struct {
+	Disks []snapshotDiskXML `xml:"disk"`
+}
+
+type snapshotDiskXML struct {
+	Name     string                 `xml:"name,attr"`
+	Snapshot string                 `xml:"snapshot,attr"`
+	Driver   *snapshotDiskDriverXML `xml:"driver,omitempty"`
+	Source   *diskSourceXML         `xml:"source,omitempty"`
+}
+
+type snapshotDiskDriverXML struct {
+	Type string `xml:"type,attr"`
+}
+
+// The types below mirror the subset of libvirt's backup and checkpoint XML
+// used by Backup. See https://libvirt.org/formatbackup.html and
+// https://libvirt.org/formatcheckpoint.html.
+
+type domainBackupXML struct {
+	XMLName     xml.Name       `xml:"domainbackup"`
+	Mode        string         `xml:"mode,attr"`
+	Incremental string         `xml:"incremental,omitempty"`
+	Disks       backupDisksXML `xml:"disks"`
+}
+
+type backupDisksXML struct {
+	Disks []backupDiskXML `xml:"disk"`
+}
+
+type backupDiskXML struct {
+	Name   string                 `xml:"name,attr"`
+	Backup string                 `xml:"backup,attr"`
+	Type   string                 `xml:"type,attr,omitempty"`
+	Target *diskSourceXML         `xml:"target,omitempty"`
+	Driver *snapshotDiskDriverXML `xml:"driver,omitempty"`
+}
+
+type domainCheckpointXML struct {
+	XMLName      xml.Name            `xml:"domaincheckpoint"`
+	Name         string              `xml:"name"`
+	CreationTime int64               `xml:"creationTime,omitempty"`
+	Parent       *snapshotParentXML  `xml:"parent,omitempty"`
+	Disks        *checkpointDisksXML `xml:"disks,omitempty"`
+}
+
+type checkpointDisksXML struct {
+	Disks []checkpointDiskXML `xml:"disk"`
+}
+
+type checkpointDiskXML struct {
+	Name       string `xml:"name,attr"`
+	Checkpoint string `xml:"checkpoint,attr"`
+}
+
+// The types below mirror the subset of libvirt's network XML used by
+// NetworkManager. See https://libvirt.org/formatnetwork.html.
+
+type networkXML struct {
+	XMLName xml.Name           `xml:"network"`
+	Name    string             `xml:"name"`
+	Forward *networkForwardXML `xml:"forward,omitempty"`
+	Bridge  *networkBridgeXML  `xml:"bridge,omitempty"`
+	IPs     []networkIPXML     `xml:"ip"`
+}
+
+type networkForwardXML struct {
+	Mode string `xml:"mode,attr"`
+}
+
+type networkBridgeXML struct {
+	Name string `xml:"name,attr,omitempty"`
+}
+
+type networkIPXML struct {
+	Address string          `xml:"address,attr"`
+	Prefix  int             `xml:"prefix,attr,omitempty"`
+	Netmask string          `xml:"netmask,attr,omitempty"`
+	DHCP    *networkDHCPXML `xml:"dhcp,omitempty"`
+}
+
+type networkDHCPXML struct {
+	Ranges []dhcpRangeXML `xml:"range"`
+	Hosts  []dhcpHostXML  `xml:"host"`
+}
+
+type dhcpRangeXML struct {
+	Start string `xml:"start,attr"`
+	End   string `xml:"end,attr"`
+}
+
+type dhcpHostXML struct {
+	XMLName xml.Name `xml:"host"`
+	MAC     string   `xml:"mac,attr,omitempty"`
+	Name    string   `xml:"name,attr,omitempty"`
+	IP      string   `xml:"ip,attr"`
+}
+
+// The types below mirror the subset of libvirt's capabilities XML used by
+// Capabilities. See https://libvirt.org/formatcaps.html and
+// https://libvirt.org/formatdomaincaps.html.
+
+type capabilitiesXML struct {
+	XMLName xml.Name       `xml:"capabilities"`
+	Host    capsHostXML    `xml:"host"`
+	Guests  []capsGuestXML `xml:"guest"`
+}
+
+type capsHostXML struct {
+	CPU capsHostCPUXML `xml:"cpu"`
+}
+
+type capsHostCPUXML struct {
+	Arch     string           `xml:"arch"`
+	Model    string           `xml:"model"`
+	Vendor   string           `xml:"vendor"`
+	Features []capsFeatureXML `xml:"feature"`
+}
+
+type capsFeatureXML struct {
+	Name   string `xml:"name,attr"`
+	Policy string `xml:"policy,attr,omitempty"`
+}
+
+type capsGuestXML struct {
+	OSType string           `xml:"os_type"`
+	Arch   capsGuestArchXML `xml:"arch"`
+}
+
+type capsGuestArchXML struct {
+	Name     string           `xml:"name,attr"`
+	Emulator string           `xml:"emulator"`
+	Machines []capsMachineXML `xml:"machine"`
+	Domains  []capsDomainXML  `xml:"domain"`
+}
+
+type capsMachineXML struct {
+	Name      string `xml:",chardata"`
+	Canonical string `xml:"canonical,attr,omitempty"`
+}
+
+type capsDomainXML struct {
+	Type string `xml:"type,attr"`
+}
+
+type domainCapabilitiesXML struct {
+	XMLName xml.Name             `xml:"domainCapabilities"`
+	Domain  string               `xml:"domain"`
+	Machine string               `xml:"machine"`
+	Arch    string               `xml:"arch"`
+	CPU     domainCapsCPUXML     `xml:"cpu"`
+	Devices domainCapsDevicesXML `xml:"devices"`
+}
+
+type domainCapsCPUXML struct {
+	Modes []domainCapsCPUModeXML `xml:"mode"`
+}
+
+type domainCapsCPUModeXML struct {
+	Name      string                  `xml:"name,attr"`
+	Supported string                  `xml:"supported,attr"`
+	Features  []capsFeatureXML        `xml:"feature"`
+	Models    []domainCapsCPUModelXML `xml:"model"`
+}
+
+type domainCapsCPUModelXML struct {
+	Name   string `xml:",chardata"`
+	Usable string `xml:"usable,attr,omitempty"`
+}
+
+type domainCapsDevicesXML struct {
+	Disk domainCapsDeviceXML  `xml:"disk"`
+	TPM  *domainCapsDeviceXML `xml:"tpm"`
+}
+
+type domainCapsDeviceXML struct {
+	Supported string              `xml:"supported,attr"`
+	Enums     []domainCapsEnumXML `xml:"enum"`
+}
+
+type domainCapsEnumXML struct {
+	Name   string   `xml:"name,attr"`
+	Values []string `xml:"value"`
+}
+
+// The types below mirror the subset of libvirt's node device XML used by
+// host device passthrough. See https://libvirt.org/formatnode.html.
+
+type nodeDeviceXML struct {
+	Name       string                  `xml:"name"`
+	Driver     string                  `xml:"driver>name"`
+	Capability nodeDeviceCapabilityXML `xml:"capability"`
+}
+
+type nodeDeviceCapabilityXML struct {
+	Type       string         `xml:"type,attr"`
+	IOMMUGroup *iommuGroupXML `xml:"iommuGroup"`
+	Vendor     usbIDXML       `xml:"vendor"`
+	Product    usbIDXML       `xml:"product"`
+}
+
+type iommuGroupXML struct {
+	Number int `xml:"number,attr"`
+}
@@ -0,0 +1,41 @@
+package logging
+
+import "log/slog"
+
+// Logger is a leveled logger. The message is followed by alternating keys
+// and values, as with log/slog, so a *slog.Logger can be used directly.
+type Logger interface {
+	Debug(msg string, keyvals ...any)
+	Info(msg string, keyvals ...any)
+	Warn(msg string, keyvals ...any)
+	Error(msg string, keyvals ...any)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// Nop returns a Logger that discards everything.
+func Nop() Logger {
+	return nopLogger{}
+}
+
+// FromSlog returns l as a Logger, or a no-op Logger when l is nil.
+func FromSlog(l *slog.Logger) Logger {
+	if l == nil {
+		return Nop()
+	}
+	return l
+}
+
+// OrNop returns l, or a no-op Logger when l is nil. Packages use it to
+// default an unset Logger field.
+func OrNop(l Logger) Logger {
+	if l == nil {
+		return Nop()
+	}
+	return l
+}
@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Label values for the result label.
+const (
+	ResultSuccess = "success"
+	ResultError   = "error"
+)
+
+// Metrics holds the Prometheus collectors of the controller in their own
+// registry. It implements filesystem.CacheObserver and
+// libvirt.OperationObserver, so it can be set on a CacheConfig, a
+// DomainManager or a Provisioner.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	DownloadBytes     prometheus.Counter
+	DownloadDuration  *prometheus.HistogramVec // By result
+	CacheLookups      *prometheus.CounterVec   // By result, "hit" or "miss"
+	Operations        *prometheus.CounterVec   // By operation and result
+	OperationDuration *prometheus.HistogramVec // By operation and result
+	Domains           *prometheus.GaugeVec     // By state, see WatchDomains
+}
+
+// New creates Metrics with all collectors registered.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		DownloadBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "libvirt_controller_download_bytes_total",
+			Help: "Bytes downloaded, excluding cache hits.",
+		}),
+		DownloadDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "libvirt_controller_download_duration_seconds",
+			Help:    "Duration of downloads.",
+			Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+		}, []string{"result"}),
+		CacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "libvirt_controller_cache_lookups_total",
+			Help: "Image cache lookups; the hit ratio is hits over all lookups.",
+		}, []string{"result"}),
+		Operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "libvirt_controller_operations_total",
+			Help: "VM operations performed.",
+		}, []string{"operation", "result"}),
+		OperationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "libvirt_controller_operation_duration_seconds",
+			Help:    "Duration of VM operations.",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+		}, []string{"operation", "result"}),
+	}
+	m.registry.MustRegister(
+		m.DownloadBytes,
+		m.DownloadDuration,
+		m.CacheLookups,
+		m.Operations,
+		m.OperationDuration,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// ObserveCacheLookup counts a cache hit or miss.
+func (m *Metrics) ObserveCacheLookup(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.CacheLookups.WithLabelValues(result).Inc()
+}
+
+// ObserveDownload records a finished download.
+func (m *Metrics) ObserveDownload(bytes int64, duration time.Duration, err error) {
+	if bytes > 0 {
+		m.DownloadBytes.Add(float64(bytes))
+	}
+	m.DownloadDuration.WithLabelValues(result(err)).Observe(duration.Seconds())
+}
+
+// ObserveOperation records a finished VM operation such as "create".
+func (m *Metrics) ObserveOperation(op string, duration time.Duration, err error) {
+	r := result(err)
+	m.Operations.WithLabelValues(op, r).Inc()
+	m.OperationDuration.WithLabelValues(op, r).Observe(duration.Seconds())
+}
+
+// WatchDomains registers a gauge of domains by state that calls count on
+// every scrape. It may only be called once.
+func (m *Metrics) WatchDomains(count func() (map[string]int, error)) {
+	m.Domains = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "libvirt_controller_domains",
+		Help: "Domains on the host by state.",
+	}, []string{"state"})
+	m.registry.MustRegister(&domainCollector{gauge: m.Domains, count: count})
+}
+
+// domainCollector refreshes the domain gauge from libvirt when scraped.
+type domainCollector struct {
+	gauge *prometheus.GaugeVec
+	count func() (map[string]int, error)
+}
+
+func (c *domainCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.gauge.Describe(ch)
+}
+
+func (c *domainCollector) Collect(ch chan<- prometheus.Metric) {
+	counts, err := c.count()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(prometheus.NewDesc("libvirt_controller_domains", "Domains on the host by state.", []string{"state"}, nil), err)
+		return
+	}
+	c.gauge.Reset()
+	for state, n := range counts {
+		c.gauge.WithLabelValues(state).Set(float64(n))
+	}
+	c.gauge.Collect(ch)
+}
+
+func result(err error) string {
+	if err != nil {
+		return ResultError
+	}
+	return ResultSuccess
+}
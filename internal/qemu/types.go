@@ -62,3 +62,36 @@ type GuestUser struct {
 type UserResponse struct {
 	Return []GuestUser `json:"return"`
 }
+
+type GuestExecResponse struct {
+	Return struct {
+		PID int `json:"pid"`
+	} `json:"return"`
+}
+
+type GuestExecStatus struct {
+	Exited       bool   `json:"exited"`
+	ExitCode     int    `json:"exitcode"`
+	Signal       int    `json:"signal"`
+	OutData      string `json:"out-data"`
+	ErrData      string `json:"err-data"`
+	OutTruncated bool   `json:"out-truncated"`
+	ErrTruncated bool   `json:"err-truncated"`
+}
+
+type GuestExecStatusResponse struct {
+	Return GuestExecStatus `json:"return"`
+}
+
+type FstrimPath struct {
+	Path    string `json:"path"`
+	Trimmed uint64 `json:"trimmed"`
+	Minimum uint64 `json:"minimum"`
+	Error   string `json:"error,omitempty"`
+}
+
+type FstrimResponse struct {
+	Return struct {
+		Paths []FstrimPath `json:"paths"`
+	} `json:"return"`
+}
@@ -14,10 +14,11 @@ import (
 )
 
 type CreateDiskRequest struct {
-	ID       float64 `json:"id"`
-	Capacity int     `json:"capacity"`
-	Path     string  `json:"path"`
-	ImageURL string  `json:"image_url,omitempty"`
+	ID          float64 `json:"id"`
+	Capacity    int     `json:"capacity"`
+	Path        string  `json:"path"`
+	ImageURL    string  `json:"image_url,omitempty"`
+	ImageFormat string  `json:"image_format,omitempty"`
 }
 
 // CreateDiskHandler handles creating a disk for a VM
@@ -55,7 +56,8 @@ func CreateDiskHandler(w http.ResponseWriter, r *http.Request) {
 	// Process disk image
 	imagePath := filepath.Join(req.Path, fmt.Sprintf("%.0f.img", req.ID))
 
-	if err := filesystem.DownloadCachedFile(req.ImageURL, imagePath, 0660); err != nil {
+	opts := filesystem.DownloadOptions{Format: req.ImageFormat}
+	if err := filesystem.DownloadCachedFileWithOptions(r.Context(), req.ImageURL, imagePath, 0660, opts); err != nil {
 		utils.JSONErrorResponse(w, fmt.Sprintf("Failed to download image from URL %s: %v", req.ImageURL, err), http.StatusInternalServerError)
 		return
 	}
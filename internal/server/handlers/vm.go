@@ -3,6 +3,7 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -53,6 +54,10 @@ func DefineDomainHandler(w http.ResponseWriter, r *http.Request) {
 		utils.JSONErrorResponse(w, "Missing 'id'", http.StatusBadRequest)
 		return
 	}
+	if err := libvirt.ValidateDomainName(req.ID); err != nil {
+		utils.JSONErrorResponse(w, fmt.Sprintf("Invalid 'id': %s", err.Error()), http.StatusBadRequest)
+		return
+	}
 	if req.XMLConfig == "" {
 		utils.JSONErrorResponse(w, "Missing 'xmlConfig'", http.StatusBadRequest)
 		return
@@ -118,6 +123,10 @@ func DomainMiddleware(next http.Handler) http.Handler {
 			utils.JSONErrorResponse(w, "VM ID missing from URL", http.StatusBadRequest)
 			return
 		}
+		if err := libvirt.ValidateDomainName(vmID); err != nil {
+			utils.JSONErrorResponse(w, fmt.Sprintf("Invalid VM ID: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
 
 		definitionsDir := os.Getenv("DEFINITIONS_DIR")
 		if definitionsDir == "" {
@@ -133,7 +142,7 @@ func DomainMiddleware(next http.Handler) http.Handler {
 		if err != nil {
 			// This catches cases where path exists but isn't a directory, or other os.Stat errors
 			fmt.Printf("Error during VM directory check %s: %v\n", vmDir, err) // Log for debugging
-			if err.Error() == fmt.Sprintf("path '%s' exists but is not a directory", vmDir) {
+			if errors.Is(err, filesystem.ErrNotDirectory) {
 				utils.JSONErrorResponse(w, fmt.Sprintf("Path '%s' exists but is not a directory for VM ID '%s'.", vmDir, vmID), http.StatusConflict)
 			} else {
 				utils.JSONErrorResponse(w, fmt.Sprintf("Failed to verify VM directory: %s", err.Error()), http.StatusInternalServerError)
@@ -200,7 +209,8 @@ func CloudInitHandler(w http.ResponseWriter, r *http.Request) {
 
 	for fileName, content := range cloudInitFiles {
 		if content != "" {
-			if err := filesystem.SaveFile(vmDir, fileName, []byte(content)); err != nil {
+			// cloud-init data may contain credentials, keep it private
+			if err := filesystem.SaveFileMode(vmDir, fileName, []byte(content), 0600); err != nil {
 				utils.JSONErrorResponse(w, fmt.Sprintf("Failed to save '%s' file", fileName), http.StatusInternalServerError)
 				return
 			}
@@ -35,6 +35,11 @@ func (s *Server) RegisterRoutes() http.Handler {
 		w.Write([]byte("ok"))
 	})
 
+	// Prometheus scrape endpoint
+	if s.metrics != nil {
+		r.Handle("/metrics", s.metrics.Handler())
+	}
+
 	r.Use(AuthMiddleware) // Apply authentication
 
 	r.Route("/v1", func(r chi.Router) {
@@ -8,17 +8,24 @@ import (
 	"time"
 
 	_ "github.com/joho/godotenv/autoload"
+
+	"libvirt-controller/internal/filesystem"
+	"libvirt-controller/internal/metrics"
 )
 
 type Server struct {
-	port int
+	port    int
+	metrics *metrics.Metrics
 }
 
 func NewServer() *http.Server {
 	port, _ := strconv.Atoi(os.Getenv("PORT"))
 	NewServer := &Server{
-		port: port,
+		port:    port,
+		metrics: metrics.New(),
 	}
+	// The disk handlers download images through caches built from the environment
+	filesystem.SetDefaultCacheObserver(NewServer.metrics)
 
 	// Declare Server config
 	server := &http.Server{
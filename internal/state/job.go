@@ -0,0 +1,80 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"libvirt-controller/internal/filesystem"
+)
+
+// jobDir is the subdirectory of the store holding job records.
+const jobDir = "jobs"
+
+var jobIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// JobRecord is the last known status of a long-running job.
+type JobRecord struct {
+	ID         string    `json:"id"`
+	State      string    `json:"state"`
+	Progress   float64   `json:"progress"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	FinishedAt time.Time `json:"finished_at,omitzero"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// PutJob creates or replaces the record of rec.ID. UpdatedAt is set to now.
+func (s *Store) PutJob(rec JobRecord) error {
+	if !jobIDPattern.MatchString(rec.ID) {
+		return fmt.Errorf("invalid job id %q", rec.ID)
+	}
+	rec.UpdatedAt = time.Now().UTC()
+
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode job %s: %w", rec.ID, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return filesystem.SaveFileMode(filepath.Join(s.dir, jobDir), rec.ID+recordExt, data, 0600)
+}
+
+// GetJob returns the record of the job, or an error wrapping ErrNotFound.
+func (s *Store) GetJob(id string) (JobRecord, error) {
+	if !jobIDPattern.MatchString(id) {
+		return JobRecord{}, fmt.Errorf("invalid job id %q", id)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, err := os.ReadFile(filepath.Join(s.dir, jobDir, id+recordExt))
+	if os.IsNotExist(err) {
+		return JobRecord{}, fmt.Errorf("%w %s", ErrNotFound, id)
+	}
+	if err != nil {
+		return JobRecord{}, fmt.Errorf("failed to read job %s: %w", id, err)
+	}
+	var rec JobRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return JobRecord{}, fmt.Errorf("failed to decode job %s: %w", id, err)
+	}
+	return rec, nil
+}
+
+// DeleteJob removes the record of the job. Deleting a missing record is not
+// an error.
+func (s *Store) DeleteJob(id string) error {
+	if !jobIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid job id %q", id)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(filepath.Join(s.dir, jobDir, id+recordExt)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete job %s: %w", id, err)
+	}
+	return nil
+}
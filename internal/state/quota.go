@@ -0,0 +1,178 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"libvirt-controller/internal/filesystem"
+)
+
+// quotaDir is the subdirectory of the store holding tenant quotas.
+const quotaDir = "quotas"
+
+// reservationDir is the subdirectory of the store holding what each VM
+// reserved from the quota of its tenant.
+const reservationDir = "reservations"
+
+var tenantPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,63}$`)
+
+// vmNamePattern matches the domain names accepted by the controller.
+var vmNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,63}$`)
+
+// ValidateTenant returns an error for a tenant id the store cannot keep a
+// quota for.
+func ValidateTenant(tenant string) error {
+	if !tenantPattern.MatchString(tenant) {
+		return fmt.Errorf("invalid tenant id %q", tenant)
+	}
+	return nil
+}
+
+// QuotaLimits caps what a tenant may consume. Zero leaves a dimension
+// unlimited.
+type QuotaLimits struct {
+	VMs       int    `json:"vms"`
+	VCPUs     int    `json:"vcpus"`
+	MemoryMiB uint64 `json:"memory_mib"`
+	DiskBytes uint64 `json:"disk_bytes"`
+}
+
+// QuotaUsage is what a tenant has reserved.
+type QuotaUsage struct {
+	VMs       int    `json:"vms"`
+	VCPUs     int    `json:"vcpus"`
+	MemoryMiB uint64 `json:"memory_mib"`
+	DiskBytes uint64 `json:"disk_bytes"`
+}
+
+// TenantQuota is the quota record of one tenant.
+type TenantQuota struct {
+	Tenant    string      `json:"tenant"`
+	Limits    QuotaLimits `json:"limits"`
+	Used      QuotaUsage  `json:"used"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// QuotaReservation is what one VM reserved from the quota of its tenant.
+type QuotaReservation struct {
+	VM     string     `json:"vm"`
+	Tenant string     `json:"tenant"`
+	Used   QuotaUsage `json:"used"`
+}
+
+// GetQuota returns the quota of the tenant, or an error wrapping
+// ErrNotFound.
+func (s *Store) GetQuota(tenant string) (TenantQuota, error) {
+	if err := ValidateTenant(tenant); err != nil {
+		return TenantQuota{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.readQuota(tenant)
+}
+
+// UpdateQuota calls fn with the quota of the tenant and saves it unless fn
+// returns an error, which is then returned. A tenant without a record
+// starts from an empty quota. The store is locked while fn runs, so the
+// read-modify-write is atomic.
+func (s *Store) UpdateQuota(tenant string, fn func(*TenantQuota) error) error {
+	if err := ValidateTenant(tenant); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, err := s.readQuota(tenant)
+	if errors.Is(err, ErrNotFound) {
+		q = TenantQuota{Tenant: tenant}
+	} else if err != nil {
+		return err
+	}
+	if err := fn(&q); err != nil {
+		return err
+	}
+	q.Tenant = tenant
+	q.UpdatedAt = time.Now().UTC()
+
+	data, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode quota of tenant %s: %w", tenant, err)
+	}
+	return filesystem.SaveFileMode(filepath.Join(s.dir, quotaDir), tenant+recordExt, data, 0600)
+}
+
+func (s *Store) readQuota(tenant string) (TenantQuota, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, quotaDir, tenant+recordExt))
+	if os.IsNotExist(err) {
+		return TenantQuota{}, fmt.Errorf("%w %s", ErrNotFound, tenant)
+	}
+	if err != nil {
+		return TenantQuota{}, fmt.Errorf("failed to read quota of tenant %s: %w", tenant, err)
+	}
+	var q TenantQuota
+	if err := json.Unmarshal(data, &q); err != nil {
+		return TenantQuota{}, fmt.Errorf("failed to decode quota of tenant %s: %w", tenant, err)
+	}
+	return q, nil
+}
+
+// PutReservation creates or replaces the reservation of rec.VM.
+func (s *Store) PutReservation(rec QuotaReservation) error {
+	if !vmNamePattern.MatchString(rec.VM) {
+		return fmt.Errorf("invalid VM name %q", rec.VM)
+	}
+	if err := ValidateTenant(rec.Tenant); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode reservation of VM %s: %w", rec.VM, err)
+	}
+	return filesystem.SaveFileMode(filepath.Join(s.dir, reservationDir), rec.VM+recordExt, data, 0600)
+}
+
+// GetReservation returns the reservation of the VM, or an error wrapping
+// ErrNotFound.
+func (s *Store) GetReservation(vm string) (QuotaReservation, error) {
+	if !vmNamePattern.MatchString(vm) {
+		return QuotaReservation{}, fmt.Errorf("invalid VM name %q", vm)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, err := os.ReadFile(filepath.Join(s.dir, reservationDir, vm+recordExt))
+	if os.IsNotExist(err) {
+		return QuotaReservation{}, fmt.Errorf("%w %s", ErrNotFound, vm)
+	}
+	if err != nil {
+		return QuotaReservation{}, fmt.Errorf("failed to read reservation of VM %s: %w", vm, err)
+	}
+	var rec QuotaReservation
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return QuotaReservation{}, fmt.Errorf("failed to decode reservation of VM %s: %w", vm, err)
+	}
+	return rec, nil
+}
+
+// DeleteReservation removes the reservation of the VM. Deleting a missing
+// reservation is not an error.
+func (s *Store) DeleteReservation(vm string) error {
+	if !vmNamePattern.MatchString(vm) {
+		return fmt.Errorf("invalid VM name %q", vm)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := filesystem.DeleteFileIfExists(filepath.Join(s.dir, reservationDir), vm+recordExt); err != nil {
+		return fmt.Errorf("failed to delete reservation of VM %s: %w", vm, err)
+	}
+	return nil
+}
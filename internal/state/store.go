@@ -0,0 +1,169 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"libvirt-controller/internal/filesystem"
+)
+
+// ErrNotFound is returned by Get for a VM without a record.
+var ErrNotFound = errors.New("no record for VM")
+
+// recordExt is the extension of record files in the store directory.
+const recordExt = ".json"
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// VMRecord is what the controller allocated for one VM.
+type VMRecord struct {
+	UUID      string       `json:"uuid"`
+	Name      string       `json:"name"`
+	VCPUs     uint         `json:"vcpus"`
+	MemoryMiB uint64       `json:"memory_mib"`
+	Disks     []DiskRecord `json:"disks,omitempty"`
+	NICs      []NICRecord  `json:"nics,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+// DiskRecord is a disk image owned by a VM.
+type DiskRecord struct {
+	Target    string `json:"target"`
+	Path      string `json:"path"`
+	Pool      string `json:"pool,omitempty"`
+	SizeBytes uint64 `json:"size_bytes"`
+}
+
+// NICRecord is a network interface owned by a VM and the address it was
+// given.
+type NICRecord struct {
+	MAC     string `json:"mac"`
+	Network string `json:"network,omitempty"`
+	Bridge  string `json:"bridge,omitempty"`
+	IP      string `json:"ip,omitempty"`
+}
+
+// Store keeps one JSON file per VM in a directory, named by the VM's UUID.
+// Every write goes through filesystem.SaveFileMode, which renames a synced
+// temp file into place, so a crash leaves either the old or the new record
+// and never a torn one. Leftover temp files are ignored.
+//
+// A Store is safe for concurrent use, but the directory must not be shared
+// between processes.
+type Store struct {
+	dir string
+	mu  sync.RWMutex
+}
+
+// NewStore opens the store in dir, creating the directory if needed.
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create state directory %s: %w", dir, err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Put creates or replaces the record of rec.UUID. CreatedAt is kept from
+// an existing record and UpdatedAt is set to now.
+func (s *Store) Put(rec VMRecord) error {
+	if !uuidPattern.MatchString(rec.UUID) {
+		return fmt.Errorf("invalid VM UUID %q", rec.UUID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	existing, err := s.read(rec.UUID)
+	switch {
+	case err == nil:
+		rec.CreatedAt = existing.CreatedAt
+	case errors.Is(err, ErrNotFound):
+		if rec.CreatedAt.IsZero() {
+			rec.CreatedAt = now
+		}
+	default:
+		return err
+	}
+	rec.UpdatedAt = now
+
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode record of VM %s: %w", rec.UUID, err)
+	}
+	return filesystem.SaveFileMode(s.dir, rec.UUID+recordExt, data, 0600)
+}
+
+// Get returns the record of the VM, or an error wrapping ErrNotFound.
+func (s *Store) Get(uuid string) (VMRecord, error) {
+	if !uuidPattern.MatchString(uuid) {
+		return VMRecord{}, fmt.Errorf("invalid VM UUID %q", uuid)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.read(uuid)
+}
+
+// List returns all records ordered by UUID.
+func (s *Store) List() ([]VMRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state directory %s: %w", s.dir, err)
+	}
+	var records []VMRecord
+	for _, entry := range entries {
+		uuid, ok := strings.CutSuffix(entry.Name(), recordExt)
+		if !ok || entry.IsDir() || !uuidPattern.MatchString(uuid) {
+			continue
+		}
+		rec, err := s.read(uuid)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].UUID < records[j].UUID })
+	return records, nil
+}
+
+// Delete removes the record of the VM. Deleting a missing record is not an
+// error.
+func (s *Store) Delete(uuid string) error {
+	if !uuidPattern.MatchString(uuid) {
+		return fmt.Errorf("invalid VM UUID %q", uuid)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := filesystem.DeleteFileIfExists(s.dir, uuid+recordExt); err != nil {
+		return fmt.Errorf("failed to delete record of VM %s: %w", uuid, err)
+	}
+	return nil
+}
+
+func (s *Store) read(uuid string) (VMRecord, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, uuid+recordExt))
+	if os.IsNotExist(err) {
+		return VMRecord{}, fmt.Errorf("%w %s", ErrNotFound, uuid)
+	}
+	if err != nil {
+		return VMRecord{}, fmt.Errorf("failed to read record of VM %s: %w", uuid, err)
+	}
+	var rec VMRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return VMRecord{}, fmt.Errorf("failed to decode record of VM %s: %w", uuid, err)
+	}
+	return rec, nil
+}
@@ -0,0 +1,57 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatalf("error opening store. Err: %v", err)
+	}
+
+	uuid := "0f8fad5b-d9cb-469f-a165-70867728950e"
+	rec := VMRecord{
+		UUID:  uuid,
+		Name:  "vm-123",
+		Disks: []DiskRecord{{Target: "vda", Path: "/data/vm/vm-123/disk.qcow2"}},
+		NICs:  []NICRecord{{MAC: "52:54:00:12:34:56", Network: "default", IP: "192.168.122.10"}},
+	}
+	if err := store.Put(rec); err != nil {
+		t.Fatalf("error putting record. Err: %v", err)
+	}
+	// A temp file left behind by a crash must not show up as a record
+	if err := os.WriteFile(filepath.Join(dir, uuid+".json.tmp-1-123"), []byte("{"), 0600); err != nil {
+		t.Fatalf("error writing temp file. Err: %v", err)
+	}
+
+	got, err := store.Get(uuid)
+	if err != nil {
+		t.Fatalf("error getting record. Err: %v", err)
+	}
+	if got.Name != "vm-123" || len(got.NICs) != 1 || got.NICs[0].IP != "192.168.122.10" || got.CreatedAt.IsZero() {
+		t.Errorf("expected stored record; got %+v", got)
+	}
+
+	records, err := store.List()
+	if err != nil {
+		t.Fatalf("error listing records. Err: %v", err)
+	}
+	if len(records) != 1 {
+		t.Errorf("expected 1 record; got %d", len(records))
+	}
+
+	if err := store.Delete(uuid); err != nil {
+		t.Fatalf("error deleting record. Err: %v", err)
+	}
+	if _, err := store.Get(uuid); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound after delete; got %v", err)
+	}
+	if err := store.Put(VMRecord{UUID: "../etc"}); err == nil {
+		t.Errorf("expected error for invalid UUID; got nil")
+	}
+}